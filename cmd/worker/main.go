@@ -5,13 +5,19 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/containerd/containerd"
 	"github.com/docker/docker/client"
 	"github.com/operator-framework/operator-sdk/pkg/log/zap"
 	"github.com/spf13/pflag"
 	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+	"github.com/supremind/container-snapshot/pkg/s3"
 	"github.com/supremind/container-snapshot/pkg/worker"
 	"github.com/supremind/container-snapshot/version"
 	"github.com/supremind/pkg/shutdown"
@@ -20,11 +26,25 @@ import (
 )
 
 const (
-	defaultConfigRoot = "/config"
-	defaultTimeout    = 30 * time.Minute
+	defaultConfigRoot        = "/config"
+	defaultTimeout           = 30 * time.Minute
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	defaultPodmanAddress     = "/run/podman/podman.sock"
+	defaultPushAttempts      = 3
+	defaultPushBackoff       = time.Second
+	defaultPushMaxBackoff    = 30 * time.Second
+	defaultPolicyTimeout     = time.Minute
 
 	envTimeout   = "TIMEOUT"
 	envNamespace = "NAMESPACE"
+
+	// credentials of the object storage, from the secret referenced by the snapshot
+	envS3AccessKeyID     = "AWS_ACCESS_KEY_ID"
+	envS3SecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	envS3SessionToken    = "AWS_SESSION_TOKEN"
+
+	// password of the signing key encrypted by cosign, same as the env read by cosign
+	envSignPassword = "COSIGN_PASSWORD"
 )
 
 var log = logf.Log.WithName("container snapshot worker").WithValues("version", version.Version)
@@ -40,30 +60,101 @@ func main() {
 
 	logf.SetLogger(zap.Logger())
 
-	go func() {
-		shutdown.BornToDie(context.Background())
-		log.Info("shutdown by signals")
-		os.Exit(1)
-	}()
+	// cancel the snapshot on signals instead of exiting at once, so the worker could clean up, e.g. unpause containers
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go shutdown.BornToDie(ctx, func() {
+		if ctx.Err() == nil {
+			log.Info("shutdown by signals")
+			cancel()
+		}
+	})
 
-	e := run()
+	e := run(ctx)
 	if e != nil {
 		log.Error(e, "snapshot worker failed")
 		os.Exit(1)
 	}
 }
 
-func run() error {
+func run(ctx context.Context) error {
 	opt := &worker.SnapshotOptions{}
 	pflag.StringVarP(&opt.Container, "container", "c", "", "required, docker name of the container going to take a snapshot")
 	pflag.StringVarP(&opt.Image, "image", "i", "", "required, name of the snapshot image")
 	pflag.StringVar(&opt.Author, "author", "", "snapshot author")
 	pflag.StringVar(&opt.Comment, "comment", "", "comment")
+	pflag.StringArrayVar(&opt.Changes, "change", nil, "dockerfile instruction applied to the snapshot, could be set multiple times")
+	pflag.StringVar(&opt.Pause, "pause", constants.PauseContainer, "pause policy while committing, None, Container or Pod, default is Container")
+	pflag.StringArrayVar(&opt.Tags, "tag", nil, "extra tag of the snapshot image, could be set multiple times")
+	pflag.StringArrayVar(&opt.Mirrors, "mirror", nil, "full name of another image the snapshot is pushed to, could be set multiple times")
+	pflag.StringArrayVar(&opt.OptionalMirrors, "optional-mirror", nil, "same as --mirror, but failures of pushing it are ignored, could be set multiple times")
+	pflag.IntVar(&opt.Retry.Attempts, "push-attempts", defaultPushAttempts, "max number of attempts pushing each destination on transient errors, 1 disables retries")
+	pflag.DurationVar(&opt.Retry.Backoff, "push-backoff", defaultPushBackoff, "delay before the first push retry, doubled for each following retry with jitter")
+	pflag.DurationVar(&opt.Retry.MaxBackoff, "push-max-backoff", defaultPushMaxBackoff, "max delay between push retries")
+	pflag.StringVar(&opt.Cleanup, "cleanup", constants.CleanupNever, "policy of removing the committed image from the node after pushing, Always, OnSuccess or Never, default is Never")
+	pflag.StringArrayVar(&opt.PodContainers, "pod-container", nil, "id of a container in the source pod, paused with the Pod pause policy, could be set multiple times")
+	pflag.BoolVar(&opt.Squash, "squash", false, "flatten layers of the committed image into a single layer before pushing or exporting it")
+	pflag.StringArrayVar(&opt.SecretEnvs, "secret-env", nil, "name of an env var of the container from secrets, removed from the snapshot image config, could be set multiple times")
+	pflag.StringArrayVar(&opt.Exclude, "exclude", nil, "glob pattern of paths dropped from the container read/write layer, could be set multiple times")
+	pflag.Int64Var(&opt.MaxSize, "max-size", 0, "max size in bytes of the container read/write layer, measured before committing, no limit if it is 0")
 
 	var configRoot string
 	var snapshot string
+	var runtime string
+	var mode string
+	var directPush bool
+	var chunkSize int64
+	var insecureRegistries []string
+	var export worker.ExportOptions
+	var s3Config s3.Config
+	var partSize int64
+	var scanSecrets bool
+	var scanRules []string
+	var scan worker.ScanOptions
+	var policyCommand []string
+	var policyURL string
+	var policyMetadata map[string]string
+	var policy worker.PolicyOptions
+	var fileChanges bool
+	var fileChangesTop int
+	var signKey string
+	var provenance bool
+	var provenanceOpt worker.ProvenanceOptions
+	var requestedAt string
 	pflag.StringVar(&configRoot, "config", defaultConfigRoot, "root path of docker config files, default is /config")
 	pflag.StringVar(&snapshot, "snapshot", "", "required, snapshot name")
+	pflag.StringVar(&runtime, "runtime", constants.RuntimeDocker, "container runtime of the container, docker, containerd or cri-o, default is docker")
+	pflag.StringVar(&mode, "mode", constants.ModeImage, "snapshot mode, Image snapshots a runnable image, Diff snapshots the container read/write layer only as a single layer artifact, default is Image")
+	pflag.BoolVar(&directPush, "direct-push", false, "export the committed image and push it with the built-in registry client, instead of the container runtime")
+	pflag.Int64Var(&chunkSize, "push-chunk-size", 0, "max size in bytes of each chunk uploading layers with --direct-push or --mode Diff, layers are uploaded in a single request if it is 0")
+	pflag.StringArrayVar(&insecureRegistries, "insecure-registry", nil, "registry host accessed over plain http by the built-in registry client and containerd, could be set multiple times")
+	pflag.StringVar(&export.Path, "export-path", "", "write the snapshot as a tarball to the path, instead of pushing it to registries")
+	pflag.StringVar(&export.Bucket, "export-bucket", "", "upload the snapshot as a tarball to the bucket of an s3 compatible object storage, instead of pushing it to registries")
+	pflag.StringVar(&export.Key, "export-key", "", "object key of the tarball uploaded with --export-bucket")
+	pflag.StringVar(&export.Format, "export-format", constants.ExportOCI, "format of the tarball written with --export-path or --export-bucket, OCI, Docker, or Layer for --mode Diff, default is OCI")
+	pflag.StringVar(&s3Config.Endpoint, "s3-endpoint", "", "url of the s3 compatible object storage, required by --export-bucket")
+	pflag.StringVar(&s3Config.Region, "s3-region", "", "region of the object storage, default is us-east-1")
+	pflag.BoolVar(&s3Config.PathStyle, "s3-path-style", false, "address buckets in url paths instead of host names")
+	pflag.Int64Var(&partSize, "s3-part-size", s3.DefaultPartSize, "size in bytes of each part uploading the tarball, at least 5MiB")
+	pflag.BoolVar(&scanSecrets, "scan-secrets", false, "scan files changed by the container for secrets, the snapshot is not pushed or exported if any is found")
+	pflag.StringArrayVar(&scanRules, "scan-rule", nil, "extra secret scan rule as name=regexp, could be set multiple times")
+	pflag.StringArrayVar(&scan.DisabledRules, "scan-disable-rule", nil, "name of a default secret scan rule not applied, could be set multiple times")
+	pflag.BoolVar(&scan.Allow, "scan-allow", false, "report secrets found by the scan without blocking the snapshot")
+	pflag.StringArrayVar(&policyCommand, "policy-command", nil, "executable and its args checking if the snapshot could be pushed, set once for each of them, "+
+		"the request is written to its stdin as json, and the decision is read from its stdout")
+	pflag.StringVar(&policyURL, "policy-url", "", "url of the http endpoint checking if the snapshot could be pushed, the request is posted as json")
+	pflag.DurationVar(&policy.Timeout, "policy-timeout", defaultPolicyTimeout, "max time of the policy check")
+	pflag.StringToStringVar(&policyMetadata, "policy-metadata", nil, "metadata of the snapshot passed to the policy checker as key=value pairs")
+	pflag.BoolVar(&fileChanges, "file-changes", false, "report files changed by the container, the largest ones in the result, and all of them in log lines")
+	pflag.IntVar(&fileChangesTop, "file-changes-top", 0, "number of the largest changed files in the result, default is 10")
+	pflag.StringVar(&signKey, "sign-key", "", "path of the pem encoded private key signing pushed images, keys encrypted by cosign are decrypted with the password in $COSIGN_PASSWORD")
+	pflag.BoolVar(&provenance, "provenance", false, "attach a provenance attestation to pushed images as oci referrers, signed with --sign-key if it is set, or write the provenance statement next to the exported tarball")
+	pflag.StringVar(&provenanceOpt.SnapshotUID, "snapshot-uid", "", "uid of the snapshot, recorded in the provenance")
+	pflag.StringVar(&provenanceOpt.Pod, "source-pod", "", "name of the source pod, recorded in the provenance")
+	pflag.StringVar(&provenanceOpt.ContainerName, "source-container-name", "", "name of the source container in the pod, recorded in the provenance")
+	pflag.StringVar(&provenanceOpt.Node, "node", "", "name of the node the source pod runs on, recorded in the provenance")
+	pflag.StringVar(&provenanceOpt.RequestedBy, "requested-by", "", "user claimed to request the snapshot, recorded in the provenance unverified")
+	pflag.StringVar(&requestedAt, "requested-at", "", "time the snapshot is requested in rfc3339, recorded in the provenance")
 	pflag.Parse()
 
 	namespace := os.Getenv(envNamespace)
@@ -71,14 +162,130 @@ func run() error {
 		return errors.New("invalid arguments")
 	}
 
-	cli, e := client.NewEnvClient()
+	switch opt.Pause {
+	case constants.PauseNone, constants.PauseContainer, constants.PausePod:
+	default:
+		return fmt.Errorf("invalid pause policy: %s", opt.Pause)
+	}
+
+	switch opt.Cleanup {
+	case constants.CleanupAlways, constants.CleanupOnSuccess, constants.CleanupNever:
+	default:
+		return fmt.Errorf("invalid cleanup policy: %s", opt.Cleanup)
+	}
+
+	switch mode {
+	case constants.ModeImage:
+	case constants.ModeDiff:
+		if opt.Squash {
+			return errors.New("--squash could not be used with --mode Diff")
+		}
+	default:
+		return fmt.Errorf("invalid snapshot mode: %s", mode)
+	}
+
+	if scanSecrets {
+		for _, r := range scanRules {
+			kv := strings.SplitN(r, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return fmt.Errorf("invalid scan rule: %s", r)
+			}
+			scan.Rules = append(scan.Rules, worker.ScanRule{Name: kv[0], Pattern: kv[1]})
+		}
+		opt.Scan = &scan
+	}
+
+	if len(policyCommand) > 0 && policyURL != "" {
+		return errors.New("only one of --policy-command and --policy-url could be set")
+	}
+	if len(policyCommand) > 0 || policyURL != "" {
+		if policyURL != "" {
+			policy.Checker = worker.NewWebhookChecker(&http.Client{}, policyURL)
+		} else {
+			checker, e := worker.NewExecChecker(policyCommand)
+			if e != nil {
+				return e
+			}
+			policy.Checker = checker
+		}
+		policy.Metadata = map[string]string{"namespace": namespace, "snapshot": snapshot}
+		for k, v := range policyMetadata {
+			policy.Metadata[k] = v
+		}
+		opt.Policy = &policy
+	}
+	if fileChanges {
+		opt.FileChanges = &worker.FileChangeOptions{Top: fileChangesTop}
+	}
+
+	if export.Path != "" && export.Bucket != "" {
+		return errors.New("only one of --export-path and --export-bucket could be set")
+	}
+	if export.Path != "" || export.Bucket != "" {
+		switch {
+		case export.Format == constants.ExportOCI:
+		case export.Format == constants.ExportDocker && mode == constants.ModeImage:
+		case export.Format == constants.ExportLayer && mode == constants.ModeDiff:
+		default:
+			return fmt.Errorf("invalid export format of %s mode: %s", mode, export.Format)
+		}
+		opt.Export = &export
+	}
+	if signKey != "" {
+		if opt.Export != nil {
+			return errors.New("--sign-key could not be used with --export-path or --export-bucket")
+		}
+		key, e := ioutil.ReadFile(signKey)
+		if e != nil {
+			return fmt.Errorf("read signing key: %w", e)
+		}
+		opt.Sign = &worker.SignOptions{Key: key, Password: []byte(os.Getenv(envSignPassword)), Pusher: registry.NewClient(&http.Client{}, chunkSize, insecureRegistries...)}
+	}
+	if provenance {
+		if requestedAt != "" {
+			t, e := time.Parse(time.RFC3339, requestedAt)
+			if e != nil {
+				return fmt.Errorf("invalid --requested-at: %w", e)
+			}
+			provenanceOpt.RequestedAt = t
+		}
+		provenanceOpt.Namespace = namespace
+		provenanceOpt.Snapshot = snapshot
+		provenanceOpt.Runtime = runtime
+		provenanceOpt.Pusher = registry.NewClient(&http.Client{}, chunkSize, insecureRegistries...)
+		opt.Provenance = &provenanceOpt
+	}
+	if export.Bucket != "" {
+		if export.Key == "" {
+			return errors.New("--export-key is required by --export-bucket")
+		}
+		s3Config.AccessKeyID = os.Getenv(envS3AccessKeyID)
+		s3Config.SecretAccessKey = os.Getenv(envS3SecretAccessKey)
+		s3Config.SessionToken = os.Getenv(envS3SessionToken)
+		uploader, e := s3.NewClient(&http.Client{}, s3Config, partSize)
+		if e != nil {
+			return fmt.Errorf("create s3 client: %w", e)
+		}
+		export.Uploader = uploader
+	}
+
+	rt, e := newRuntime(runtime, insecureRegistries)
 	if e != nil {
-		return fmt.Errorf("create docker client: %w", e)
+		return e
+	}
+	// diff artifacts are always pushed by the built-in registry client, as runtimes push images only
+	if mode == constants.ModeDiff {
+		rt, e = worker.NewDiffRuntime(rt, registry.NewClient(&http.Client{}, chunkSize, insecureRegistries...))
+	} else if directPush {
+		rt, e = worker.NewDirectPushRuntime(rt, registry.NewClient(&http.Client{}, chunkSize, insecureRegistries...))
+	}
+	if e != nil {
+		return e
 	}
 
-	log = log.WithValues("namespace", namespace, "snapshot", snapshot, "container", opt.Container, "image", opt.Image)
+	log = log.WithValues("namespace", namespace, "snapshot", snapshot, "container", opt.Container, "image", opt.Image, "runtime", runtime, "mode", mode, "direct push", directPush)
 
-	c, e := worker.New(cli, configRoot)
+	c, e := worker.New(rt, configRoot)
 	if e != nil {
 		return e
 	}
@@ -90,13 +297,22 @@ func run() error {
 			timeout = d
 		}
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	e = c.TakeSnapshot(ctx, opt)
+	result, e := c.TakeSnapshot(ctx, opt)
+	if e := writeTerminationLog(result); e != nil {
+		log.Error(e, "write termination message")
+	}
+	if result.FileChanges != nil {
+		if e := worker.WriteFileChanges(os.Stdout, result.AllFileChanges, constants.MaxFileChangesLog); e != nil {
+			log.Error(e, "write file changes")
+		}
+	}
 	if e != nil {
 		log.Error(e, "take snapshot failed")
 
+		// exit codes are kept for operators not knowing the worker result
 		var code int32 = 127
 		if errors.Is(e, worker.ErrInvalidImage) {
 			code = constants.ExitCodeInvalidImage
@@ -104,6 +320,28 @@ func run() error {
 			code = constants.ExitCodeDockerCommit
 		} else if errors.Is(e, worker.ErrPush) {
 			code = constants.ExitCodeDockerPush
+		} else if errors.Is(e, worker.ErrChanges) {
+			code = constants.ExitCodeInvalidChanges
+		} else if errors.Is(e, worker.ErrExport) {
+			code = constants.ExitCodeExport
+		} else if errors.Is(e, worker.ErrSquash) {
+			code = constants.ExitCodeSquash
+		} else if errors.Is(e, worker.ErrExclude) {
+			code = constants.ExitCodeExclude
+		} else if errors.Is(e, worker.ErrScan) {
+			code = constants.ExitCodeScan
+		} else if errors.Is(e, worker.ErrSecret) {
+			code = constants.ExitCodeSecretDetected
+		} else if errors.Is(e, worker.ErrPolicy) {
+			code = constants.ExitCodePolicy
+		} else if errors.Is(e, worker.ErrRejected) {
+			code = constants.ExitCodePolicyRejected
+		} else if errors.Is(e, worker.ErrTooLarge) {
+			code = constants.ExitCodeTooLarge
+		} else if errors.Is(e, worker.ErrSign) {
+			code = constants.ExitCodeSign
+		} else if errors.Is(e, worker.ErrAttest) {
+			code = constants.ExitCodeAttest
 		}
 		os.Exit(int(code))
 	}
@@ -111,13 +349,36 @@ func run() error {
 	return e
 }
 
-func writeTerminationLog(e error) error {
-	f, e := os.Create(corev1.TerminationMessagePathDefault)
-	if e != nil {
-		return fmt.Errorf("open ternination message file: %w", e)
+func newRuntime(runtime string, insecureRegistries []string) (worker.Runtime, error) {
+	switch runtime {
+	case constants.RuntimeDocker:
+		cli, e := client.NewEnvClient()
+		if e != nil {
+			return nil, fmt.Errorf("create docker client: %w", e)
+		}
+		return worker.NewDockerRuntime(cli), nil
+
+	case constants.RuntimeContainerd:
+		cli, e := containerd.New(defaultContainerdAddress)
+		if e != nil {
+			return nil, fmt.Errorf("create containerd client: %w", e)
+		}
+		return worker.NewContainerdRuntime(cli, worker.ContainerdNamespace, insecureRegistries...), nil
+
+	case constants.RuntimeCRIO:
+		return worker.NewPodmanRuntime(worker.NewLibpodClient(defaultPodmanAddress)), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported container runtime: %s", runtime)
 	}
-	defer f.Close()
+}
 
-	_, e = f.WriteString(e.Error())
-	return e
+// writeTerminationLog reports the snapshot result to the operator, as json in the termination message
+func writeTerminationLog(result *worker.Result) error {
+	// kubernetes cuts longer messages, which could not be parsed then
+	b, e := result.EncodeTermination(constants.MaxTerminationMessage)
+	if e != nil {
+		return fmt.Errorf("encode termination message: %w", e)
+	}
+	return ioutil.WriteFile(corev1.TerminationMessagePathDefault, b, 0644)
 }
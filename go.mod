@@ -3,14 +3,22 @@ module github.com/supremind/container-snapshot
 go 1.13
 
 require (
+	github.com/containerd/containerd v1.3.2
+	github.com/containerd/typeurl v0.0.0-20180627222232-a93fcdb778cd
 	github.com/docker/distribution v2.8.2+incompatible
 	github.com/docker/docker v17.12.1-ce+incompatible
+	github.com/docker/go-events v0.0.0-20190806004212-e31b211e4f1c // indirect
 	github.com/go-logr/logr v0.1.0
+	github.com/gogo/googleapis v1.3.2 // indirect
 	github.com/onsi/ginkgo v1.12.2
 	github.com/onsi/gomega v1.10.1
+	github.com/opencontainers/go-digest v1.0.0-rc1
+	github.com/opencontainers/image-spec v1.0.1
+	github.com/opencontainers/runtime-spec v0.1.2-0.20190507144316-5b71a03e2700
 	github.com/operator-framework/operator-sdk v0.17.1
 	github.com/spf13/pflag v1.0.5
 	github.com/supremind/pkg v0.1.0
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	k8s.io/api v0.17.4
 	k8s.io/apimachinery v0.17.4
 	k8s.io/apiserver v0.17.4
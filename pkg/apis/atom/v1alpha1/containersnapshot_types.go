@@ -3,6 +3,7 @@ package v1alpha1
 import (
 	"github.com/operator-framework/operator-sdk/pkg/status"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -18,10 +19,274 @@ type ContainerSnapshotSpec struct {
 	// Image is the snapshot image, registry host and tag are optional
 	Image string `json:"image"`
 
+	// AdditionalTags are extra tags of the snapshot image, pushed to the same repository as Image
+	// +optional
+	AdditionalTags []string `json:"additionalTags,omitempty"`
+
+	// Mirrors are other images the snapshot is pushed to, such as repositories in other registries.
+	// Credentials of their registries are looked up in ImagePushSecrets too
+	// +optional
+	Mirrors []ImageMirror `json:"mirrors,omitempty"`
+
 	// ImagePushSecrets are references to docker-registry secret in the same namespace to use for pushing checkout image,
 	// same as an ImagePullSecrets.
 	// More info: https://kubernetes.io/docs/concepts/containers/images#specifying-imagepullsecrets-on-a-pod
 	ImagePushSecrets []v1.LocalObjectReference `json:"imagePushSecrets"`
+
+	// Changes are dockerfile instructions applied to the snapshot, same as `docker commit --change`.
+	// Supported instructions are CMD, ENTRYPOINT, ENV, EXPOSE, LABEL, USER, VOLUME and WORKDIR
+	// +optional
+	Changes []string `json:"changes,omitempty"`
+
+	// PausePolicy tells which containers are paused while committing:
+	// None pauses nothing, Container pauses the source container only, which is the default,
+	// and Pod pauses all containers of the source pod, to freeze them at the same moment
+	// +kubebuilder:validation:Enum=None;Container;Pod
+	// +optional
+	PausePolicy string `json:"pausePolicy,omitempty"`
+
+	// PushRetry configures retries of pushing each destination on transient registry errors,
+	// such as server errors, connection resets or rate limits. the worker retries 3 times by default
+	// +optional
+	PushRetry *PushRetry `json:"pushRetry,omitempty"`
+
+	// CleanupPolicy tells when the committed image is removed from the node after pushing:
+	// Always removes it even if the push fails, OnSuccess removes it only if all required destinations are pushed,
+	// and Never keeps it, which is the default
+	// +kubebuilder:validation:Enum=Always;OnSuccess;Never
+	// +optional
+	CleanupPolicy string `json:"cleanupPolicy,omitempty"`
+
+	// DirectPush makes the worker export the committed image and push it with its built-in registry client,
+	// instead of pushing through the container runtime on the node. It is not supported by containerd,
+	// which is pushed by the worker already
+	// +optional
+	DirectPush *DirectPush `json:"directPush,omitempty"`
+
+	// Export writes the snapshot as a tarball instead of pushing it to registries, for clusters without registries.
+	// Image is still the name of the snapshot in the tarball, while AdditionalTags, Mirrors and push options are ignored
+	// +optional
+	Export *SnapshotExport `json:"export,omitempty"`
+
+	// Squash flattens layers of the base image and the container read/write layer into a single layer,
+	// before pushing or exporting the snapshot. Histories of the image are kept in its config as empty layers.
+	// It keeps images committed again and again under the max number of layers, but layers are no longer shared with the base image
+	// +optional
+	Squash bool `json:"squash,omitempty"`
+
+	// Mode tells what the snapshot is made of: Image snapshots a runnable image, which is the default,
+	// and Diff snapshots the container read/write layer only, as a single layer OCI artifact annotated with
+	// the name and digest of the source image, to keep what is changed by every run and apply it later.
+	// Diff artifacts are always pushed by the built-in registry client of the worker, and Squash is ignored
+	// +kubebuilder:validation:Enum=Image;Diff
+	// +optional
+	Mode string `json:"mode,omitempty"`
+
+	// Exclude are glob patterns of paths dropped from the container read/write layer, such as caches or credential files.
+	// Patterns with a slash match paths from the root, e.g. /tmp/*, others match base names at any depth, e.g. .ssh or *.pem,
+	// and everything in a matched directory is dropped too. Matched paths of the base image are deleted by whiteouts as well
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+
+	// MaxSize is the max size of the container read/write layer, such as 10Gi, measured before committing.
+	// Larger containers are refused with a SnapshotTooLarge condition, and nothing is committed or pushed.
+	// The operator-wide default is set by the DEFAULT_MAX_SIZE env of the operator, and 0 disables it
+	// +optional
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+
+	// KeepSecretEnvs keeps env vars of the source container from secrets in the snapshot image config.
+	// They are removed by default, as the image would hand the credentials to everyone able to pull it.
+	// Env vars from secretKeyRef and all keys of secrets in envFrom are removed
+	// +optional
+	KeepSecretEnvs bool `json:"keepSecretEnvs,omitempty"`
+
+	// SecretScan scans files changed by the container for secrets, such as private keys, cloud access keys or high entropy strings,
+	// after paths are excluded. The snapshot is not pushed or exported if any secret is found, unless the snapshot is annotated with
+	// container-snapshot.atom.supremind.com/allow-secrets: "true". Paths of files found are reported, values of secrets are not
+	// +optional
+	SecretScan *SecretScan `json:"secretScan,omitempty"`
+
+	// Policy asks an external checker if the snapshot could be pushed or exported, after the secret scan.
+	// The checker receives the committed image id, a summary of files changed by the container and metadata of the snapshot,
+	// and the snapshot fails with a PolicyRejected condition if it is denied
+	// +optional
+	Policy *SnapshotPolicy `json:"policy,omitempty"`
+
+	// FileChanges reports files added, modified and deleted by the container, after paths are excluded.
+	// Counts and the largest changes are reported in the status, and all of them are kept in a ConfigMap owned by the snapshot
+	// +optional
+	FileChanges *FileChangeReport `json:"fileChanges,omitempty"`
+
+	// Signing signs the snapshot image, its additional tags and mirrors after they are pushed, with a private key from a secret.
+	// Signatures are pushed next to the images as sha256-<digest>.sig tags, which cosign and admission controllers built on it verify
+	// with the public key only. It is ignored if the snapshot is exported instead of pushed.
+	// The provenance attestation attached to pushed images is signed with the same key
+	// +optional
+	Signing *ImageSigning `json:"signing,omitempty"`
+
+	// DisableProvenance stops attaching the in-toto provenance attestation of the snapshot.
+	// By default, the attestation is attached to the snapshot image, its additional tags and mirrors as OCI referrers after they are pushed,
+	// which registries must accept, or written next to the exported tarball
+	// +optional
+	DisableProvenance bool `json:"disableProvenance,omitempty"`
+}
+
+// ImageSigning is a private key signing pushed images
+type ImageSigning struct {
+	// Secret is a secret in the same namespace with the pem encoded private key, mounted into the snapshot worker.
+	// ECDSA, RSA and Ed25519 keys are supported, either unencrypted or encrypted by `cosign generate-key-pair`,
+	// with the password of encrypted keys in cosign.password of the secret
+	Secret v1.LocalObjectReference `json:"secret"`
+
+	// Key is the key of the private key in the secret, cosign.key by default
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// FileChangeReport configures the report of files changed by the container
+type FileChangeReport struct {
+	// Top is the number of the largest changes reported in the status, 10 by default.
+	// They are reported by the worker termination message, which is limited to 4KiB
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=20
+	// +optional
+	Top int32 `json:"top,omitempty"`
+}
+
+// SnapshotPolicy is an external policy checker, either a command run in the worker or an http webhook.
+// The request is passed to the command by stdin, or posted to the webhook, as json,
+// and the decision is read from stdout of the command, or the response body, as json like {"allow": false, "reason": "..."}
+type SnapshotPolicy struct {
+	// Command is the executable and its args run in the worker container, one of Command and URL must be set
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// ConfigMap is mounted at /policy in the worker container, to keep the checker script in it, e.g. [sh, /policy/check.sh]
+	// +optional
+	ConfigMap *v1.LocalObjectReference `json:"configMap,omitempty"`
+
+	// URL is the http endpoint the request is posted to
+	// +optional
+	URL string `json:"url,omitempty"`
+
+	// Timeout limits time of the check, 1 minute by default
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// SecretScan configures rules of the secret scan, default rules are private-key, aws-access-key, gcp-service-account,
+// github-token, slack-token and high-entropy-string
+type SecretScan struct {
+	// Rules are extra rules matched against each line of changed files
+	// +optional
+	Rules []SecretScanRule `json:"rules,omitempty"`
+
+	// DisabledRules are names of default rules not applied, such as high-entropy-string for files of random data
+	// +optional
+	DisabledRules []string `json:"disabledRules,omitempty"`
+}
+
+// SecretScanRule is a named regular expression of secrets, in the RE2 syntax
+type SecretScanRule struct {
+	// Name is reported with files matching the rule
+	Name string `json:"name"`
+
+	// Pattern is the regular expression matched against each line
+	Pattern string `json:"pattern"`
+}
+
+// SnapshotExport tells where and how the snapshot tarball is written
+type SnapshotExport struct {
+	// Format is the tarball format, OCI for the OCI image layout, which is the default,
+	// Docker for the docker archive, same as `docker save`, or Layer for the uncompressed read/write layer tarball.
+	// Docker is for the Image mode only, and Layer is for the Diff mode only
+	// +kubebuilder:validation:Enum=OCI;Docker;Layer
+	// +optional
+	Format string `json:"format,omitempty"`
+
+	// Volume is the persistent volume claim the tarball is written to.
+	// One of Volume and S3 must be set, S3 is ignored if both are set
+	// +optional
+	Volume *VolumeExport `json:"volume,omitempty"`
+
+	// S3 is the object the tarball is uploaded to, in an s3 compatible object storage
+	// +optional
+	S3 *S3Export `json:"s3,omitempty"`
+}
+
+// S3Export is a tarball object in an s3 compatible object storage, uploaded with multipart uploads
+type S3Export struct {
+	// Endpoint is the url of the object storage, such as https://s3.us-east-1.amazonaws.com or http://minio.storage:9000
+	Endpoint string `json:"endpoint"`
+
+	// Region is the region of the bucket, us-east-1 by default
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Bucket is the bucket the tarball is uploaded to
+	Bucket string `json:"bucket"`
+
+	// Key is the object key of the tarball, <snapshot name>.tar by default
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// PathStyle addresses the bucket in url paths instead of host names, which most s3 compatible services require
+	// +optional
+	PathStyle bool `json:"pathStyle,omitempty"`
+
+	// PartSize is the size in bytes of each part uploaded, 16MiB by default
+	// +kubebuilder:validation:Minimum=5242880
+	// +optional
+	PartSize int64 `json:"partSize,omitempty"`
+
+	// CredentialsSecret is a secret in the same namespace with the access key in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY,
+	// and an optional AWS_SESSION_TOKEN. The upload is anonymous if it is not set
+	// +optional
+	CredentialsSecret *v1.LocalObjectReference `json:"credentialsSecret,omitempty"`
+}
+
+// VolumeExport is a tarball file in a persistent volume claim
+type VolumeExport struct {
+	// ClaimName is the name of a PersistentVolumeClaim in the same namespace, mounted into the snapshot worker
+	ClaimName string `json:"claimName"`
+
+	// Path is the path of the tarball in the volume, <snapshot name>.tar by default. Missing directories are created
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// DirectPush configures pushing with the built-in registry client of the worker
+type DirectPush struct {
+	// ChunkSize is the max size in bytes of each chunk uploading layers, layers are uploaded in a single request if it is 0
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	ChunkSize int64 `json:"chunkSize,omitempty"`
+}
+
+// PushRetry configures retries with exponential backoff and jitter, retries are bounded by the worker timeout
+type PushRetry struct {
+	// Attempts is the max number of attempts pushing each destination, 1 disables retries
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// Backoff is the delay before the first retry, doubled for each following retry
+	// +optional
+	Backoff *metav1.Duration `json:"backoff,omitempty"`
+
+	// MaxBackoff caps the delay between retries
+	// +optional
+	MaxBackoff *metav1.Duration `json:"maxBackoff,omitempty"`
+}
+
+// ImageMirror is another image the snapshot is pushed to
+type ImageMirror struct {
+	// Image is the mirror image, registry host and tag are optional
+	Image string `json:"image"`
+
+	// Optional mirrors do not fail the snapshot if pushing to them fails
+	// +optional
+	Optional bool `json:"optional,omitempty"`
 }
 
 // ContainerSnapshotStatus defines the observed state of ContainerSnapshot
@@ -38,6 +303,91 @@ type ContainerSnapshotStatus struct {
 	// ContainerID is the docker id of the source container
 	ContainerID string `json:"containerID"`
 
+	// Runtime is the container runtime running the source container, parsed from the container id
+	// +kubebuilder:validation:Enum=docker;containerd;cri-o
+	// +optional
+	Runtime string `json:"runtime,omitempty"`
+
+	// Phase is the last phase the snapshot worker reached, reported by the worker
+	// +kubebuilder:validation:Enum=Validate;Commit;Exclude;Scan;Policy;Squash;Push;Sign;Attest;Export;Complete
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// ImageID is the id of the committed image on the node
+	// +optional
+	ImageID string `json:"imageID,omitempty"`
+
+	// Digest is the manifest digest of the pushed snapshot image
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// Signature is the signature of the snapshot image, as <image>:sha256-<digest>.sig@<signature digest>, if it is signed
+	// +optional
+	Signature string `json:"signature,omitempty"`
+
+	// Provenance is the provenance attestation attached to the snapshot image as an oci referrer, as <image>@<attestation digest>.
+	// It is an in-toto statement with the SLSA provenance predicate, in a DSSE envelope if the snapshot is signed
+	// +optional
+	Provenance string `json:"provenance,omitempty"`
+
+	// Size is the size in bytes of the container read/write layer committed into the snapshot,
+	// or measured before committing if it is over the max size
+	// +optional
+	Size int64 `json:"size,omitempty"`
+
+	// Layers is the number of layers of the snapshot image, 1 if it is squashed
+	// +optional
+	Layers int32 `json:"layers,omitempty"`
+
+	// FreedBytes is the disk space freed on the node by removing the committed image, as the cleanup policy requires
+	// +optional
+	FreedBytes int64 `json:"freedBytes,omitempty"`
+
+	// ExcludedFiles is the number of files dropped from the container read/write layer by exclude patterns
+	// +optional
+	ExcludedFiles int32 `json:"excludedFiles,omitempty"`
+
+	// ExcludedBytes is the total size in bytes of files dropped from the container read/write layer by exclude patterns
+	// +optional
+	ExcludedBytes int64 `json:"excludedBytes,omitempty"`
+
+	// ScrubbedEnvs are names of env vars from secrets removed from the snapshot image config
+	// +optional
+	ScrubbedEnvs []string `json:"scrubbedEnvs,omitempty"`
+
+	// SecretFindings are files found with secrets by the secret scan, at most 10 of them are reported
+	// +optional
+	SecretFindings []SecretFinding `json:"secretFindings,omitempty"`
+
+	// FileChanges summarizes files changed by the container, if it is asked for by the spec
+	// +optional
+	FileChanges *FileChangeSummary `json:"fileChanges,omitempty"`
+
+	// StartTime is the time the snapshot worker started
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is the time the snapshot worker finished, either succeeded or failed
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// CommitDuration is the time spent committing the source container, including pausing containers
+	// +optional
+	CommitDuration *metav1.Duration `json:"commitDuration,omitempty"`
+
+	// PushDuration is the time spent pushing the snapshot to all destinations
+	// +optional
+	PushDuration *metav1.Duration `json:"pushDuration,omitempty"`
+
+	// Destinations are push results of the snapshot image, its additional tags and mirrors,
+	// the snapshot is complete only if all required destinations are pushed
+	// +optional
+	Destinations []DestinationStatus `json:"destinations,omitempty"`
+
+	// Export is the tarball the snapshot is written to, if it is exported instead of pushed
+	// +optional
+	Export *ExportStatus `json:"export,omitempty"`
+
 	// container snapshot worker state
 	// +kubebuilder:validation:Enum=Created;Running;Complete;Failed;Unknown
 	WorkerState WorkerState `json:"workerState"`
@@ -49,6 +399,137 @@ type ContainerSnapshotStatus struct {
 	Conditions status.Conditions `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 }
 
+// DestinationStatus is the push result of an image the snapshot is pushed to
+type DestinationStatus struct {
+	// Image is the full name of the pushed image
+	Image string `json:"image"`
+
+	// Pushed tells if the image is pushed successfully
+	Pushed bool `json:"pushed"`
+
+	// Optional is true for optional mirrors
+	// +optional
+	Optional bool `json:"optional,omitempty"`
+
+	// Digest is the manifest digest of the pushed image
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// Signature is the signature of the pushed image, if it is signed
+	// +optional
+	Signature string `json:"signature,omitempty"`
+
+	// Provenance is the provenance attestation attached to the pushed image
+	// +optional
+	Provenance string `json:"provenance,omitempty"`
+
+	// Attempts is the number of push attempts made
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// Error is the class of the push error, such as PushAuthDenied or PushTimeout, or SignFailed if the pushed image is not signed,
+	// or AttestFailed if the provenance is not attached
+	// +optional
+	Error string `json:"error,omitempty"`
+
+	// Message is the error message of a failed push, signing or attestation
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// SecretFinding is a file found with secrets, values of secrets are never reported
+type SecretFinding struct {
+	// Path is the absolute path of the file in the snapshot
+	Path string `json:"path"`
+
+	// Rule is the name of the rule matched
+	Rule string `json:"rule"`
+
+	// Line is the first line matched, starts from 1
+	// +optional
+	Line int32 `json:"line,omitempty"`
+}
+
+// FileChangeSummary summarizes files changed by the container, directories are not counted
+type FileChangeSummary struct {
+	// Added, Modified and Deleted are the number of paths of each kind
+	Added    int32 `json:"added"`
+	Modified int32 `json:"modified"`
+	Deleted  int32 `json:"deleted"`
+
+	// Changed is the number of paths added or modified, for container runtimes not telling them apart, such as containerd
+	// +optional
+	Changed int32 `json:"changed,omitempty"`
+
+	// Bytes is the total size in bytes of files added or modified
+	Bytes int64 `json:"bytes"`
+
+	// Largest are the largest changes, as many as the top of the spec
+	// +optional
+	Largest []FileChange `json:"largest,omitempty"`
+
+	// ConfigMap is the name of the ConfigMap keeping all changes, one line for each as "<kind> <size> <path>"
+	// +optional
+	ConfigMap string `json:"configMap,omitempty"`
+
+	// Missing tells why all changes could not be kept in a ConfigMap, such as the worker log being lost.
+	// Failures reading the worker log are retried until it is saved or missing
+	// +optional
+	Missing string `json:"missing,omitempty"`
+}
+
+// FileChange is a path changed by the container
+type FileChange struct {
+	// Path is the absolute path in the snapshot
+	Path string `json:"path"`
+
+	// Kind is Added, Modified, Changed or Deleted
+	// +kubebuilder:validation:Enum=Added;Modified;Changed;Deleted
+	Kind string `json:"kind"`
+
+	// Size is the size in bytes of the file added or modified
+	// +optional
+	Size int64 `json:"size,omitempty"`
+}
+
+// ExportStatus is the tarball the snapshot is written to
+type ExportStatus struct {
+	// Format is the tarball format, OCI, Docker or Layer
+	Format string `json:"format"`
+
+	// ClaimName is the name of the PersistentVolumeClaim the tarball is written to
+	// +optional
+	ClaimName string `json:"claimName,omitempty"`
+
+	// Path is the path of the tarball in the volume
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Bucket is the bucket the tarball is uploaded to
+	// +optional
+	Bucket string `json:"bucket,omitempty"`
+
+	// Key is the object key of the uploaded tarball
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// ETag is the etag of the uploaded object
+	// +optional
+	ETag string `json:"etag,omitempty"`
+
+	// Checksum is the sha256 digest of the tarball
+	// +optional
+	Checksum string `json:"checksum,omitempty"`
+
+	// Size is the size of the tarball in bytes
+	// +optional
+	Size int64 `json:"size,omitempty"`
+
+	// Provenance is the path in the volume or the object key of the provenance statement next to the tarball
+	// +optional
+	Provenance string `json:"provenance,omitempty"`
+}
+
 // WorkerState indicates underlaying snapshot worker state
 type WorkerState string
 
@@ -69,6 +550,26 @@ const (
 	DockerCommitFailed      status.ConditionType = "DockerCommitFailed"
 	DockerPushFailed        status.ConditionType = "DockerPushFailed"
 	InvalidImage            status.ConditionType = "InvalidImage"
+	UnsupportedRuntime      status.ConditionType = "UnsupportedRuntime"
+	InvalidChanges          status.ConditionType = "InvalidChanges"
+	ExportFailed            status.ConditionType = "ExportFailed"
+	SquashFailed            status.ConditionType = "SquashFailed"
+	ExcludeFailed           status.ConditionType = "ExcludeFailed"
+	SecretScanFailed        status.ConditionType = "SecretScanFailed"
+	SecretDetected          status.ConditionType = "SecretDetected"
+	PolicyCheckFailed       status.ConditionType = "PolicyCheckFailed"
+	PolicyRejected          status.ConditionType = "PolicyRejected"
+	SnapshotTooLarge        status.ConditionType = "SnapshotTooLarge"
+	SignFailed              status.ConditionType = "SignFailed"
+	AttestFailed            status.ConditionType = "AttestFailed"
+
+	// push failures told apart by registry errors, other push failures are reported as DockerPushFailed
+	RegistryAuthFailed    status.ConditionType = "RegistryAuthFailed"
+	RegistryAccessDenied  status.ConditionType = "RegistryAccessDenied"
+	RegistryQuotaExceeded status.ConditionType = "RegistryQuotaExceeded"
+	RegistryRateLimited   status.ConditionType = "RegistryRateLimited"
+	RegistryTLSError      status.ConditionType = "RegistryTLSError"
+	RegistryTimeout       status.ConditionType = "RegistryTimeout"
 )
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -81,6 +582,9 @@ const (
 // +kubebuilder:printcolumn:name="Container",type="string",JSONPath=".spec.containerName",description="container name of snapshot source"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // +kubebuilder:printcolumn:name="State",type="string",JSONPath=".status.workerState",description="container snapshot worker state"
+// +kubebuilder:printcolumn:name="Digest",type="string",JSONPath=".status.digest",description="manifest digest of the pushed snapshot image",priority=1
+// +kubebuilder:printcolumn:name="Size",type="integer",JSONPath=".status.size",description="size of the committed read/write layer in bytes",priority=1
+// +kubebuilder:printcolumn:name="Completed",type="date",JSONPath=".status.completionTime",description="time the snapshot worker finished"
 type ContainerSnapshot struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
@@ -5,4 +5,128 @@ const (
 	ExitCodeInvalidImage int32 = 100 + iota
 	ExitCodeDockerCommit
 	ExitCodeDockerPush
+	ExitCodeInvalidChanges
+	ExitCodeExport
+	ExitCodeSquash
+	ExitCodeExclude
+	ExitCodeScan
+	ExitCodeSecretDetected
+	ExitCodePolicy
+	ExitCodePolicyRejected
+	ExitCodeTooLarge
+	ExitCodeSign
+	ExitCodeAttest
+)
+
+// ResultVersion is the version of worker result documents written to the termination message
+const ResultVersion = "v1"
+
+// MaxTerminationMessage is the size kubernetes cuts termination messages to, worker results must fit in it
+const MaxTerminationMessage = 4096
+
+// FileChangesLogPrefix prefixes worker log lines of all files changed by the container, which are too many for the termination message.
+// a begin line is followed by a json line for each change, and an end line of "end <logged> <total>",
+// so a list cut by log rotation or lost lines is told from a complete one
+const FileChangesLogPrefix = "container-snapshot file changes: "
+
+// markers of the file changes in the worker log
+const (
+	FileChangesLogBegin = "begin"
+	FileChangesLogEnd   = "end"
+)
+
+// ProvenanceSuffix is appended to the path or the object key of exported tarballs, for their provenance statements
+const ProvenanceSuffix = ".intoto.json"
+
+// MaxFileChangesLog is the max size in bytes of file changes logged by the worker, the rest are counted in the end line only
+const MaxFileChangesLog = 1 << 20
+
+// phases of the snapshot worker, the last phase reached is reported in the worker result
+const (
+	PhaseValidate = "Validate"
+	PhaseCommit   = "Commit"
+	PhaseExclude  = "Exclude"
+	PhaseScan     = "Scan"
+	PhasePolicy   = "Policy"
+	PhaseSquash   = "Squash"
+	PhasePush     = "Push"
+	PhaseExport   = "Export"
+	PhaseSign     = "Sign"
+	PhaseAttest   = "Attest"
+	PhaseComplete = "Complete"
+)
+
+// error classes in the worker result, telling why the snapshot failed
+const (
+	ErrorInvalidImage   = "InvalidImage"
+	ErrorInvalidChanges = "InvalidChanges"
+	ErrorCommit         = "CommitFailed"
+	ErrorPush           = "PushFailed"
+	ErrorExport         = "ExportFailed"
+	ErrorSquash         = "SquashFailed"
+	ErrorExclude        = "ExcludeFailed"
+	ErrorScan           = "ScanFailed"
+	ErrorSecretDetected = "SecretDetected"
+	ErrorPolicy         = "PolicyCheckFailed"
+	ErrorPolicyRejected = "PolicyRejected"
+	ErrorTooLarge       = "SnapshotTooLarge"
+	ErrorSign           = "SignFailed"
+	ErrorAttest         = "AttestFailed"
+
+	// classes of push failures, reported for each destination,
+	// the class of the first failed destination is reported as the class of the snapshot
+	ErrorPushAuthDenied      = "PushAuthDenied"
+	ErrorPushAccessDenied    = "PushAccessDenied"
+	ErrorPushManifestInvalid = "PushManifestInvalid"
+	ErrorPushQuotaExceeded   = "PushQuotaExceeded"
+	ErrorPushRateLimited     = "PushRateLimited"
+	ErrorPushTLS             = "PushTLSError"
+	ErrorPushTimeout         = "PushTimeout"
+	ErrorPushNetwork         = "PushNetworkError"
+	ErrorPushServer          = "PushServerError"
+)
+
+// container runtimes supported by the worker, same as the container id prefixes in pod status
+const (
+	RuntimeDocker     = "docker"
+	RuntimeContainerd = "containerd"
+	RuntimeCRIO       = "cri-o"
+)
+
+// pause policies of the source pod containers while committing
+const (
+	// PauseNone commits the container without pausing
+	PauseNone = "None"
+	// PauseContainer pauses the source container only, same as docker commit defaults
+	PauseContainer = "Container"
+	// PausePod pauses all containers of the source pod, to freeze them at the same moment
+	PausePod = "Pod"
+)
+
+// cleanup policies of the committed image on the node
+const (
+	// CleanupAlways removes the committed image no matter the snapshot is pushed or not
+	CleanupAlways = "Always"
+	// CleanupOnSuccess removes the committed image only if it is pushed to all required destinations
+	CleanupOnSuccess = "OnSuccess"
+	// CleanupNever keeps the committed image, which is the default
+	CleanupNever = "Never"
+)
+
+// formats of exported snapshot tarballs
+const (
+	// ExportOCI is the OCI image layout
+	ExportOCI = "OCI"
+	// ExportDocker is the docker archive, same as `docker save`
+	ExportDocker = "Docker"
+	// ExportLayer is the uncompressed read/write layer tarball, for diff snapshots only
+	ExportLayer = "Layer"
+)
+
+// snapshot modes, telling what the snapshot is made of
+const (
+	// ModeImage snapshots the container as a runnable image, which is the default
+	ModeImage = "Image"
+	// ModeDiff snapshots the container read/write layer only, as a single layer artifact annotated with the source image
+	ModeDiff = "Diff"
 )
@@ -1,10 +1,17 @@
 package containersnapshot
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	stderr "errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,10 +22,12 @@ import (
 	"github.com/operator-framework/operator-sdk/pkg/status"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/storage/names"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
@@ -32,13 +41,31 @@ import (
 
 const (
 	labelKeyPrefix              = "container-snapshot.atom.supremind.com/"
+	annotationAllowSecrets      = labelKeyPrefix + "allow-secrets"
+	annotationRequestedBy       = labelKeyPrefix + "requested-by"
 	imagePushSecretPath         = "/config"
 	dockerSocketPath            = "/var/run/docker.sock"
-	containerIDPrefix           = "docker://"
+	containerdSocketPath        = "/run/containerd/containerd.sock"
+	podmanSocketPath            = "/run/podman/podman.sock"
+	exportVolumePath            = "/export"
+	policyVolumePath            = "/policy"
+	signingVolumePath           = "/signing"
+	signingKeyFile              = "cosign.key"
+	signingPasswordKey          = "cosign.password"
+	containerIDSeparator        = "://"
 	envKeyWorkerImage           = "WORKER_IMAGE"
 	envKeyWorkerImagePullSecret = "WORKER_IMAGE_PULL_SECRET"
+	envKeyDefaultMaxSize        = "DEFAULT_MAX_SIZE"
+	envKeyInsecureRegistries    = "INSECURE_REGISTRIES"
+	envKeyS3AccessKeyID         = "AWS_ACCESS_KEY_ID"
+	envKeyS3SecretAccessKey     = "AWS_SECRET_ACCESS_KEY"
+	envKeyS3SessionToken        = "AWS_SESSION_TOKEN"
+	envKeySigningPassword       = "COSIGN_PASSWORD"
 	requestTimeout              = 10 * time.Second
 	retryLater                  = 1 * time.Minute
+	fileChangesKey              = "changes"
+	// maxFileChangesSize keeps file changes under the size limit of ConfigMaps, which is 1MiB
+	maxFileChangesSize = 1000 << 10
 )
 
 var (
@@ -48,24 +75,64 @@ var (
 	errSourcePodFinished       = stderr.New("source pod finished")
 	errWorkerPodNotFound       = stderr.New("can not find worker pod")
 	errTooManyWorkerPods       = stderr.New("find more than one worker pods")
+	errUnsupportedRuntime      = stderr.New("container runtime is not supported")
+	errFileChangesNotFound     = stderr.New("can not find file changes in the worker log")
+	errFileChangesInvalid      = stderr.New("invalid file changes in the worker log")
+	errFileChangesIncomplete   = stderr.New("file changes in the worker log are incomplete")
+	errFileChangesConflict     = stderr.New("config map of file changes exists, and it is not owned by the snapshot")
 )
 
+// runtimeSockets are host paths of the sockets worker pods talk to, for each supported container runtime
+var runtimeSockets = map[string]string{
+	constants.RuntimeDocker:     dockerSocketPath,
+	constants.RuntimeContainerd: containerdSocketPath,
+	constants.RuntimeCRIO:       podmanSocketPath,
+}
+
 var log = logf.Log.WithName("container snapshot operator")
 
 // Add creates a new ContainerSnapshot Controller and adds it to the Manager. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+	clientset, e := kubernetes.NewForConfig(mgr.GetConfig())
+	if e != nil {
+		return e
+	}
+	r, e := newReconciler(mgr, &clientsetLogReader{clientset: clientset})
+	if e != nil {
+		return e
+	}
+	return add(mgr, r)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
+func newReconciler(mgr manager.Manager, logs podLogReader) (reconcile.Reconciler, error) {
+	var maxSize int64
+	if v := os.Getenv(envKeyDefaultMaxSize); v != "" {
+		q, e := resource.ParseQuantity(v)
+		if e != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envKeyDefaultMaxSize, e)
+		}
+		maxSize = q.Value()
+	}
+
+	var insecureRegistries []string
+	for _, r := range strings.Split(os.Getenv(envKeyInsecureRegistries), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			insecureRegistries = append(insecureRegistries, r)
+		}
+	}
+
 	return &ReconcileContainerSnapshot{
 		client:                mgr.GetClient(),
 		scheme:                mgr.GetScheme(),
+		logs:                  logs,
 		workerImage:           os.Getenv(envKeyWorkerImage),
 		workerImagePullSecret: os.Getenv(envKeyWorkerImagePullSecret),
-	}
+		defaultMaxSize:        maxSize,
+		insecureRegistries:    insecureRegistries,
+		apiReader:             mgr.GetAPIReader(),
+	}, nil
 }
 
 // add adds a new Controller to mgr with r as the reconcile.Reconciler
@@ -103,8 +170,29 @@ type ReconcileContainerSnapshot struct {
 	// that reads objects from the cache and writes to the apiserver
 	client                client.Client
 	scheme                *runtime.Scheme
+	logs                  podLogReader
 	workerImage           string
 	workerImagePullSecret string
+	// defaultMaxSize is the max size in bytes of snapshots without their own max size, no limit if it is 0
+	defaultMaxSize int64
+	// insecureRegistries are registries the built-in registry client of the worker accesses over plain http
+	insecureRegistries []string
+	// apiReader reads objects from the apiserver directly, for objects not worth caching, like secrets
+	apiReader client.Reader
+}
+
+// podLogReader reads logs of pod containers, which the controller-runtime client can not do
+type podLogReader interface {
+	ReadLogs(ctx context.Context, namespace, pod, container string) (io.ReadCloser, error)
+}
+
+// clientsetLogReader reads pod logs by the kubernetes clientset
+type clientsetLogReader struct {
+	clientset kubernetes.Interface
+}
+
+func (r *clientsetLogReader) ReadLogs(ctx context.Context, namespace, pod, container string) (io.ReadCloser, error) {
+	return r.clientset.CoreV1().Pods(namespace).GetLogs(pod, &corev1.PodLogOptions{Container: container}).Context(ctx).Stream()
 }
 
 // Reconcile reads that state of the cluster for a ContainerSnapshot object and makes changes based on the state read
@@ -142,7 +230,10 @@ func (r *ReconcileContainerSnapshot) Reconcile(request reconcile.Request) (recon
 	case atomv1alpha1.WorkerCreated, atomv1alpha1.WorkerRunning, atomv1alpha1.WorkerUnknown:
 		return r.onUpdate(ctx, instance)
 	case atomv1alpha1.WorkerFailed, atomv1alpha1.WorkerComplete:
-		// do nothing
+		// nothing to do but file changes failed to save when the worker finished
+		if pendingFileChanges(instance) {
+			return r.retryFileChanges(ctx, instance)
+		}
 		return reconcile.Result{}, nil
 	default:
 		return r.onCreation(ctx, instance)
@@ -171,7 +262,7 @@ func (r *ReconcileContainerSnapshot) onCreation(ctx context.Context, cr *atomv1a
 		}
 	}()
 
-	nodeName, containerID, e := r.getSourceContainer(ctx, cr)
+	src, e := r.getSourceContainer(ctx, cr)
 	if e != nil {
 		reqLogger.Error(e, "inspect source container")
 
@@ -199,6 +290,15 @@ func (r *ReconcileContainerSnapshot) onCreation(ctx context.Context, cr *atomv1a
 			})
 			cr.Status.WorkerState = atomv1alpha1.WorkerFailed
 			stale = true
+		} else if stderr.Is(e, errUnsupportedRuntime) {
+			cr.Status.Conditions.SetCondition(status.Condition{
+				Type:               atomv1alpha1.UnsupportedRuntime,
+				Status:             corev1.ConditionTrue,
+				Message:            e.Error(),
+				LastTransitionTime: metav1.Now(),
+			})
+			cr.Status.WorkerState = atomv1alpha1.WorkerFailed
+			stale = true
 		} else if stderr.Is(e, errSourcePodNotReady) {
 			// will retry
 			stale = cr.Status.Conditions.SetCondition(status.Condition{
@@ -212,12 +312,13 @@ func (r *ReconcileContainerSnapshot) onCreation(ctx context.Context, cr *atomv1a
 		return
 	}
 
-	stale = cr.Status.NodeName != nodeName || cr.Status.ContainerID != containerID
-	cr.Status.NodeName = nodeName
-	cr.Status.ContainerID = containerID
+	stale = cr.Status.NodeName != src.nodeName || cr.Status.ContainerID != src.containerID || cr.Status.Runtime != src.runtime
+	cr.Status.NodeName = src.nodeName
+	cr.Status.ContainerID = src.containerID
+	cr.Status.Runtime = src.runtime
 
 	// Define a new Pod object
-	pod := r.newWorkerPod(cr)
+	pod := r.newWorkerPod(cr, src)
 	reqLogger = reqLogger.WithValues("pod namespace", pod.Namespace, "pod name", pod.Name)
 
 	// Set ContainerSnapshot instance as the owner and controller
@@ -271,6 +372,18 @@ func (r *ReconcileContainerSnapshot) onUpdate(ctx context.Context, cr *atomv1alp
 
 	stale := false
 
+	if collectResult(cr, pod) {
+		stale = true
+		reqLogger.Info("update snapshot result", "digest", cr.Status.Digest, "size", cr.Status.Size)
+	}
+	// file changes are kept for reviewers only, the snapshot result does not depend on them
+	var retry bool
+	if pendingFileChanges(cr) {
+		var saved bool
+		saved, retry = r.keepFileChanges(ctx, cr, pod)
+		stale = stale || saved
+	}
+
 	if cr.Status.WorkerState != state {
 		stale = true
 		reqLogger.Info("update snapshot worker state", "from", cr.Status.WorkerState, "to", state)
@@ -282,7 +395,14 @@ func (r *ReconcileContainerSnapshot) onUpdate(ctx context.Context, cr *atomv1alp
 		reqLogger.Info("update snapshot condition", "type", cond.Type, "status", cond.Status)
 	}
 	if stale {
-		return r.applyUpdate(ctx, cr)
+		result, e := r.applyUpdate(ctx, cr)
+		if retry && e == nil {
+			result.RequeueAfter = retryLater
+		}
+		return result, e
+	}
+	if retry {
+		return reconcile.Result{RequeueAfter: retryLater}, nil
 	}
 
 	return reconcile.Result{}, nil
@@ -297,15 +417,26 @@ func (r *ReconcileContainerSnapshot) applyUpdate(ctx context.Context, cr *atomv1
 	return reconcile.Result{}, e
 }
 
-func (r *ReconcileContainerSnapshot) getSourceContainer(ctx context.Context, cr *atomv1alpha1.ContainerSnapshot) (nodeName, containerID string, e error) {
+// sourceContainer is the source container of a snapshot, and what the worker needs to know about it
+type sourceContainer struct {
+	nodeName    string
+	containerID string
+	runtime     string
+	// podContainers are ids of all running containers in the source pod
+	podContainers []string
+	// secretEnvs are names of env vars of the source container from secrets
+	secretEnvs []string
+}
+
+// getSourceContainer finds the source container in the source pod
+func (r *ReconcileContainerSnapshot) getSourceContainer(ctx context.Context, cr *atomv1alpha1.ContainerSnapshot) (*sourceContainer, error) {
 	reqLogger := logger(cr)
 
 	pod := &corev1.Pod{}
-	e = r.client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: cr.Spec.PodName}, pod)
+	e := r.client.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: cr.Spec.PodName}, pod)
 	if e != nil {
 		reqLogger.Error(e, "can not get source pod")
-		e = errSourcePodNotFound
-		return
+		return nil, errSourcePodNotFound
 	}
 
 	switch pod.Status.Phase {
@@ -316,26 +447,86 @@ func (r *ReconcileContainerSnapshot) getSourceContainer(ctx context.Context, cr
 	}
 	if e != nil {
 		reqLogger.Error(e, "source pod should be running")
-		return
+		return nil, e
 	}
 
-	nodeName = pod.Spec.NodeName
+	src := &sourceContainer{nodeName: pod.Spec.NodeName}
 	for _, c := range pod.Status.ContainerStatuses {
 		if c.Name == cr.Spec.ContainerName {
-			containerID = strings.TrimPrefix(c.ContainerID, containerIDPrefix)
-			break
+			src.runtime, src.containerID = parseContainerID(c.ContainerID)
+		}
+		if c.State.Running != nil {
+			_, id := parseContainerID(c.ContainerID)
+			src.podContainers = append(src.podContainers, id)
 		}
 	}
-	if containerID == "" {
+	if src.containerID == "" {
 		e = errSourceContainerNotFound
 		reqLogger.Error(e, "source container not found")
+		return nil, e
+	}
+	if _, ok := runtimeSockets[src.runtime]; !ok {
+		e = fmt.Errorf("%w: %s", errUnsupportedRuntime, src.runtime)
+		reqLogger.Error(e, "source container runs on an unsupported runtime")
+		return nil, e
+	}
+
+	if !cr.Spec.KeepSecretEnvs {
+		for _, c := range pod.Spec.Containers {
+			if c.Name == cr.Spec.ContainerName {
+				if src.secretEnvs, e = r.getSecretEnvs(ctx, pod.Namespace, &c); e != nil {
+					reqLogger.Error(e, "find env vars of the source container from secrets")
+					return nil, e
+				}
+			}
+		}
+	}
+
+	return src, nil
+}
+
+// getSecretEnvs returns names of env vars of the container from secrets, either by secret key refs or all keys of secrets in envFrom
+func (r *ReconcileContainerSnapshot) getSecretEnvs(ctx context.Context, namespace string, c *corev1.Container) ([]string, error) {
+	var names []string
+	for _, from := range c.EnvFrom {
+		if from.SecretRef == nil {
+			continue
+		}
+		secret := &corev1.Secret{}
+		// secrets are read uncached, or the manager would watch and cache all secrets for their key names only
+		if e := r.apiReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: from.SecretRef.Name}, secret); e != nil {
+			// the container is running without optional secrets
+			if errors.IsNotFound(e) && from.SecretRef.Optional != nil && *from.SecretRef.Optional {
+				continue
+			}
+			return nil, fmt.Errorf("get secret %s: %w", from.SecretRef.Name, e)
+		}
+		for key := range secret.Data {
+			names = append(names, from.Prefix+key)
+		}
+	}
+	for _, env := range c.Env {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			names = append(names, env.Name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// parseContainerID splits a container id in pod status, formatted as <runtime>://<id>
+func parseContainerID(full string) (rt, id string) {
+	parts := strings.SplitN(full, containerIDSeparator, 2)
+	if len(parts) != 2 {
+		return "", full
 	}
 
-	return
+	return parts[0], parts[1]
 }
 
 // newWorkerPod returns a pod with the same name/namespace as the cr
-func (r *ReconcileContainerSnapshot) newWorkerPod(cr *atomv1alpha1.ContainerSnapshot) *corev1.Pod {
+func (r *ReconcileContainerSnapshot) newWorkerPod(cr *atomv1alpha1.ContainerSnapshot, src *sourceContainer) *corev1.Pod {
 	labels := map[string]string{
 		labelKeyPrefix + "snapshot":  cr.Name,
 		labelKeyPrefix + "pod":       cr.Spec.PodName,
@@ -361,7 +552,7 @@ func (r *ReconcileContainerSnapshot) newWorkerPod(cr *atomv1alpha1.ContainerSnap
 				Name:            "snapshot-worker",
 				Image:           r.workerImage,
 				Command:         []string{"container-snapshot-worker"},
-				Args:            []string{"--container", cr.Status.ContainerID, "--image", cr.Spec.Image, "--snapshot", cr.Name},
+				Args:            r.workerArgs(cr, src),
 				ImagePullPolicy: corev1.PullAlways,
 				Env: []corev1.EnvVar{{
 					Name: "NAMESPACE",
@@ -378,8 +569,8 @@ func (r *ReconcileContainerSnapshot) newWorkerPod(cr *atomv1alpha1.ContainerSnap
 						ReadOnly:  true,
 					},
 					{
-						Name:      "docker-socket",
-						MountPath: dockerSocketPath,
+						Name:      "runtime-socket",
+						MountPath: runtimeSockets[cr.Status.Runtime],
 					},
 				},
 			}},
@@ -393,10 +584,10 @@ func (r *ReconcileContainerSnapshot) newWorkerPod(cr *atomv1alpha1.ContainerSnap
 					},
 				},
 				{
-					Name: "docker-socket",
+					Name: "runtime-socket",
 					VolumeSource: corev1.VolumeSource{
 						HostPath: &corev1.HostPathVolumeSource{
-							Path: dockerSocketPath,
+							Path: runtimeSockets[cr.Status.Runtime],
 							Type: (*corev1.HostPathType)(pointer.StringPtr(string(corev1.HostPathSocket))),
 						},
 					},
@@ -405,6 +596,73 @@ func (r *ReconcileContainerSnapshot) newWorkerPod(cr *atomv1alpha1.ContainerSnap
 		},
 	}
 
+	if export := cr.Spec.Export; export != nil && export.Volume != nil {
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "export",
+			MountPath: exportVolumePath,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "export",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: export.Volume.ClaimName},
+			},
+		})
+	}
+
+	if policy := cr.Spec.Policy; policy != nil && policy.ConfigMap != nil {
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "policy",
+			MountPath: policyVolumePath,
+			ReadOnly:  true,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "policy",
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: *policy.ConfigMap,
+					DefaultMode:          pointer.Int32Ptr(0555),
+				},
+			},
+		})
+	}
+
+	if export := cr.Spec.Export; export != nil && export.Volume == nil && export.S3 != nil && export.S3.CredentialsSecret != nil {
+		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, s3CredentialEnvs(export.S3.CredentialsSecret.Name)...)
+	}
+
+	if signing := cr.Spec.Signing; signing != nil && cr.Spec.Export == nil {
+		key := signing.Key
+		if key == "" {
+			key = signingKeyFile
+		}
+		pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      "signing",
+			MountPath: signingVolumePath,
+			ReadOnly:  true,
+		})
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name: "signing",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  signing.Secret.Name,
+					Items:       []corev1.KeyToPath{{Key: key, Path: signingKeyFile}},
+					DefaultMode: pointer.Int32Ptr(0400),
+				},
+			},
+		})
+		// only keys encrypted by cosign have passwords
+		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{
+			Name: envKeySigningPassword,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: signing.Secret,
+					Key:                  signingPasswordKey,
+					Optional:             pointer.BoolPtr(true),
+				},
+			},
+		})
+	}
+
 	for _, sec := range cr.Spec.ImagePushSecrets {
 		name := names.SimpleNameGenerator.GenerateName("sec-")
 		pod.Spec.Volumes[0].VolumeSource.Projected.Sources = append(pod.Spec.Volumes[0].VolumeSource.Projected.Sources, corev1.VolumeProjection{
@@ -428,6 +686,176 @@ func (r *ReconcileContainerSnapshot) newWorkerPod(cr *atomv1alpha1.ContainerSnap
 	return pod
 }
 
+func (r *ReconcileContainerSnapshot) workerArgs(cr *atomv1alpha1.ContainerSnapshot, src *sourceContainer) []string {
+	args := []string{"--container", cr.Status.ContainerID, "--image", cr.Spec.Image, "--snapshot", cr.Name, "--runtime", cr.Status.Runtime}
+	for _, t := range cr.Spec.AdditionalTags {
+		args = append(args, "--tag", t)
+	}
+	for _, m := range cr.Spec.Mirrors {
+		if m.Optional {
+			args = append(args, "--optional-mirror", m.Image)
+		} else {
+			args = append(args, "--mirror", m.Image)
+		}
+	}
+	for _, c := range cr.Spec.Changes {
+		args = append(args, "--change", c)
+	}
+	if cr.Spec.PausePolicy != "" {
+		args = append(args, "--pause", cr.Spec.PausePolicy)
+	}
+	if cr.Spec.CleanupPolicy != "" {
+		args = append(args, "--cleanup", cr.Spec.CleanupPolicy)
+	}
+	if d := cr.Spec.DirectPush; d != nil {
+		args = append(args, "--direct-push")
+		if d.ChunkSize > 0 {
+			args = append(args, "--push-chunk-size", strconv.FormatInt(d.ChunkSize, 10))
+		}
+	}
+	// the built-in registry client also pushes diffs, signatures and attestations, not only direct pushes
+	for _, r := range r.insecureRegistries {
+		args = append(args, "--insecure-registry", r)
+	}
+	if r := cr.Spec.PushRetry; r != nil {
+		if r.Attempts > 0 {
+			args = append(args, "--push-attempts", strconv.Itoa(int(r.Attempts)))
+		}
+		if r.Backoff != nil {
+			args = append(args, "--push-backoff", r.Backoff.Duration.String())
+		}
+		if r.MaxBackoff != nil {
+			args = append(args, "--push-max-backoff", r.MaxBackoff.Duration.String())
+		}
+	}
+	if export := cr.Spec.Export; export != nil {
+		if export.Volume != nil {
+			args = append(args, "--export-path", filepath.Join(exportVolumePath, exportPath(cr)))
+		} else if o := export.S3; o != nil {
+			key := o.Key
+			if key == "" {
+				key = cr.Name + ".tar"
+			}
+			args = append(args, "--export-bucket", o.Bucket, "--export-key", key, "--s3-endpoint", o.Endpoint)
+			if o.Region != "" {
+				args = append(args, "--s3-region", o.Region)
+			}
+			if o.PathStyle {
+				args = append(args, "--s3-path-style")
+			}
+			if o.PartSize > 0 {
+				args = append(args, "--s3-part-size", strconv.FormatInt(o.PartSize, 10))
+			}
+		}
+		if export.Format != "" {
+			args = append(args, "--export-format", export.Format)
+		}
+	}
+	// exported snapshots are not pushed, so there is nothing to sign
+	if cr.Spec.Signing != nil && cr.Spec.Export == nil {
+		args = append(args, "--sign-key", filepath.Join(signingVolumePath, signingKeyFile))
+	}
+	// the requesting user annotation is set by whoever creates the snapshot, and no webhook here verifies it,
+	// so it is recorded as claimed, trustworthy only if a webhook of the cluster stamps it.
+	// exported snapshots have the provenance written next to the tarball
+	if !cr.Spec.DisableProvenance {
+		args = append(args, "--provenance", "--snapshot-uid", string(cr.UID),
+			"--source-pod", cr.Spec.PodName, "--source-container-name", cr.Spec.ContainerName, "--node", cr.Status.NodeName)
+		if user := cr.Annotations[annotationRequestedBy]; user != "" {
+			args = append(args, "--requested-by", user)
+		}
+		if !cr.CreationTimestamp.IsZero() {
+			args = append(args, "--requested-at", cr.CreationTimestamp.UTC().Format(time.RFC3339))
+		}
+	}
+	if cr.Spec.Mode == constants.ModeDiff {
+		args = append(args, "--mode", cr.Spec.Mode)
+	} else if cr.Spec.Squash {
+		args = append(args, "--squash")
+	}
+	for _, name := range src.secretEnvs {
+		args = append(args, "--secret-env", name)
+	}
+	for _, pattern := range cr.Spec.Exclude {
+		args = append(args, "--exclude", pattern)
+	}
+	maxSize := r.defaultMaxSize
+	if cr.Spec.MaxSize != nil {
+		maxSize = cr.Spec.MaxSize.Value()
+	}
+	if maxSize > 0 {
+		args = append(args, "--max-size", strconv.FormatInt(maxSize, 10))
+	}
+	if scan := cr.Spec.SecretScan; scan != nil {
+		args = append(args, "--scan-secrets")
+		for _, r := range scan.Rules {
+			args = append(args, "--scan-rule", r.Name+"="+r.Pattern)
+		}
+		for _, name := range scan.DisabledRules {
+			args = append(args, "--scan-disable-rule", name)
+		}
+		// secrets found are reported but do not block the snapshot, if the snapshot is annotated to allow them
+		if allow, _ := strconv.ParseBool(cr.Annotations[annotationAllowSecrets]); allow {
+			args = append(args, "--scan-allow")
+		}
+	}
+	if changes := cr.Spec.FileChanges; changes != nil {
+		args = append(args, "--file-changes")
+		if changes.Top > 0 {
+			args = append(args, "--file-changes-top", strconv.Itoa(int(changes.Top)))
+		}
+	}
+	if policy := cr.Spec.Policy; policy != nil {
+		if policy.URL != "" {
+			args = append(args, "--policy-url", policy.URL)
+		}
+		for _, c := range policy.Command {
+			args = append(args, "--policy-command", c)
+		}
+		if policy.Timeout != nil {
+			args = append(args, "--policy-timeout", policy.Timeout.Duration.String())
+		}
+		// the worker knows the namespace and the name of the snapshot already
+		for _, kv := range [][2]string{{"pod", cr.Spec.PodName}, {"container", cr.Spec.ContainerName}, {"node", cr.Status.NodeName}} {
+			args = append(args, "--policy-metadata", kv[0]+"="+kv[1])
+		}
+	}
+	if cr.Spec.PausePolicy == constants.PausePod {
+		for _, c := range src.podContainers {
+			args = append(args, "--pod-container", c)
+		}
+	}
+
+	return args
+}
+
+// s3CredentialEnvs returns envs of the worker with s3 credentials from the secret
+func s3CredentialEnvs(secret string) []corev1.EnvVar {
+	var envs []corev1.EnvVar
+	for _, key := range []string{envKeyS3AccessKeyID, envKeyS3SecretAccessKey, envKeyS3SessionToken} {
+		envs = append(envs, corev1.EnvVar{
+			Name: key,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+					Key:                  key,
+					Optional:             pointer.BoolPtr(key == envKeyS3SessionToken),
+				},
+			},
+		})
+	}
+	return envs
+}
+
+// exportPath returns the path of the tarball in the export volume, paths out of the volume are kept in it
+func exportPath(cr *atomv1alpha1.ContainerSnapshot) string {
+	p := strings.TrimPrefix(filepath.Clean("/"+cr.Spec.Export.Volume.Path), "/")
+	if p == "" {
+		return cr.Name + ".tar"
+	}
+	return p
+}
+
 func (r *ReconcileContainerSnapshot) getWorkerPod(ctx context.Context, ns string, uid types.UID) (*corev1.Pod, error) {
 	var pods corev1.PodList
 	e := r.client.List(ctx, &pods,
@@ -451,30 +879,381 @@ func logger(cr *atomv1alpha1.ContainerSnapshot) logr.Logger {
 	return log.WithValues("snapshot name", cr.Name, "snapshot namespace", cr.Namespace)
 }
 
-func parseTerminationState(pod *corev1.Pod) *status.Condition {
-	if len(pod.Status.ContainerStatuses) == 1 {
-		if term := pod.Status.ContainerStatuses[0].LastTerminationState.Terminated; term != nil {
-			var typ status.ConditionType
-			switch term.ExitCode {
-			case constants.ExitCodeInvalidImage:
-				typ = atomv1alpha1.InvalidImage
-			case constants.ExitCodeDockerCommit:
-				typ = atomv1alpha1.DockerCommitFailed
-			case constants.ExitCodeDockerPush:
-				typ = atomv1alpha1.DockerPushFailed
+// workerResult is the versioned snapshot result written by the worker as its termination message
+type workerResult struct {
+	Version        string                           `json:"version"`
+	Phase          string                           `json:"phase"`
+	Error          string                           `json:"error,omitempty"`
+	Message        string                           `json:"message,omitempty"`
+	ImageID        string                           `json:"imageID,omitempty"`
+	Digest         string                           `json:"digest,omitempty"`
+	Signature      string                           `json:"signature,omitempty"`
+	Provenance     string                           `json:"provenance,omitempty"`
+	Size           int64                            `json:"size,omitempty"`
+	Layers         int32                            `json:"layers,omitempty"`
+	FreedBytes     int64                            `json:"freedBytes,omitempty"`
+	ExcludedFiles  int32                            `json:"excludedFiles,omitempty"`
+	ExcludedBytes  int64                            `json:"excludedBytes,omitempty"`
+	ScrubbedEnvs   []string                         `json:"scrubbedEnvs,omitempty"`
+	SecretFindings []atomv1alpha1.SecretFinding     `json:"secretFindings,omitempty"`
+	FileChanges    *workerFileChanges               `json:"fileChanges,omitempty"`
+	StartedAt      metav1.Time                      `json:"startedAt"`
+	FinishedAt     metav1.Time                      `json:"finishedAt"`
+	CommitDuration *metav1.Duration                 `json:"commitDuration,omitempty"`
+	PushDuration   *metav1.Duration                 `json:"pushDuration,omitempty"`
+	Destinations   []atomv1alpha1.DestinationStatus `json:"destinations,omitempty"`
+	Export         *atomv1alpha1.ExportStatus       `json:"export,omitempty"`
+}
+
+// workerFileChanges summarizes files changed by the container in the worker result, with the largest changes only
+type workerFileChanges struct {
+	Added    int32                     `json:"added"`
+	Modified int32                     `json:"modified"`
+	Changed  int32                     `json:"changed,omitempty"`
+	Deleted  int32                     `json:"deleted"`
+	Bytes    int64                     `json:"bytes"`
+	Changes  []atomv1alpha1.FileChange `json:"changes,omitempty"`
+}
+
+// errorConditions are conditions of error classes in worker results
+var errorConditions = map[string]status.ConditionType{
+	constants.ErrorInvalidImage:   atomv1alpha1.InvalidImage,
+	constants.ErrorInvalidChanges: atomv1alpha1.InvalidChanges,
+	constants.ErrorCommit:         atomv1alpha1.DockerCommitFailed,
+	constants.ErrorPush:           atomv1alpha1.DockerPushFailed,
+	constants.ErrorExport:         atomv1alpha1.ExportFailed,
+	constants.ErrorSquash:         atomv1alpha1.SquashFailed,
+	constants.ErrorExclude:        atomv1alpha1.ExcludeFailed,
+	constants.ErrorScan:           atomv1alpha1.SecretScanFailed,
+	constants.ErrorSecretDetected: atomv1alpha1.SecretDetected,
+	constants.ErrorPolicy:         atomv1alpha1.PolicyCheckFailed,
+	constants.ErrorPolicyRejected: atomv1alpha1.PolicyRejected,
+	constants.ErrorTooLarge:       atomv1alpha1.SnapshotTooLarge,
+	constants.ErrorSign:           atomv1alpha1.SignFailed,
+	constants.ErrorAttest:         atomv1alpha1.AttestFailed,
+
+	constants.ErrorPushAuthDenied:      atomv1alpha1.RegistryAuthFailed,
+	constants.ErrorPushAccessDenied:    atomv1alpha1.RegistryAccessDenied,
+	constants.ErrorPushQuotaExceeded:   atomv1alpha1.RegistryQuotaExceeded,
+	constants.ErrorPushRateLimited:     atomv1alpha1.RegistryRateLimited,
+	constants.ErrorPushTLS:             atomv1alpha1.RegistryTLSError,
+	constants.ErrorPushTimeout:         atomv1alpha1.RegistryTimeout,
+	constants.ErrorPushManifestInvalid: atomv1alpha1.DockerPushFailed,
+	constants.ErrorPushNetwork:         atomv1alpha1.DockerPushFailed,
+	constants.ErrorPushServer:          atomv1alpha1.DockerPushFailed,
+}
+
+// collectResult records timings of the worker and its result into the snapshot status, returns true if the status is changed
+func collectResult(cr *atomv1alpha1.ContainerSnapshot, pod *corev1.Pod) bool {
+	term := terminatedState(pod)
+	if term == nil {
+		return false
+	}
+
+	old := cr.Status.DeepCopy()
+	startedAt, finishedAt := term.StartedAt, term.FinishedAt
+	if result := parseWorkerResult(pod); result != nil {
+		if !result.StartedAt.IsZero() {
+			startedAt = result.StartedAt
+		}
+		if !result.FinishedAt.IsZero() {
+			finishedAt = result.FinishedAt
+		}
+		cr.Status.Phase = result.Phase
+		cr.Status.ImageID = result.ImageID
+		cr.Status.Digest = result.Digest
+		cr.Status.Signature = result.Signature
+		cr.Status.Provenance = result.Provenance
+		cr.Status.Size = result.Size
+		cr.Status.Layers = result.Layers
+		cr.Status.FreedBytes = result.FreedBytes
+		cr.Status.ExcludedFiles = result.ExcludedFiles
+		cr.Status.ExcludedBytes = result.ExcludedBytes
+		cr.Status.ScrubbedEnvs = result.ScrubbedEnvs
+		cr.Status.SecretFindings = result.SecretFindings
+		cr.Status.FileChanges = nil
+		if c := result.FileChanges; c != nil {
+			cr.Status.FileChanges = &atomv1alpha1.FileChangeSummary{
+				Added:    c.Added,
+				Modified: c.Modified,
+				Changed:  c.Changed,
+				Deleted:  c.Deleted,
+				Bytes:    c.Bytes,
+				Largest:  c.Changes,
+			}
+			// the config map is saved by the operator after the result is collected
+			if old.FileChanges != nil {
+				cr.Status.FileChanges.ConfigMap = old.FileChanges.ConfigMap
+			}
+		}
+		cr.Status.CommitDuration = result.CommitDuration
+		cr.Status.PushDuration = result.PushDuration
+		cr.Status.Destinations = result.Destinations
+		cr.Status.Export = result.Export
+		// the worker reports the path it writes to, which is in the mounted volume
+		if export := cr.Status.Export; export != nil && cr.Spec.Export != nil && cr.Spec.Export.Volume != nil {
+			export.ClaimName = cr.Spec.Export.Volume.ClaimName
+			export.Path = exportPath(cr)
+			if export.Provenance != "" {
+				export.Provenance = export.Path + constants.ProvenanceSuffix
+			}
+		}
+	}
+	cr.Status.StartTime = &startedAt
+	cr.Status.CompletionTime = &finishedAt
+
+	return !reflect.DeepEqual(old, &cr.Status)
+}
+
+// pendingFileChanges tells if all file changes reported by the worker are neither saved nor known to be missing
+func pendingFileChanges(cr *atomv1alpha1.ContainerSnapshot) bool {
+	changes := cr.Status.FileChanges
+	return changes != nil && cr.Spec.FileChanges != nil && changes.ConfigMap == "" && changes.Missing == ""
+}
+
+// retryFileChanges saves file changes of a finished snapshot, which are not saved when the worker finished
+func (r *ReconcileContainerSnapshot) retryFileChanges(ctx context.Context, cr *atomv1alpha1.ContainerSnapshot) (reconcile.Result, error) {
+	pod, e := r.getWorkerPod(ctx, cr.Namespace, cr.UID)
+	if e != nil {
+		if !errors.IsNotFound(e) && !stderr.Is(e, errWorkerPodNotFound) {
+			return reconcile.Result{}, e
+		}
+		// the worker log is gone with the pod
+		cr.Status.FileChanges.Missing = errWorkerPodNotFound.Error()
+		return r.applyUpdate(ctx, cr)
+	}
+
+	stale, retry := r.keepFileChanges(ctx, cr, pod)
+	var result reconcile.Result
+	if stale {
+		result, e = r.applyUpdate(ctx, cr)
+	}
+	if retry && e == nil {
+		result.RequeueAfter = retryLater
+	}
+	return result, e
+}
+
+// keepFileChanges saves file changes, or records why they are missing if they could never be saved.
+// returns whether the status is updated, and whether saving them should be retried later
+func (r *ReconcileContainerSnapshot) keepFileChanges(ctx context.Context, cr *atomv1alpha1.ContainerSnapshot, pod *corev1.Pod) (bool, bool) {
+	reqLogger := logger(cr)
+	e := r.saveFileChanges(ctx, cr, pod)
+	switch {
+	case e == nil:
+		reqLogger.Info("save file changes", "config map", cr.Status.FileChanges.ConfigMap)
+		return true, false
+	case stderr.Is(e, errFileChangesNotFound) || stderr.Is(e, errFileChangesInvalid) || stderr.Is(e, errFileChangesIncomplete) ||
+		stderr.Is(e, errFileChangesConflict):
+		reqLogger.Error(e, "file changes are missing")
+		cr.Status.FileChanges.Missing = e.Error()
+		return true, false
+	default:
+		reqLogger.Error(e, "save file changes, will retry")
+		return false, true
+	}
+}
+
+// saveFileChanges keeps all files changed by the container, logged by the worker, in a config map owned by the snapshot
+func (r *ReconcileContainerSnapshot) saveFileChanges(ctx context.Context, cr *atomv1alpha1.ContainerSnapshot, pod *corev1.Pod) error {
+	changes, total, e := r.readFileChanges(ctx, pod)
+	if e != nil {
+		return e
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cr.Name + "-changes",
+			Namespace: cr.Namespace,
+			Labels:    map[string]string{labelKeyPrefix + "snapshot": cr.Name},
+		},
+		Data: map[string]string{fileChangesKey: formatFileChanges(changes, total)},
+	}
+	if e := controllerutil.SetControllerReference(cr, cm, r.scheme); e != nil {
+		return e
+	}
+	if e := r.client.Create(ctx, cm); e != nil {
+		if !errors.IsAlreadyExists(e) {
+			return e
+		}
+		// saved already, but the status was not updated
+		existing := &corev1.ConfigMap{}
+		if e := r.client.Get(ctx, types.NamespacedName{Namespace: cm.Namespace, Name: cm.Name}, existing); e != nil {
+			return e
+		}
+		if !metav1.IsControlledBy(existing, cr) {
+			return fmt.Errorf("%w: %s", errFileChangesConflict, cm.Name)
+		}
+	}
+
+	cr.Status.FileChanges.ConfigMap = cm.Name
+	return nil
+}
+
+// readFileChanges finds file changes between the markers in the worker log, which are too many for the termination message,
+// returns the changes logged, and the total number of changes including those over the size limit of the log
+func (r *ReconcileContainerSnapshot) readFileChanges(ctx context.Context, pod *corev1.Pod) ([]atomv1alpha1.FileChange, int, error) {
+	rc, e := r.logs.ReadLogs(ctx, pod.Namespace, pod.Name, pod.Spec.Containers[0].Name)
+	if e != nil {
+		return nil, 0, fmt.Errorf("read worker log: %w", e)
+	}
+	defer rc.Close()
+
+	var changes []atomv1alpha1.FileChange
+	begun := false
+	br := bufio.NewReader(rc)
+	for {
+		line, e := br.ReadString('\n')
+		if e != nil && e != io.EOF {
+			return nil, 0, fmt.Errorf("read worker log: %w", e)
+		}
+
+		if strings.HasPrefix(line, constants.FileChangesLogPrefix) {
+			content := strings.TrimSpace(strings.TrimPrefix(line, constants.FileChangesLogPrefix))
+			switch {
+			case content == constants.FileChangesLogBegin:
+				changes, begun = []atomv1alpha1.FileChange{}, true
+
+			case strings.HasPrefix(content, constants.FileChangesLogEnd+" "):
+				var logged, total int
+				if _, e := fmt.Sscanf(content, constants.FileChangesLogEnd+" %d %d", &logged, &total); e != nil {
+					return nil, 0, fmt.Errorf("%w: %v", errFileChangesInvalid, e)
+				}
+				if !begun || len(changes) != logged {
+					return nil, 0, fmt.Errorf("%w: %d of %d changes found", errFileChangesIncomplete, len(changes), logged)
+				}
+				return changes, total, nil
+
+			case begun:
+				var c atomv1alpha1.FileChange
+				if e := json.Unmarshal([]byte(content), &c); e != nil {
+					return nil, 0, fmt.Errorf("%w: %v", errFileChangesInvalid, e)
+				}
+				changes = append(changes, c)
+
 			default:
-				return nil
+				// the beginning is cut from the log
+				return nil, 0, fmt.Errorf("%w: no beginning", errFileChangesIncomplete)
+			}
+		}
+
+		if e == io.EOF {
+			if begun {
+				return nil, 0, fmt.Errorf("%w: no end", errFileChangesIncomplete)
 			}
+			return nil, 0, errFileChangesNotFound
+		}
+	}
+}
 
+// formatFileChanges formats each change as a line of "<kind> <size> <path>", changes over the size limit are counted only
+func formatFileChanges(changes []atomv1alpha1.FileChange, total int) string {
+	var b strings.Builder
+	for i, c := range changes {
+		line := fmt.Sprintf("%s %d %s\n", c.Kind, c.Size, c.Path)
+		if b.Len()+len(line) > maxFileChangesSize {
+			fmt.Fprintf(&b, "... and %d more\n", total-i)
+			return b.String()
+		}
+		b.WriteString(line)
+	}
+	if total > len(changes) {
+		fmt.Fprintf(&b, "... and %d more\n", total-len(changes))
+	}
+	return b.String()
+}
+
+// terminatedState returns the terminated state of the worker container, or nil if it is not terminated
+func terminatedState(pod *corev1.Pod) *corev1.ContainerStateTerminated {
+	if len(pod.Status.ContainerStatuses) != 1 {
+		return nil
+	}
+	if term := pod.Status.ContainerStatuses[0].State.Terminated; term != nil {
+		return term
+	}
+
+	return pod.Status.ContainerStatuses[0].LastTerminationState.Terminated
+}
+
+// parseWorkerResult returns nil if the termination message is not a worker result of a known version,
+// e.g. written by an older worker, which reports by exit codes only
+func parseWorkerResult(pod *corev1.Pod) *workerResult {
+	term := terminatedState(pod)
+	if term == nil || term.Message == "" {
+		return nil
+	}
+
+	var result workerResult
+	if e := json.Unmarshal([]byte(term.Message), &result); e != nil || result.Version != constants.ResultVersion {
+		return nil
+	}
+
+	return &result
+}
+
+// parseTerminationState returns the failure condition from the worker result, or from the exit code if there is no result
+func parseTerminationState(pod *corev1.Pod) *status.Condition {
+	term := terminatedState(pod)
+	if term == nil {
+		return nil
+	}
+
+	msg := term.Message
+	if result := parseWorkerResult(pod); result != nil {
+		if result.Error == "" {
+			return nil
+		}
+		if typ, ok := errorConditions[result.Error]; ok {
 			return &status.Condition{
 				Type:               typ,
 				Status:             corev1.ConditionTrue,
-				Message:            term.Message,
-				Reason:             status.ConditionReason(term.Reason),
+				Message:            result.Message,
+				Reason:             status.ConditionReason(result.Error),
 				LastTransitionTime: term.FinishedAt,
 			}
 		}
+		msg = result.Message
 	}
 
-	return nil
+	var typ status.ConditionType
+	switch term.ExitCode {
+	case constants.ExitCodeInvalidImage:
+		typ = atomv1alpha1.InvalidImage
+	case constants.ExitCodeDockerCommit:
+		typ = atomv1alpha1.DockerCommitFailed
+	case constants.ExitCodeDockerPush:
+		typ = atomv1alpha1.DockerPushFailed
+	case constants.ExitCodeInvalidChanges:
+		typ = atomv1alpha1.InvalidChanges
+	case constants.ExitCodeExport:
+		typ = atomv1alpha1.ExportFailed
+	case constants.ExitCodeSquash:
+		typ = atomv1alpha1.SquashFailed
+	case constants.ExitCodeExclude:
+		typ = atomv1alpha1.ExcludeFailed
+	case constants.ExitCodeScan:
+		typ = atomv1alpha1.SecretScanFailed
+	case constants.ExitCodeSecretDetected:
+		typ = atomv1alpha1.SecretDetected
+	case constants.ExitCodePolicy:
+		typ = atomv1alpha1.PolicyCheckFailed
+	case constants.ExitCodePolicyRejected:
+		typ = atomv1alpha1.PolicyRejected
+	case constants.ExitCodeTooLarge:
+		typ = atomv1alpha1.SnapshotTooLarge
+	case constants.ExitCodeSign:
+		typ = atomv1alpha1.SignFailed
+	case constants.ExitCodeAttest:
+		typ = atomv1alpha1.AttestFailed
+	default:
+		return nil
+	}
+
+	return &status.Condition{
+		Type:               typ,
+		Status:             corev1.ConditionTrue,
+		Message:            msg,
+		Reason:             status.ConditionReason(term.Reason),
+		LastTransitionTime: term.FinishedAt,
+	}
 }
@@ -2,6 +2,14 @@ package containersnapshot
 
 import (
 	"context"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,13 +18,16 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/operator-framework/operator-sdk/pkg/status"
 	corev1 "k8s.io/api/core/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -33,12 +44,15 @@ var _ = Describe("snapshot operator", func() {
 		snpKey    = types.NamespacedName{Name: "example-snapshot", Namespace: namespace}
 		now       = metav1.Now()
 		ctx       = context.Background()
+		logs      = &fakeLogReader{}
 		re        = &ReconcileContainerSnapshot{
+			logs:                  logs,
 			workerImage:           "worker-image:latest",
 			workerImagePullSecret: "worker-image-pull-secret",
 		}
 		simpleSnapshot *atomv1alpha1.ContainerSnapshot
 		sourcePod      *corev1.Pod
+		apiServer      client.Client
 	)
 
 	BeforeEach(func() {
@@ -105,6 +119,9 @@ var _ = Describe("snapshot operator", func() {
 		re.scheme.AddKnownTypes(atomv1alpha1.SchemeGroupVersion, simpleSnapshot)
 		// Create a fake client to mock API calls.
 		re.client = &indexFakeClient{fake.NewFakeClientWithScheme(re.scheme)}
+		// and another one for the uncached reader, objects read by it are not in the cache
+		apiServer = fake.NewFakeClientWithScheme(re.scheme)
+		re.apiReader = apiServer
 	})
 
 	Context("creating snapshot", func() {
@@ -144,135 +161,1293 @@ var _ = Describe("snapshot operator", func() {
 					"--container", "xxxx-source-image",
 					"--image", "reg.example.com/snapshots/example-snapshot:v0.0.1",
 					"--snapshot", "example-snapshot",
+					"--runtime", "docker",
+					"--provenance", "--snapshot-uid", string(uid),
+					"--source-pod", "source-pod", "--source-container-name", "source-container", "--node", "example-node",
 				}))
+				Expect(container.VolumeMounts[1].MountPath).Should(Equal(dockerSocketPath))
+			})
+		})
+
+		Context("with commit changes", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.Changes = []string{`CMD ["serve"]`, "LABEL stage=dev"}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass changes to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--change", `CMD ["serve"]`, "--change", "LABEL stage=dev"))
+			})
+		})
+
+		Context("with additional tags and mirrors", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.AdditionalTags = []string{"latest"}
+				simpleSnapshot.Spec.Mirrors = []atomv1alpha1.ImageMirror{
+					{Image: "mirror.example.com/example-snapshot:v0.0.1"},
+					{Image: "backup.example.com/example-snapshot:v0.0.1", Optional: true},
+				}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass all destinations to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements(
+					"--tag", "latest",
+					"--mirror", "mirror.example.com/example-snapshot:v0.0.1",
+					"--optional-mirror", "backup.example.com/example-snapshot:v0.0.1",
+				))
+			})
+		})
+
+		Context("with the Pod pause policy", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.PausePolicy = constants.PausePod
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass all pod containers to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements(
+					"--pause", "Pod",
+					"--pod-container", "xxxx-source-image",
+					"--pod-container", "xxxx-sidecar-image",
+				))
+			})
+		})
+
+		Context("with the diff mode", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.Mode = constants.ModeDiff
+				simpleSnapshot.Spec.Squash = true
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass the mode to the worker, without squashing", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--mode", "Diff"))
+				Expect(out.Spec.Containers[0].Args).ShouldNot(ContainElement("--squash"))
+			})
+		})
+
+		Context("with env vars from secrets", func() {
+			BeforeEach(func() {
+				sourcePod.Spec.Containers[0].Env = []corev1.EnvVar{
+					{Name: "LOG_LEVEL", Value: "debug"},
+					{Name: "DB_PASSWORD", ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "db"}, Key: "password"},
+					}},
+				}
+				sourcePod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+					{Prefix: "S3_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "s3"}}},
+					{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Optional: pointer.BoolPtr(true)}},
+				}
+				Expect(apiServer.Create(ctx, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "s3", Namespace: namespace},
+					Data:       map[string][]byte{"ACCESS_KEY": []byte("key"), "SECRET_KEY": []byte("secret")},
+				})).Should(Succeed())
+			})
+
+			It("should pass names of secret env vars to the worker", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements(
+					"--secret-env", "DB_PASSWORD",
+					"--secret-env", "S3_ACCESS_KEY",
+					"--secret-env", "S3_SECRET_KEY",
+				))
+				Expect(out.Spec.Containers[0].Args).ShouldNot(ContainElement("LOG_LEVEL"))
+			})
+
+			It("should keep secret env vars if opted out", func() {
+				simpleSnapshot.Spec.KeepSecretEnvs = true
+				Expect(re.client.Update(ctx, simpleSnapshot)).Should(Succeed())
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).ShouldNot(ContainElement("--secret-env"))
+			})
+		})
+
+		Context("with exclude patterns", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.Exclude = []string{"/tmp/*", ".ssh"}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass exclude patterns to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--exclude", "/tmp/*", "--exclude", ".ssh"))
+			})
+		})
+
+		Context("with the secret scan", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.SecretScan = &atomv1alpha1.SecretScan{
+					Rules:         []atomv1alpha1.SecretScanRule{{Name: "internal-token", Pattern: `itk_[a-z0-9]{32}`}},
+					DisabledRules: []string{"high-entropy-string"},
+				}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass scan rules to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				args := out.Spec.Containers[0].Args
+				Expect(args).Should(ContainElements("--scan-secrets", "--scan-rule", "internal-token=itk_[a-z0-9]{32}", "--scan-disable-rule", "high-entropy-string"))
+				Expect(args).ShouldNot(ContainElement("--scan-allow"))
+			})
+
+			Context("annotated to allow secrets", func() {
+				BeforeEach(func() {
+					simpleSnapshot.Annotations = map[string]string{annotationAllowSecrets: "true"}
+				})
+
+				It("should let the worker report secrets without blocking the snapshot", func() {
+					out, e := re.getWorkerPod(ctx, namespace, uid)
+					Expect(e).Should(Succeed())
+					Expect(out.Spec.Containers[0].Args).Should(ContainElements("--scan-secrets", "--scan-allow"))
+				})
+			})
+		})
+
+		Context("with a policy checker", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.Policy = &atomv1alpha1.SnapshotPolicy{
+					Command:   []string{"sh", "/policy/check.sh"},
+					ConfigMap: &corev1.LocalObjectReference{Name: "snapshot-policy"},
+					Timeout:   &metav1.Duration{Duration: 30 * time.Second},
+				}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass the checker and metadata of the snapshot to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				args := out.Spec.Containers[0].Args
+				Expect(args).Should(ContainElements("--policy-command", "sh", "--policy-command", "/policy/check.sh", "--policy-timeout", "30s"))
+				Expect(args).Should(ContainElements("--policy-metadata", "pod="+simpleSnapshot.Spec.PodName, "--policy-metadata", "container="+simpleSnapshot.Spec.ContainerName))
+				Expect(args).ShouldNot(ContainElement("--policy-url"))
+			})
+
+			It("should mount the config map of the checker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].VolumeMounts).Should(ContainElement(corev1.VolumeMount{Name: "policy", MountPath: policyVolumePath, ReadOnly: true}))
+				var volume *corev1.Volume
+				for i := range out.Spec.Volumes {
+					if out.Spec.Volumes[i].Name == "policy" {
+						volume = &out.Spec.Volumes[i]
+					}
+				}
+				Expect(volume).ShouldNot(BeNil())
+				Expect(volume.ConfigMap.Name).Should(Equal("snapshot-policy"))
+			})
+		})
+
+		Context("with file changes reported", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.FileChanges = &atomv1alpha1.FileChangeReport{Top: 5}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should ask the worker for the largest changes", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--file-changes", "--file-changes-top", "5"))
+			})
+		})
+
+		Context("with insecure registries", func() {
+			BeforeEach(func() {
+				re.insecureRegistries = []string{"reg.local:5000", "10.0.0.1"}
+			})
+
+			AfterEach(func() {
+				re.insecureRegistries = nil
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass them to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--insecure-registry", "reg.local:5000", "--insecure-registry", "10.0.0.1"))
+			})
+		})
+
+		Context("with the max size", func() {
+			BeforeEach(func() {
+				re.defaultMaxSize = 20 << 30
+			})
+
+			AfterEach(func() {
+				re.defaultMaxSize = 0
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass the operator-wide default to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--max-size", "21474836480"))
+			})
+
+			Context("set by the snapshot", func() {
+				BeforeEach(func() {
+					size := resource.MustParse("10Gi")
+					simpleSnapshot.Spec.MaxSize = &size
+				})
+
+				It("should pass the max size of the snapshot instead", func() {
+					out, e := re.getWorkerPod(ctx, namespace, uid)
+					Expect(e).Should(Succeed())
+					Expect(out.Spec.Containers[0].Args).Should(ContainElements("--max-size", "10737418240"))
+				})
+			})
+
+			Context("disabled by the snapshot", func() {
+				BeforeEach(func() {
+					size := resource.MustParse("0")
+					simpleSnapshot.Spec.MaxSize = &size
+				})
+
+				It("should not limit the size", func() {
+					out, e := re.getWorkerPod(ctx, namespace, uid)
+					Expect(e).Should(Succeed())
+					Expect(out.Spec.Containers[0].Args).ShouldNot(ContainElement("--max-size"))
+				})
+			})
+		})
+
+		Context("with image signing", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.Signing = &atomv1alpha1.ImageSigning{
+					Secret: corev1.LocalObjectReference{Name: "signing-key"},
+					Key:    "snapshots.key",
+				}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should mount the key and pass it to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+
+				container := out.Spec.Containers[0]
+				Expect(container.Args).Should(ContainElements("--sign-key", "/signing/cosign.key"))
+				Expect(container.VolumeMounts).Should(ContainElement(corev1.VolumeMount{Name: "signing", MountPath: signingVolumePath, ReadOnly: true}))
+				Expect(out.Spec.Volumes).Should(ContainElement(corev1.Volume{
+					Name: "signing",
+					VolumeSource: corev1.VolumeSource{
+						Secret: &corev1.SecretVolumeSource{
+							SecretName:  "signing-key",
+							Items:       []corev1.KeyToPath{{Key: "snapshots.key", Path: "cosign.key"}},
+							DefaultMode: pointer.Int32Ptr(0400),
+						},
+					},
+				}))
+				Expect(container.Env).Should(ContainElement(corev1.EnvVar{
+					Name: "COSIGN_PASSWORD",
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "signing-key"},
+							Key:                  "cosign.password",
+							Optional:             pointer.BoolPtr(true),
+						},
+					},
+				}))
+			})
+
+			Context("and export", func() {
+				BeforeEach(func() {
+					simpleSnapshot.Spec.Export = &atomv1alpha1.SnapshotExport{
+						Volume: &atomv1alpha1.VolumeExport{ClaimName: "snapshots"},
+					}
+				})
+
+				It("should not sign exported snapshots", func() {
+					out, e := re.getWorkerPod(ctx, namespace, uid)
+					Expect(e).Should(Succeed())
+					Expect(out.Spec.Containers[0].Args).ShouldNot(ContainElement("--sign-key"))
+					Expect(out.Spec.Volumes).Should(HaveLen(3))
+				})
+
+				It("should still ask for the provenance of exported snapshots", func() {
+					out, e := re.getWorkerPod(ctx, namespace, uid)
+					Expect(e).Should(Succeed())
+					Expect(out.Spec.Containers[0].Args).Should(ContainElement("--provenance"))
+				})
+			})
+		})
+
+		Context("with the requesting user", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Annotations = map[string]string{annotationRequestedBy: "alice@example.com"}
+				simpleSnapshot.CreationTimestamp = metav1.Date(2020, 3, 1, 8, 0, 0, 0, time.UTC)
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should record the user and the request time in the provenance", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--requested-by", "alice@example.com"))
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--requested-at", "2020-03-01T08:00:00Z"))
+			})
+		})
+
+		Context("with the provenance disabled", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.DisableProvenance = true
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should not ask the worker for the provenance", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).ShouldNot(ContainElement("--provenance"))
+			})
+		})
+
+		Context("with push options and the cleanup policy", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.PushRetry = &atomv1alpha1.PushRetry{
+					Attempts: 5,
+					Backoff:  &metav1.Duration{Duration: 2 * time.Second},
+				}
+				simpleSnapshot.Spec.CleanupPolicy = constants.CleanupOnSuccess
+				simpleSnapshot.Spec.DirectPush = &atomv1alpha1.DirectPush{ChunkSize: 1 << 20}
+				simpleSnapshot.Spec.Squash = true
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass push options and the cleanup policy to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--push-attempts", "5", "--push-backoff", "2s"))
+				Expect(out.Spec.Containers[0].Args).ShouldNot(ContainElement("--push-max-backoff"))
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--cleanup", "OnSuccess"))
+				Expect(out.Spec.Containers[0].Args).Should(ContainElements("--direct-push", "--push-chunk-size", "1048576"))
+				Expect(out.Spec.Containers[0].Args).Should(ContainElement("--squash"))
+			})
+		})
+
+		Context("with export to a volume", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.Export = &atomv1alpha1.SnapshotExport{
+					Format: constants.ExportDocker,
+					Volume: &atomv1alpha1.VolumeExport{ClaimName: "snapshots", Path: "../team/snapshot.tar"},
+				}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should mount the claim and pass the tarball path to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+
+				container := out.Spec.Containers[0]
+				Expect(container.Args).Should(ContainElements("--export-path", "/export/team/snapshot.tar", "--export-format", "Docker"))
+				Expect(container.VolumeMounts).Should(ContainElement(corev1.VolumeMount{Name: "export", MountPath: exportVolumePath}))
+				Expect(out.Spec.Volumes).Should(ContainElement(corev1.Volume{
+					Name: "export",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "snapshots"},
+					},
+				}))
+			})
+		})
+
+		Context("with export to an object storage", func() {
+			BeforeEach(func() {
+				simpleSnapshot.Spec.Export = &atomv1alpha1.SnapshotExport{
+					S3: &atomv1alpha1.S3Export{
+						Endpoint:          "http://minio.storage:9000",
+						Bucket:            "snapshots",
+						PathStyle:         true,
+						CredentialsSecret: &corev1.LocalObjectReference{Name: "minio-credentials"},
+					},
+				}
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should pass the object and credentials to the worker", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+
+				container := out.Spec.Containers[0]
+				Expect(container.Args).Should(ContainElements("--export-bucket", "snapshots", "--export-key", simpleSnapshot.Name+".tar", "--s3-endpoint", "http://minio.storage:9000", "--s3-path-style"))
+				Expect(container.Args).ShouldNot(ContainElement("--s3-region"))
+				Expect(container.Env).Should(ContainElement(corev1.EnvVar{
+					Name: "AWS_SECRET_ACCESS_KEY",
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "minio-credentials"},
+							Key:                  "AWS_SECRET_ACCESS_KEY",
+							Optional:             pointer.BoolPtr(false),
+						},
+					},
+				}))
+				Expect(out.Spec.Volumes).Should(HaveLen(2))
+			})
+		})
+
+		Context("for source container running on containerd", func() {
+			BeforeEach(func() {
+				sourcePod.Status.ContainerStatuses[0].ContainerID = "containerd://xxxx-source-image"
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should create a worker pod talking to containerd", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+
+				container := out.Spec.Containers[0]
+				Expect(container.Args).Should(ContainElements("--container", "xxxx-source-image", "--runtime", "containerd"))
+				Expect(container.VolumeMounts[1].MountPath).Should(Equal(containerdSocketPath))
+			})
+		})
+
+		Context("for source container running on cri-o", func() {
+			BeforeEach(func() {
+				sourcePod.Status.ContainerStatuses[0].ContainerID = "cri-o://xxxx-source-image"
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should create a worker pod talking to podman", func() {
+				out, e := re.getWorkerPod(ctx, namespace, uid)
+				Expect(e).Should(Succeed())
+
+				container := out.Spec.Containers[0]
+				Expect(container.Args).Should(ContainElements("--container", "xxxx-source-image", "--runtime", "cri-o"))
+				Expect(container.VolumeMounts[1].MountPath).Should(Equal(podmanSocketPath))
+				Expect(out.Spec.Volumes[1].HostPath.Path).Should(Equal(podmanSocketPath))
+			})
+		})
+
+		Context("for source container running on an unsupported runtime", func() {
+			BeforeEach(func() {
+				sourcePod.Status.ContainerStatuses[0].ContainerID = "rkt://xxxx-source-image"
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should fail", func() {
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerFailed))
+				Expect(snp.Status.Conditions.IsTrueFor(atomv1alpha1.UnsupportedRuntime)).Should(BeTrue())
 			})
 		})
 
 		Context("for pending source pod", func() {
 			BeforeEach(func() {
-				sourcePod.Status.Phase = corev1.PodPending
+				sourcePod.Status.Phase = corev1.PodPending
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{RequeueAfter: retryLater}))
+			})
+
+			It("should not update worker state", func() {
+				Expect(getWorkerState(ctx, re.client, snpKey)).Should(BeEmpty())
+			})
+
+			It("should not create any worker pod", func() {
+				Consistently(func() error {
+					_, e := re.getWorkerPod(ctx, namespace, uid)
+					return e
+				}()).Should(HaveOccurred())
+			})
+		})
+
+		Context("for failed source pod", func() {
+			BeforeEach(func() {
+				sourcePod.Status.Phase = corev1.PodFailed
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should fail", func() {
+				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerFailed))
+			})
+
+			It("should not create any worker pod", func() {
+				Consistently(func() error {
+					_, e := re.getWorkerPod(ctx, namespace, uid)
+					return e
+				}()).Should(HaveOccurred())
+			})
+		})
+
+		Context("for succeeded source pod", func() {
+			BeforeEach(func() {
+				sourcePod.Status.Phase = corev1.PodSucceeded
+			})
+
+			JustBeforeEach(func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should fail", func() {
+				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerFailed))
+			})
+
+			It("should not create any worker pod", func() {
+				Consistently(func() error {
+					_, e := re.getWorkerPod(ctx, namespace, uid)
+					return e
+				}()).Should(HaveOccurred())
+			})
+		})
+	})
+
+	Context("updating snapshot", func() {
+		var worker *corev1.Pod
+
+		BeforeEach(func() {
+			Expect(re.client.Create(ctx, sourcePod)).Should(Succeed())
+			Expect(re.client.Create(ctx, simpleSnapshot)).Should(Succeed())
+			Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+
+			snp, e := getSnapshot(ctx, re.client, snpKey)
+			Expect(e).Should(Succeed())
+			worker, e = re.getWorkerPod(ctx, namespace, snp.UID)
+			Expect(e).Should(Succeed())
+		})
+
+		JustBeforeEach(func() {
+			Expect(re.client.Status().Update(ctx, worker)).Should(Succeed())
+		})
+
+		Context("when worker is running", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodRunning
+			})
+
+			It("should update snapshot's workerState to running", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerRunning))
+			})
+		})
+
+		Context("when worker succeeds", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodSucceeded
+			})
+
+			It("should update snapshot's workerState to complete", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerComplete))
+			})
+		})
+
+		Context("when worker fails", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					LastTerminationState: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeDockerCommit,
+							Reason:     "Error",
+							Message:    "docker commit failed: blah, blah...",
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should update snapshot's workerState to failed, and collect condition", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.Conditions).Should(HaveLen(1))
+				Expect(snp.Status.Conditions[0].Type).Should(Equal(atomv1alpha1.DockerCommitFailed))
+			})
+		})
+
+		Context("when worker reports push results", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodSucceeded
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							Reason:     "Completed",
+							Message:    `{"version":"v1","phase":"Complete","commitDuration":"2s","imageID":"sha256:image-id","digest":"sha256:digest","size":1024,"layers":3,"freedBytes":1024,"excludedFiles":12,"excludedBytes":4096,"scrubbedEnvs":["DB_PASSWORD"],"pushDuration":"1m30s","destinations":[{"image":"reg.example.com/snapshots/example-snapshot:v0.0.1","pushed":true,"digest":"sha256:digest"},{"image":"backup.example.com/example-snapshot:v0.0.1","pushed":false,"optional":true,"message":"denied"}]}`,
+							StartedAt:  now,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should record destinations in the snapshot status", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerComplete))
+				Expect(snp.Status.Destinations).Should(Equal([]atomv1alpha1.DestinationStatus{
+					{Image: "reg.example.com/snapshots/example-snapshot:v0.0.1", Pushed: true, Digest: "sha256:digest"},
+					{Image: "backup.example.com/example-snapshot:v0.0.1", Optional: true, Message: "denied"},
+				}))
+			})
+
+			It("should record the pushed image and timings", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.ImageID).Should(Equal("sha256:image-id"))
+				Expect(snp.Status.Digest).Should(Equal("sha256:digest"))
+				Expect(snp.Status.Size).Should(Equal(int64(1024)))
+				Expect(snp.Status.Layers).Should(Equal(int32(3)))
+				Expect(snp.Status.FreedBytes).Should(Equal(int64(1024)))
+				Expect(snp.Status.ExcludedFiles).Should(Equal(int32(12)))
+				Expect(snp.Status.ExcludedBytes).Should(Equal(int64(4096)))
+				Expect(snp.Status.ScrubbedEnvs).Should(Equal([]string{"DB_PASSWORD"}))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhaseComplete))
+				Expect(snp.Status.CommitDuration.Duration).Should(Equal(2 * time.Second))
+				Expect(snp.Status.PushDuration.Duration).Should(Equal(90 * time.Second))
+				Expect(snp.Status.StartTime.Unix()).Should(Equal(now.Unix()))
+				Expect(snp.Status.CompletionTime.Unix()).Should(Equal(now.Add(1 * time.Minute).Unix()))
+			})
+		})
+
+		Context("when worker fails to push a required destination", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeDockerPush,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Push","error":"PushFailed","message":"image push failed: mirror.example.com/example-snapshot:v0.0.1","destinations":[{"image":"reg.example.com/snapshots/example-snapshot:v0.0.1","pushed":true},{"image":"mirror.example.com/example-snapshot:v0.0.1","pushed":false,"message":"denied"}]}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should fail with the failed destinations", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerFailed))
+				Expect(snp.Status.Destinations).Should(HaveLen(2))
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.DockerPushFailed)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(Equal("image push failed: mirror.example.com/example-snapshot:v0.0.1"))
+				Expect(cond.Reason).Should(Equal(status.ConditionReason(constants.ErrorPush)))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhasePush))
+			})
+		})
+
+		Context("when worker reports a failure in its result", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   1,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Commit","error":"CommitFailed","message":"container commit failed: xxxx-source-image","startedAt":"2020-05-01T10:00:00Z","finishedAt":"2020-05-01T10:00:05Z"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should collect the condition from the result instead of the exit code", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.DockerCommitFailed)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(Equal("container commit failed: xxxx-source-image"))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhaseCommit))
+				Expect(snp.Status.StartTime.UTC()).Should(Equal(time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)))
+				Expect(snp.Status.CompletionTime.UTC()).Should(Equal(time.Date(2020, 5, 1, 10, 0, 5, 0, time.UTC)))
+			})
+		})
+
+		Context("when worker fails to push for registry errors", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeDockerPush,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Push","error":"PushQuotaExceeded","message":"image push failed: reg.example.com/snapshots/example-snapshot:v0.0.1: registry quota exceeded: denied: quota exceeded","destinations":[{"image":"reg.example.com/snapshots/example-snapshot:v0.0.1","pushed":false,"error":"PushQuotaExceeded","message":"registry quota exceeded: denied: quota exceeded"}]}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should collect the fine-grained condition", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.Conditions).Should(HaveLen(1))
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.RegistryQuotaExceeded)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Reason).Should(Equal(status.ConditionReason(constants.ErrorPushQuotaExceeded)))
+				Expect(cond.Message).Should(ContainSubstring("denied: quota exceeded"))
+				Expect(snp.Status.Destinations[0].Error).Should(Equal(constants.ErrorPushQuotaExceeded))
+			})
+		})
+
+		Context("when worker writes a result of an unknown version", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeDockerPush,
+							Reason:     "Error",
+							Message:    `{"version":"v0","error":"Unknown"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should fall back to the exit code", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.Conditions.IsTrueFor(atomv1alpha1.DockerPushFailed)).Should(BeTrue())
+				Expect(snp.Status.Phase).Should(BeEmpty())
+			})
+		})
+
+		Context("when worker exports the snapshot to a volume", func() {
+			BeforeEach(func() {
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				snp.Spec.Export = &atomv1alpha1.SnapshotExport{Volume: &atomv1alpha1.VolumeExport{ClaimName: "snapshots"}}
+				Expect(re.client.Update(ctx, snp)).Should(Succeed())
+
+				worker.Status.Phase = corev1.PodSucceeded
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							Reason:     "Completed",
+							Message:    `{"version":"v1","phase":"Complete","imageID":"sha256:image-id","digest":"sha256:digest","export":{"format":"OCI","path":"/export/example-snapshot.tar","checksum":"sha256:checksum","size":4096,"duration":"3s","provenance":"/export/example-snapshot.tar.intoto.json"}}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should record the tarball in the snapshot status", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerComplete))
+				Expect(snp.Status.Destinations).Should(BeEmpty())
+				Expect(snp.Status.Export).Should(Equal(&atomv1alpha1.ExportStatus{
+					Format:     constants.ExportOCI,
+					ClaimName:  "snapshots",
+					Path:       snp.Name + ".tar",
+					Checksum:   "sha256:checksum",
+					Size:       4096,
+					Provenance: snp.Name + ".tar" + constants.ProvenanceSuffix,
+				}))
+			})
+		})
+
+		Context("when worker uploads the snapshot to an object storage", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodSucceeded
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							Reason:     "Completed",
+							Message:    `{"version":"v1","phase":"Complete","digest":"sha256:digest","export":{"format":"OCI","bucket":"snapshots","key":"example-snapshot.tar","etag":"9b2cf535f27731c974343645a3985328-3","checksum":"sha256:checksum","size":4096}}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
 			})
 
-			JustBeforeEach(func() {
-				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{RequeueAfter: retryLater}))
+			It("should record the object in the snapshot status", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.Export).Should(Equal(&atomv1alpha1.ExportStatus{
+					Format:   constants.ExportOCI,
+					Bucket:   "snapshots",
+					Key:      "example-snapshot.tar",
+					ETag:     "9b2cf535f27731c974343645a3985328-3",
+					Checksum: "sha256:checksum",
+					Size:     4096,
+				}))
 			})
+		})
 
-			It("should not update worker state", func() {
-				Expect(getWorkerState(ctx, re.client, snpKey)).Should(BeEmpty())
+		Context("when worker fails to export the snapshot", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeExport,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Export","error":"ExportFailed","message":"image export failed: no space left on device"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
 			})
 
-			It("should not create any worker pod", func() {
-				Consistently(func() error {
-					_, e := re.getWorkerPod(ctx, namespace, uid)
-					return e
-				}()).Should(HaveOccurred())
+			It("should collect an export failed condition", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.ExportFailed)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("no space left on device"))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhaseExport))
 			})
 		})
 
-		Context("for failed source pod", func() {
+		Context("when worker fails to squash the snapshot", func() {
 			BeforeEach(func() {
-				sourcePod.Status.Phase = corev1.PodFailed
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeSquash,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Squash","error":"SquashFailed","message":"image squash failed: save image: no such image"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
 			})
 
-			JustBeforeEach(func() {
+			It("should collect a squash failed condition", func() {
 				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.SquashFailed)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("no such image"))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhaseSquash))
 			})
+		})
 
-			It("should fail", func() {
-				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerFailed))
+		Context("when worker fails to exclude paths", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeExclude,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Validate","error":"ExcludeFailed","message":"invalid exclude pattern \"[\": syntax error in pattern"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
 			})
 
-			It("should not create any worker pod", func() {
-				Consistently(func() error {
-					_, e := re.getWorkerPod(ctx, namespace, uid)
-					return e
-				}()).Should(HaveOccurred())
+			It("should collect an exclude failed condition", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.ExcludeFailed)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("invalid exclude pattern"))
 			})
 		})
 
-		Context("for succeeded source pod", func() {
+		Context("when worker detects secrets", func() {
 			BeforeEach(func() {
-				sourcePod.Status.Phase = corev1.PodSucceeded
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeSecretDetected,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Scan","error":"SecretDetected","message":"secrets found in 1 files: /root/.aws/credentials:2 (aws-access-key)","secretFindings":[{"path":"/root/.aws/credentials","rule":"aws-access-key","line":2}]}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
 			})
 
-			JustBeforeEach(func() {
+			It("should collect a secret detected condition and the findings", func() {
 				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerFailed))
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.SecretDetected)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("/root/.aws/credentials"))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhaseScan))
+				Expect(snp.Status.SecretFindings).Should(Equal([]atomv1alpha1.SecretFinding{{Path: "/root/.aws/credentials", Rule: "aws-access-key", Line: 2}}))
 			})
+		})
 
-			It("should fail", func() {
-				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerFailed))
+		Context("when the policy rejects the snapshot", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodePolicyRejected,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Policy","error":"PolicyRejected","message":"rejected by the policy: scratch data is not allowed"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
 			})
 
-			It("should not create any worker pod", func() {
-				Consistently(func() error {
-					_, e := re.getWorkerPod(ctx, namespace, uid)
-					return e
-				}()).Should(HaveOccurred())
+			It("should collect a policy rejected condition", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerFailed))
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.PolicyRejected)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("scratch data is not allowed"))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhasePolicy))
 			})
 		})
-	})
 
-	Context("updating snapshot", func() {
-		var worker *corev1.Pod
+		Context("when the container is too large", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeTooLarge,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Commit","error":"SnapshotTooLarge","message":"snapshot too large: the container read/write layer is 32.0GiB (34359738368 bytes), over the max size 20.0GiB (21474836480 bytes)","size":34359738368}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
 
-		BeforeEach(func() {
-			Expect(re.client.Create(ctx, sourcePod)).Should(Succeed())
-			Expect(re.client.Create(ctx, simpleSnapshot)).Should(Succeed())
-			Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			It("should collect a snapshot too large condition with the measured size", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerFailed))
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.SnapshotTooLarge)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("32.0GiB (34359738368 bytes)"))
+				Expect(snp.Status.Size).Should(Equal(int64(34359738368)))
+			})
+		})
 
-			snp, e := getSnapshot(ctx, re.client, snpKey)
-			Expect(e).Should(Succeed())
-			worker, e = re.getWorkerPod(ctx, namespace, snp.UID)
-			Expect(e).Should(Succeed())
+		Context("when worker signs the pushed image", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodSucceeded
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							Reason:     "Completed",
+							Message:    `{"version":"v1","phase":"Complete","digest":"sha256:digest","signature":"reg.example.com/snapshots/example-snapshot:sha256-digest.sig@sha256:signature","destinations":[{"image":"reg.example.com/snapshots/example-snapshot:v0.0.1","pushed":true,"digest":"sha256:digest","signature":"reg.example.com/snapshots/example-snapshot:sha256-digest.sig@sha256:signature"}]}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should record the signature in the snapshot status", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.Signature).Should(Equal("reg.example.com/snapshots/example-snapshot:sha256-digest.sig@sha256:signature"))
+				Expect(snp.Status.Destinations[0].Signature).Should(Equal(snp.Status.Signature))
+			})
 		})
 
-		JustBeforeEach(func() {
-			Expect(re.client.Status().Update(ctx, worker)).Should(Succeed())
+		Context("when worker fails to sign the pushed image", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeSign,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Sign","error":"SignFailed","message":"image signing failed: reg.example.com/snapshots/example-snapshot:v0.0.1: push signature: denied"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should collect a sign failed condition", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerFailed))
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.SignFailed)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("push signature: denied"))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhaseSign))
+			})
 		})
 
-		Context("when worker is running", func() {
+		Context("when worker attests the pushed image", func() {
 			BeforeEach(func() {
-				worker.Status.Phase = corev1.PodRunning
+				worker.Status.Phase = corev1.PodSucceeded
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							Reason:     "Completed",
+							Message:    `{"version":"v1","phase":"Complete","digest":"sha256:digest","provenance":"reg.example.com/snapshots/example-snapshot@sha256:provenance","destinations":[{"image":"reg.example.com/snapshots/example-snapshot:v0.0.1","pushed":true,"digest":"sha256:digest","provenance":"reg.example.com/snapshots/example-snapshot@sha256:provenance"}]}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
 			})
 
-			It("should update snapshot's workerState to running", func() {
+			It("should record the provenance in the snapshot status", func() {
 				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
-				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerRunning))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.Provenance).Should(Equal("reg.example.com/snapshots/example-snapshot@sha256:provenance"))
+				Expect(snp.Status.Destinations[0].Provenance).Should(Equal(snp.Status.Provenance))
 			})
 		})
 
-		Context("when worker succeeds", func() {
+		Context("when worker fails to attest the pushed image", func() {
+			BeforeEach(func() {
+				worker.Status.Phase = corev1.PodFailed
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							ExitCode:   constants.ExitCodeAttest,
+							Reason:     "Error",
+							Message:    `{"version":"v1","phase":"Attest","error":"AttestFailed","message":"provenance attestation failed: reg.example.com/snapshots/example-snapshot:v0.0.1: push attestation: denied"}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+			})
+
+			It("should collect an attest failed condition", func() {
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerFailed))
+				cond := snp.Status.Conditions.GetCondition(atomv1alpha1.AttestFailed)
+				Expect(cond).ShouldNot(BeNil())
+				Expect(cond.Message).Should(ContainSubstring("push attestation: denied"))
+				Expect(snp.Status.Phase).Should(Equal(constants.PhaseAttest))
+			})
+		})
+
+		Context("when worker reports file changes", func() {
 			BeforeEach(func() {
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				snp.Spec.FileChanges = &atomv1alpha1.FileChangeReport{Top: 1}
+				Expect(re.client.Update(ctx, snp)).Should(Succeed())
+
 				worker.Status.Phase = corev1.PodSucceeded
+				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					State: corev1.ContainerState{
+						Terminated: &corev1.ContainerStateTerminated{
+							Reason:     "Completed",
+							Message:    `{"version":"v1","phase":"Complete","fileChanges":{"added":1,"modified":1,"deleted":1,"bytes":11,"changes":[{"path":"/etc/hosts","kind":"Modified","size":7}]}}`,
+							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
+						},
+					},
+				}}
+				logs.logs = "worker started\n" +
+					constants.FileChangesLogPrefix + "begin\n" +
+					constants.FileChangesLogPrefix + `{"path":"/etc/hosts","kind":"Modified","size":7}` + "\n" +
+					constants.FileChangesLogPrefix + `{"path":"/etc/motd","kind":"Deleted"}` + "\n" +
+					constants.FileChangesLogPrefix + `{"path":"/tmp/junk","kind":"Added","size":4}` + "\n" +
+					constants.FileChangesLogPrefix + "end 3 3\n"
 			})
 
-			It("should update snapshot's workerState to complete", func() {
+			It("should collect the summary, and save all changes in a config map", func() {
 				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
-				Expect(getWorkerState(ctx, re.client, snpKey)).Should(Equal(atomv1alpha1.WorkerComplete))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.FileChanges).Should(Equal(&atomv1alpha1.FileChangeSummary{
+					Added: 1, Modified: 1, Deleted: 1, Bytes: 11,
+					Largest:   []atomv1alpha1.FileChange{{Path: "/etc/hosts", Kind: "Modified", Size: 7}},
+					ConfigMap: "example-snapshot-changes",
+				}))
+
+				cm := &corev1.ConfigMap{}
+				Expect(re.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "example-snapshot-changes"}, cm)).Should(Succeed())
+				Expect(metav1.IsControlledBy(cm, snp)).Should(BeTrue())
+				Expect(cm.Data).Should(HaveKeyWithValue("changes", "Modified 7 /etc/hosts\nDeleted 0 /etc/motd\nAdded 4 /tmp/junk\n"))
+
+				// the config map is kept in the status once it is saved
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e = getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.FileChanges.ConfigMap).Should(Equal("example-snapshot-changes"))
+			})
+
+			It("should collect the summary even if the worker log has no changes", func() {
+				logs.logs = "worker started\n"
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerComplete))
+				Expect(snp.Status.FileChanges.Added).Should(Equal(int32(1)))
+				Expect(snp.Status.FileChanges.ConfigMap).Should(BeEmpty())
+				Expect(snp.Status.FileChanges.Missing).Should(Equal(errFileChangesNotFound.Error()))
+
+				// missing changes are not retried
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+			})
+
+			It("should count changes over the size limit of the worker log", func() {
+				logs.logs = strings.Replace(logs.logs, "end 3 3", "end 3 5", 1)
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				cm := &corev1.ConfigMap{}
+				Expect(re.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: "example-snapshot-changes"}, cm)).Should(Succeed())
+				Expect(cm.Data).Should(HaveKeyWithValue("changes", "Modified 7 /etc/hosts\nDeleted 0 /etc/motd\nAdded 4 /tmp/junk\n... and 2 more\n"))
+			})
+
+			Context("when the changes are cut from the worker log", func() {
+				expectIncomplete := func(cut string) {
+					logs.logs = cut
+					Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+					snp, e := getSnapshot(ctx, re.client, snpKey)
+					Expect(e).Should(Succeed())
+					Expect(snp.Status.FileChanges.ConfigMap).Should(BeEmpty())
+					Expect(snp.Status.FileChanges.Missing).Should(HavePrefix(errFileChangesIncomplete.Error()))
+				}
+
+				It("should not save them without the end", func() {
+					expectIncomplete(logs.logs[:strings.Index(logs.logs, constants.FileChangesLogPrefix+"end")])
+				})
+
+				It("should not save them without the beginning", func() {
+					expectIncomplete(logs.logs[strings.Index(logs.logs, constants.FileChangesLogPrefix+"{"):])
+				})
+
+				It("should not save them with lines lost in the middle", func() {
+					expectIncomplete(strings.Replace(logs.logs, constants.FileChangesLogPrefix+`{"path":"/etc/motd","kind":"Deleted"}`+"\n", "", 1))
+				})
+			})
+
+			It("should retry saving changes if the worker log could not be read", func() {
+				logs.err = errors.New("connection refused")
+				defer func() { logs.err = nil }()
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{RequeueAfter: retryLater}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.WorkerState).Should(Equal(atomv1alpha1.WorkerComplete))
+				Expect(snp.Status.FileChanges.ConfigMap).Should(BeEmpty())
+				Expect(snp.Status.FileChanges.Missing).Should(BeEmpty())
+
+				// the snapshot is complete, but its changes are still saved
+				logs.err = nil
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e = getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.FileChanges.ConfigMap).Should(Equal("example-snapshot-changes"))
+			})
+
+			It("should record the changes missing if the worker pod is gone", func() {
+				logs.err = errors.New("connection refused")
+				defer func() { logs.err = nil }()
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{RequeueAfter: retryLater}))
+				Expect(re.client.Delete(ctx, worker)).Should(Succeed())
+
+				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
+				snp, e := getSnapshot(ctx, re.client, snpKey)
+				Expect(e).Should(Succeed())
+				Expect(snp.Status.FileChanges.Missing).Should(Equal(errWorkerPodNotFound.Error()))
 			})
 		})
 
-		Context("when worker fails", func() {
+		Context("when worker rejects commit changes", func() {
 			BeforeEach(func() {
 				worker.Status.Phase = corev1.PodFailed
 				worker.Status.ContainerStatuses = []corev1.ContainerStatus{{
 					LastTerminationState: corev1.ContainerState{
 						Terminated: &corev1.ContainerStateTerminated{
-							ExitCode:   constants.ExitCodeDockerCommit,
+							ExitCode:   constants.ExitCodeInvalidChanges,
 							Reason:     "Error",
-							Message:    "docker commit failed: blah, blah...",
 							FinishedAt: metav1.Time{Time: now.Add(1 * time.Minute)},
 						},
 					},
 				}}
 			})
 
-			It("should update snapshot's workerState to failed, and collect condition", func() {
+			It("should collect an invalid changes condition", func() {
 				Expect(re.Reconcile(reconcile.Request{NamespacedName: snpKey})).Should(Equal(reconcile.Result{}))
 				snp, e := getSnapshot(ctx, re.client, snpKey)
 				Expect(e).Should(Succeed())
-				Expect(snp.Status.Conditions).Should(HaveLen(1))
-				Expect(snp.Status.Conditions[0].Type).Should(Equal(atomv1alpha1.DockerCommitFailed))
+				Expect(snp.Status.Conditions.IsTrueFor(atomv1alpha1.InvalidChanges)).Should(BeTrue())
 			})
 		})
 	})
@@ -306,6 +1481,38 @@ var _ = Describe("snapshot operator", func() {
 	})
 })
 
+var _ = Describe("error conditions", func() {
+	It("should have a condition for every push error class", func() {
+		// the classes are read from the source of the constants, so new classes could not be missed
+		f, e := parser.ParseFile(token.NewFileSet(), "../../constants/constants.go", nil, 0)
+		Expect(e).Should(Succeed())
+
+		var classes []string
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				value := spec.(*ast.ValueSpec)
+				for i, name := range value.Names {
+					if !strings.HasPrefix(name.Name, "ErrorPush") || i >= len(value.Values) {
+						continue
+					}
+					class, e := strconv.Unquote(value.Values[i].(*ast.BasicLit).Value)
+					Expect(e).Should(Succeed())
+					classes = append(classes, class)
+				}
+			}
+		}
+
+		Expect(classes).Should(ContainElement(constants.ErrorPushServer))
+		for _, class := range classes {
+			Expect(errorConditions).Should(HaveKey(class), class)
+		}
+	})
+})
+
 func getSnapshot(ctx context.Context, c client.Client, key types.NamespacedName) (*atomv1alpha1.ContainerSnapshot, error) {
 	snp := atomv1alpha1.ContainerSnapshot{}
 	e := c.Get(ctx, key, &snp)
@@ -324,6 +1531,20 @@ func getWorkerState(ctx context.Context, c client.Client, key types.NamespacedNa
 	return snp.Status.WorkerState, nil
 }
 
+// fakeLogReader returns the same logs of all pods
+type fakeLogReader struct {
+	logs string
+	// err fails reading logs
+	err error
+}
+
+func (r *fakeLogReader) ReadLogs(ctx context.Context, namespace, pod, container string) (io.ReadCloser, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return ioutil.NopCloser(strings.NewReader(r.logs)), nil
+}
+
 // fake client does not index or fillter objects by owner references, make it do
 type indexFakeClient struct {
 	client.Client
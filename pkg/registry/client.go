@@ -0,0 +1,757 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("registry client")
+
+const (
+	// clientID is reported to token servers when refreshing tokens
+	clientID = "container-snapshot"
+
+	headerContentDigest = "Docker-Content-Digest"
+	// headerSubject is set by registries supporting the referrers api, in responses of manifests with subjects
+	headerSubject = "OCI-Subject"
+)
+
+// manifestMediaTypes are media types of manifests accepted when resolving digests, which registries must not convert
+var manifestMediaTypes = []string{
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// Image is an image going to be pushed, made of a config blob and layer blobs
+type Image struct {
+	// MediaType is the media type of the image manifest
+	MediaType string
+	Config    Blob
+	Layers    []Blob
+	// Annotations are annotations of the manifest
+	Annotations map[string]string
+	// ArtifactType is the type of artifacts other than images, and Subject is the manifest the artifact refers to,
+	// such as the image an attestation is about
+	ArtifactType string
+	Subject      *ocispec.Descriptor
+}
+
+// Blob is a blob of an image, with a way to read its content
+type Blob struct {
+	ocispec.Descriptor
+	// Open returns a reader of the blob content, the reader is closed after reading
+	Open func() (io.ReadCloser, error)
+}
+
+// manifest is the image manifest, schema version 2 of both docker and oci images
+type manifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType,omitempty"`
+	ArtifactType  string               `json:"artifactType,omitempty"`
+	Config        ocispec.Descriptor   `json:"config"`
+	Layers        []ocispec.Descriptor `json:"layers"`
+	Subject       *ocispec.Descriptor  `json:"subject,omitempty"`
+	Annotations   map[string]string    `json:"annotations,omitempty"`
+}
+
+// referrer is a descriptor of an artifact in the referrers index, with the artifact type
+type referrer struct {
+	ocispec.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// referrersIndex is the image index listing referrers of a manifest, for registries not supporting the referrers api
+type referrersIndex struct {
+	SchemaVersion int        `json:"schemaVersion"`
+	MediaType     string     `json:"mediaType"`
+	Manifests     []referrer `json:"manifests"`
+}
+
+// Manifest returns the image manifest
+func (img *Image) Manifest() ([]byte, error) {
+	m := manifest{
+		SchemaVersion: 2,
+		MediaType:     img.MediaType,
+		ArtifactType:  img.ArtifactType,
+		Config:        img.Config.Descriptor,
+		Layers:        make([]ocispec.Descriptor, 0, len(img.Layers)),
+		Subject:       img.Subject,
+		Annotations:   img.Annotations,
+	}
+	for _, l := range img.Layers {
+		m.Layers = append(m.Layers, l.Descriptor)
+	}
+
+	return json.Marshal(m)
+}
+
+// Client pushes images to registries through the OCI distribution API, aka docker registry v2 API
+type Client struct {
+	client *http.Client
+	// chunkSize is the max size of each chunk uploading blobs, blobs are uploaded in a single request if it is not positive
+	chunkSize int64
+
+	// insecure are registries served over plain http
+	insecure map[string]bool
+
+	lock sync.Mutex
+	// repos are repositories known to have each blob, by registry and blob digest.
+	// blobs are mounted from them instead of uploaded when pushing to other repositories of the same registry
+	repos map[string]map[digest.Digest]string
+}
+
+// NewClient returns a registry client sending requests with the http client,
+// insecure registries are accessed over plain http instead of https
+func NewClient(client *http.Client, chunkSize int64, insecure ...string) *Client {
+	c := &Client{
+		client:    client,
+		chunkSize: chunkSize,
+		insecure:  make(map[string]bool, len(insecure)),
+		repos:     make(map[string]map[digest.Digest]string),
+	}
+	for _, r := range insecure {
+		c.insecure[r] = true
+	}
+	return c
+}
+
+// Push uploads blobs of the image and puts its manifest as ref, auth is nil for an anonymous push.
+// returns digest of the pushed manifest
+func (c *Client) Push(ctx context.Context, ref reference.Named, img *Image, auth *types.AuthConfig) (digest.Digest, error) {
+	ref = reference.TagNameOnly(ref)
+	tagged, ok := ref.(reference.Tagged)
+	if !ok {
+		return "", fmt.Errorf("no tag in %s", ref)
+	}
+
+	s := c.newSession(ref, auth)
+	m, e := s.pushImage(ctx, img)
+	if e != nil {
+		return "", e
+	}
+	d, _, e := s.putManifest(ctx, tagged.Tag(), img.MediaType, m)
+	return d, e
+}
+
+// PushReferrer pushes the artifact referring to its subject to the repository of ref, by digest instead of tags.
+// the artifact is listed by the referrers api of the subject, or added to the referrers index tagged as sha256-<subject digest>
+// for registries not supporting the api. returns digest of the pushed manifest
+func (c *Client) PushReferrer(ctx context.Context, ref reference.Named, img *Image, auth *types.AuthConfig) (digest.Digest, error) {
+	if img.Subject == nil {
+		return "", errors.New("no subject of the artifact")
+	}
+
+	s := c.newSession(ref, auth)
+	m, e := s.pushImage(ctx, img)
+	if e != nil {
+		return "", e
+	}
+	d := digest.FromBytes(m)
+	if _, header, e := s.putManifest(ctx, d.String(), img.MediaType, m); e != nil {
+		return "", e
+	} else if header.Get(headerSubject) != "" {
+		return d, nil
+	}
+
+	desc := referrer{
+		Descriptor:   ocispec.Descriptor{MediaType: img.MediaType, Digest: d, Size: int64(len(m)), Annotations: img.Annotations},
+		ArtifactType: img.ArtifactType,
+	}
+	if e := s.addReferrer(ctx, img.Subject.Digest, desc); e != nil {
+		return "", fmt.Errorf("update referrers index: %w", e)
+	}
+	return d, nil
+}
+
+// newSession returns a session to the repository of ref
+func (c *Client) newSession(ref reference.Named, auth *types.AuthConfig) *session {
+	scheme := "https://"
+	if c.insecure[reference.Domain(ref)] {
+		scheme = "http://"
+	}
+	return &session{
+		Client:   c,
+		registry: reference.Domain(ref),
+		base:     scheme + apiHost(reference.Domain(ref)) + "/v2/",
+		repo:     reference.Path(ref),
+		auth:     auth,
+	}
+}
+
+// Resolve returns the manifest descriptor of ref by its digest or tag, auth is nil for an anonymous request
+func (c *Client) Resolve(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (ocispec.Descriptor, error) {
+	ref = reference.TagNameOnly(ref)
+	var tag string
+	if canonical, ok := ref.(reference.Canonical); ok {
+		tag = canonical.Digest().String()
+	} else if tagged, ok := ref.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	} else {
+		return ocispec.Descriptor{}, fmt.Errorf("no tag in %s", ref)
+	}
+
+	s := c.newSession(ref, auth)
+	if e := s.authorize(ctx, nil); e != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("authorize: %w", e)
+	}
+
+	header := http.Header{}
+	header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, e := s.send(ctx, http.MethodHead, s.base+s.repo+"/manifests/"+tag, header, nil, 0, http.StatusOK)
+	if e != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("head manifest: %w", e)
+	}
+	resp.Body.Close()
+
+	d, e := digest.Parse(resp.Header.Get(headerContentDigest))
+	if e != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("parse manifest digest: %w", e)
+	}
+	return ocispec.Descriptor{MediaType: resp.Header.Get("Content-Type"), Digest: d, Size: resp.ContentLength}, nil
+}
+
+// Fetch gets the manifest of ref by its tag, returns the image with blobs read from the registry, or nil if it does not exist.
+// auth is nil for an anonymous request
+func (c *Client) Fetch(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (*Image, error) {
+	ref = reference.TagNameOnly(ref)
+	tagged, ok := ref.(reference.Tagged)
+	if !ok {
+		return nil, fmt.Errorf("no tag in %s", ref)
+	}
+
+	s := c.newSession(ref, auth)
+	if e := s.authorize(ctx, nil); e != nil {
+		return nil, fmt.Errorf("authorize: %w", e)
+	}
+
+	header := http.Header{}
+	header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, e := s.send(ctx, http.MethodGet, s.base+s.repo+"/manifests/"+tagged.Tag(), header, nil, 0, http.StatusOK, http.StatusNotFound)
+	if e != nil {
+		return nil, fmt.Errorf("get manifest: %w", e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var m manifest
+	if e := json.NewDecoder(resp.Body).Decode(&m); e != nil {
+		return nil, fmt.Errorf("decode manifest: %w", e)
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	img := &Image{
+		MediaType:    m.MediaType,
+		Config:       s.remoteBlob(ctx, m.Config),
+		Layers:       make([]Blob, 0, len(m.Layers)),
+		Annotations:  m.Annotations,
+		ArtifactType: m.ArtifactType,
+		Subject:      m.Subject,
+	}
+	for _, l := range m.Layers {
+		img.Layers = append(img.Layers, s.remoteBlob(ctx, l))
+	}
+	return img, nil
+}
+
+// apiHost returns the host serving the registry api
+func apiHost(domain string) string {
+	if domain == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return domain
+}
+
+// remember records that the repository has the blob
+func (c *Client) remember(registry, repo string, d digest.Digest) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.repos[registry] == nil {
+		c.repos[registry] = make(map[digest.Digest]string)
+	}
+	c.repos[registry][d] = repo
+}
+
+// lookup returns another repository of the same registry known to have the blob
+func (c *Client) lookup(registry, repo string, d digest.Digest) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	from, ok := c.repos[registry][d]
+	if !ok || from == repo {
+		return "", false
+	}
+	return from, true
+}
+
+// session pushes an image to a repository
+type session struct {
+	*Client
+	registry string
+	// base is the url of the registry api, ends with /v2/
+	base string
+	repo string
+	auth *types.AuthConfig
+	// authorization is the authorization header sent with every request
+	authorization string
+}
+
+// mountSources returns other repositories the blobs could be mounted from
+func (s *session) mountSources(blobs []Blob) []string {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, b := range blobs {
+		if from, ok := s.lookup(s.registry, s.repo, b.Digest); ok && !seen[from] {
+			seen[from] = true
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// authorize pings the registry, and prepares the authorization for the challenge it responds.
+// bearer tokens are requested with push access to the repository, and pull access to repositories mounting blobs from
+func (s *session) authorize(ctx context.Context, sources []string) error {
+	if s.auth != nil && s.auth.RegistryToken != "" {
+		s.authorization = "Bearer " + s.auth.RegistryToken
+		return nil
+	}
+
+	resp, e := s.do(ctx, http.MethodGet, s.base, http.StatusOK, http.StatusUnauthorized)
+	if e != nil {
+		return e
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		username, password, e := Credentials(s.auth)
+		if e != nil {
+			return e
+		}
+		if username != "" {
+			s.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		}
+		return nil
+
+	case "bearer":
+		scopes := []string{"repository:" + s.repo + ":pull,push"}
+		for _, from := range sources {
+			scopes = append(scopes, "repository:"+from+":pull")
+		}
+		token, e := s.fetchToken(ctx, params["realm"], params["service"], scopes)
+		if e != nil {
+			return fmt.Errorf("fetch token: %w", e)
+		}
+		s.authorization = "Bearer " + token
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported auth scheme %q", scheme)
+	}
+}
+
+// fetchToken gets a bearer token from the token server, with the identity token as an oauth2 refresh token if it is set,
+// or with the username and password as basic auth
+func (s *session) fetchToken(ctx context.Context, realm, service string, scopes []string) (string, error) {
+	if realm == "" {
+		return "", errors.New("no realm in the bearer challenge")
+	}
+
+	var req *http.Request
+	var e error
+	if s.auth != nil && s.auth.IdentityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", s.auth.IdentityToken)
+		form.Set("service", service)
+		form.Set("scope", strings.Join(scopes, " "))
+		form.Set("client_id", clientID)
+		req, e = http.NewRequestWithContext(ctx, http.MethodPost, realm, strings.NewReader(form.Encode()))
+		if e != nil {
+			return "", fmt.Errorf("create request: %w", e)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := url.Values{}
+		if service != "" {
+			query.Set("service", service)
+		}
+		for _, scope := range scopes {
+			query.Add("scope", scope)
+		}
+		req, e = http.NewRequestWithContext(ctx, http.MethodGet, realm+"?"+query.Encode(), nil)
+		if e != nil {
+			return "", fmt.Errorf("create request: %w", e)
+		}
+		username, password, e := Credentials(s.auth)
+		if e != nil {
+			return "", e
+		}
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+	}
+
+	resp, e := s.client.Do(req)
+	if e != nil {
+		return "", e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(req, resp)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if e := json.NewDecoder(resp.Body).Decode(&token); e != nil {
+		return "", fmt.Errorf("decode token: %w", e)
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return "", errors.New("no token in the response")
+}
+
+// pushBlob uploads the blob to the repository, unless it exists already or could be mounted from another repository
+func (s *session) pushBlob(ctx context.Context, b Blob) error {
+	resp, e := s.do(ctx, http.MethodHead, s.base+s.repo+"/blobs/"+b.Digest.String(), http.StatusOK, http.StatusNotFound)
+	if e != nil {
+		return fmt.Errorf("check blob: %w", e)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		log.V(1).Info("blob exists", "repository", s.repo, "digest", b.Digest)
+		s.remember(s.registry, s.repo, b.Digest)
+		return nil
+	}
+
+	query := url.Values{}
+	from, mount := s.lookup(s.registry, s.repo, b.Digest)
+	if mount {
+		query.Set("mount", b.Digest.String())
+		query.Set("from", from)
+	}
+	resp, e = s.do(ctx, http.MethodPost, s.base+s.repo+"/blobs/uploads/?"+query.Encode(), http.StatusCreated, http.StatusAccepted)
+	if e != nil {
+		return fmt.Errorf("start upload: %w", e)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated {
+		log.V(1).Info("blob mounted", "repository", s.repo, "digest", b.Digest, "from", from)
+		s.remember(s.registry, s.repo, b.Digest)
+		return nil
+	}
+
+	location, e := uploadLocation(resp)
+	if e != nil {
+		return e
+	}
+	if e := s.upload(ctx, location, b); e != nil {
+		return e
+	}
+
+	log.V(1).Info("blob uploaded", "repository", s.repo, "digest", b.Digest, "size", b.Size)
+	s.remember(s.registry, s.repo, b.Digest)
+	return nil
+}
+
+// upload sends the blob content to the upload location, in chunks if the blob is larger than the chunk size
+func (s *session) upload(ctx context.Context, location *url.URL, b Blob) error {
+	rc, e := b.Open()
+	if e != nil {
+		return fmt.Errorf("open blob: %w", e)
+	}
+	defer rc.Close()
+
+	var body io.Reader = rc
+	size := b.Size
+	if s.chunkSize > 0 && b.Size > s.chunkSize {
+		for offset := int64(0); offset < b.Size; {
+			n := s.chunkSize
+			if offset+n > b.Size {
+				n = b.Size - offset
+			}
+
+			header := http.Header{}
+			header.Set("Content-Type", "application/octet-stream")
+			header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+			resp, e := s.send(ctx, http.MethodPatch, location.String(), header, io.LimitReader(rc, n), n, http.StatusAccepted)
+			if e != nil {
+				return fmt.Errorf("upload chunk at %d: %w", offset, e)
+			}
+			resp.Body.Close()
+			if location, e = uploadLocation(resp); e != nil {
+				return e
+			}
+			offset += n
+		}
+		body, size = nil, 0
+	}
+
+	query := location.Query()
+	query.Set("digest", b.Digest.String())
+	location.RawQuery = query.Encode()
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	resp, e := s.send(ctx, http.MethodPut, location.String(), header, body, size, http.StatusCreated)
+	if e != nil {
+		return fmt.Errorf("complete upload: %w", e)
+	}
+	return resp.Body.Close()
+}
+
+// pushImage authorizes the session and uploads blobs of the image, returns the manifest to put
+func (s *session) pushImage(ctx context.Context, img *Image) ([]byte, error) {
+	blobs := append([]Blob{img.Config}, img.Layers...)
+	if e := s.authorize(ctx, s.mountSources(blobs)); e != nil {
+		return nil, fmt.Errorf("authorize: %w", e)
+	}
+	for _, b := range blobs {
+		if e := s.pushBlob(ctx, b); e != nil {
+			return nil, fmt.Errorf("push blob %s: %w", b.Digest, e)
+		}
+	}
+
+	m, e := img.Manifest()
+	if e != nil {
+		return nil, fmt.Errorf("marshal manifest: %w", e)
+	}
+	return m, nil
+}
+
+// putManifest puts the manifest as the tag or digest, returns the manifest digest and the response header
+func (s *session) putManifest(ctx context.Context, tag, mediaType string, m []byte) (digest.Digest, http.Header, error) {
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+	resp, e := s.send(ctx, http.MethodPut, s.base+s.repo+"/manifests/"+tag, header, bytes.NewReader(m), int64(len(m)), http.StatusCreated)
+	if e != nil {
+		return "", nil, fmt.Errorf("put manifest: %w", e)
+	}
+	resp.Body.Close()
+
+	if d, e := digest.Parse(resp.Header.Get(headerContentDigest)); e == nil {
+		return d, resp.Header, nil
+	}
+	return digest.FromBytes(m), resp.Header, nil
+}
+
+// addReferrer adds the referrer to the index tagged as <alg>-<hex> of the subject digest, the index is created if it does not exist.
+// the index is read and put back, so concurrent pushes of referrers to the same subject may lose one of them
+func (s *session) addReferrer(ctx context.Context, subject digest.Digest, desc referrer) error {
+	tag := subject.Algorithm().String() + "-" + subject.Hex()
+	header := http.Header{}
+	header.Set("Accept", ocispec.MediaTypeImageIndex)
+	resp, e := s.send(ctx, http.MethodGet, s.base+s.repo+"/manifests/"+tag, header, nil, 0, http.StatusOK, http.StatusNotFound)
+	if e != nil {
+		return fmt.Errorf("get manifest: %w", e)
+	}
+	defer resp.Body.Close()
+
+	index := referrersIndex{SchemaVersion: 2, MediaType: ocispec.MediaTypeImageIndex}
+	if resp.StatusCode == http.StatusOK {
+		if e := json.NewDecoder(resp.Body).Decode(&index); e != nil {
+			return fmt.Errorf("decode index: %w", e)
+		}
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == desc.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, desc)
+
+	m, e := json.Marshal(index)
+	if e != nil {
+		return e
+	}
+	_, _, e = s.putManifest(ctx, tag, ocispec.MediaTypeImageIndex, m)
+	return e
+}
+
+// remoteBlob returns the blob of the descriptor, read from the repository when it is opened
+func (s *session) remoteBlob(ctx context.Context, desc ocispec.Descriptor) Blob {
+	return Blob{
+		Descriptor: desc,
+		Open: func() (io.ReadCloser, error) {
+			resp, e := s.do(ctx, http.MethodGet, s.base+s.repo+"/blobs/"+desc.Digest.String(), http.StatusOK)
+			if e != nil {
+				return nil, fmt.Errorf("get blob: %w", e)
+			}
+			return resp.Body, nil
+		},
+	}
+}
+
+// do sends a request without body
+func (s *session) do(ctx context.Context, method, u string, expected ...int) (*http.Response, error) {
+	return s.send(ctx, method, u, nil, nil, 0, expected...)
+}
+
+// send sends a request with the session authorization, and fails if the response status is not expected
+func (s *session) send(ctx context.Context, method, u string, header http.Header, body io.Reader, size int64, expected ...int) (*http.Response, error) {
+	req, e := http.NewRequestWithContext(ctx, method, u, body)
+	if e != nil {
+		return nil, fmt.Errorf("create request: %w", e)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if s.authorization != "" {
+		req.Header.Set("Authorization", s.authorization)
+	}
+
+	resp, e := s.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	for _, code := range expected {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+
+	defer resp.Body.Close()
+	return nil, statusError(req, resp)
+}
+
+// statusError describes an unexpected response, with the error codes of the distribution spec if the registry reports them,
+// such as "DENIED: requested access to the resource is denied"
+func statusError(req *http.Request, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var errs struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	var details []string
+	if json.Unmarshal(body, &errs) == nil {
+		for _, e := range errs.Errors {
+			details = append(details, e.Code+": "+e.Message)
+		}
+	}
+	if len(details) == 0 && len(body) > 0 {
+		details = append(details, strings.TrimSpace(string(body)))
+	}
+
+	msg := fmt.Sprintf("%s %s: unexpected http status: %s", req.Method, req.URL.Path, resp.Status)
+	if len(details) > 0 {
+		msg += ": " + strings.Join(details, "; ")
+	}
+	return errors.New(msg)
+}
+
+// uploadLocation returns the url to continue the upload, which may be relative to the request url
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, errors.New("no upload location in the response")
+	}
+	u, e := resp.Request.URL.Parse(location)
+	if e != nil {
+		return nil, fmt.Errorf("parse upload location %s: %w", location, e)
+	}
+	return u, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"
+func parseChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i < 0 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+
+	return scheme, params
+}
+
+// Credentials returns the username and secret of the docker auth, the identity token is returned as the secret without a username.
+// the username and password are decoded from the base64 encoded auth field if they are not set, as docker config files have them
+func Credentials(auth *types.AuthConfig) (string, string, error) {
+	if auth == nil {
+		return "", "", nil
+	}
+	if auth.IdentityToken != "" {
+		return "", auth.IdentityToken, nil
+	}
+	if auth.Username != "" || auth.Auth == "" {
+		return auth.Username, auth.Password, nil
+	}
+
+	decoded, e := base64.StdEncoding.DecodeString(auth.Auth)
+	if e != nil {
+		return "", "", fmt.Errorf("decode auth: %w", e)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid auth: %s", auth.ServerAddress)
+	}
+
+	return parts[0], parts[1], nil
+}
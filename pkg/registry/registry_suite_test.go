@@ -0,0 +1,563 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/containerd/containerd/images"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRegistry(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Registry Suite")
+}
+
+var _ = Describe("registry client", func() {
+	var (
+		ctx      = context.Background()
+		registry *mockRegistry
+		client   *Client
+		img      *Image
+		auth     = &types.AuthConfig{Username: "user", Password: "password"}
+	)
+
+	BeforeEach(func() {
+		registry = newMockRegistry("user", "password")
+		client = NewClient(registry.server.Client(), 0)
+		img = &Image{
+			MediaType: images.MediaTypeDockerSchema2Manifest,
+			Config:    newBlob(images.MediaTypeDockerSchema2Config, `{"architecture":"amd64"}`),
+			Layers: []Blob{
+				newBlob(images.MediaTypeDockerSchema2LayerGzip, "base layer"),
+				newBlob(images.MediaTypeDockerSchema2LayerGzip, "container layer"),
+			},
+		}
+	})
+
+	AfterEach(func() {
+		registry.server.Close()
+	})
+
+	ref := func(name string) reference.Named {
+		r, e := reference.ParseNormalizedNamed(registry.host() + "/" + name)
+		Expect(e).Should(Succeed())
+		return r
+	}
+
+	Context("when pushing an image", func() {
+		It("should upload blobs and put the manifest", func() {
+			d, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+
+			m, ok := registry.manifests["snapshots/app:v1"]
+			Expect(ok).Should(BeTrue())
+			Expect(d).Should(Equal(digest.FromBytes(m)))
+			Expect(string(m)).Should(ContainSubstring(images.MediaTypeDockerSchema2Manifest))
+			Expect(registry.blobs["snapshots/app"]).Should(HaveLen(3))
+			Expect(registry.blobs["snapshots/app"][img.Layers[1].Digest]).Should(Equal([]byte("container layer")))
+		})
+
+		It("should get a token for the repository with the credential", func() {
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			Expect(registry.scopes).Should(Equal([][]string{{"repository:snapshots/app:pull,push"}}))
+		})
+
+		It("should push with the latest tag if no tag is given", func() {
+			_, e := client.Push(ctx, ref("snapshots/app"), img, auth)
+			Expect(e).Should(Succeed())
+			Expect(registry.manifests).Should(HaveKey("snapshots/app:latest"))
+		})
+
+		It("should fail with a bad credential", func() {
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, &types.AuthConfig{Username: "user", Password: "wrong"})
+			Expect(e).Should(HaveOccurred())
+			Expect(e.Error()).Should(ContainSubstring("UNAUTHORIZED: authentication required"))
+		})
+
+		It("should report registry errors", func() {
+			registry.denied = true
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(HaveOccurred())
+			Expect(e.Error()).Should(ContainSubstring("unexpected http status: 403 Forbidden: DENIED: requested access to the resource is denied"))
+		})
+
+		It("should decode the encoded auth of docker config files", func() {
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, &types.AuthConfig{Auth: "dXNlcjpwYXNzd29yZA=="})
+			Expect(e).Should(Succeed())
+			Expect(registry.scopes).Should(HaveLen(1))
+		})
+
+		It("should use the registry token directly", func() {
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, &types.AuthConfig{RegistryToken: "mock-token"})
+			Expect(e).Should(Succeed())
+			Expect(registry.scopes).Should(BeEmpty())
+		})
+	})
+
+	Context("when blobs exist in the repository", func() {
+		It("should not upload them again", func() {
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			uploads := registry.uploads
+
+			img.Layers[1] = newBlob(images.MediaTypeDockerSchema2LayerGzip, "another container layer")
+			_, e = NewClient(registry.server.Client(), 0).Push(ctx, ref("snapshots/app:v2"), img, auth)
+			Expect(e).Should(Succeed())
+			Expect(registry.uploads).Should(Equal(uploads + 1))
+		})
+	})
+
+	Context("when pushing to another repository of the same registry", func() {
+		It("should mount blobs from the pushed repository", func() {
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			uploads := registry.uploads
+
+			_, e = client.Push(ctx, ref("mirrors/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			Expect(registry.uploads).Should(Equal(uploads))
+			Expect(registry.mounts).Should(Equal(3))
+			Expect(registry.blobs["mirrors/app"]).Should(HaveLen(3))
+			Expect(registry.scopes[1]).Should(Equal([]string{"repository:mirrors/app:pull,push", "repository:snapshots/app:pull"}))
+		})
+	})
+
+	Context("with a chunk size", func() {
+		It("should upload large blobs in chunks", func() {
+			client = NewClient(registry.server.Client(), 4)
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			// 24, 10 and 15 bytes in chunks of 4 bytes
+			Expect(registry.patches).Should(Equal(6 + 3 + 4))
+			Expect(registry.blobs["snapshots/app"][img.Layers[1].Digest]).Should(Equal([]byte("container layer")))
+		})
+	})
+
+	Context("when resolving an image", func() {
+		It("should return the descriptor of the pushed manifest", func() {
+			d, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			resolved, e := NewClient(registry.server.Client(), 0).Resolve(ctx, ref("snapshots/app:v1"), auth)
+			Expect(e).Should(Succeed())
+			Expect(resolved).Should(Equal(ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema2Manifest,
+				Digest:    d,
+				Size:      int64(len(registry.manifests["snapshots/app:v1"])),
+			}))
+		})
+
+		It("should resolve the manifest by digest", func() {
+			d, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			withDigest, e := reference.WithDigest(reference.TrimNamed(ref("snapshots/app")), d)
+			Expect(e).Should(Succeed())
+			resolved, e := client.Resolve(ctx, withDigest, auth)
+			Expect(e).Should(Succeed())
+			Expect(resolved.Digest).Should(Equal(d))
+		})
+
+		It("should fail if the image does not exist", func() {
+			_, e := client.Resolve(ctx, ref("snapshots/app:v1"), auth)
+			Expect(e).Should(MatchError(ContainSubstring("404 Not Found")))
+		})
+	})
+
+	Context("when fetching an image", func() {
+		It("should return the pushed manifest with its blobs", func() {
+			img.Annotations = map[string]string{"created-by": "test"}
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+
+			fetched, e := NewClient(registry.server.Client(), 0).Fetch(ctx, ref("snapshots/app:v1"), auth)
+			Expect(e).Should(Succeed())
+			Expect(fetched.MediaType).Should(Equal(img.MediaType))
+			Expect(fetched.Annotations).Should(Equal(img.Annotations))
+			Expect(fetched.Config.Descriptor).Should(Equal(img.Config.Descriptor))
+			Expect(fetched.Layers).Should(HaveLen(2))
+			Expect(fetched.Layers[1].Descriptor).Should(Equal(img.Layers[1].Descriptor))
+
+			rc, e := fetched.Layers[1].Open()
+			Expect(e).Should(Succeed())
+			defer rc.Close()
+			content, e := ioutil.ReadAll(rc)
+			Expect(e).Should(Succeed())
+			Expect(string(content)).Should(Equal("container layer"))
+		})
+
+		It("should return nil if the image does not exist", func() {
+			fetched, e := client.Fetch(ctx, ref("snapshots/app:v1"), auth)
+			Expect(e).Should(Succeed())
+			Expect(fetched).Should(BeNil())
+		})
+	})
+
+	Context("when pushing a referrer", func() {
+		var (
+			subject  ocispec.Descriptor
+			artifact *Image
+		)
+
+		BeforeEach(func() {
+			d, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			subject = ocispec.Descriptor{MediaType: img.MediaType, Digest: d, Size: int64(len(registry.manifests["snapshots/app:v1"]))}
+			artifact = &Image{
+				MediaType:    ocispec.MediaTypeImageManifest,
+				ArtifactType: "application/vnd.example+json",
+				Config:       newBlob("application/vnd.oci.empty.v1+json", "{}"),
+				Layers:       []Blob{newBlob("application/vnd.example+json", `{"example":true}`)},
+				Annotations:  map[string]string{"example": "true"},
+				Subject:      &subject,
+			}
+		})
+
+		subjectTag := func() string {
+			return "snapshots/app:sha256-" + subject.Digest.Hex()
+		}
+
+		It("should put the manifest by digest with the subject", func() {
+			d, e := client.PushReferrer(ctx, ref("snapshots/app:v1"), artifact, auth)
+			Expect(e).Should(Succeed())
+
+			m, ok := registry.manifests["snapshots/app:"+d.String()]
+			Expect(ok).Should(BeTrue())
+			var pushed manifest
+			Expect(json.Unmarshal(m, &pushed)).Should(Succeed())
+			Expect(pushed.ArtifactType).Should(Equal("application/vnd.example+json"))
+			Expect(pushed.Subject).Should(Equal(&subject))
+			Expect(registry.manifests).ShouldNot(HaveKey("snapshots/app:latest"))
+		})
+
+		It("should not update the referrers index if the registry supports the referrers api", func() {
+			registry.referrers = true
+			_, e := client.PushReferrer(ctx, ref("snapshots/app:v1"), artifact, auth)
+			Expect(e).Should(Succeed())
+			Expect(registry.manifests).ShouldNot(HaveKey(subjectTag()))
+		})
+
+		It("should add the artifact to the referrers index otherwise", func() {
+			d, e := client.PushReferrer(ctx, ref("snapshots/app:v1"), artifact, auth)
+			Expect(e).Should(Succeed())
+
+			another := *artifact
+			another.Layers = []Blob{newBlob("application/vnd.example+json", `{"example":false}`)}
+			d2, e := client.PushReferrer(ctx, ref("snapshots/app:v1"), &another, auth)
+			Expect(e).Should(Succeed())
+			// pushing again does not list the artifact twice
+			_, e = client.PushReferrer(ctx, ref("snapshots/app:v1"), artifact, auth)
+			Expect(e).Should(Succeed())
+
+			var index referrersIndex
+			Expect(json.Unmarshal(registry.manifests[subjectTag()], &index)).Should(Succeed())
+			Expect(index.MediaType).Should(Equal(ocispec.MediaTypeImageIndex))
+			Expect(index.Manifests).Should(HaveLen(2))
+			Expect(index.Manifests[0].Digest).Should(Equal(d))
+			Expect(index.Manifests[0].ArtifactType).Should(Equal("application/vnd.example+json"))
+			Expect(index.Manifests[0].Annotations).Should(Equal(map[string]string{"example": "true"}))
+			Expect(index.Manifests[0].Size).Should(Equal(int64(len(registry.manifests["snapshots/app:"+d.String()]))))
+			Expect(index.Manifests[1].Digest).Should(Equal(d2))
+		})
+
+		It("should fail without a subject", func() {
+			artifact.Subject = nil
+			_, e := client.PushReferrer(ctx, ref("snapshots/app:v1"), artifact, auth)
+			Expect(e).Should(MatchError("no subject of the artifact"))
+		})
+	})
+
+	Context("when the registry is insecure", func() {
+		BeforeEach(func() {
+			registry.server.Close()
+			registry.server = httptest.NewServer(registry)
+		})
+
+		It("should push over plain http", func() {
+			_, e := NewClient(registry.server.Client(), 0, registry.host()).Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(Succeed())
+			Expect(registry.manifests).Should(HaveKey("snapshots/app:v1"))
+		})
+
+		It("should not push over plain http unless it is listed", func() {
+			_, e := client.Push(ctx, ref("snapshots/app:v1"), img, auth)
+			Expect(e).Should(HaveOccurred())
+		})
+	})
+
+	Context("when getting credentials from docker auths", func() {
+		It("should decode the encoded auth", func() {
+			user, secret, e := Credentials(&types.AuthConfig{Auth: "dXNlcjpwYXNzd29yZA=="})
+			Expect(e).Should(Succeed())
+			Expect(user).Should(Equal("user"))
+			Expect(secret).Should(Equal("password"))
+		})
+
+		It("should prefer the identity token", func() {
+			user, secret, e := Credentials(&types.AuthConfig{Username: "user", IdentityToken: "token"})
+			Expect(e).Should(Succeed())
+			Expect(user).Should(BeEmpty())
+			Expect(secret).Should(Equal("token"))
+		})
+
+		It("should reject malformed auths", func() {
+			_, _, e := Credentials(&types.AuthConfig{Auth: "dXNlcg=="})
+			Expect(e).Should(HaveOccurred())
+		})
+	})
+
+	Context("when parsing auth challenges", func() {
+		It("should parse the scheme and params", func() {
+			scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull,push"`)
+			Expect(scheme).Should(Equal("Bearer"))
+			Expect(params).Should(Equal(map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/busybox:pull,push",
+			}))
+		})
+
+		It("should parse challenges without params", func() {
+			scheme, params := parseChallenge(`Basic realm=registry`)
+			Expect(scheme).Should(Equal("Basic"))
+			Expect(params).Should(Equal(map[string]string{"realm": "registry"}))
+		})
+	})
+})
+
+func newBlob(mediaType, content string) Blob {
+	return Blob{
+		Descriptor: ocispec.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromString(content),
+			Size:      int64(len(content)),
+		},
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(content)), nil
+		},
+	}
+}
+
+// mockRegistry is an in-process registry stand-in, serving the token auth and push endpoints of the distribution api
+type mockRegistry struct {
+	lock     sync.Mutex
+	server   *httptest.Server
+	username string
+	password string
+	// denied rejects all manifests
+	denied bool
+	// referrers supports the referrers api, manifests with subjects are listed by the registry itself
+	referrers bool
+
+	// scopes are scopes of each token request
+	scopes [][]string
+	// blobs are blobs by repository and digest
+	blobs map[string]map[digest.Digest][]byte
+	// manifests are manifests by repository:tag or repository:digest
+	manifests map[string][]byte
+	// sessions are contents of ongoing uploads by upload id
+	sessions map[string]*bytes.Buffer
+	uploads  int
+	mounts   int
+	patches  int
+}
+
+const mockToken = "mock-token"
+
+func newMockRegistry(username, password string) *mockRegistry {
+	r := &mockRegistry{
+		username:  username,
+		password:  password,
+		blobs:     make(map[string]map[digest.Digest][]byte),
+		manifests: make(map[string][]byte),
+		sessions:  make(map[string]*bytes.Buffer),
+	}
+	r.server = httptest.NewTLSServer(r)
+	return r
+}
+
+func (r *mockRegistry) host() string {
+	return strings.TrimPrefix(strings.TrimPrefix(r.server.URL, "https://"), "http://")
+}
+
+func (r *mockRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if req.URL.Path == "/token" {
+		if u, p, _ := req.BasicAuth(); u != r.username || p != r.password {
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+			return
+		}
+		r.scopes = append(r.scopes, req.URL.Query()["scope"])
+		json.NewEncoder(w).Encode(map[string]string{"token": mockToken})
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer "+mockToken {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="mock"`, r.server.URL))
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+
+	case strings.Contains(path, "/blobs/uploads/"):
+		i := strings.Index(path, "/blobs/uploads/")
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+
+	case strings.Contains(path, "/blobs/") && (req.Method == http.MethodHead || req.Method == http.MethodGet):
+		i := strings.Index(path, "/blobs/")
+		b, ok := r.blobs[path[:i]][digest.Digest(path[i+len("/blobs/"):])]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(b)
+		}
+
+	case strings.Contains(path, "/manifests/") && req.Method == http.MethodPut:
+		i := strings.Index(path, "/manifests/")
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+
+	case strings.Contains(path, "/manifests/") && (req.Method == http.MethodHead || req.Method == http.MethodGet):
+		i := strings.Index(path, "/manifests/")
+		m, ok := r.manifests[path[:i]+":"+path[i+len("/manifests/"):]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		var desc struct {
+			MediaType string `json:"mediaType"`
+		}
+		json.Unmarshal(m, &desc)
+		w.Header().Set("Content-Type", desc.MediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m)))
+		w.Header().Set(headerContentDigest, digest.FromBytes(m).String())
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(m)
+		}
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *mockRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repo, id string) {
+	switch req.Method {
+	case http.MethodPost:
+		query := req.URL.Query()
+		if d := digest.Digest(query.Get("mount")); d != "" {
+			if content, ok := r.blobs[query.Get("from")][d]; ok {
+				r.mounts++
+				r.putBlob(repo, d, content)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		r.uploads++
+		id := strconv.Itoa(r.uploads)
+		r.sessions[id] = &bytes.Buffer{}
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodPatch:
+		buf, ok := r.sessions[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+			return
+		}
+		if req.Header.Get("Content-Range") != fmt.Sprintf("%d-%d", buf.Len(), buf.Len()+int(req.ContentLength)-1) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "bad range")
+			return
+		}
+		r.patches++
+		io.Copy(buf, req.Body)
+		w.Header().Set("Location", "/v2/"+repo+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodPut:
+		buf, ok := r.sessions[id]
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+			return
+		}
+		io.Copy(buf, req.Body)
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if digest.FromBytes(buf.Bytes()) != d {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+			return
+		}
+		delete(r.sessions, id)
+		r.putBlob(repo, d, buf.Bytes())
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *mockRegistry) serveManifest(w http.ResponseWriter, req *http.Request, repo, tag string) {
+	if r.denied {
+		writeError(w, http.StatusForbidden, "DENIED", "requested access to the resource is denied")
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	var m manifest
+	if e := json.Unmarshal(body, &m); e != nil || m.MediaType != req.Header.Get("Content-Type") {
+		writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", "manifest invalid")
+		return
+	}
+	if m.MediaType != ocispec.MediaTypeImageIndex {
+		for _, desc := range append([]ocispec.Descriptor{m.Config}, m.Layers...) {
+			if _, ok := r.blobs[repo][desc.Digest]; !ok {
+				writeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry")
+				return
+			}
+		}
+	}
+
+	r.manifests[repo+":"+tag] = body
+	r.manifests[repo+":"+digest.FromBytes(body).String()] = body
+	if r.referrers && m.Subject != nil {
+		w.Header().Set(headerSubject, m.Subject.Digest.String())
+	}
+	w.Header().Set(headerContentDigest, digest.FromBytes(body).String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *mockRegistry) putBlob(repo string, d digest.Digest, content []byte) {
+	if r.blobs[repo] == nil {
+		r.blobs[repo] = make(map[digest.Digest][]byte)
+	}
+	r.blobs[repo][d] = content
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
@@ -0,0 +1,357 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var log = logf.Log.WithName("s3 client")
+
+const (
+	// MinPartSize is the min size of parts except the last one, required by s3
+	MinPartSize = 5 << 20
+	// DefaultPartSize is the part size if it is not set
+	DefaultPartSize = 16 << 20
+	// maxParts is the max number of parts of an upload, required by s3
+	maxParts = 10000
+
+	defaultRegion = "us-east-1"
+
+	// abortTimeout limits time of aborting failed uploads, which is done even if the upload is cancelled
+	abortTimeout = 30 * time.Second
+
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	timeFormat    = "20060102T150405Z"
+	dateFormat    = "20060102"
+	headerDate    = "X-Amz-Date"
+	headerContent = "X-Amz-Content-Sha256"
+	headerToken   = "X-Amz-Security-Token"
+)
+
+// Config tells how to reach the s3 compatible service
+type Config struct {
+	// Endpoint is the url of the service, such as https://s3.us-east-1.amazonaws.com or http://minio.storage:9000
+	Endpoint string
+	// Region is the region requests are signed for, us-east-1 by default
+	Region string
+	// PathStyle addresses buckets in url paths instead of host names, which most s3 compatible services require
+	PathStyle bool
+
+	// requests are anonymous without an access key
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// Client uploads objects to s3 compatible object storages, with multipart uploads signed by aws signature version 4
+type Client struct {
+	client   *http.Client
+	endpoint *url.URL
+	config   Config
+	partSize int64
+	// now is the time requests are signed at
+	now func() time.Time
+}
+
+// NewClient returns a client uploading objects in parts of partSize, DefaultPartSize is used if it is 0
+func NewClient(httpClient *http.Client, config Config, partSize int64) (*Client, error) {
+	endpoint, e := url.Parse(config.Endpoint)
+	if e != nil {
+		return nil, fmt.Errorf("parse endpoint: %w", e)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint: %s", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = defaultRegion
+	}
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		return nil, fmt.Errorf("part size %d is less than %d", partSize, MinPartSize)
+	}
+
+	return &Client{client: httpClient, endpoint: endpoint, config: config, partSize: partSize, now: time.Now}, nil
+}
+
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName xml.Name
+	ETag    string `xml:"ETag"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Upload streams r to the object with a multipart upload, and returns the etag of the object.
+// the upload is aborted if it fails, so no parts are left in the bucket
+func (c *Client) Upload(ctx context.Context, bucket, key string, r io.Reader) (string, error) {
+	u := c.objectURL(bucket, key)
+
+	var initiated initiateResult
+	if e := c.do(ctx, http.MethodPost, u, url.Values{"uploads": {""}}, nil, &initiated); e != nil {
+		return "", fmt.Errorf("initiate upload: %w", e)
+	}
+	uploadID := url.Values{"uploadId": {initiated.UploadID}}
+	log.Info("upload initiated", "bucket", bucket, "key", key, "upload id", initiated.UploadID)
+
+	etag, e := c.upload(ctx, u, initiated.UploadID, r)
+	if e != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+		defer cancel()
+		if e := c.do(ctx, http.MethodDelete, u, uploadID, nil, nil); e != nil {
+			log.Error(e, "abort upload", "bucket", bucket, "key", key, "upload id", initiated.UploadID)
+		}
+		return "", e
+	}
+	return etag, nil
+}
+
+func (c *Client) upload(ctx context.Context, u *url.URL, uploadID string, r io.Reader) (string, error) {
+	var complete completeUpload
+	buf := make([]byte, c.partSize)
+	for n := 1; ; n++ {
+		size, e := io.ReadFull(r, buf)
+		if e == io.EOF && n > 1 {
+			break
+		}
+		if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+			return "", fmt.Errorf("read part %d: %w", n, e)
+		}
+		if n > maxParts {
+			return "", fmt.Errorf("too many parts, more than %d parts of %d bytes", maxParts, c.partSize)
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		resp, err := c.request(ctx, http.MethodPut, u, query, buf[:size])
+		if err != nil {
+			return "", fmt.Errorf("upload part %d: %w", n, err)
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+
+		// the last part is shorter than the part size
+		if e != nil {
+			break
+		}
+	}
+
+	body, e := xml.Marshal(complete)
+	if e != nil {
+		return "", e
+	}
+	var result completeResult
+	if e := c.do(ctx, http.MethodPost, u, url.Values{"uploadId": {uploadID}}, body, &result); e != nil {
+		return "", fmt.Errorf("complete upload: %w", e)
+	}
+	// s3 may report errors of completing uploads in the body of a 200 response
+	if result.XMLName.Local == "Error" {
+		return "", fmt.Errorf("complete upload: %s: %s", result.Code, result.Message)
+	}
+	return strings.Trim(result.ETag, `"`), nil
+}
+
+// do sends the request, and decodes the xml response into v if it is not nil
+func (c *Client) do(ctx context.Context, method string, u *url.URL, query url.Values, body []byte, v interface{}) error {
+	resp, e := c.request(ctx, method, u, query, body)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// request sends a signed request, and returns the response if it succeeds
+func (c *Client) request(ctx context.Context, method string, u *url.URL, query url.Values, body []byte) (*http.Response, error) {
+	target := *u
+	target.RawQuery = encodeQuery(query)
+	req, e := http.NewRequest(method, target.String(), bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	req = req.WithContext(ctx)
+	c.sign(req, body)
+
+	resp, e := c.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, statusError(req, resp)
+	}
+	return resp, nil
+}
+
+// objectURL returns the url of the object, with the bucket in the path or the host name
+func (c *Client) objectURL(bucket, key string) *url.URL {
+	u := *c.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if c.config.PathStyle {
+		p += "/" + bucket
+	} else {
+		u.Host = bucket + "." + u.Host
+	}
+	u.Path = p + "/" + key
+	u.RawPath = p + "/" + escapePath(key)
+	return &u
+}
+
+// sign signs the request with aws signature version 4, all headers set are signed
+func (c *Client) sign(req *http.Request, body []byte) {
+	if c.config.AccessKeyID == "" {
+		return
+	}
+
+	now := c.now().UTC()
+	sum := sha256.Sum256(body)
+	req.Header.Set(headerDate, now.Format(timeFormat))
+	req.Header.Set(headerContent, hex.EncodeToString(sum[:]))
+	if c.config.SessionToken != "" {
+		req.Header.Set(headerToken, c.config.SessionToken)
+	}
+
+	scope := strings.Join([]string{now.Format(dateFormat), c.config.Region, "s3", "aws4_request"}, "/")
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get(headerContent),
+	}, "\n")
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{signAlgorithm, now.Format(timeFormat), scope, hex.EncodeToString(requestSum[:])}, "\n")
+
+	key := []byte("AWS4" + c.config.SecretAccessKey)
+	for _, s := range []string{now.Format(dateFormat), c.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, c.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// canonicalHeaders returns names of signed headers, and the canonical headers of the request, including the host
+func canonicalHeaders(req *http.Request) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString(k + ":" + headers[k] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+// canonicalQuery encodes the query sorted by keys, with spaces encoded as %20
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// encodeQuery encodes the query as it is signed, keys with empty values are sent without "=", e.g. ?uploads
+func encodeQuery(query url.Values) string {
+	q := canonicalQuery(query)
+	return strings.Replace(strings.TrimSuffix(q, "="), "=&", "&", -1)
+}
+
+// escape encodes all bytes except unreserved characters, as aws signature version 4 requires
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// escapePath escapes each segment of the object key
+func escapePath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func statusError(req *http.Request, resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var s3err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	msg := fmt.Sprintf("%s %s: unexpected http status: %s", req.Method, req.URL.Path, resp.Status)
+	if xml.Unmarshal(body, &s3err) == nil && s3err.Code != "" {
+		msg += ": " + s3err.Code + ": " + s3err.Message
+	} else if len(body) > 0 {
+		msg += ": " + strings.TrimSpace(string(body))
+	}
+	return errors.New(msg)
+}
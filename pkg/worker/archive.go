@@ -0,0 +1,225 @@
+package worker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+// dockerArchiveManifest is an entry of manifest.json in docker archives, see `docker save`
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// extractedArchive is a docker archive of a single image extracted into dir
+type extractedArchive struct {
+	dir      string
+	manifest dockerArchiveManifest
+	// links are symlinks in the archive, docker archives link duplicated layers to the first one
+	links map[string]string
+}
+
+// extractDockerArchive extracts a docker archive of a single image into dir
+func extractDockerArchive(r io.Reader, dir string) (*extractedArchive, error) {
+	a := &extractedArchive{dir: dir, links: make(map[string]string)}
+	tr := tar.NewReader(r)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, fmt.Errorf("read archive: %w", e)
+		}
+
+		name, e := archivePath(hdr.Name)
+		if e != nil {
+			return nil, e
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if e := os.MkdirAll(filepath.Join(dir, name), 0700); e != nil {
+				return nil, e
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if e := extractFile(tr, filepath.Join(dir, name)); e != nil {
+				return nil, fmt.Errorf("extract %s: %w", hdr.Name, e)
+			}
+		case tar.TypeSymlink:
+			a.links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		}
+	}
+
+	buf, e := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if e != nil {
+		return nil, fmt.Errorf("read archive manifest: %w", e)
+	}
+	var manifests []dockerArchiveManifest
+	if e := json.Unmarshal(buf, &manifests); e != nil {
+		return nil, fmt.Errorf("parse archive manifest: %w", e)
+	}
+	if len(manifests) != 1 {
+		return nil, fmt.Errorf("expect 1 image in the archive, got %d", len(manifests))
+	}
+	a.manifest = manifests[0]
+
+	return a, nil
+}
+
+// path returns the path of the extracted file named in the archive manifest, following symlinks
+func (a *extractedArchive) path(name string) (string, error) {
+	name, e := archivePath(name)
+	if e != nil {
+		return "", e
+	}
+	if target, ok := a.links[name]; ok {
+		if name, e = archivePath(target); e != nil {
+			return "", e
+		}
+	}
+	return filepath.Join(a.dir, name), nil
+}
+
+// loadDockerArchive extracts a docker archive into dir, and returns the image in it as a docker schema 2 image.
+// layers are saved uncompressed in docker archives, they are compressed with gzip into dir for pushing.
+// the gzip header is left empty, so the same layer is always compressed to the same blob by the same worker
+func loadDockerArchive(r io.Reader, dir string) (*registry.Image, error) {
+	a, e := extractDockerArchive(r, dir)
+	if e != nil {
+		return nil, e
+	}
+
+	configPath, e := a.path(a.manifest.Config)
+	if e != nil {
+		return nil, e
+	}
+	config, e := fileBlob(configPath, images.MediaTypeDockerSchema2Config)
+	if e != nil {
+		return nil, fmt.Errorf("load image config: %w", e)
+	}
+
+	img := &registry.Image{
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config:    *config,
+	}
+	for i, l := range a.manifest.Layers {
+		layerPath, e := a.path(l)
+		if e != nil {
+			return nil, e
+		}
+		layer, e := compressLayer(layerPath, filepath.Join(dir, fmt.Sprintf("layer-%d.tar.gz", i)))
+		if e != nil {
+			return nil, fmt.Errorf("compress layer %s: %w", l, e)
+		}
+		img.Layers = append(img.Layers, *layer)
+	}
+
+	return img, nil
+}
+
+// archivePath cleans a path in the archive, and rejects paths out of the archive
+func archivePath(name string) (string, error) {
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid path in archive: %s", name)
+	}
+	return cleaned, nil
+}
+
+func extractFile(r io.Reader, dst string) error {
+	if e := os.MkdirAll(filepath.Dir(dst), 0700); e != nil {
+		return e
+	}
+	f, e := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if e != nil {
+		return e
+	}
+	if _, e := io.Copy(f, r); e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// fileBlob returns a blob of the file content
+func fileBlob(file, mediaType string) (*registry.Blob, error) {
+	f, e := os.Open(file)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	d, e := digest.Canonical.FromReader(f)
+	if e != nil {
+		return nil, e
+	}
+	info, e := f.Stat()
+	if e != nil {
+		return nil, e
+	}
+
+	return &registry.Blob{
+		Descriptor: ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: info.Size()},
+		Open:       func() (io.ReadCloser, error) { return os.Open(file) },
+	}, nil
+}
+
+// compressLayer compresses the layer tarball with gzip into dst, and returns the compressed blob
+func compressLayer(src, dst string) (*registry.Blob, error) {
+	in, e := os.Open(src)
+	if e != nil {
+		return nil, e
+	}
+	defer in.Close()
+
+	out, e := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if e != nil {
+		return nil, e
+	}
+	defer out.Close()
+
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	zw := gzip.NewWriter(io.MultiWriter(out, digester.Hash(), counter))
+	if _, e := io.Copy(zw, in); e != nil {
+		return nil, e
+	}
+	if e := zw.Close(); e != nil {
+		return nil, e
+	}
+	if e := out.Close(); e != nil {
+		return nil, e
+	}
+
+	return &registry.Blob{
+		Descriptor: ocispec.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2LayerGzip,
+			Digest:    digester.Digest(),
+			Size:      counter.n,
+		},
+		Open: func() (io.ReadCloser, error) { return os.Open(dst) },
+	}, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
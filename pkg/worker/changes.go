@@ -0,0 +1,189 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// supported dockerfile instructions in snapshot changes, same as `docker commit --change`,
+// except ONBUILD and HEALTHCHECK, which are not part of oci image config
+const (
+	instructionCmd        = "CMD"
+	instructionEntrypoint = "ENTRYPOINT"
+	instructionEnv        = "ENV"
+	instructionExpose     = "EXPOSE"
+	instructionLabel      = "LABEL"
+	instructionUser       = "USER"
+	instructionVolume     = "VOLUME"
+	instructionWorkdir    = "WORKDIR"
+)
+
+// changedFields are runtime config fields overridden by each instruction
+var changedFields = map[string]string{
+	instructionCmd:        "Cmd",
+	instructionEntrypoint: "Entrypoint",
+	instructionEnv:        "Env",
+	instructionExpose:     "ExposedPorts",
+	instructionLabel:      "",
+	instructionUser:       "User",
+	instructionVolume:     "",
+	instructionWorkdir:    "WorkingDir",
+}
+
+// change is a parsed dockerfile instruction
+type change struct {
+	instruction string
+	args        string
+}
+
+func parseChanges(changes []string) ([]change, error) {
+	out := make([]change, 0, len(changes))
+	for _, c := range changes {
+		parts := strings.SplitN(strings.TrimSpace(c), " ", 2)
+		inst := strings.ToUpper(parts[0])
+		if _, ok := changedFields[inst]; !ok {
+			return nil, fmt.Errorf("unsupported instruction %q", parts[0])
+		}
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("%s requires at least one argument", inst)
+		}
+
+		out = append(out, change{instruction: inst, args: strings.TrimSpace(parts[1])})
+	}
+
+	return out, nil
+}
+
+// applyOCIChanges applies changes to an oci image config, as docker daemon does on commit
+func applyOCIChanges(config *ocispec.ImageConfig, changes []change) error {
+	for _, c := range changes {
+		switch c.instruction {
+		case instructionCmd:
+			config.Cmd = parseCommand(c.args)
+		case instructionEntrypoint:
+			config.Entrypoint = parseCommand(c.args)
+		case instructionEnv:
+			pairs, e := parseKeyValues(c.args)
+			if e != nil {
+				return fmt.Errorf("%s: %w", c.instruction, e)
+			}
+			for _, kv := range pairs {
+				config.Env = setEnv(config.Env, kv[0], kv[1])
+			}
+		case instructionExpose:
+			if config.ExposedPorts == nil {
+				config.ExposedPorts = make(map[string]struct{})
+			}
+			for _, port := range strings.Fields(c.args) {
+				if !strings.Contains(port, "/") {
+					port += "/tcp"
+				}
+				config.ExposedPorts[port] = struct{}{}
+			}
+		case instructionLabel:
+			pairs, e := parseKeyValues(c.args)
+			if e != nil {
+				return fmt.Errorf("%s: %w", c.instruction, e)
+			}
+			if config.Labels == nil {
+				config.Labels = make(map[string]string)
+			}
+			for _, kv := range pairs {
+				config.Labels[kv[0]] = kv[1]
+			}
+		case instructionUser:
+			config.User = c.args
+		case instructionVolume:
+			if config.Volumes == nil {
+				config.Volumes = make(map[string]struct{})
+			}
+			var volumes []string
+			if json.Unmarshal([]byte(c.args), &volumes) != nil {
+				volumes = strings.Fields(c.args)
+			}
+			for _, v := range volumes {
+				config.Volumes[v] = struct{}{}
+			}
+		case instructionWorkdir:
+			config.WorkingDir = c.args
+		}
+	}
+
+	return nil
+}
+
+// parseCommand parses a command in either exec form or shell form
+func parseCommand(args string) []string {
+	var cmd []string
+	if json.Unmarshal([]byte(args), &cmd) == nil {
+		return cmd
+	}
+
+	return []string{"/bin/sh", "-c", args}
+}
+
+// parseKeyValues parses arguments of ENV and LABEL, formatted as `key value` or `key=value key2="value 2"`
+func parseKeyValues(args string) ([][2]string, error) {
+	words := splitWords(args)
+	if !strings.Contains(words[0], "=") {
+		parts := strings.SplitN(args, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing value of %s", parts[0])
+		}
+		return [][2]string{{parts[0], strings.TrimSpace(parts[1])}}, nil
+	}
+
+	pairs := make([][2]string, 0, len(words))
+	for _, w := range words {
+		kv := strings.SplitN(w, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid key value pair: %s", w)
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+
+	return pairs, nil
+}
+
+// splitWords splits by spaces, double quoted spaces are kept and quotes are removed
+func splitWords(s string) []string {
+	var words []string
+	var word strings.Builder
+	quoted, inWord := false, false
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case r == ' ' && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words
+}
+
+func setEnv(env []string, key, value string) []string {
+	for i, kv := range env {
+		if strings.SplitN(kv, "=", 2)[0] == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+
+	return append(env, key+"="+value)
+}
@@ -0,0 +1,249 @@
+package worker
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// labels recording where the runtime config of a snapshot comes from, values are comma separated field names
+const (
+	LabelConfigFromContainer = "container-snapshot.atom.supremind.com/config-from-container"
+	LabelConfigFromImage     = "container-snapshot.atom.supremind.com/config-from-image"
+	LabelConfigFromChanges   = "container-snapshot.atom.supremind.com/config-from-changes"
+)
+
+// configSources records which runtime config fields are carried over from the source container,
+// which are kept as in the base image, and which are overridden by commit changes
+type configSources struct {
+	container []string
+	image     []string
+	changes   []string
+}
+
+func (s *configSources) pick(field string, fromContainer bool) {
+	if fromContainer {
+		s.container = append(s.container, field)
+	} else {
+		s.image = append(s.image, field)
+	}
+}
+
+// override moves fields overridden by the changes out of the container and image sources
+func (s *configSources) override(changes []change) {
+	for _, c := range changes {
+		field := changedFields[c.instruction]
+		if field == "" || contains(s.changes, field) {
+			continue
+		}
+		s.container = remove(s.container, field)
+		s.image = remove(s.image, field)
+		s.changes = append(s.changes, field)
+	}
+}
+
+func (s *configSources) label(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels)+3)
+	for k, v := range labels {
+		out[k] = v
+	}
+	out[LabelConfigFromContainer] = strings.Join(s.container, ",")
+	out[LabelConfigFromImage] = strings.Join(s.image, ",")
+	if len(s.changes) > 0 {
+		out[LabelConfigFromChanges] = strings.Join(s.changes, ",")
+	}
+
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, s string) []string {
+	out := list[:0]
+	for _, item := range list {
+		if item != s {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// mergeDockerConfig builds the snapshot config from runtime config of the source container, with labels of the base image.
+// the daemon still merges container labels into the committed image, including io.kubernetes.* labels set by kubelet,
+// commit options could not remove them. changes are not applied here, docker daemon applies them on commit
+func mergeDockerConfig(ctr, base *container.Config, changes []change) *container.Config {
+	if base == nil {
+		base = &container.Config{}
+	}
+
+	var sources configSources
+	sources.pick("Cmd", !reflect.DeepEqual(ctr.Cmd, base.Cmd))
+	sources.pick("Entrypoint", !reflect.DeepEqual(ctr.Entrypoint, base.Entrypoint))
+	sources.pick("Env", !reflect.DeepEqual(ctr.Env, base.Env))
+	sources.pick("WorkingDir", ctr.WorkingDir != base.WorkingDir)
+	sources.pick("ExposedPorts", !reflect.DeepEqual(ctr.ExposedPorts, base.ExposedPorts))
+	sources.pick("User", ctr.User != base.User)
+	sources.override(changes)
+
+	return &container.Config{
+		Image:        ctr.Image,
+		Cmd:          ctr.Cmd,
+		Entrypoint:   ctr.Entrypoint,
+		Env:          ctr.Env,
+		WorkingDir:   ctr.WorkingDir,
+		ExposedPorts: ctr.ExposedPorts,
+		User:         ctr.User,
+		Labels:       sources.label(base.Labels),
+	}
+}
+
+// configChanges returns dockerfile instructions setting fields of the merged config carried over from the container,
+// and labels recording where the config comes from, for runtimes taking changes instead of configs on commit
+func configChanges(config *container.Config) ([]string, []string) {
+	var fields []string
+	for _, field := range strings.Split(config.Labels[LabelConfigFromContainer], ",") {
+		switch field {
+		case "Cmd":
+			fields = append(fields, instructionCmd+" "+jsonArray(config.Cmd))
+		case "Entrypoint":
+			fields = append(fields, instructionEntrypoint+" "+jsonArray(config.Entrypoint))
+		case "Env":
+			for _, env := range config.Env {
+				if kv := strings.SplitN(env, "=", 2); len(kv) == 2 {
+					fields = append(fields, instructionEnv+" "+kv[0]+"="+dockerfileQuote(kv[1]))
+				}
+			}
+		case "WorkingDir":
+			if config.WorkingDir != "" {
+				fields = append(fields, instructionWorkdir+" "+config.WorkingDir)
+			}
+		case "ExposedPorts":
+			ports := make([]string, 0, len(config.ExposedPorts))
+			for p := range config.ExposedPorts {
+				ports = append(ports, string(p))
+			}
+			if len(ports) > 0 {
+				sort.Strings(ports)
+				fields = append(fields, instructionExpose+" "+strings.Join(ports, " "))
+			}
+		case "User":
+			if config.User != "" {
+				fields = append(fields, instructionUser+" "+config.User)
+			}
+		}
+	}
+
+	var labels []string
+	for _, key := range []string{LabelConfigFromContainer, LabelConfigFromImage, LabelConfigFromChanges} {
+		if v, ok := config.Labels[key]; ok {
+			labels = append(labels, instructionLabel+" "+key+"="+dockerfileQuote(v))
+		}
+	}
+	return fields, labels
+}
+
+// dockerQuoteReplacer escapes characters special in double quoted dockerfile words,
+// backslashes before other characters are kept as is, and non-ascii text needs no escaping
+var dockerQuoteReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+
+// dockerfileQuote double quotes a value for dockerfile instructions, so it is not expanded as variables
+func dockerfileQuote(v string) string {
+	return `"` + dockerQuoteReplacer.Replace(v) + `"`
+}
+
+func jsonArray(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+// mergeOCIConfig carries runtime config of the source container from its oci runtime spec into the image config,
+// the container process args are split back to entrypoint and cmd when they start with the image entrypoint,
+// then changes are applied on top of it
+func mergeOCIConfig(spec *specs.Spec, base ocispec.ImageConfig, changes []change) (ocispec.ImageConfig, error) {
+	var sources configSources
+	out := base
+
+	if spec != nil && spec.Process != nil {
+		args := spec.Process.Args
+		switch {
+		case reflect.DeepEqual(args, append(append([]string{}, base.Entrypoint...), base.Cmd...)):
+			sources.pick("Entrypoint", false)
+			sources.pick("Cmd", false)
+		case len(base.Entrypoint) > 0 && len(args) >= len(base.Entrypoint) && reflect.DeepEqual(args[:len(base.Entrypoint)], base.Entrypoint):
+			sources.pick("Entrypoint", false)
+			sources.pick("Cmd", true)
+			out.Cmd = args[len(base.Entrypoint):]
+		default:
+			sources.pick("Entrypoint", true)
+			sources.pick("Cmd", true)
+			out.Entrypoint = args
+			out.Cmd = nil
+		}
+
+		sources.pick("Env", !reflect.DeepEqual(spec.Process.Env, base.Env))
+		out.Env = spec.Process.Env
+		sources.pick("WorkingDir", spec.Process.Cwd != base.WorkingDir)
+		out.WorkingDir = spec.Process.Cwd
+	} else {
+		sources.pick("Entrypoint", false)
+		sources.pick("Cmd", false)
+		sources.pick("Env", false)
+		sources.pick("WorkingDir", false)
+	}
+	// exposed ports are not part of the runtime spec
+	sources.pick("ExposedPorts", false)
+	if spec != nil && spec.Process != nil {
+		user, fromContainer := ociUser(spec.Process.User, base.User)
+		sources.pick("User", fromContainer)
+		out.User = user
+	} else {
+		sources.pick("User", false)
+	}
+	sources.override(changes)
+	out.Labels = sources.label(base.Labels)
+
+	if e := applyOCIChanges(&out, changes); e != nil {
+		return out, e
+	}
+
+	return out, nil
+}
+
+// ociUser returns the user of the container process as an image config user, and whether it is not the base image user.
+// the process runs as resolved ids, user names of the base image are not resolved, so they are kept
+func ociUser(u specs.User, base string) (string, bool) {
+	if u.Username != "" {
+		return u.Username, u.Username != base
+	}
+
+	uid := strconv.FormatUint(uint64(u.UID), 10)
+	user := uid + ":" + strconv.FormatUint(uint64(u.GID), 10)
+	name := strings.SplitN(base, ":", 2)[0]
+	switch {
+	case base == "":
+		if u.UID == 0 && u.GID == 0 {
+			return base, false
+		}
+	case base == uid || base == user:
+		return base, false
+	case name != "" && strings.Trim(name, "0123456789") != "":
+		return base, false
+	}
+	return user, true
+}
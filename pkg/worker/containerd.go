@@ -0,0 +1,511 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/rootfs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/typeurl"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+const (
+	// ContainerdNamespace is the containerd namespace kubernetes containers live in
+	ContainerdNamespace = "k8s.io"
+
+	labelUncompressed = "containerd.io/uncompressed"
+	labelGCRefContent = "containerd.io/gc.ref.content"
+)
+
+// ContainerdClient is a subset of containerd Client, to make the worker interface simpler
+type ContainerdClient interface {
+	LoadContainer(ctx context.Context, id string) (containerd.Container, error)
+	ContainerService() containers.Store
+	ImageService() images.Store
+	ContentStore() content.Store
+	SnapshotService(snapshotterName string) snapshots.Snapshotter
+	DiffService() containerd.DiffService
+	WithLease(ctx context.Context) (context.Context, func(context.Context) error, error)
+	Push(ctx context.Context, ref string, desc ocispec.Descriptor, opts ...containerd.RemoteOpt) error
+}
+
+type containerdRuntime struct {
+	client    ContainerdClient
+	namespace string
+	// insecure are registries served over plain http
+	insecure map[string]bool
+}
+
+// NewContainerdRuntime returns a runtime taking snapshots through containerd,
+// containers and images are looked up in the given containerd namespace,
+// and insecure registries are pushed over plain http instead of https
+func NewContainerdRuntime(cli ContainerdClient, namespace string, insecure ...string) Runtime {
+	r := &containerdRuntime{client: cli, namespace: namespace, insecure: make(map[string]bool, len(insecure))}
+	for _, reg := range insecure {
+		r.insecure[reg] = true
+	}
+	return r
+}
+
+// manifest is an image manifest carrying its media type, which is required by docker schema2 manifests
+type manifest struct {
+	MediaType string `json:"mediaType,omitempty"`
+	ocispec.Manifest
+}
+
+// Commit diffs the container's rw snapshot against its parent as a new layer,
+// and creates an image with the layer stacked on top of the source image
+func (r *containerdRuntime) Commit(ctx context.Context, ctr string, ref reference.Named, opt *SnapshotOptions) (*Image, error) {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+	ctx, done, e := r.client.WithLease(ctx)
+	if e != nil {
+		return nil, fmt.Errorf("create lease: %w", e)
+	}
+	defer done(namespaces.WithNamespace(context.Background(), r.namespace))
+
+	info, e := r.client.ContainerService().Get(ctx, ctr)
+	if e != nil {
+		return nil, fmt.Errorf("get container %s: %w", ctr, e)
+	}
+	base, e := r.client.ImageService().Get(ctx, info.Image)
+	if e != nil {
+		return nil, fmt.Errorf("get source image %s: %w", info.Image, e)
+	}
+
+	cs := r.client.ContentStore()
+	mfst, e := images.Manifest(ctx, cs, base.Target, platforms.Default())
+	if e != nil {
+		return nil, fmt.Errorf("read manifest of source image %s: %w", info.Image, e)
+	}
+	raw, e := content.ReadBlob(ctx, cs, mfst.Config)
+	if e != nil {
+		return nil, fmt.Errorf("read config of source image %s: %w", info.Image, e)
+	}
+	var img ocispec.Image
+	if e := json.Unmarshal(raw, &img); e != nil {
+		return nil, fmt.Errorf("unmarshal config of source image %s: %w", info.Image, e)
+	}
+
+	var spec *specs.Spec
+	if info.Spec != nil {
+		v, e := typeurl.UnmarshalAny(info.Spec)
+		if e != nil {
+			return nil, fmt.Errorf("unmarshal runtime spec of container %s: %w", ctr, e)
+		}
+		spec, _ = v.(*specs.Spec)
+	}
+	changes, e := parseChanges(opt.Changes)
+	if e != nil {
+		return nil, e
+	}
+	img.Config, e = mergeOCIConfig(spec, img.Config, changes)
+	if e != nil {
+		return nil, fmt.Errorf("apply commit changes: %w", e)
+	}
+	log.Info("merged snapshot config", "from container", img.Config.Labels[LabelConfigFromContainer], "from image", img.Config.Labels[LabelConfigFromImage])
+
+	// keep the snapshot in the same media type family as its source image
+	manifestType, layerType := ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageLayerGzip
+	if mfst.Config.MediaType == images.MediaTypeDockerSchema2Config {
+		manifestType, layerType = images.MediaTypeDockerSchema2Manifest, images.MediaTypeDockerSchema2LayerGzip
+	}
+
+	sn := r.client.SnapshotService(info.Snapshotter)
+	usage, e := sn.Usage(ctx, info.SnapshotKey)
+	if e != nil {
+		return nil, fmt.Errorf("get usage of container snapshot %s: %w", info.SnapshotKey, e)
+	}
+	layer, e := rootfs.CreateDiff(ctx, info.SnapshotKey, sn, r.client.DiffService(),
+		diff.WithMediaType(layerType),
+		diff.WithReference("snapshot-layer-"+ctr),
+	)
+	if e != nil {
+		return nil, fmt.Errorf("diff container snapshot %s: %w", info.SnapshotKey, e)
+	}
+	layerInfo, e := cs.Info(ctx, layer.Digest)
+	if e != nil {
+		return nil, fmt.Errorf("get info of layer %s: %w", layer.Digest, e)
+	}
+	diffID, e := digest.Parse(layerInfo.Labels[labelUncompressed])
+	if e != nil {
+		return nil, fmt.Errorf("get diff id of layer %s: %w", layer.Digest, e)
+	}
+
+	now := time.Now().UTC()
+	img.Created = &now
+	img.Author = opt.Author
+	img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, diffID)
+	img.History = append(img.History, ocispec.History{
+		Created:   &now,
+		CreatedBy: "container snapshot of " + ctr,
+		Author:    opt.Author,
+		Comment:   opt.Comment,
+	})
+	configDesc, e := writeJSONBlob(ctx, cs, mfst.Config.MediaType, &img, nil)
+	if e != nil {
+		return nil, fmt.Errorf("write image config: %w", e)
+	}
+
+	mfst.Config = configDesc
+	mfst.Layers = append(mfst.Layers, layer)
+	if e := r.writeImage(ctx, ref, manifestType, mfst); e != nil {
+		return nil, e
+	}
+
+	return &Image{
+		ID:           configDesc.Digest.String(),
+		Size:         usage.Size,
+		Layers:       len(mfst.Layers),
+		Source:       info.Image,
+		SourceDigest: base.Target.Digest.String(),
+	}, nil
+}
+
+// Measure measures the container rw snapshot by its snapshotter
+func (r *containerdRuntime) Measure(ctx context.Context, ctr string) (int64, error) {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+	info, e := r.client.ContainerService().Get(ctx, ctr)
+	if e != nil {
+		return 0, fmt.Errorf("get container %s: %w", ctr, e)
+	}
+	usage, e := r.client.SnapshotService(info.Snapshotter).Usage(ctx, info.SnapshotKey)
+	if e != nil {
+		return 0, fmt.Errorf("get usage of container snapshot %s: %w", info.SnapshotKey, e)
+	}
+	return usage.Size, nil
+}
+
+// Rewrite rewrites layers of the image in the content store, and points the image to the rewritten one.
+// the image before rewritten is garbage collected by containerd, as no image refers to it
+func (r *containerdRuntime) Rewrite(ctx context.Context, ref reference.Named, img *Image, rw *layerRewrite) (*Image, error) {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+	ctx, done, e := r.client.WithLease(ctx)
+	if e != nil {
+		return nil, fmt.Errorf("create lease: %w", e)
+	}
+	defer done(namespaces.WithNamespace(context.Background(), r.namespace))
+
+	name := reference.TagNameOnly(ref).String()
+	committed, e := r.client.ImageService().Get(ctx, name)
+	if e != nil {
+		return nil, fmt.Errorf("get image %s: %w", name, e)
+	}
+	cs := r.client.ContentStore()
+	mfst, e := images.Manifest(ctx, cs, committed.Target, platforms.Default())
+	if e != nil {
+		return nil, fmt.Errorf("read manifest of image %s: %w", name, e)
+	}
+	raw, e := content.ReadBlob(ctx, cs, mfst.Config)
+	if e != nil {
+		return nil, fmt.Errorf("read config of image %s: %w", name, e)
+	}
+
+	if len(mfst.Layers) == 0 {
+		return nil, fmt.Errorf("no layer in image %s", name)
+	}
+
+	layers := make([]layerOpener, 0, len(mfst.Layers))
+	for _, l := range mfst.Layers {
+		l := l
+		layers = append(layers, func() (io.ReadCloser, error) { return openLayer(ctx, cs, l) })
+	}
+	layer, diffID, e := r.writeRewrittenLayer(ctx, name, committed.Target.MediaType, layers, rw)
+	if e != nil {
+		return nil, e
+	}
+
+	config, e := rw.config(raw, len(mfst.Layers), diffID)
+	if e != nil {
+		return nil, e
+	}
+	configDesc, e := writeJSONBlob(ctx, cs, mfst.Config.MediaType, json.RawMessage(config), nil)
+	if e != nil {
+		return nil, fmt.Errorf("write image config: %w", e)
+	}
+
+	mfst.Config = configDesc
+	mfst.Layers = mfst.Layers[:rw.kept(len(mfst.Layers))]
+	if layer != nil {
+		mfst.Layers = append(mfst.Layers, *layer)
+	}
+	if e := r.writeImage(ctx, ref, committed.Target.MediaType, mfst); e != nil {
+		return nil, e
+	}
+
+	rewritten := *img
+	rewritten.ID, rewritten.Layers = configDesc.Digest.String(), len(mfst.Layers)
+	return &rewritten, nil
+}
+
+// writeRewrittenLayer writes the layer rewritten from layers into the content store, compressed in the media type family of the manifest.
+// returns the descriptor and the diff id of the layer, or nil if no layer is rewritten
+func (r *containerdRuntime) writeRewrittenLayer(ctx context.Context, name, manifestType string, layers []layerOpener, rw *layerRewrite) (*ocispec.Descriptor, digest.Digest, error) {
+	if rw.write == nil {
+		return nil, "", nil
+	}
+
+	dir, e := ioutil.TempDir("", rw.name+"-")
+	if e != nil {
+		return nil, "", e
+	}
+	defer os.RemoveAll(dir)
+
+	layerPath := filepath.Join(dir, rw.name+".tar")
+	diffID, e := rw.writeLayer(layers, layerPath)
+	if e != nil {
+		return nil, "", e
+	}
+	layer, e := compressLayer(layerPath, layerPath+".gz")
+	if e != nil {
+		return nil, "", fmt.Errorf("compress %s layer: %w", rw.name, e)
+	}
+	if manifestType == ocispec.MediaTypeImageManifest {
+		layer.MediaType = ocispec.MediaTypeImageLayerGzip
+	}
+	rc, e := layer.Open()
+	if e != nil {
+		return nil, "", e
+	}
+	defer rc.Close()
+	e = content.WriteBlob(ctx, r.client.ContentStore(), rw.name+"-layer-"+name, rc, layer.Descriptor, content.WithLabels(map[string]string{labelUncompressed: diffID.String()}))
+	if e != nil {
+		return nil, "", fmt.Errorf("write %s layer: %w", rw.name, e)
+	}
+	return &layer.Descriptor, diffID, nil
+}
+
+// Diff returns the top layer of the committed image, which is the container read/write layer
+func (r *containerdRuntime) Diff(ctx context.Context, ref reference.Named) (io.ReadCloser, error) {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+	name := reference.TagNameOnly(ref).String()
+	img, e := r.client.ImageService().Get(ctx, name)
+	if e != nil {
+		return nil, fmt.Errorf("get image %s: %w", name, e)
+	}
+	cs := r.client.ContentStore()
+	mfst, e := images.Manifest(ctx, cs, img.Target, platforms.Default())
+	if e != nil {
+		return nil, fmt.Errorf("read manifest of image %s: %w", name, e)
+	}
+	if len(mfst.Layers) == 0 {
+		return nil, fmt.Errorf("no layer in image %s", name)
+	}
+	return openLayer(ctx, cs, mfst.Layers[len(mfst.Layers)-1])
+}
+
+// writeImage writes the manifest, and creates or updates the image named ref pointing to it
+func (r *containerdRuntime) writeImage(ctx context.Context, ref reference.Named, manifestType string, mfst ocispec.Manifest) error {
+	gcRefs := map[string]string{labelGCRefContent + ".config": mfst.Config.Digest.String()}
+	for i, l := range mfst.Layers {
+		gcRefs[labelGCRefContent+".l."+strconv.Itoa(i)] = l.Digest.String()
+	}
+	target, e := writeJSONBlob(ctx, r.client.ContentStore(), manifestType, &manifest{MediaType: manifestType, Manifest: mfst}, gcRefs)
+	if e != nil {
+		return fmt.Errorf("write image manifest: %w", e)
+	}
+
+	name := reference.TagNameOnly(ref).String()
+	is := r.client.ImageService()
+	snapshot := images.Image{Name: name, Target: target}
+	if _, e = is.Update(ctx, snapshot, "target"); errdefs.IsNotFound(e) {
+		_, e = is.Create(ctx, snapshot)
+	}
+	if e != nil {
+		return fmt.Errorf("create image %s: %w", name, e)
+	}
+
+	return nil
+}
+
+// openLayer returns a reader of the uncompressed layer in the content store
+func openLayer(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ra, e := cs.ReaderAt(ctx, desc)
+	if e != nil {
+		return nil, e
+	}
+	r, e := compression.DecompressStream(content.NewReader(ra))
+	if e != nil {
+		ra.Close()
+		return nil, e
+	}
+	return &layerReader{ReadCloser: r, ra: ra}, nil
+}
+
+// layerReader closes the content reader with the decompressor
+type layerReader struct {
+	io.ReadCloser
+	ra content.ReaderAt
+}
+
+func (r *layerReader) Close() error {
+	r.ReadCloser.Close()
+	return r.ra.Close()
+}
+
+func (r *containerdRuntime) Pause(ctx context.Context, ctr string) error {
+	task, e := r.task(ctx, ctr)
+	if e != nil {
+		return e
+	}
+	return task.Pause(namespaces.WithNamespace(ctx, r.namespace))
+}
+
+func (r *containerdRuntime) Unpause(ctx context.Context, ctr string) error {
+	task, e := r.task(ctx, ctr)
+	if e != nil {
+		return e
+	}
+	return task.Resume(namespaces.WithNamespace(ctx, r.namespace))
+}
+
+func (r *containerdRuntime) task(ctx context.Context, ctr string) (containerd.Task, error) {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+	c, e := r.client.LoadContainer(ctx, ctr)
+	if e != nil {
+		return nil, fmt.Errorf("load container %s: %w", ctr, e)
+	}
+	task, e := c.Task(ctx, nil)
+	if e != nil {
+		return nil, fmt.Errorf("get task of container %s: %w", ctr, e)
+	}
+
+	return task, nil
+}
+
+// Tag creates an image named target pointing to the same manifest as source
+func (r *containerdRuntime) Tag(ctx context.Context, source, target reference.Named) error {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+
+	is := r.client.ImageService()
+	name := reference.TagNameOnly(source).String()
+	img, e := is.Get(ctx, name)
+	if e != nil {
+		return fmt.Errorf("get image %s: %w", name, e)
+	}
+
+	tagged := images.Image{Name: reference.TagNameOnly(target).String(), Target: img.Target}
+	if _, e = is.Update(ctx, tagged, "target"); errdefs.IsNotFound(e) {
+		_, e = is.Create(ctx, tagged)
+	}
+	if e != nil {
+		return fmt.Errorf("create image %s: %w", tagged.Name, e)
+	}
+
+	return nil
+}
+
+// Remove deletes all names of the image, containerd has no image ids,
+// and its content is garbage collected once no image refers to it
+func (r *containerdRuntime) Remove(ctx context.Context, img *Image, refs []reference.Named) error {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+
+	is := r.client.ImageService()
+	for i, ref := range refs {
+		name := reference.TagNameOnly(ref).String()
+		var opts []images.DeleteOpt
+		// wait for the garbage collection after the last name is deleted
+		if i == len(refs)-1 {
+			opts = append(opts, images.SynchronousDelete())
+		}
+		if e := is.Delete(ctx, name, opts...); e != nil && !errdefs.IsNotFound(e) {
+			return fmt.Errorf("delete image %s: %w", name, e)
+		}
+	}
+
+	return nil
+}
+
+// Export writes the image with the containerd exporter, which writes an OCI image layout with the docker archive manifest.
+// the image is named in the docker archive manifest only for the Docker format
+func (r *containerdRuntime) Export(ctx context.Context, ref reference.Named, format string, w io.Writer) (string, error) {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+
+	is := r.client.ImageService()
+	name := reference.TagNameOnly(ref).String()
+	img, e := is.Get(ctx, name)
+	if e != nil {
+		return "", fmt.Errorf("get image %s: %w", name, e)
+	}
+
+	opts := []archive.ExportOpt{archive.WithImage(is, name)}
+	switch format {
+	case constants.ExportOCI:
+		opts = append(opts, archive.WithSkipDockerManifest())
+	case constants.ExportDocker:
+	default:
+		return "", fmt.Errorf("unknown export format %s", format)
+	}
+	if e := archive.Export(ctx, r.client.ContentStore(), w, opts...); e != nil {
+		return "", e
+	}
+
+	return img.Target.Digest.String(), nil
+}
+
+func (r *containerdRuntime) Push(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (string, error) {
+	ctx = namespaces.WithNamespace(ctx, r.namespace)
+
+	name := reference.TagNameOnly(ref).String()
+	img, e := r.client.ImageService().Get(ctx, name)
+	if e != nil {
+		return "", fmt.Errorf("get image %s: %w", name, e)
+	}
+
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Credentials: func(string) (string, string, error) {
+			return registry.Credentials(auth)
+		},
+		PlainHTTP: r.insecure[reference.Domain(ref)],
+	})
+
+	if e := r.client.Push(ctx, name, img.Target, containerd.WithResolver(resolver)); e != nil {
+		return "", classifyPushError(e)
+	}
+
+	return img.Target.Digest.String(), nil
+}
+
+func writeJSONBlob(ctx context.Context, cs content.Store, mediaType string, v interface{}, labels map[string]string) (ocispec.Descriptor, error) {
+	buf, e := json.Marshal(v)
+	if e != nil {
+		return ocispec.Descriptor{}, e
+	}
+
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(buf),
+		Size:      int64(len(buf)),
+	}
+	e = content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(buf), desc, content.WithLabels(labels))
+	if e != nil {
+		return ocispec.Descriptor{}, e
+	}
+
+	return desc, nil
+}
@@ -0,0 +1,659 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/typeurl"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("containerd runtime", func() {
+	var (
+		ctx     = context.Background()
+		root    string
+		client  *mockContainerdClient
+		worker  Worker
+		options = SnapshotOptions{
+			Container: "container-id",
+			Image:     "image-name",
+			Author:    "someone",
+		}
+	)
+
+	BeforeEach(func() {
+		var e error
+		root, e = ioutil.TempDir("", "containerd-content-")
+		Expect(e).Should(Succeed())
+		client, e = newMockContainerdClient(root)
+		Expect(e).Should(Succeed())
+		worker = Worker{
+			runtime: NewContainerdRuntime(client, ContainerdNamespace),
+			auths:   make(mergedDockerAuth),
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	Context("when containerd steps all good", func() {
+		It("should succeed", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+		})
+
+		It("should measure the container snapshot", func() {
+			size, e := measureSize(ctx, worker.runtime, "container-id")
+			Expect(e).Should(Succeed())
+			Expect(size).Should(Equal(int64(4096)))
+		})
+
+		It("should stack the container layer on top of the source image", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			Expect(img.Target.MediaType).Should(Equal(images.MediaTypeDockerSchema2Manifest))
+
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			Expect(mfst.MediaType).Should(Equal(images.MediaTypeDockerSchema2Manifest))
+			Expect(mfst.Layers).Should(HaveLen(2))
+			Expect(mfst.Layers[1].MediaType).Should(Equal(images.MediaTypeDockerSchema2LayerGzip))
+
+			var config ocispec.Image
+			Expect(readJSONBlob(ctx, client.content, mfst.Config, &config)).Should(Succeed())
+			Expect(config.Author).Should(Equal("someone"))
+			Expect(config.RootFS.DiffIDs).Should(Equal([]digest.Digest{"sha256:base-diff-id", client.diffID}))
+			Expect(config.History).Should(HaveLen(2))
+		})
+
+		It("should carry over the container config", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			var config ocispec.Image
+			Expect(readJSONBlob(ctx, client.content, mfst.Config, &config)).Should(Succeed())
+
+			Expect(config.Config.Entrypoint).Should(Equal([]string{"/entrypoint.sh"}))
+			Expect(config.Config.Cmd).Should(Equal([]string{"serve", "--debug"}))
+			Expect(config.Config.Env).Should(Equal([]string{"PATH=/bin", "DEBUG=1"}))
+			Expect(config.Config.WorkingDir).Should(Equal("/"))
+			Expect(config.Config.Labels).Should(HaveKeyWithValue(LabelConfigFromContainer, "Cmd,Env"))
+			Expect(config.Config.Labels).Should(HaveKeyWithValue(LabelConfigFromImage, "Entrypoint,WorkingDir,ExposedPorts,User"))
+		})
+
+		It("should carry over the user running the container", func() {
+			ctr := client.containers.containers["container-id"]
+			spec, e := typeurl.MarshalAny(&specs.Spec{Process: &specs.Process{
+				Args: []string{"/entrypoint.sh", "serve"},
+				Env:  []string{"PATH=/bin"},
+				Cwd:  "/",
+				User: specs.User{UID: 1000, GID: 1000},
+			}})
+			Expect(e).Should(Succeed())
+			ctr.Spec = spec
+			client.containers.containers["container-id"] = ctr
+
+			_, e = worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			var config ocispec.Image
+			Expect(readJSONBlob(ctx, client.content, mfst.Config, &config)).Should(Succeed())
+
+			Expect(config.Config.User).Should(Equal("1000:1000"))
+			Expect(config.Config.Labels).Should(HaveKeyWithValue(LabelConfigFromContainer, "User"))
+		})
+
+		It("should keep the user of the base image if the container runs as it", func() {
+			for _, c := range []struct {
+				user specs.User
+				base string
+			}{
+				{specs.User{}, ""},
+				{specs.User{UID: 1000, GID: 1000}, "1000"},
+				{specs.User{UID: 1000, GID: 100}, "1000:100"},
+				{specs.User{UID: 1000, GID: 1000}, "app"},
+				{specs.User{Username: "app"}, "app"},
+			} {
+				user, fromContainer := ociUser(c.user, c.base)
+				Expect(fromContainer).Should(BeFalse())
+				Expect(user).Should(Equal(c.base))
+			}
+			user, fromContainer := ociUser(specs.User{UID: 1000, GID: 1000}, "999")
+			Expect(fromContainer).Should(BeTrue())
+			Expect(user).Should(Equal("1000:1000"))
+		})
+
+		It("should push the snapshot image", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(client.pushed).Should(Equal([]string{"docker.io/library/image-name:latest"}))
+		})
+
+		It("should report the pushed image", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			Expect(result.ImageID).Should(Equal(mfst.Config.Digest.String()))
+			Expect(result.Digest).Should(Equal(img.Target.Digest.String()))
+			Expect(result.Size).Should(Equal(int64(4096)))
+		})
+	})
+
+	Context("with additional tags", func() {
+		It("should tag the snapshot image with the same manifest", func() {
+			opts := options
+			opts.Tags = []string{"v1"}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			tagged, e := client.images.Get(ctx, "docker.io/library/image-name:v1")
+			Expect(e).Should(Succeed())
+			Expect(tagged.Target).Should(Equal(img.Target))
+			Expect(client.pushed).Should(Equal([]string{"docker.io/library/image-name:latest", "docker.io/library/image-name:v1"}))
+		})
+	})
+
+	Context("with the OnSuccess cleanup policy", func() {
+		It("should delete all names of the snapshot image", func() {
+			opts := options
+			opts.Tags = []string{"v1"}
+			opts.Cleanup = constants.CleanupOnSuccess
+			result, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(result.FreedBytes).Should(Equal(int64(4096)))
+			Expect(client.images.images).Should(HaveLen(1))
+			Expect(client.images.images).Should(HaveKey("docker.io/library/source-image:latest"))
+		})
+	})
+
+	Context("when exporting to a tarball", func() {
+		It("should write the OCI image layout with the containerd exporter", func() {
+			opts := options
+			opts.Export = &ExportOptions{Format: constants.ExportOCI, Path: filepath.Join(root, "export", "image.tar")}
+			result, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.pushed).Should(BeEmpty())
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			Expect(result.Digest).Should(Equal(img.Target.Digest.String()))
+			files := readTarball(opts.Export.Path)
+			Expect(files).Should(HaveKey("index.json"))
+			Expect(files).ShouldNot(HaveKeyWithValue("manifest.json", ContainSubstring("image-name:latest")))
+			Expect(files).Should(HaveKey("blobs/sha256/" + img.Target.Digest.Hex()))
+		})
+
+		It("should write the docker archive manifest for the Docker format", func() {
+			opts := options
+			opts.Export = &ExportOptions{Format: constants.ExportDocker, Path: filepath.Join(root, "export", "image.tar")}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(readTarball(opts.Export.Path)).Should(HaveKeyWithValue("manifest.json", ContainSubstring("image-name:latest")))
+		})
+	})
+
+	Context("when commit changes are given", func() {
+		It("should apply changes to the image config", func() {
+			opts := options
+			opts.Changes = []string{
+				"cmd serve --verbose",
+				`ENV DEBUG=0 NAME="my app"`,
+				"EXPOSE 8080",
+				"LABEL maintainer someone@example.com",
+				"WORKDIR /app",
+			}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			var config ocispec.Image
+			Expect(readJSONBlob(ctx, client.content, mfst.Config, &config)).Should(Succeed())
+
+			Expect(config.Config.Cmd).Should(Equal([]string{"/bin/sh", "-c", "serve --verbose"}))
+			Expect(config.Config.Env).Should(Equal([]string{"PATH=/bin", "DEBUG=0", "NAME=my app"}))
+			Expect(config.Config.ExposedPorts).Should(HaveKey("8080/tcp"))
+			Expect(config.Config.WorkingDir).Should(Equal("/app"))
+			Expect(config.Config.Labels).Should(HaveKeyWithValue("maintainer", "someone@example.com"))
+			Expect(config.Config.Labels).Should(HaveKeyWithValue(LabelConfigFromChanges, "Cmd,Env,ExposedPorts,WorkingDir"))
+		})
+	})
+
+	Context("with the Pod pause policy", func() {
+		It("should resume all paused tasks", func() {
+			client.tasks["sidecar-id"] = containerd.Running
+			opts := options
+			opts.Pause = constants.PausePod
+			opts.PodContainers = []string{"container-id", "sidecar-id"}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.tasks).Should(Equal(map[string]containerd.ProcessStatus{
+				"container-id": containerd.Running,
+				"sidecar-id":   containerd.Running,
+			}))
+		})
+
+		It("should fail if a task can not be found", func() {
+			opts := options
+			opts.Pause = constants.PausePod
+			opts.PodContainers = []string{"container-id", "unknown-id"}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrCommit))
+			Expect(client.tasks["container-id"]).Should(Equal(containerd.Running))
+		})
+	})
+
+	Context("when source container is not found", func() {
+		It("should fail", func() {
+			opts := options
+			opts.Container = "unknown-container"
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrCommit))
+		})
+	})
+
+	Context("when push fails", func() {
+		BeforeEach(func() {
+			client.badPush = true
+		})
+
+		It("should fail", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPush))
+		})
+	})
+
+	Context("when the registry is served over plain http", func() {
+		// containerd always accesses loopback registries over plain http,
+		// so the test registry is dialed by another name through the default transport used by the resolver
+		const host = "registry.example.com:5000"
+
+		var (
+			registry  *httptest.Server
+			transport http.RoundTripper
+			requested []string
+			opts      SnapshotOptions
+		)
+
+		BeforeEach(func() {
+			requested = nil
+			registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = append(requested, r.Method+" "+r.URL.Path)
+				w.Header().Set("Content-Type", images.MediaTypeDockerSchema2Manifest)
+				w.Header().Set("Docker-Content-Digest", digest.FromString("manifest").String())
+				w.Header().Set("Content-Length", "8")
+			}))
+			transport = http.DefaultTransport
+			http.DefaultTransport = &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, registry.Listener.Addr().String())
+				},
+			}
+			client.resolve = true
+			opts = options
+			opts.Image = host + "/snapshots/app:v1"
+		})
+
+		AfterEach(func() {
+			http.DefaultTransport = transport
+			registry.Close()
+		})
+
+		It("should push insecure registries over plain http", func() {
+			worker.runtime = NewContainerdRuntime(client, ContainerdNamespace, host)
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(requested).Should(ContainElement("HEAD /v2/snapshots/app/manifests/v1"))
+		})
+
+		It("should push other registries over https", func() {
+			result, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Destinations[0].Error).Should(Equal(constants.ErrorPushTLS))
+			Expect(requested).Should(BeEmpty())
+		})
+	})
+
+	It("should not push images not committed yet", func() {
+		ref, e := reference.ParseNormalizedNamed("image-name")
+		Expect(e).Should(Succeed())
+		_, e = NewContainerdRuntime(client, ContainerdNamespace).Push(ctx, ref, nil)
+		Expect(e).ShouldNot(Succeed())
+	})
+})
+
+type mockContainerdClient struct {
+	// tasks are task status of containers, running or paused
+	tasks      map[string]containerd.ProcessStatus
+	containers *mockContainerStore
+	images     *mockImageStore
+	content    content.Store
+	diffID     digest.Digest
+	badPush    bool
+	// resolve resolves pushed images with the resolver given, to tell how the registry is accessed
+	resolve bool
+	pushed  []string
+}
+
+func newMockContainerdClient(root string) (*mockContainerdClient, error) {
+	cs, e := local.NewLabeledStore(root, &mockLabelStore{labels: make(map[digest.Digest]map[string]string)})
+	if e != nil {
+		return nil, e
+	}
+	spec, e := typeurl.MarshalAny(&specs.Spec{
+		Process: &specs.Process{
+			Args: []string{"/entrypoint.sh", "serve", "--debug"},
+			Env:  []string{"PATH=/bin", "DEBUG=1"},
+			Cwd:  "/",
+		},
+	})
+	if e != nil {
+		return nil, e
+	}
+	c := &mockContainerdClient{
+		containers: &mockContainerStore{containers: map[string]containers.Container{
+			"container-id": {
+				ID:          "container-id",
+				Image:       "docker.io/library/source-image:latest",
+				Snapshotter: "overlayfs",
+				SnapshotKey: "container-id",
+				Spec:        spec,
+			},
+		}},
+		images:  &mockImageStore{images: make(map[string]images.Image)},
+		content: cs,
+		tasks:   map[string]containerd.ProcessStatus{"container-id": containerd.Running},
+	}
+
+	ctx := context.Background()
+	config, e := writeJSONBlob(ctx, cs, images.MediaTypeDockerSchema2Config, &ocispec.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		Config: ocispec.ImageConfig{
+			Entrypoint: []string{"/entrypoint.sh"},
+			Cmd:        []string{"serve"},
+			Env:        []string{"PATH=/bin"},
+			WorkingDir: "/",
+		},
+		RootFS:  ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{"sha256:base-diff-id"}},
+		History: []ocispec.History{{CreatedBy: "base"}},
+	}, nil)
+	if e != nil {
+		return nil, e
+	}
+	base := layerTarball(map[string]string{"etc/": "", "etc/os-release": "base", "tmp/": "", "tmp/cache": "cached"})
+	layer := ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema2LayerGzip, Digest: digest.FromBytes(base), Size: int64(len(base))}
+	if e := content.WriteBlob(ctx, cs, "base-layer", bytes.NewReader(base), layer); e != nil {
+		return nil, e
+	}
+	target, e := writeJSONBlob(ctx, cs, images.MediaTypeDockerSchema2Manifest, &manifest{
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Manifest: ocispec.Manifest{
+			Config: config,
+			Layers: []ocispec.Descriptor{layer},
+		},
+	}, nil)
+	if e != nil {
+		return nil, e
+	}
+	c.images.images["docker.io/library/source-image:latest"] = images.Image{Name: "docker.io/library/source-image:latest", Target: target}
+
+	return c, nil
+}
+
+func (c *mockContainerdClient) LoadContainer(ctx context.Context, id string) (containerd.Container, error) {
+	if _, ok := c.tasks[id]; !ok {
+		return nil, errdefs.ErrNotFound
+	}
+	return &mockContainer{id: id, client: c}, nil
+}
+
+func (c *mockContainerdClient) ContainerService() containers.Store {
+	return c.containers
+}
+
+func (c *mockContainerdClient) ImageService() images.Store {
+	return c.images
+}
+
+func (c *mockContainerdClient) ContentStore() content.Store {
+	return c.content
+}
+
+func (c *mockContainerdClient) SnapshotService(snapshotterName string) snapshots.Snapshotter {
+	return &mockSnapshotter{}
+}
+
+func (c *mockContainerdClient) DiffService() containerd.DiffService {
+	return &mockDiffService{client: c}
+}
+
+func (c *mockContainerdClient) WithLease(ctx context.Context) (context.Context, func(context.Context) error, error) {
+	return ctx, func(context.Context) error { return nil }, nil
+}
+
+func (c *mockContainerdClient) Push(ctx context.Context, ref string, desc ocispec.Descriptor, opts ...containerd.RemoteOpt) error {
+	if c.badPush {
+		return errors.New("can not push image")
+	}
+	if c.resolve {
+		var rc containerd.RemoteContext
+		for _, opt := range opts {
+			if e := opt(nil, &rc); e != nil {
+				return e
+			}
+		}
+		if _, _, e := rc.Resolver.Resolve(ctx, ref); e != nil {
+			return e
+		}
+	}
+
+	c.pushed = append(c.pushed, ref)
+	return nil
+}
+
+type mockContainer struct {
+	containerd.Container
+	id     string
+	client *mockContainerdClient
+}
+
+func (c *mockContainer) Task(ctx context.Context, attach cio.Attach) (containerd.Task, error) {
+	return &mockTask{id: c.id, client: c.client}, nil
+}
+
+type mockTask struct {
+	containerd.Task
+	id     string
+	client *mockContainerdClient
+}
+
+func (t *mockTask) Pause(ctx context.Context) error {
+	t.client.tasks[t.id] = containerd.Paused
+	return nil
+}
+
+func (t *mockTask) Resume(ctx context.Context) error {
+	t.client.tasks[t.id] = containerd.Running
+	return nil
+}
+
+type mockContainerStore struct {
+	containers.Store
+	containers map[string]containers.Container
+}
+
+func (s *mockContainerStore) Get(ctx context.Context, id string) (containers.Container, error) {
+	c, ok := s.containers[id]
+	if !ok {
+		return containers.Container{}, errdefs.ErrNotFound
+	}
+	return c, nil
+}
+
+type mockImageStore struct {
+	images.Store
+	images map[string]images.Image
+}
+
+func (s *mockImageStore) Get(ctx context.Context, name string) (images.Image, error) {
+	img, ok := s.images[name]
+	if !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	return img, nil
+}
+
+func (s *mockImageStore) Create(ctx context.Context, img images.Image) (images.Image, error) {
+	if _, ok := s.images[img.Name]; ok {
+		return images.Image{}, errdefs.ErrAlreadyExists
+	}
+	s.images[img.Name] = img
+	return img, nil
+}
+
+func (s *mockImageStore) Delete(ctx context.Context, name string, opts ...images.DeleteOpt) error {
+	if _, ok := s.images[name]; !ok {
+		return errdefs.ErrNotFound
+	}
+	delete(s.images, name)
+	return nil
+}
+
+func (s *mockImageStore) Update(ctx context.Context, img images.Image, fieldpaths ...string) (images.Image, error) {
+	if _, ok := s.images[img.Name]; !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	s.images[img.Name] = img
+	return img, nil
+}
+
+type mockSnapshotter struct {
+	snapshots.Snapshotter
+}
+
+func (s *mockSnapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	return snapshots.Info{Kind: snapshots.KindActive, Name: key, Parent: "parent"}, nil
+}
+
+func (s *mockSnapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
+	return snapshots.Usage{Inodes: 2, Size: 4096}, nil
+}
+
+func (s *mockSnapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, error) {
+	return nil, nil
+}
+
+func (s *mockSnapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	return nil, nil
+}
+
+func (s *mockSnapshotter) Remove(ctx context.Context, key string) error {
+	return nil
+}
+
+type mockDiffService struct {
+	containerd.DiffService
+	client *mockContainerdClient
+}
+
+func (d *mockDiffService) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (ocispec.Descriptor, error) {
+	var config diff.Config
+	for _, opt := range opts {
+		if e := opt(&config); e != nil {
+			return ocispec.Descriptor{}, e
+		}
+	}
+
+	layer := layerTarball(map[string]string{"app/": "", "app/data": "changed", "tmp/": "", "tmp/.wh.cache": ""})
+	d.client.diffID = digest.FromBytes(layer)
+	desc := ocispec.Descriptor{MediaType: config.MediaType, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+	e := content.WriteBlob(ctx, d.client.content, config.Reference, bytes.NewReader(layer), desc,
+		content.WithLabels(map[string]string{labelUncompressed: d.client.diffID.String()}))
+
+	return desc, e
+}
+
+type mockLabelStore struct {
+	labels map[digest.Digest]map[string]string
+}
+
+func (s *mockLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	return s.labels[dgst], nil
+}
+
+func (s *mockLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s.labels[dgst] = labels
+	return nil
+}
+
+func (s *mockLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	labels := s.labels[dgst]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[dgst] = labels
+	return labels, nil
+}
+
+func readJSONBlob(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, v interface{}) error {
+	buf, e := content.ReadBlob(ctx, cs, desc)
+	if e != nil {
+		return e
+	}
+	return json.Unmarshal(buf, v)
+}
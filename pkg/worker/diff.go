@@ -0,0 +1,299 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+// MediaTypeDiffConfig is the config media type of diff artifacts, telling them apart from runnable images
+const MediaTypeDiffConfig = "application/vnd.supremind.container-snapshot.diff.config.v1+json"
+
+// annotations of diff artifacts, telling the image the read/write layer is applied on
+const (
+	AnnotationBaseName   = "org.opencontainers.image.base.name"
+	AnnotationBaseDigest = "org.opencontainers.image.base.digest"
+)
+
+// DiffReader is implemented by runtimes able to read layers of committed images
+type DiffReader interface {
+	// Diff returns a reader of the uncompressed read/write layer of the committed image ref, which is its top layer
+	Diff(ctx context.Context, ref reference.Named) (io.ReadCloser, error)
+}
+
+// savedDiff returns a reader of the top layer of the image saved by the runtime as a docker archive,
+// the saved image is removed when the reader is closed
+func savedDiff(ctx context.Context, saver ImageSaver, image string) (io.ReadCloser, error) {
+	dir, e := ioutil.TempDir("", "diff-")
+	if e != nil {
+		return nil, e
+	}
+	f, e := openSavedDiff(ctx, saver, image, dir)
+	if e != nil {
+		os.RemoveAll(dir)
+		return nil, e
+	}
+	return &tempFile{File: f, dir: dir}, nil
+}
+
+func openSavedDiff(ctx context.Context, saver ImageSaver, image, dir string) (*os.File, error) {
+	saved, e := saver.Save(ctx, image)
+	if e != nil {
+		return nil, fmt.Errorf("save image: %w", e)
+	}
+	a, e := extractDockerArchive(saved, dir)
+	saved.Close()
+	if e != nil {
+		return nil, fmt.Errorf("extract image: %w", e)
+	}
+	if len(a.manifest.Layers) == 0 {
+		return nil, errors.New("no layer in the committed image")
+	}
+	p, e := a.path(a.manifest.Layers[len(a.manifest.Layers)-1])
+	if e != nil {
+		return nil, e
+	}
+	return os.Open(p)
+}
+
+// tempFile is a file in a temporary directory, the directory is removed when the file is closed
+type tempFile struct {
+	*os.File
+	dir string
+}
+
+func (f *tempFile) Close() error {
+	e := f.File.Close()
+	os.RemoveAll(f.dir)
+	return e
+}
+
+// diffConfig is the config blob of diff artifacts
+type diffConfig struct {
+	Created    time.Time `json:"created"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	Container  string    `json:"container"`
+	Base       string    `json:"base,omitempty"`
+	BaseDigest string    `json:"baseDigest,omitempty"`
+	// DiffID is the digest of the uncompressed layer
+	DiffID digest.Digest `json:"diffID"`
+}
+
+// diffRuntime commits containers through the runtime, but pushes and exports only the read/write layer of the committed image,
+// as a single layer OCI artifact annotated with the source image. artifacts are pushed by the pusher, runtimes push images only
+type diffRuntime struct {
+	Runtime
+	reader DiffReader
+	pusher ImagePusher
+
+	container string
+	opt       *SnapshotOptions
+	committed *Image
+	// dir keeps the layer and the artifact, it is removed with the image
+	dir string
+	// layer is the uncompressed layer tarball in dir
+	layer    string
+	artifact *registry.Image
+}
+
+// NewDiffRuntime wraps a runtime able to read the read/write layer of committed images, only the layer is pushed by the pusher
+func NewDiffRuntime(rt Runtime, pusher ImagePusher) (Runtime, error) {
+	reader, ok := rt.(DiffReader)
+	if !ok {
+		return nil, errors.New("the container runtime can not read layers of committed images")
+	}
+
+	return &diffRuntime{Runtime: rt, reader: reader, pusher: pusher}, nil
+}
+
+func (r *diffRuntime) Commit(ctx context.Context, ctr string, ref reference.Named, opt *SnapshotOptions) (*Image, error) {
+	img, e := r.Runtime.Commit(ctx, ctr, ref, opt)
+	if e != nil {
+		return nil, e
+	}
+	r.container, r.opt, r.committed = ctr, opt, img
+	return img, nil
+}
+
+// Rewrite rewrites the committed image through the runtime, the read/write layer is read from the rewritten image instead
+func (r *diffRuntime) Rewrite(ctx context.Context, ref reference.Named, img *Image, rw *layerRewrite) (*Image, error) {
+	rewriter, ok := r.Runtime.(ImageRewriter)
+	if !ok {
+		return nil, fmt.Errorf("the container runtime can not %s images", rw.name)
+	}
+	rewritten, e := rewriter.Rewrite(ctx, ref, img, rw)
+	if e != nil {
+		return nil, e
+	}
+	r.committed = rewritten
+	return rewritten, nil
+}
+
+// Push pushes the diff artifact as ref, the artifact is built at the first push, and reused by following pushes and retries
+func (r *diffRuntime) Push(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (string, error) {
+	if r.artifact == nil {
+		if e := r.build(ctx, ref); e != nil {
+			return "", fmt.Errorf("build diff artifact: %w", e)
+		}
+	}
+
+	d, e := r.pusher.Push(ctx, ref, r.artifact, auth)
+	if e != nil {
+		return "", classifyPushError(e)
+	}
+	return d.String(), nil
+}
+
+// Export writes the diff artifact as an OCI image layout, or the layer tarball itself
+func (r *diffRuntime) Export(ctx context.Context, ref reference.Named, format string, w io.Writer) (string, error) {
+	if r.artifact == nil {
+		if e := r.build(ctx, ref); e != nil {
+			return "", fmt.Errorf("build diff artifact: %w", e)
+		}
+	}
+
+	switch format {
+	case constants.ExportOCI:
+		return writeOCILayout(w, r.artifact, ref)
+
+	case constants.ExportLayer:
+		f, e := os.Open(r.layer)
+		if e != nil {
+			return "", e
+		}
+		defer f.Close()
+		_, e = io.Copy(w, f)
+		return "", e
+
+	default:
+		return "", fmt.Errorf("diff artifacts can not be exported as %s", format)
+	}
+}
+
+func (r *diffRuntime) Remove(ctx context.Context, img *Image, refs []reference.Named) error {
+	if r.dir != "" {
+		if e := os.RemoveAll(r.dir); e != nil {
+			log.Error(e, "remove diff artifact", "dir", r.dir)
+		}
+	}
+	return r.Runtime.Remove(ctx, img, refs)
+}
+
+// build reads the read/write layer of the committed image, and makes the artifact of it
+func (r *diffRuntime) build(ctx context.Context, ref reference.Named) error {
+	if r.committed == nil {
+		return errors.New("no image committed")
+	}
+
+	if r.dir == "" {
+		dir, e := ioutil.TempDir("", "diff-")
+		if e != nil {
+			return e
+		}
+		r.dir = dir
+	}
+
+	layerPath := filepath.Join(r.dir, "diff.tar")
+	diffID, e := r.writeDiff(ctx, ref, layerPath)
+	if e != nil {
+		return fmt.Errorf("read container layer: %w", e)
+	}
+	layer, e := compressLayer(layerPath, filepath.Join(r.dir, "diff.tar.gz"))
+	if e != nil {
+		return fmt.Errorf("compress container layer: %w", e)
+	}
+	layer.MediaType = ocispec.MediaTypeImageLayerGzip
+
+	created := time.Now().UTC()
+	base := r.committed.Source
+	if named, e := reference.ParseNormalizedNamed(base); e == nil {
+		base = reference.TagNameOnly(named).String()
+	}
+	buf, e := json.Marshal(diffConfig{
+		Created:    created,
+		Author:     r.opt.Author,
+		Comment:    r.opt.Comment,
+		Container:  r.container,
+		Base:       base,
+		BaseDigest: r.committed.SourceDigest,
+		DiffID:     diffID,
+	})
+	if e != nil {
+		return e
+	}
+	configPath := filepath.Join(r.dir, "config.json")
+	if e := ioutil.WriteFile(configPath, buf, 0600); e != nil {
+		return e
+	}
+	config, e := fileBlob(configPath, MediaTypeDiffConfig)
+	if e != nil {
+		return e
+	}
+
+	annotations := map[string]string{ocispec.AnnotationCreated: created.Format(time.RFC3339)}
+	if base != "" {
+		annotations[AnnotationBaseName] = base
+	}
+	if r.committed.SourceDigest != "" {
+		annotations[AnnotationBaseDigest] = r.committed.SourceDigest
+	}
+
+	r.layer = layerPath
+	r.artifact = &registry.Image{
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Config:      *config,
+		Layers:      []registry.Blob{*layer},
+		Annotations: annotations,
+	}
+	log.Info("diff artifact built", "base", base, "base digest", r.committed.SourceDigest, "diff id", diffID, "size", layer.Size)
+	return nil
+}
+
+// writeDiff writes the uncompressed read/write layer read by the runtime to the path, returns the digest of the layer
+func (r *diffRuntime) writeDiff(ctx context.Context, ref reference.Named, path string) (digest.Digest, error) {
+	rc, e := r.reader.Diff(ctx, ref)
+	if e != nil {
+		return "", e
+	}
+	defer rc.Close()
+
+	f, e := os.Create(path)
+	if e != nil {
+		return "", e
+	}
+	defer f.Close()
+	w := &digestWriter{w: f, digester: digest.Canonical.Digester()}
+	if _, e := io.Copy(w, rc); e != nil {
+		return "", e
+	}
+	return w.digester.Digest(), f.Close()
+}
+
+// Diff returns the read/write layer of the committed image read by the runtime
+func (r *diffRuntime) Diff(ctx context.Context, ref reference.Named) (io.ReadCloser, error) {
+	return r.reader.Diff(ctx, ref)
+}
+
+// Changes lists paths changed in the container by the runtime
+func (r *diffRuntime) Changes(ctx context.Context, ctr string) (map[string]string, error) {
+	return listChanges(ctx, r.Runtime, ctr)
+}
+
+// Measure measures the container by the runtime
+func (r *diffRuntime) Measure(ctx context.Context, ctr string) (int64, error) {
+	return measureSize(ctx, r.Runtime, ctr)
+}
@@ -0,0 +1,197 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+var _ = Describe("diff snapshots", func() {
+	var (
+		ctx     = context.Background()
+		client  *mockDockerClient
+		pusher  *mockPusher
+		worker  Worker
+		options SnapshotOptions
+		// top is the container layer, same as the one diffed by the mock containerd
+		top []byte
+	)
+
+	BeforeEach(func() {
+		top = layerTarball(map[string]string{"app/": "", "app/data": "changed", "tmp/": "", "tmp/.wh.cache": ""})
+		client = &mockDockerClient{archive: dockerArchive(map[string]string{
+			"manifest.json":  `[{"Config":"abc.json","RepoTags":null,"Layers":["base/layer.tar","top/layer.tar"]}]`,
+			"abc.json":       `{"architecture":"amd64","rootfs":{"type":"layers"}}`,
+			"base/layer.tar": string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "base"})),
+			"top/layer.tar":  string(top),
+		}, nil)}
+		pusher = &mockPusher{}
+		rt, e := NewDiffRuntime(NewDockerRuntime(client), pusher)
+		Expect(e).Should(Succeed())
+		worker = Worker{runtime: rt}
+		options = SnapshotOptions{
+			Container: "container-id",
+			Image:     "reg.example.com/snapshots/image-name:v1",
+			Author:    "someone",
+			Tags:      []string{"latest"},
+		}
+	})
+
+	It("should push the read/write layer as a single layer artifact", func() {
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(client.pushed).Should(BeEmpty())
+		Expect(pusher.pushed).Should(Equal([]string{
+			"reg.example.com/snapshots/image-name:v1",
+			"reg.example.com/snapshots/image-name:latest",
+		}))
+		Expect(result.Digest).Should(Equal("sha256:mock-direct-digest"))
+		Expect(client.saves).Should(Equal(1), "the artifact is built once")
+
+		artifact := pusher.image
+		Expect(artifact.MediaType).Should(Equal(ocispec.MediaTypeImageManifest))
+		Expect(artifact.Config.MediaType).Should(Equal(MediaTypeDiffConfig))
+		Expect(artifact.Layers).Should(HaveLen(1))
+		Expect(artifact.Layers[0].MediaType).Should(Equal(ocispec.MediaTypeImageLayerGzip))
+		Expect(readLayer(artifact.Layers[0])).Should(Equal(top))
+	})
+
+	It("should annotate the artifact with the source image", func() {
+		_, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+
+		artifact := pusher.image
+		Expect(artifact.Annotations).Should(HaveKeyWithValue(AnnotationBaseName, "docker.io/library/source-image:latest"))
+		Expect(artifact.Annotations).Should(HaveKeyWithValue(AnnotationBaseDigest, "sha256:source-image"))
+		Expect(artifact.Annotations).Should(HaveKey(ocispec.AnnotationCreated))
+
+		m, e := artifact.Manifest()
+		Expect(e).Should(Succeed())
+		var mfst ocispec.Manifest
+		Expect(json.Unmarshal(m, &mfst)).Should(Succeed())
+		Expect(mfst.Annotations).Should(Equal(artifact.Annotations))
+
+		rc, e := artifact.Config.Open()
+		Expect(e).Should(Succeed())
+		defer rc.Close()
+		var config diffConfig
+		Expect(json.NewDecoder(rc).Decode(&config)).Should(Succeed())
+		Expect(config.Container).Should(Equal("container-id"))
+		Expect(config.Author).Should(Equal("someone"))
+		Expect(config.Base).Should(Equal("docker.io/library/source-image:latest"))
+		Expect(config.DiffID).Should(Equal(digest.FromBytes(top)))
+	})
+
+	Context("when exporting the artifact", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var e error
+			dir, e = ioutil.TempDir("", "diff-test-")
+			Expect(e).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("should write the layer tarball", func() {
+			options.Export = &ExportOptions{Format: constants.ExportLayer, Path: filepath.Join(dir, "diff.tar")}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(pusher.pushed).Should(BeEmpty())
+
+			buf, e := ioutil.ReadFile(options.Export.Path)
+			Expect(e).Should(Succeed())
+			Expect(buf).Should(Equal(top))
+			Expect(result.Export.Checksum).Should(Equal(digest.FromBytes(top).String()))
+		})
+
+		It("should write the artifact as an OCI image layout", func() {
+			options.Export = &ExportOptions{Format: constants.ExportOCI, Path: filepath.Join(dir, "diff.tar")}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			files := readTarball(options.Export.Path)
+			manifest := files["blobs/sha256/"+digest.Digest(result.Digest).Hex()]
+			var mfst ocispec.Manifest
+			Expect(json.Unmarshal(manifest, &mfst)).Should(Succeed())
+			Expect(mfst.Config.MediaType).Should(Equal(MediaTypeDiffConfig))
+			Expect(mfst.Layers).Should(HaveLen(1))
+			Expect(mfst.Annotations).Should(HaveKeyWithValue(AnnotationBaseDigest, "sha256:source-image"))
+		})
+
+		It("should not write the artifact as a docker archive", func() {
+			options.Export = &ExportOptions{Format: constants.ExportDocker, Path: filepath.Join(dir, "diff.tar")}
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrExport))
+		})
+	})
+
+	Context("with the containerd runtime", func() {
+		var root string
+
+		BeforeEach(func() {
+			var e error
+			root, e = ioutil.TempDir("", "containerd-content-")
+			Expect(e).Should(Succeed())
+			cli, e := newMockContainerdClient(root)
+			Expect(e).Should(Succeed())
+			rt, e := NewDiffRuntime(NewContainerdRuntime(cli, ContainerdNamespace), pusher)
+			Expect(e).Should(Succeed())
+			worker = Worker{runtime: rt, auths: make(mergedDockerAuth)}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(root)
+		})
+
+		It("should push the container layer diffed by containerd", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			artifact := pusher.image
+			Expect(artifact.Layers).Should(HaveLen(1))
+			Expect(readLayer(artifact.Layers[0])).Should(Equal(top))
+			Expect(artifact.Annotations).Should(HaveKeyWithValue(AnnotationBaseName, "docker.io/library/source-image:latest"))
+			Expect(artifact.Annotations[AnnotationBaseDigest]).Should(HavePrefix("sha256:"))
+		})
+	})
+
+	Context("when finding the source image digest", func() {
+		It("should prefer the repository the source image is named in", func() {
+			Expect(sourceDigest("reg.example.com/base:v1", []string{
+				"mirror.example.com/base@sha256:1111111111111111111111111111111111111111111111111111111111111111",
+				"reg.example.com/base@sha256:2222222222222222222222222222222222222222222222222222222222222222",
+			}, "sha256:id")).Should(Equal("sha256:2222222222222222222222222222222222222222222222222222222222222222"))
+		})
+
+		It("should fall back to the image id", func() {
+			Expect(sourceDigest("base:v1", nil, "sha256:id")).Should(Equal("sha256:id"))
+		})
+	})
+})
+
+// readLayer reads the uncompressed content of the layer blob
+func readLayer(b registry.Blob) []byte {
+	rc, e := b.Open()
+	Expect(e).Should(Succeed())
+	defer rc.Close()
+	r, e := compression.DecompressStream(rc)
+	Expect(e).Should(Succeed())
+	defer r.Close()
+	buf, e := ioutil.ReadAll(r)
+	Expect(e).Should(Succeed())
+	return buf
+}
@@ -0,0 +1,146 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+// ImageSaver is implemented by runtimes able to export images as docker archives, same as `docker save`
+type ImageSaver interface {
+	Save(ctx context.Context, image string) (io.ReadCloser, error)
+}
+
+// ImagePusher pushes images to registries without the container runtime, such as the registry client
+type ImagePusher interface {
+	Push(ctx context.Context, ref reference.Named, img *registry.Image, auth *types.AuthConfig) (digest.Digest, error)
+}
+
+// directPushRuntime commits and tags images through the container runtime, but exports the committed image and pushes it itself,
+// so pushing does not depend on the configuration and throughput of the shared runtime on the node
+type directPushRuntime struct {
+	Runtime
+	saver  ImageSaver
+	pusher ImagePusher
+
+	committed *Image
+	// dir keeps the exported image, it is removed with the image
+	dir      string
+	exported *registry.Image
+}
+
+// NewDirectPushRuntime wraps a runtime able to export images, images are pushed by the pusher instead of the runtime
+func NewDirectPushRuntime(rt Runtime, pusher ImagePusher) (Runtime, error) {
+	saver, ok := rt.(ImageSaver)
+	if !ok {
+		return nil, errors.New("the container runtime can not export images for direct push")
+	}
+
+	return &directPushRuntime{Runtime: rt, saver: saver, pusher: pusher}, nil
+}
+
+func (r *directPushRuntime) Commit(ctx context.Context, ctr string, ref reference.Named, opt *SnapshotOptions) (*Image, error) {
+	img, e := r.Runtime.Commit(ctx, ctr, ref, opt)
+	if e != nil {
+		return nil, e
+	}
+	r.committed = img
+	return img, nil
+}
+
+// Rewrite rewrites the committed image through the runtime, the rewritten image is exported and pushed instead
+func (r *directPushRuntime) Rewrite(ctx context.Context, ref reference.Named, img *Image, rw *layerRewrite) (*Image, error) {
+	rewriter, ok := r.Runtime.(ImageRewriter)
+	if !ok {
+		return nil, fmt.Errorf("the container runtime can not %s images", rw.name)
+	}
+	rewritten, e := rewriter.Rewrite(ctx, ref, img, rw)
+	if e != nil {
+		return nil, e
+	}
+	r.committed = rewritten
+	return rewritten, nil
+}
+
+// Diff returns the read/write layer of the committed image read by the runtime
+func (r *directPushRuntime) Diff(ctx context.Context, ref reference.Named) (io.ReadCloser, error) {
+	reader, ok := r.Runtime.(DiffReader)
+	if !ok {
+		return nil, errors.New("the container runtime can not read layers of committed images")
+	}
+	return reader.Diff(ctx, ref)
+}
+
+// Changes lists paths changed in the container by the runtime
+func (r *directPushRuntime) Changes(ctx context.Context, ctr string) (map[string]string, error) {
+	return listChanges(ctx, r.Runtime, ctr)
+}
+
+// Measure measures the container by the runtime
+func (r *directPushRuntime) Measure(ctx context.Context, ctr string) (int64, error) {
+	return measureSize(ctx, r.Runtime, ctr)
+}
+
+// Push pushes the committed image as ref, the image is exported at the first push, and reused by following pushes and retries
+func (r *directPushRuntime) Push(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (string, error) {
+	if r.exported == nil {
+		if e := r.export(ctx); e != nil {
+			return "", fmt.Errorf("export image: %w", e)
+		}
+	}
+
+	d, e := r.pusher.Push(ctx, ref, r.exported, auth)
+	if e != nil {
+		return "", classifyPushError(e)
+	}
+	return d.String(), nil
+}
+
+func (r *directPushRuntime) export(ctx context.Context) error {
+	if r.committed == nil {
+		return errors.New("no image committed")
+	}
+
+	if r.dir == "" {
+		dir, e := ioutil.TempDir("", "snapshot-")
+		if e != nil {
+			return e
+		}
+		r.dir = dir
+	}
+
+	rc, e := r.saver.Save(ctx, r.committed.ID)
+	if e != nil {
+		return e
+	}
+	defer rc.Close()
+
+	img, e := loadDockerArchive(rc, r.dir)
+	if e != nil {
+		return e
+	}
+	log.Info("image exported", "id", r.committed.ID, "layers", len(img.Layers))
+	r.exported = img
+	return nil
+}
+
+func (r *directPushRuntime) Save(ctx context.Context, image string) (io.ReadCloser, error) {
+	return r.saver.Save(ctx, image)
+}
+
+func (r *directPushRuntime) Remove(ctx context.Context, img *Image, refs []reference.Named) error {
+	if r.dir != "" {
+		if e := os.RemoveAll(r.dir); e != nil {
+			log.Error(e, "remove exported image", "dir", r.dir)
+		}
+	}
+	return r.Runtime.Remove(ctx, img, refs)
+}
@@ -0,0 +1,158 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/containerd/containerd/images"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+var _ = Describe("direct push runtime", func() {
+	var (
+		ctx     = context.Background()
+		client  *mockDockerClient
+		pusher  *mockPusher
+		worker  Worker
+		options = SnapshotOptions{
+			Container: "container-id",
+			Image:     "reg.example.com/snapshots/image-name:v1",
+			Tags:      []string{"latest"},
+		}
+	)
+
+	config := `{"architecture":"amd64","rootfs":{"type":"layers"}}`
+
+	BeforeEach(func() {
+		client = &mockDockerClient{archive: dockerArchive(map[string]string{
+			"manifest.json":  `[{"Config":"abc.json","RepoTags":null,"Layers":["base/layer.tar","dup/layer.tar","top/layer.tar"]}]`,
+			"abc.json":       config,
+			"base/layer.tar": "base layer",
+			"top/layer.tar":  "container layer",
+		}, map[string]string{
+			"dup/layer.tar": "../base/layer.tar",
+		})}
+		pusher = &mockPusher{}
+		rt, e := NewDirectPushRuntime(NewDockerRuntime(client), pusher)
+		Expect(e).Should(Succeed())
+		worker = Worker{runtime: rt}
+	})
+
+	It("should push the exported image to all destinations", func() {
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(client.pushed).Should(BeEmpty())
+		Expect(pusher.pushed).Should(Equal([]string{
+			"reg.example.com/snapshots/image-name:v1",
+			"reg.example.com/snapshots/image-name:latest",
+		}))
+		Expect(result.Digest).Should(Equal("sha256:mock-direct-digest"))
+	})
+
+	It("should export the committed image only once", func() {
+		_, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(client.saves).Should(Equal(1))
+	})
+
+	It("should convert the archive to a docker schema 2 image", func() {
+		_, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+
+		img := pusher.image
+		Expect(img.MediaType).Should(Equal(images.MediaTypeDockerSchema2Manifest))
+		Expect(img.Config.Digest).Should(Equal(digest.FromString(config)))
+		Expect(img.Layers).Should(HaveLen(3))
+		Expect(img.Layers[1].Digest).Should(Equal(img.Layers[0].Digest), "duplicated layers are linked")
+		for i, content := range []string{"base layer", "base layer", "container layer"} {
+			Expect(img.Layers[i].MediaType).Should(Equal(images.MediaTypeDockerSchema2LayerGzip))
+			rc, e := img.Layers[i].Open()
+			Expect(e).Should(Succeed())
+			buf, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			Expect(digest.FromBytes(buf)).Should(Equal(img.Layers[i].Digest))
+			Expect(int64(len(buf))).Should(Equal(img.Layers[i].Size))
+			zr, e := gzip.NewReader(bytes.NewReader(buf))
+			Expect(e).Should(Succeed())
+			Expect(ioutil.ReadAll(zr)).Should(Equal([]byte(content)))
+		}
+	})
+
+	It("should remove the exported image with the committed image", func() {
+		opts := options
+		opts.Cleanup = constants.CleanupAlways
+		_, e := worker.TakeSnapshot(ctx, &opts)
+		Expect(e).Should(Succeed())
+		Expect(client.removed).Should(Equal([]string{"mock id"}))
+		_, e = os.Stat(worker.runtime.(*directPushRuntime).dir)
+		Expect(os.IsNotExist(e)).Should(BeTrue())
+	})
+
+	It("should fail to push if the image can not be exported", func() {
+		client.archive = nil
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(MatchError(ErrPush))
+		Expect(result.Message).Should(ContainSubstring("export image: can not save image"))
+	})
+
+	It("should classify push errors", func() {
+		pusher.err = "PUT /v2/snapshots/image-name/manifests/v1: unexpected http status: 403 Forbidden: DENIED: requested access to the resource is denied"
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(MatchError(ErrPush))
+		Expect(result.Error).Should(Equal(constants.ErrorPushAccessDenied))
+	})
+
+	It("should reject paths out of the archive", func() {
+		client.archive = dockerArchive(map[string]string{"../manifest.json": "[]"}, nil)
+		_, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(MatchError(ErrPush))
+	})
+
+	It("should not wrap runtimes which can not export images", func() {
+		_, e := NewDirectPushRuntime(NewContainerdRuntime(&mockContainerdClient{}, ContainerdNamespace), pusher)
+		Expect(e).Should(HaveOccurred())
+	})
+})
+
+// dockerArchive builds a docker archive of the files and symlinks
+func dockerArchive(files map[string]string, links map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})).Should(Succeed())
+		_, e := tw.Write([]byte(content))
+		Expect(e).Should(Succeed())
+	}
+	for name, target := range links {
+		Expect(tw.WriteHeader(&tar.Header{Name: name, Linkname: target, Typeflag: tar.TypeSymlink})).Should(Succeed())
+	}
+	Expect(tw.Close()).Should(Succeed())
+	return buf.Bytes()
+}
+
+type mockPusher struct {
+	err    string
+	image  *registry.Image
+	pushed []string
+}
+
+func (p *mockPusher) Push(ctx context.Context, ref reference.Named, img *registry.Image, auth *types.AuthConfig) (digest.Digest, error) {
+	if p.err != "" {
+		return "", errors.New(p.err)
+	}
+	p.image = img
+	p.pushed = append(p.pushed, ref.String())
+	return "sha256:mock-direct-digest", nil
+}
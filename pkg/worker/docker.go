@@ -0,0 +1,285 @@
+package worker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// DockerClient is a subset of docker CommonAPIClient, to make the worker interface simpler
+type DockerClient interface {
+	ContainerInspectWithRaw(ctx context.Context, container string, getSize bool) (types.ContainerJSON, []byte, error)
+	ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error)
+	ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error)
+	ContainerPause(ctx context.Context, container string) error
+	ContainerUnpause(ctx context.Context, container string) error
+	ImageTag(ctx context.Context, source, target string) error
+	ImagePush(ctx context.Context, ref string, options types.ImagePushOptions) (io.ReadCloser, error)
+	ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error)
+	ImageSave(ctx context.Context, images []string) (io.ReadCloser, error)
+	ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error)
+	ContainerDiff(ctx context.Context, ctr string) ([]container.ContainerChangeResponseItem, error)
+}
+
+type dockerRuntime struct {
+	client DockerClient
+}
+
+// NewDockerRuntime returns a runtime taking snapshots through the docker daemon
+func NewDockerRuntime(cli DockerClient) Runtime {
+	return &dockerRuntime{client: cli}
+}
+
+func (r *dockerRuntime) Commit(ctx context.Context, ctr string, ref reference.Named, opt *SnapshotOptions) (*Image, error) {
+	// the read/write layer size is calculated with getSize
+	info, _, e := r.client.ContainerInspectWithRaw(ctx, ctr, true)
+	if e != nil {
+		return nil, fmt.Errorf("inspect container %s: %w", ctr, e)
+	}
+	if info.ContainerJSONBase == nil || info.Config == nil {
+		return nil, fmt.Errorf("inspect container %s: no config found", ctr)
+	}
+	base, _, e := r.client.ImageInspectWithRaw(ctx, info.Image)
+	if e != nil {
+		return nil, fmt.Errorf("inspect source image %s: %w", info.Image, e)
+	}
+
+	changes, e := parseChanges(opt.Changes)
+	if e != nil {
+		return nil, e
+	}
+	config := mergeDockerConfig(info.Config, base.Config, changes)
+	log.Info("merged snapshot config", "from container", config.Labels[LabelConfigFromContainer], "from image", config.Labels[LabelConfigFromImage])
+
+	id, e := r.client.ContainerCommit(ctx, ctr, types.ContainerCommitOptions{
+		Reference: ref.String(),
+		Author:    opt.Author,
+		Comment:   opt.Comment,
+		Changes:   opt.Changes,
+		Config:    config,
+		// containers are paused by the worker as the pause policy requires
+		Pause: false,
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	// the committed image has one more layer than the source image
+	img := &Image{
+		ID:           id.ID,
+		Layers:       len(base.RootFS.Layers) + 1,
+		Source:       info.Config.Image,
+		SourceDigest: sourceDigest(info.Config.Image, base.RepoDigests, base.ID),
+	}
+	if info.SizeRw != nil {
+		img.Size = *info.SizeRw
+	}
+
+	return img, nil
+}
+
+// sourceDigest returns the manifest digest of the source image from its repo digests, preferring the repository it is named in,
+// or the image id if it is not pulled from any registry
+func sourceDigest(name string, repoDigests []string, id string) string {
+	var repo string
+	if ref, e := reference.ParseNormalizedNamed(name); e == nil {
+		repo = ref.Name()
+	}
+
+	var found string
+	for _, rd := range repoDigests {
+		ref, e := reference.ParseNormalizedNamed(rd)
+		if e != nil {
+			continue
+		}
+		canonical, ok := ref.(reference.Canonical)
+		if !ok {
+			continue
+		}
+		if ref.Name() == repo {
+			return canonical.Digest().String()
+		}
+		if found == "" {
+			found = canonical.Digest().String()
+		}
+	}
+	if found != "" {
+		return found
+	}
+	return id
+}
+
+func (r *dockerRuntime) Pause(ctx context.Context, ctr string) error {
+	return r.client.ContainerPause(ctx, ctr)
+}
+
+func (r *dockerRuntime) Unpause(ctx context.Context, ctr string) error {
+	return r.client.ContainerUnpause(ctx, ctr)
+}
+
+func (r *dockerRuntime) Tag(ctx context.Context, source, target reference.Named) error {
+	return r.client.ImageTag(ctx, reference.TagNameOnly(source).String(), reference.TagNameOnly(target).String())
+}
+
+func (r *dockerRuntime) Remove(ctx context.Context, img *Image, refs []reference.Named) error {
+	// force is required to remove an image by id if it has more than one tag
+	deleted, e := r.client.ImageRemove(ctx, img.ID, types.ImageRemoveOptions{Force: true, PruneChildren: true})
+	if e != nil {
+		return e
+	}
+	for _, d := range deleted {
+		log.Info("image removed", "untagged", d.Untagged, "deleted", d.Deleted)
+	}
+	return nil
+}
+
+func (r *dockerRuntime) Save(ctx context.Context, image string) (io.ReadCloser, error) {
+	return r.client.ImageSave(ctx, []string{image})
+}
+
+// Diff returns the top layer of the image saved from the daemon
+func (r *dockerRuntime) Diff(ctx context.Context, ref reference.Named) (io.ReadCloser, error) {
+	return savedDiff(ctx, r, reference.TagNameOnly(ref).String())
+}
+
+// Measure measures the container read/write layer by the daemon, which walks the layer
+func (r *dockerRuntime) Measure(ctx context.Context, ctr string) (int64, error) {
+	info, _, e := r.client.ContainerInspectWithRaw(ctx, ctr, true)
+	if e != nil {
+		return 0, fmt.Errorf("inspect container %s: %w", ctr, e)
+	}
+	if info.ContainerJSONBase == nil || info.SizeRw == nil {
+		return 0, fmt.Errorf("inspect container %s: no size reported", ctr)
+	}
+	return *info.SizeRw, nil
+}
+
+// Changes lists paths changed in the container by the daemon
+func (r *dockerRuntime) Changes(ctx context.Context, ctr string) (map[string]string, error) {
+	items, e := r.client.ContainerDiff(ctx, ctr)
+	if e != nil {
+		return nil, e
+	}
+	return containerChanges(items)
+}
+
+// Rewrite rewrites the image saved from the daemon, and loads the rewritten image back.
+// the image before rewritten is removed, it is left dangling by the rewritten one
+func (r *dockerRuntime) Rewrite(ctx context.Context, ref reference.Named, img *Image, rw *layerRewrite) (*Image, error) {
+	config, layers, e := rewriteSavedImage(ctx, r, r.load, ref, img, rw)
+	if e != nil {
+		return nil, e
+	}
+	if config.String() == img.ID {
+		return img, nil
+	}
+	if _, e := r.client.ImageRemove(ctx, img.ID, types.ImageRemoveOptions{PruneChildren: true}); e != nil {
+		log.Error(e, "remove the image before rewritten", "id", img.ID)
+	}
+
+	rewritten := *img
+	rewritten.ID, rewritten.Layers = config.String(), layers
+	return &rewritten, nil
+}
+
+// load loads the docker archive, failures are reported inside the response stream
+func (r *dockerRuntime) load(ctx context.Context, archive io.Reader) error {
+	resp, e := r.client.ImageLoad(ctx, archive, true)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+
+	if !resp.JSON {
+		_, e := io.Copy(ioutil.Discard, resp.Body)
+		return e
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var jm jsonmessage.JSONMessage
+		if e := dec.Decode(&jm); e != nil {
+			if e == io.EOF {
+				return nil
+			}
+			return e
+		}
+		if jm.Error != nil {
+			return jm.Error
+		}
+		log.Info(strings.TrimSpace(jm.Stream))
+	}
+}
+
+func (r *dockerRuntime) Push(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (string, error) {
+	image := reference.FamiliarString(ref)
+
+	var coded string
+	if auth != nil {
+		var e error
+		coded, e = formatAuth(*auth)
+		if e != nil {
+			return "", e
+		}
+	}
+
+	resp, e := r.client.ImagePush(ctx, image, types.ImagePushOptions{
+		RegistryAuth: coded,
+	})
+	if e != nil {
+		return "", classifyPushError(e)
+	}
+
+	return r.printPushMessage(resp)
+}
+
+// printPushMessage logs the push progress, and returns the manifest digest carried by the final aux message.
+// the daemon reports push failures inside the stream, they are returned as typed errors
+func (r *dockerRuntime) printPushMessage(rc io.ReadCloser) (string, error) {
+	dec := json.NewDecoder(rc)
+	defer rc.Close()
+
+	var digest string
+	for {
+		var jm jsonmessage.JSONMessage
+		if e := dec.Decode(&jm); e != nil {
+			if e == io.EOF {
+				return digest, nil
+			}
+			// the stream may be broken by a connection reset
+			return "", classifyPushError(e)
+		}
+
+		if jm.Error != nil {
+			return "", classifyPushError(jm.Error)
+		}
+		if jm.ErrorMessage != "" {
+			return "", classifyPushError(errors.New(jm.ErrorMessage))
+		}
+		if jm.Aux != nil {
+			var pushed types.PushResult
+			if e := json.Unmarshal(*jm.Aux, &pushed); e == nil && pushed.Digest != "" {
+				digest = pushed.Digest
+			}
+		}
+		log.Info(jm.ProgressMessage, "id", jm.ID, "status", jm.Status, "stream", jm.Stream, "from", jm.From, "error message", jm.ErrorMessage)
+	}
+}
+
+func formatAuth(auth types.AuthConfig) (string, error) {
+	buf, e := json.Marshal(auth)
+	if e != nil {
+		return "", fmt.Errorf("marshal auth: %w", e)
+	}
+
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
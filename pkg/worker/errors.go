@@ -1,29 +1,153 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"strings"
+
+	"github.com/supremind/container-snapshot/pkg/constants"
 )
 
 type Error struct {
 	msg    string
 	reason error
+	// class overrides the class of the reason, if it is set
+	class string
 }
 
 func (e *Error) Error() string {
-	return fmt.Sprint(e.msg, e.reason.Error())
+	return fmt.Sprintf("%s: %s", e.reason.Error(), e.msg)
 }
 
 func (e *Error) Unwrap() error {
 	return e.reason
 }
 
+// Class returns the error class reported in the worker result
+func (e *Error) Class() string {
+	if e.class != "" {
+		return e.class
+	}
+	return errorClasses[e.reason]
+}
+
 var (
 	ErrInvalidImage = errors.New("invlid image name")
 	ErrCommit       = errors.New("container commit failed")
 	ErrPush         = errors.New("image push failed")
+	ErrChanges      = errors.New("invalid commit changes")
+	ErrExport       = errors.New("image export failed")
+	ErrSquash       = errors.New("image squash failed")
+	ErrExclude      = errors.New("path exclusion failed")
+	ErrScan         = errors.New("secret scan failed")
+	ErrSecret       = errors.New("secrets detected")
+	ErrPolicy       = errors.New("policy check failed")
+	ErrRejected     = errors.New("rejected by the policy")
+	ErrTooLarge     = errors.New("snapshot too large")
+	ErrSign         = errors.New("image signing failed")
+	ErrAttest       = errors.New("provenance attestation failed")
+
+	// errors of pushing a single destination, told apart from registry error messages
+	ErrPushAuthDenied      = errors.New("registry denied the credential")
+	ErrPushAccessDenied    = errors.New("repository not found or no permission")
+	ErrPushManifestInvalid = errors.New("registry rejected the manifest")
+	ErrPushQuotaExceeded   = errors.New("registry quota exceeded")
+	ErrPushRateLimited     = errors.New("registry rate limited")
+	ErrPushTLS             = errors.New("tls error")
+	ErrPushTimeout         = errors.New("timeout")
+	ErrPushNetwork         = errors.New("network error")
+	ErrPushServer          = errors.New("registry server error")
 )
 
+var errorClasses = map[error]string{
+	ErrInvalidImage: constants.ErrorInvalidImage,
+	ErrCommit:       constants.ErrorCommit,
+	ErrPush:         constants.ErrorPush,
+	ErrChanges:      constants.ErrorInvalidChanges,
+	ErrExport:       constants.ErrorExport,
+	ErrSquash:       constants.ErrorSquash,
+	ErrExclude:      constants.ErrorExclude,
+	ErrScan:         constants.ErrorScan,
+	ErrSecret:       constants.ErrorSecretDetected,
+	ErrPolicy:       constants.ErrorPolicy,
+	ErrRejected:     constants.ErrorPolicyRejected,
+	ErrTooLarge:     constants.ErrorTooLarge,
+	ErrSign:         constants.ErrorSign,
+	ErrAttest:       constants.ErrorAttest,
+
+	ErrPushAuthDenied:      constants.ErrorPushAuthDenied,
+	ErrPushAccessDenied:    constants.ErrorPushAccessDenied,
+	ErrPushManifestInvalid: constants.ErrorPushManifestInvalid,
+	ErrPushQuotaExceeded:   constants.ErrorPushQuotaExceeded,
+	ErrPushRateLimited:     constants.ErrorPushRateLimited,
+	ErrPushTLS:             constants.ErrorPushTLS,
+	ErrPushTimeout:         constants.ErrorPushTimeout,
+	ErrPushNetwork:         constants.ErrorPushNetwork,
+	ErrPushServer:          constants.ErrorPushServer,
+}
+
+// pushErrorPatterns are lower cased snippets of registry and daemon error messages for each kind of push errors,
+// registries report errors codes of the distribution spec, such as DENIED or MANIFEST_INVALID, and daemons may rephrase them.
+// kinds are matched in order: quota errors come before auth errors since some registries report them as denied,
+// server errors come before timeouts for gateway timeouts, and timeouts come before tls errors for tls handshake timeouts
+var pushErrorPatterns = []struct {
+	reason   error
+	patterns []string
+}{
+	{ErrPushQuotaExceeded, []string{"quota exceeded", "quota_exceeded", "exceeded quota", "exceed the configured upper limit", "insufficient storage"}},
+	{ErrPushManifestInvalid, []string{"manifest invalid", "manifest_invalid", "invalid manifest", "manifest blob unknown", "manifest_blob_unknown", "manifest unverified"}},
+	{ErrPushRateLimited, []string{"toomanyrequests", "too many requests", "rate limit"}},
+	{ErrPushServer, []string{"internal server error", "bad gateway", "service unavailable", "gateway timeout", "unexpected http status: 5"}},
+	{ErrPushTimeout, []string{"i/o timeout", "handshake timeout", "deadline exceeded", "timed out", "timeout exceeded"}},
+	{ErrPushTLS, []string{"x509:", "tls:", "certificate", "server gave http response to https client"}},
+	{ErrPushNetwork, []string{"connection refused", "connection reset", "no such host", "network is unreachable", "broken pipe", "unexpected eof"}},
+	{ErrPushAuthDenied, []string{"unauthorized", "authentication required", "no basic auth credentials", "incorrect username or password", "invalid username/password"}},
+	{ErrPushAccessDenied, []string{"denied", "forbidden", "insufficient_scope", "authorization failed", "name unknown", "name_unknown", "repository does not exist", "repository name not known"}},
+}
+
+// classifyPushError wraps a push error as a typed error by its message, unknown errors are returned as is
+func classifyPushError(e error) error {
+	var netErr net.Error
+	if errors.Is(e, context.DeadlineExceeded) || errors.As(e, &netErr) && netErr.Timeout() {
+		return &Error{msg: e.Error(), reason: ErrPushTimeout}
+	}
+
+	msg := strings.ToLower(e.Error())
+	for _, kind := range pushErrorPatterns {
+		for _, p := range kind.patterns {
+			if strings.Contains(msg, p) {
+				return &Error{msg: e.Error(), reason: kind.reason}
+			}
+		}
+	}
+	if errors.As(e, &netErr) {
+		return &Error{msg: e.Error(), reason: ErrPushNetwork}
+	}
+
+	return e
+}
+
+// isAuthError tells if a push error may be fixed by another credential
+func isAuthError(e error) bool {
+	return errors.Is(e, ErrPushAuthDenied) || errors.Is(e, ErrPushAccessDenied)
+}
+
+// isRetryable tells if a push error is transient, and may be fixed by pushing again later
+func isRetryable(e error) bool {
+	return errors.Is(e, ErrPushNetwork) || errors.Is(e, ErrPushTimeout) || errors.Is(e, ErrPushRateLimited) || errors.Is(e, ErrPushServer)
+}
+
+// errorClass returns the class of a typed worker error, or empty for other errors
+func errorClass(e error) string {
+	var we *Error
+	if errors.As(e, &we) {
+		return we.Class()
+	}
+	return ""
+}
+
 func errInvalidImage(msg string) *Error {
 	return &Error{
 		msg:    msg,
@@ -44,3 +168,80 @@ func errPush(msg string) *Error {
 		reason: ErrPush,
 	}
 }
+
+func errExport(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrExport,
+	}
+}
+
+func errSquash(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrSquash,
+	}
+}
+
+func errExclude(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrExclude,
+	}
+}
+
+func errScan(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrScan,
+	}
+}
+
+func errSecretDetected(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrSecret,
+	}
+}
+
+func errPolicy(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrPolicy,
+	}
+}
+
+func errPolicyRejected(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrRejected,
+	}
+}
+
+func errTooLarge(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrTooLarge,
+	}
+}
+
+func errSign(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrSign,
+	}
+}
+
+func errAttest(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrAttest,
+	}
+}
+
+func errChanges(msg string) *Error {
+	return &Error{
+		msg:    msg,
+		reason: ErrChanges,
+	}
+}
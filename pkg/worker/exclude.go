@@ -0,0 +1,160 @@
+package worker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// excluded is what is dropped from the read/write layer by exclude patterns
+type excluded struct {
+	// files is the number of files dropped, directories are not counted
+	files int
+	// bytes is the total size of files dropped
+	bytes int64
+}
+
+// pathMatcher matches paths in layers by glob patterns, same as path.Match.
+// patterns with a slash are matched against the whole path from the root, others are matched against the base name at any depth,
+// and paths in a matched directory are matched too
+type pathMatcher []string
+
+// newPathMatcher returns the matcher of the patterns, or an error if any pattern is malformed
+func newPathMatcher(patterns []string) (pathMatcher, error) {
+	m := make(pathMatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		p := strings.TrimSuffix(pattern, "/")
+		if strings.Contains(p, "/") {
+			p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		}
+		if p == "" || p == "." {
+			return nil, fmt.Errorf("invalid exclude pattern %q: the root directory could not be excluded", pattern)
+		}
+		if _, e := path.Match(p, ""); e != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, e)
+		}
+		m = append(m, p)
+	}
+	return m, nil
+}
+
+// matchOne tells if the path itself matches any pattern
+func (m pathMatcher) matchOne(name string) bool {
+	for _, p := range m {
+		target := name
+		if !strings.Contains(p, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the top most matched path of the path and its parents, or empty if none is matched
+func (m pathMatcher) match(name string) string {
+	matched := ""
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if m.matchOne(p) {
+			matched = p
+		}
+	}
+	return matched
+}
+
+// excludeRewrite drops paths matching the patterns from the top layer of the image, which is the container read/write layer.
+// lower layers are kept as they are, and matched paths in them are hidden by whiteouts. what is dropped is counted into stats
+func excludeRewrite(m pathMatcher, stats *excluded) *layerRewrite {
+	return &layerRewrite{
+		name:     "exclude",
+		keepBase: true,
+		write: func(layers []layerOpener, w io.Writer) error {
+			return excludePaths(layers, m, w, stats)
+		},
+		config: rewriteTopConfig,
+	}
+}
+
+// excludePaths writes the top layer without paths matching the patterns, layers are ordered from the base to the top.
+// whiteouts are added for matched paths found in lower layers, so they are deleted from the image as well
+func excludePaths(layers []layerOpener, m pathMatcher, w io.Writer, stats *excluded) error {
+	if len(layers) == 0 {
+		return nil
+	}
+
+	// matched paths of lower layers, whiteouts of them are written to the top layer
+	whiteouts := make(map[string]bool)
+	for i, l := range layers[:len(layers)-1] {
+		e := walkLayer(l, func(name string, _ *tar.Header, _ io.Reader) error {
+			if strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+				return nil
+			}
+			if matched := m.match(name); matched != "" {
+				whiteouts[matched] = true
+			}
+			return nil
+		})
+		if e != nil {
+			return fmt.Errorf("read layer %d: %w", i, e)
+		}
+	}
+
+	var dropped excluded
+	tw := tar.NewWriter(w)
+	e := walkLayer(layers[len(layers)-1], func(name string, hdr *tar.Header, r io.Reader) error {
+		// whiteouts of matched paths are written below, others are kept
+		target := name
+		if base := path.Base(name); base == whiteoutOpaque {
+			target = path.Dir(name)
+		} else if strings.HasPrefix(base, whiteoutPrefix) {
+			target = path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix))
+		}
+		drop := m.match(target) != ""
+		// hard links to dropped files are dropped too, they could not be extracted without their targets
+		if !drop && hdr.Typeflag == tar.TypeLink {
+			drop = m.match(strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")) != ""
+		}
+		if drop {
+			if target == name && hdr.Typeflag != tar.TypeDir {
+				dropped.files++
+				dropped.bytes += hdr.Size
+			}
+			return nil
+		}
+
+		if e := tw.WriteHeader(hdr); e != nil {
+			return e
+		}
+		_, e := io.Copy(tw, r)
+		return e
+	})
+	if e != nil {
+		return fmt.Errorf("read top layer: %w", e)
+	}
+
+	names := make([]string, 0, len(whiteouts))
+	for name := range whiteouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)),
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+		}
+		if e := tw.WriteHeader(hdr); e != nil {
+			return e
+		}
+	}
+	if e := tw.Close(); e != nil {
+		return e
+	}
+
+	*stats = dropped
+	return nil
+}
@@ -0,0 +1,231 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("exclude", func() {
+	var ctx = context.Background()
+
+	exclude := func(patterns []string, layers ...[]byte) (map[string]string, excluded) {
+		m, e := newPathMatcher(patterns)
+		Expect(e).Should(Succeed())
+		openers := make([]layerOpener, 0, len(layers))
+		for _, l := range layers {
+			l := l
+			openers = append(openers, func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(l)), nil })
+		}
+		var stats excluded
+		buf := &bytes.Buffer{}
+		Expect(excludePaths(openers, m, buf, &stats)).Should(Succeed())
+		return layerEntries(buf.Bytes()), stats
+	}
+
+	Context("when matching paths", func() {
+		It("should match paths from the root by patterns with a slash", func() {
+			m, e := newPathMatcher([]string{"/tmp/*", "var/cache/"})
+			Expect(e).Should(Succeed())
+			Expect(m.match("tmp/junk")).Should(Equal("tmp/junk"))
+			Expect(m.match("tmp")).Should(BeEmpty())
+			Expect(m.match("var/cache/apt/archives")).Should(Equal("var/cache"))
+			Expect(m.match("app/tmp/junk")).Should(BeEmpty())
+		})
+
+		It("should match base names at any depth by patterns without a slash", func() {
+			m, e := newPathMatcher([]string{".ssh", "*.pem"})
+			Expect(e).Should(Succeed())
+			Expect(m.match("root/.ssh/id_rsa")).Should(Equal("root/.ssh"))
+			Expect(m.match("etc/ssl/private/server.pem")).Should(Equal("etc/ssl/private/server.pem"))
+			Expect(m.match("etc/ssl/private/server.key")).Should(BeEmpty())
+		})
+
+		It("should reject malformed patterns and the root directory", func() {
+			_, e := newPathMatcher([]string{"[a-"})
+			Expect(e).Should(HaveOccurred())
+			_, e = newPathMatcher([]string{"/"})
+			Expect(e).Should(HaveOccurred())
+		})
+	})
+
+	Context("when excluding paths from the top layer", func() {
+		It("should drop matched files and count them", func() {
+			files, stats := exclude([]string{"/tmp/*", ".ssh"},
+				layerTarball(map[string]string{"etc/": "", "etc/hosts": "base"}),
+				layerTarball(map[string]string{"app/": "", "app/data": "keep", "root/": "", "root/.ssh/": "", "root/.ssh/id_rsa": "secret", "tmp/": "", "tmp/junk": "junk"}),
+			)
+			Expect(files).Should(Equal(map[string]string{"app/": "", "app/data": "keep", "root/": "", "tmp/": ""}))
+			Expect(stats).Should(Equal(excluded{files: 2, bytes: int64(len("secret") + len("junk"))}))
+		})
+
+		It("should add whiteouts of matched paths in lower layers", func() {
+			files, stats := exclude([]string{".ssh", "/tmp/*"},
+				layerTarball(map[string]string{"root/": "", "root/.ssh/": "", "root/.ssh/known_hosts": "hosts", "tmp/": "", "tmp/old": "old"}),
+				layerTarball(map[string]string{"root/": "", "root/.ssh/": "", "root/.ssh/id_rsa": "secret"}),
+			)
+			Expect(files).Should(Equal(map[string]string{"root/": "", "root/.wh..ssh": "", "tmp/.wh.old": ""}))
+			Expect(stats.files).Should(Equal(1))
+		})
+
+		It("should keep whiteouts of other paths", func() {
+			files, _ := exclude([]string{"*.log"},
+				layerTarball(map[string]string{"var/": "", "var/app.log": "log", "var/data": "data"}),
+				layerTarball(map[string]string{"var/": "", "var/.wh.data": "", "var/.wh.app.log": ""}),
+			)
+			Expect(files).Should(Equal(map[string]string{"var/": "", "var/.wh.data": "", "var/.wh.app.log": ""}))
+		})
+
+		It("should drop hard links to dropped files", func() {
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			Expect(tw.WriteHeader(&tar.Header{Name: "key.pem", Mode: 0600, Size: 6, Typeflag: tar.TypeReg})).Should(Succeed())
+			_, e := tw.Write([]byte("secret"))
+			Expect(e).Should(Succeed())
+			Expect(tw.WriteHeader(&tar.Header{Name: "key", Linkname: "key.pem", Typeflag: tar.TypeLink})).Should(Succeed())
+			Expect(tw.Close()).Should(Succeed())
+
+			files, stats := exclude([]string{"*.pem"}, buf.Bytes())
+			Expect(files).Should(BeEmpty())
+			Expect(stats.files).Should(Equal(2))
+		})
+	})
+
+	Context("with the docker runtime", func() {
+		var (
+			client  *mockDockerClient
+			worker  Worker
+			options SnapshotOptions
+		)
+
+		BeforeEach(func() {
+			client = &mockDockerClient{archive: dockerArchive(map[string]string{
+				"manifest.json":  `[{"Config":"abc.json","RepoTags":["image-name:latest"],"Layers":["base/layer.tar","top/layer.tar"]}]`,
+				"abc.json":       `{"architecture":"amd64","history":[{"created_by":"base"},{"created_by":"commit"}],"rootfs":{"type":"layers","diff_ids":["sha256:a","sha256:b"]}}`,
+				"base/layer.tar": string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "base", "root/": "", "root/.ssh/": "", "root/.ssh/known_hosts": "hosts"})),
+				"top/layer.tar":  string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "changed", "tmp/": "", "tmp/junk": "junk"})),
+			}, nil)}
+			worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+			options = SnapshotOptions{
+				Container: "container-id",
+				Image:     "image-name",
+				Exclude:   []string{"/tmp/*", ".ssh"},
+			}
+		})
+
+		It("should load the image with the rewritten read/write layer back", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.ExcludedFiles).Should(Equal(1))
+			Expect(result.ExcludedBytes).Should(Equal(int64(len("junk"))))
+			Expect(result.Layers).Should(Equal(2))
+
+			archive := layerEntries(client.loaded)
+			var mfst []dockerArchiveManifest
+			Expect(json.Unmarshal([]byte(archive["manifest.json"]), &mfst)).Should(Succeed())
+			Expect(mfst).Should(HaveLen(1))
+			Expect(mfst[0].Layers).Should(HaveLen(2))
+			Expect(layerEntries([]byte(archive[mfst[0].Layers[0]]))).Should(HaveKey("root/.ssh/known_hosts"))
+			top := []byte(archive[mfst[0].Layers[1]])
+			Expect(layerEntries(top)).Should(Equal(map[string]string{"etc/": "", "etc/hosts": "changed", "tmp/": "", "root/.wh..ssh": ""}))
+
+			var config ocispec.Image
+			Expect(json.Unmarshal([]byte(archive[mfst[0].Config]), &config)).Should(Succeed())
+			Expect(config.RootFS.DiffIDs).Should(Equal([]digest.Digest{"sha256:a", digest.FromBytes(top)}))
+			Expect(config.History).Should(HaveLen(2))
+			Expect(result.ImageID).Should(Equal(digest.FromString(archive[mfst[0].Config]).String()))
+		})
+
+		It("should exclude paths before squashing", func() {
+			options.Squash = true
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Layers).Should(Equal(1))
+
+			archive := layerEntries(client.loaded)
+			var mfst []dockerArchiveManifest
+			Expect(json.Unmarshal([]byte(archive["manifest.json"]), &mfst)).Should(Succeed())
+			Expect(layerEntries([]byte(archive[mfst[0].Layers[0]]))).Should(Equal(map[string]string{"etc/": "", "etc/hosts": "changed", "root/": "", "tmp/": ""}))
+		})
+
+		It("should remove the committed image if the exclusion fails with the Always policy", func() {
+			client.archive = nil
+			options.Cleanup = constants.CleanupAlways
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrExclude))
+			Expect(result.Phase).Should(Equal(constants.PhaseExclude))
+			Expect(client.removed).Should(Equal([]string{"mock id"}))
+			Expect(client.pushed).Should(BeEmpty())
+		})
+
+		It("should fail with malformed patterns before committing", func() {
+			options.Exclude = []string{"[a-"}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrExclude))
+			Expect(result.Phase).Should(Equal(constants.PhaseValidate))
+			Expect(result.Error).Should(Equal(constants.ErrorExclude))
+		})
+	})
+
+	Context("with the containerd runtime", func() {
+		var (
+			root   string
+			client *mockContainerdClient
+			worker Worker
+		)
+
+		BeforeEach(func() {
+			var e error
+			root, e = ioutil.TempDir("", "containerd-content-")
+			Expect(e).Should(Succeed())
+			client, e = newMockContainerdClient(root)
+			Expect(e).Should(Succeed())
+			worker = Worker{runtime: NewContainerdRuntime(client, ContainerdNamespace), auths: make(mergedDockerAuth)}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(root)
+		})
+
+		It("should point the snapshot image to the rewritten one", func() {
+			result, e := worker.TakeSnapshot(ctx, &SnapshotOptions{
+				Container: "container-id",
+				Image:     "image-name",
+				Exclude:   []string{"/app/data"},
+			})
+			Expect(e).Should(Succeed())
+			Expect(result.Layers).Should(Equal(2))
+			Expect(result.ExcludedFiles).Should(Equal(1))
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			Expect(mfst.Layers).Should(HaveLen(2))
+			Expect(result.ImageID).Should(Equal(mfst.Config.Digest.String()))
+
+			rc, e := openLayer(ctx, client.content, mfst.Layers[1])
+			Expect(e).Should(Succeed())
+			defer rc.Close()
+			layer, e := ioutil.ReadAll(rc)
+			Expect(e).Should(Succeed())
+			Expect(layerEntries(layer)).Should(Equal(map[string]string{"app/": "", "tmp/": "", "tmp/.wh.cache": ""}))
+
+			var config ocispec.Image
+			Expect(readJSONBlob(ctx, client.content, mfst.Config, &config)).Should(Succeed())
+			Expect(config.RootFS.DiffIDs).Should(HaveLen(2))
+			Expect(config.RootFS.DiffIDs[1]).Should(Equal(digest.FromBytes(layer)))
+		})
+	})
+})
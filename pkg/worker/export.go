@@ -0,0 +1,299 @@
+package worker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+// ExportOptions tells where and how the snapshot tarball is written, to the file at Path, or the object Key in Bucket
+type ExportOptions struct {
+	// Format is the tarball format, OCI or Docker
+	Format string `json:"format,omitempty"`
+	// Path is the path of the tarball file
+	Path string `json:"path,omitempty"`
+	// Bucket and Key are the object the tarball is uploaded as, by the Uploader
+	Bucket   string         `json:"bucket,omitempty"`
+	Key      string         `json:"key,omitempty"`
+	Uploader ObjectUploader `json:"-"`
+}
+
+// Export is the result of writing the snapshot tarball
+type Export struct {
+	Format string `json:"format"`
+	Path   string `json:"path,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	// ETag is the etag of the uploaded object
+	ETag string `json:"etag,omitempty"`
+	// Checksum is the sha256 digest of the tarball
+	Checksum string `json:"checksum,omitempty"`
+	// Size is size of the tarball in bytes
+	Size     int64  `json:"size,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	// Provenance is the path or the object key of the provenance statement written next to the tarball
+	Provenance string `json:"provenance,omitempty"`
+}
+
+// ImageExporter is implemented by runtimes able to write images as tarballs by themselves.
+// returns the manifest digest of the image, empty if the format has no manifest
+type ImageExporter interface {
+	Export(ctx context.Context, ref reference.Named, format string, w io.Writer) (string, error)
+}
+
+// ObjectUploader uploads objects to object storages, such as the s3 client. returns the etag of the object
+type ObjectUploader interface {
+	Upload(ctx context.Context, bucket, key string, r io.Reader) (string, error)
+}
+
+// exportSnapshot writes the committed image as a tarball, and records where it is written and the checksum of it
+func (c *Worker) exportSnapshot(ctx context.Context, result *Result, ref reference.Named, opt *ExportOptions) *Error {
+	start := time.Now()
+	result.Export = &Export{Format: opt.Format, Path: opt.Path, Bucket: opt.Bucket, Key: opt.Key}
+	defer func() {
+		result.Export.Duration = time.Since(start).Round(time.Millisecond).String()
+	}()
+
+	var manifest string
+	var w *digestWriter
+	var e error
+	if opt.Path != "" {
+		manifest, w, e = c.exportFile(ctx, ref, opt)
+	} else {
+		manifest, w, e = c.exportObject(ctx, ref, opt, result.Export)
+	}
+	if e != nil {
+		log.Error(e, "export image failed", "path", opt.Path, "bucket", opt.Bucket, "key", opt.Key)
+		return errExport(e.Error())
+	}
+
+	result.Digest = manifest
+	result.Export.Checksum = w.digester.Digest().String()
+	result.Export.Size = w.n
+	log.Info("image exported", "path", opt.Path, "bucket", opt.Bucket, "key", opt.Key, "format", opt.Format, "checksum", result.Export.Checksum, "size", w.n)
+	return nil
+}
+
+// exportFile writes the tarball to a temporary file first, so a broken tarball is never left at the path
+func (c *Worker) exportFile(ctx context.Context, ref reference.Named, opt *ExportOptions) (string, *digestWriter, error) {
+	if e := os.MkdirAll(filepath.Dir(opt.Path), 0755); e != nil {
+		return "", nil, fmt.Errorf("create export directory: %w", e)
+	}
+	f, e := ioutil.TempFile(filepath.Dir(opt.Path), "."+filepath.Base(opt.Path)+"-")
+	if e != nil {
+		return "", nil, fmt.Errorf("create export file: %w", e)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := &digestWriter{w: f, digester: digest.Canonical.Digester()}
+	manifest, e := c.writeTarball(ctx, ref, opt.Format, w)
+	if e == nil {
+		e = f.Close()
+	}
+	if e == nil {
+		e = os.Chmod(f.Name(), 0644)
+	}
+	if e == nil {
+		e = os.Rename(f.Name(), opt.Path)
+	}
+	return manifest, w, e
+}
+
+// exportObject streams the tarball to the uploader while it is written, the uploader aborts the upload if writing fails
+func (c *Worker) exportObject(ctx context.Context, ref reference.Named, opt *ExportOptions, export *Export) (string, *digestWriter, error) {
+	if opt.Uploader == nil {
+		return "", nil, errors.New("no object uploader")
+	}
+
+	pr, pw := io.Pipe()
+	w := &digestWriter{w: pw, digester: digest.Canonical.Digester()}
+	type written struct {
+		manifest string
+		e        error
+	}
+	done := make(chan written, 1)
+	go func() {
+		manifest, e := c.writeTarball(ctx, ref, opt.Format, w)
+		// the uploader reads the error, or io.EOF if e is nil
+		pw.CloseWithError(e)
+		done <- written{manifest, e}
+	}()
+
+	etag, e := opt.Uploader.Upload(ctx, opt.Bucket, opt.Key, pr)
+	// unblock the writer if the upload stops before reading all
+	pr.CloseWithError(e)
+	result := <-done
+	// errors of writing are read by the uploader, so the upload error tells both
+	if e != nil {
+		return "", nil, fmt.Errorf("upload object: %w", e)
+	}
+	if result.e != nil {
+		return "", nil, result.e
+	}
+	export.ETag = etag
+	return result.manifest, w, nil
+}
+
+// writeTarball writes the image in the format, through the runtime if it exports images by itself,
+// or converted from the docker archive saved by the runtime
+func (c *Worker) writeTarball(ctx context.Context, ref reference.Named, format string, w io.Writer) (string, error) {
+	if exporter, ok := c.runtime.(ImageExporter); ok {
+		return exporter.Export(ctx, ref, format, w)
+	}
+
+	saver, ok := c.runtime.(ImageSaver)
+	if !ok {
+		return "", errors.New("the container runtime can not export images")
+	}
+	// saved by name, so the image is tagged after loaded
+	rc, e := saver.Save(ctx, reference.TagNameOnly(ref).String())
+	if e != nil {
+		return "", fmt.Errorf("save image: %w", e)
+	}
+	defer rc.Close()
+
+	switch format {
+	case constants.ExportDocker:
+		_, e := io.Copy(w, rc)
+		return "", e
+
+	case constants.ExportOCI:
+		dir, e := ioutil.TempDir("", "snapshot-")
+		if e != nil {
+			return "", e
+		}
+		defer os.RemoveAll(dir)
+
+		img, e := loadDockerArchive(rc, dir)
+		if e != nil {
+			return "", fmt.Errorf("load docker archive: %w", e)
+		}
+		return writeOCILayout(w, ociImage(img), ref)
+
+	default:
+		return "", fmt.Errorf("unknown export format %s", format)
+	}
+}
+
+// ociImage returns the image with oci media types, docker image configs and layers are compatible with oci ones
+func ociImage(img *registry.Image) *registry.Image {
+	out := &registry.Image{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    img.Config,
+		Layers:    make([]registry.Blob, len(img.Layers)),
+	}
+	out.Config.MediaType = ocispec.MediaTypeImageConfig
+	for i, l := range img.Layers {
+		out.Layers[i] = l
+		out.Layers[i].MediaType = ocispec.MediaTypeImageLayerGzip
+	}
+	return out
+}
+
+// writeOCILayout writes the image as an OCI image layout tarball, named as ref in the index. returns the manifest digest
+func writeOCILayout(w io.Writer, img *registry.Image, ref reference.Named) (string, error) {
+	manifest, e := img.Manifest()
+	if e != nil {
+		return "", fmt.Errorf("marshal manifest: %w", e)
+	}
+	tag, e := tagOf(ref)
+	if e != nil {
+		return "", e
+	}
+	ref = reference.TagNameOnly(ref)
+	desc := ocispec.Descriptor{
+		MediaType: img.MediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+		Annotations: map[string]string{
+			images.AnnotationImageName: ref.String(),
+			ocispec.AnnotationRefName:  tag,
+		},
+	}
+	index, e := json.Marshal(ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, Manifests: []ocispec.Descriptor{desc}})
+	if e != nil {
+		return "", fmt.Errorf("marshal index: %w", e)
+	}
+	layout, e := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if e != nil {
+		return "", fmt.Errorf("marshal layout: %w", e)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if e := tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, Typeflag: tar.TypeDir}); e != nil {
+			return "", e
+		}
+	}
+	written := make(map[digest.Digest]bool)
+	for _, b := range append([]registry.Blob{img.Config}, img.Layers...) {
+		if written[b.Digest] {
+			continue
+		}
+		written[b.Digest] = true
+		if e := writeBlob(tw, b); e != nil {
+			return "", fmt.Errorf("write blob %s: %w", b.Digest, e)
+		}
+	}
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{"blobs/sha256/" + desc.Digest.Hex(), manifest},
+		{ocispec.ImageLayoutFile, layout},
+		{"index.json", index},
+	} {
+		if e := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); e != nil {
+			return "", e
+		}
+		if _, e := tw.Write(f.content); e != nil {
+			return "", e
+		}
+	}
+
+	return desc.Digest.String(), tw.Close()
+}
+
+func writeBlob(tw *tar.Writer, b registry.Blob) error {
+	rc, e := b.Open()
+	if e != nil {
+		return e
+	}
+	defer rc.Close()
+
+	if e := tw.WriteHeader(&tar.Header{Name: "blobs/sha256/" + b.Digest.Hex(), Mode: 0644, Size: b.Size, Typeflag: tar.TypeReg}); e != nil {
+		return e
+	}
+	_, e = io.Copy(tw, rc)
+	return e
+}
+
+// digestWriter digests and counts bytes written through it
+type digestWriter struct {
+	w        io.Writer
+	digester digest.Digester
+	n        int64
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, e := w.w.Write(p)
+	w.digester.Hash().Write(p[:n])
+	w.n += int64(n)
+	return n, e
+}
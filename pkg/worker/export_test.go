@@ -0,0 +1,249 @@
+package worker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("exporting snapshots", func() {
+	var (
+		ctx     = context.Background()
+		client  *mockDockerClient
+		worker  Worker
+		dir     string
+		options SnapshotOptions
+	)
+
+	BeforeEach(func() {
+		var e error
+		dir, e = ioutil.TempDir("", "export-test-")
+		Expect(e).Should(Succeed())
+
+		client = &mockDockerClient{archive: dockerArchive(map[string]string{
+			"manifest.json":  `[{"Config":"abc.json","RepoTags":["reg.example.com/snapshots/image-name:v1"],"Layers":["base/layer.tar"]}]`,
+			"abc.json":       `{"architecture":"amd64"}`,
+			"base/layer.tar": "base layer",
+		}, nil)}
+		worker = Worker{runtime: NewDockerRuntime(client)}
+		options = SnapshotOptions{
+			Container: "container-id",
+			Image:     "reg.example.com/snapshots/image-name:v1",
+			Export:    &ExportOptions{Format: constants.ExportDocker, Path: filepath.Join(dir, "snapshots", "image.tar")},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should write the docker archive instead of pushing", func() {
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+		Expect(client.pushed).Should(BeEmpty())
+		Expect(result.Destinations).Should(BeEmpty())
+
+		buf, e := ioutil.ReadFile(options.Export.Path)
+		Expect(e).Should(Succeed())
+		Expect(buf).Should(Equal(client.archive))
+		Expect(result.Export.Path).Should(Equal(options.Export.Path))
+		Expect(result.Export.Checksum).Should(Equal(digest.FromBytes(buf).String()))
+		Expect(result.Export.Size).Should(Equal(int64(len(buf))))
+	})
+
+	It("should write the OCI image layout", func() {
+		options.Export.Format = constants.ExportOCI
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+
+		files := readTarball(options.Export.Path)
+		Expect(files).Should(HaveKey(ocispec.ImageLayoutFile))
+		var index ocispec.Index
+		Expect(json.Unmarshal(files["index.json"], &index)).Should(Succeed())
+		Expect(index.Manifests).Should(HaveLen(1))
+		Expect(index.Manifests[0].Digest.String()).Should(Equal(result.Digest))
+		Expect(index.Manifests[0].Annotations).Should(HaveKeyWithValue(ocispec.AnnotationRefName, "v1"))
+
+		var m ocispec.Manifest
+		Expect(json.Unmarshal(files["blobs/sha256/"+index.Manifests[0].Digest.Hex()], &m)).Should(Succeed())
+		Expect(m.Config.MediaType).Should(Equal(ocispec.MediaTypeImageConfig))
+		Expect(m.Layers).Should(HaveLen(1))
+		Expect(m.Layers[0].MediaType).Should(Equal(ocispec.MediaTypeImageLayerGzip))
+		for _, desc := range append(m.Layers, m.Config) {
+			Expect(digest.FromBytes(files["blobs/sha256/"+desc.Digest.Hex()])).Should(Equal(desc.Digest))
+		}
+	})
+
+	It("should remove the committed image as the cleanup policy requires", func() {
+		options.Cleanup = constants.CleanupOnSuccess
+		_, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(client.removed).Should(Equal([]string{"mock id"}))
+	})
+
+	It("should not leave broken tarballs if the export fails", func() {
+		client.archive = nil
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(MatchError(ErrExport))
+		Expect(result.Phase).Should(Equal(constants.PhaseExport))
+		Expect(result.Error).Should(Equal(constants.ErrorExport))
+		files, e := ioutil.ReadDir(filepath.Dir(options.Export.Path))
+		Expect(e).Should(Succeed())
+		Expect(files).Should(BeEmpty())
+	})
+
+	Context("with the provenance", func() {
+		statementOf := func(content []byte) (Statement, Provenance) {
+			var s Statement
+			Expect(json.Unmarshal(content, &s)).Should(Succeed())
+			var p Provenance
+			Expect(json.Unmarshal(s.Predicate, &p)).Should(Succeed())
+			return s, p
+		}
+
+		BeforeEach(func() {
+			options.Export.Format = constants.ExportOCI
+			options.Provenance = &ProvenanceOptions{Namespace: "default", Snapshot: "image-snapshot", SnapshotUID: "snapshot-uid"}
+		})
+
+		It("should write the statement next to the tarball", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+			Expect(result.Export.Provenance).Should(Equal(options.Export.Path + constants.ProvenanceSuffix))
+
+			content, e := ioutil.ReadFile(result.Export.Provenance)
+			Expect(e).Should(Succeed())
+			s, p := statementOf(content)
+			checksum := digest.Digest(result.Export.Checksum)
+			manifest := digest.Digest(result.Digest)
+			Expect(s.Subject).Should(Equal([]Subject{
+				{Name: "image.tar", Digest: map[string]string{"sha256": checksum.Hex()}},
+				{Name: "reg.example.com/snapshots/image-name", Digest: map[string]string{"sha256": manifest.Hex()}},
+			}))
+			Expect(p.Invocation.Parameters.Snapshot).Should(Equal("image-snapshot"))
+			Expect(p.Metadata.BuildInvocationID).Should(Equal("snapshot-uid"))
+		})
+
+		It("should describe the tarball only if it has no manifest", func() {
+			options.Export.Format = constants.ExportDocker
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			content, e := ioutil.ReadFile(result.Export.Provenance)
+			Expect(e).Should(Succeed())
+			s, _ := statementOf(content)
+			Expect(s.Subject).Should(HaveLen(1))
+			Expect(s.Subject[0].Name).Should(Equal("image.tar"))
+		})
+
+		It("should upload the statement next to the tarball object", func() {
+			uploader := &mockUploader{}
+			options.Export = &ExportOptions{Format: constants.ExportOCI, Bucket: "snapshots", Key: "team/image.tar", Uploader: uploader}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Export.Provenance).Should(Equal("team/image.tar" + constants.ProvenanceSuffix))
+			Expect(uploader.objects).Should(HaveKey("snapshots/team/image.tar" + constants.ProvenanceSuffix))
+			s, _ := statementOf(uploader.objects["snapshots/team/image.tar"+constants.ProvenanceSuffix])
+			Expect(s.Subject[0].Digest).Should(HaveKeyWithValue("sha256", digest.FromBytes(uploader.objects["snapshots/team/image.tar"]).Hex()))
+		})
+
+		It("should fail if the statement could not be written", func() {
+			Expect(os.MkdirAll(options.Export.Path+constants.ProvenanceSuffix, 0755)).Should(Succeed())
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrAttest))
+			Expect(result.Phase).Should(Equal(constants.PhaseAttest))
+			Expect(result.Export.Checksum).ShouldNot(BeEmpty())
+		})
+	})
+
+	Context("when uploading to object storages", func() {
+		var uploader *mockUploader
+
+		BeforeEach(func() {
+			uploader = &mockUploader{}
+			options.Export = &ExportOptions{Format: constants.ExportDocker, Bucket: "snapshots", Key: "team/image.tar", Uploader: uploader}
+		})
+
+		It("should stream the tarball to the uploader", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+			Expect(uploader.objects).Should(HaveKeyWithValue("snapshots/team/image.tar", client.archive))
+			Expect(result.Export.Bucket).Should(Equal("snapshots"))
+			Expect(result.Export.Key).Should(Equal("team/image.tar"))
+			Expect(result.Export.ETag).Should(Equal("mock-etag"))
+			Expect(result.Export.Checksum).Should(Equal(digest.FromBytes(client.archive).String()))
+			Expect(result.Export.Size).Should(Equal(int64(len(client.archive))))
+		})
+
+		It("should fail if the upload fails", func() {
+			uploader.err = errors.New("AccessDenied: Access Denied")
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrExport))
+			Expect(result.Message).Should(ContainSubstring("AccessDenied"))
+		})
+
+		It("should fail the upload if writing the tarball fails", func() {
+			options.Export.Format = constants.ExportOCI
+			client.archive = dockerArchive(map[string]string{"abc.json": `{"architecture":"amd64"}`}, nil)
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrExport))
+			Expect(result.Message).Should(ContainSubstring("read archive manifest"))
+			Expect(uploader.objects).Should(BeEmpty())
+		})
+	})
+})
+
+type mockUploader struct {
+	objects map[string][]byte
+	err     error
+}
+
+func (u *mockUploader) Upload(ctx context.Context, bucket, key string, r io.Reader) (string, error) {
+	buf, e := ioutil.ReadAll(r)
+	if e != nil {
+		return "", e
+	}
+	if u.err != nil {
+		return "", u.err
+	}
+	if u.objects == nil {
+		u.objects = make(map[string][]byte)
+	}
+	u.objects[bucket+"/"+key] = buf
+	return "mock-etag", nil
+}
+
+// readTarball reads contents of regular files in the tarball
+func readTarball(path string) map[string][]byte {
+	f, e := os.Open(path)
+	Expect(e).Should(Succeed())
+	defer f.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return files
+		}
+		Expect(e).Should(Succeed())
+		if hdr.Typeflag == tar.TypeReg {
+			files[hdr.Name], e = ioutil.ReadAll(tr)
+			Expect(e).Should(Succeed())
+		}
+	}
+}
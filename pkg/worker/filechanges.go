@@ -0,0 +1,194 @@
+package worker
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types/container"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+// kinds of paths changed by the container
+const (
+	ChangeAdded    = "Added"
+	ChangeModified = "Modified"
+	// ChangeChanged is a path added or modified, for runtimes not telling them apart
+	ChangeChanged = "Changed"
+	ChangeDeleted = "Deleted"
+)
+
+// defaultTopChanges is the number of the largest changes reported by default
+const defaultTopChanges = 10
+
+// dockerChangeKinds are kinds of container changes reported by docker and libpod
+var dockerChangeKinds = map[uint8]string{
+	0: ChangeModified,
+	1: ChangeAdded,
+	2: ChangeDeleted,
+}
+
+// FileChangeOptions configures the summary of files changed by the container
+type FileChangeOptions struct {
+	// Top is the number of the largest changes reported in the result, 10 if it is not set
+	Top int `json:"top,omitempty"`
+}
+
+// ChangeLister is implemented by runtimes able to list paths changed in containers, telling added paths from modified ones
+type ChangeLister interface {
+	// Changes returns kinds of paths changed in the container, keyed by absolute paths
+	Changes(ctx context.Context, container string) (map[string]string, error)
+}
+
+// DiffSummary summarizes files in the container read/write layer, directories are not counted
+type DiffSummary struct {
+	// Added, Modified and Deleted are the number of paths of each kind, and Changed is the number of paths added or modified,
+	// for runtimes not telling them apart
+	Added    int `json:"added"`
+	Modified int `json:"modified"`
+	Changed  int `json:"changed,omitempty"`
+	Deleted  int `json:"deleted"`
+	// Bytes is the total size of files added or modified
+	Bytes   int64        `json:"bytes"`
+	Changes []FileChange `json:"changes,omitempty"`
+}
+
+// FileChange is a path changed by the container
+type FileChange struct {
+	// Path is the absolute path in the snapshot
+	Path string `json:"path"`
+	// Kind is Added, Modified, Changed or Deleted
+	Kind string `json:"kind"`
+	Size int64  `json:"size,omitempty"`
+}
+
+// WriteFileChanges logs changes one per line between the begin and end markers, at most max bytes of them.
+// lines are short enough not to be split by container runtimes, and changes over the limit are counted in the end line only
+func WriteFileChanges(w io.Writer, changes []FileChange, max int) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s%s\n", constants.FileChangesLogPrefix, constants.FileChangesLogBegin)
+
+	var logged, size int
+	for _, c := range changes {
+		b, e := json.Marshal(c)
+		if e != nil {
+			return e
+		}
+		if size+len(b) > max {
+			break
+		}
+		fmt.Fprintf(bw, "%s%s\n", constants.FileChangesLogPrefix, b)
+		logged, size = logged+1, size+len(b)
+	}
+
+	fmt.Fprintf(bw, "%s%s %d %d\n", constants.FileChangesLogPrefix, constants.FileChangesLogEnd, logged, len(changes))
+	return bw.Flush()
+}
+
+// listChanges lists paths changed in the container, or returns nil if the runtime could not list them
+func listChanges(ctx context.Context, rt Runtime, ctr string) (map[string]string, error) {
+	lister, ok := rt.(ChangeLister)
+	if !ok {
+		return nil, nil
+	}
+	return lister.Changes(ctx, ctr)
+}
+
+// containerChanges returns kinds of docker or libpod container changes keyed by paths
+func containerChanges(items []container.ContainerChangeResponseItem) (map[string]string, error) {
+	kinds := make(map[string]string, len(items))
+	for _, item := range items {
+		kind, ok := dockerChangeKinds[item.Kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown kind %d of changed path %s", item.Kind, item.Path)
+		}
+		kinds[path.Clean("/"+item.Path)] = kind
+	}
+	return kinds, nil
+}
+
+// summarizeChanges summarizes the read/write layer of the committed image, kinds are of paths listed before committing
+func (c *Worker) summarizeChanges(ctx context.Context, ref reference.Named, kinds map[string]string) (*DiffSummary, error) {
+	reader, ok := c.runtime.(DiffReader)
+	if !ok {
+		return nil, errors.New("the container runtime can not read layers of committed images")
+	}
+	rc, e := reader.Diff(ctx, ref)
+	if e != nil {
+		return nil, fmt.Errorf("read container layer: %w", e)
+	}
+	defer rc.Close()
+
+	diff, e := summarizeDiff(rc, kinds)
+	if e != nil {
+		return nil, fmt.Errorf("summarize container layer: %w", e)
+	}
+	return diff, nil
+}
+
+// summarizeDiff lists files of the layer tarball sorted by paths, whiteouts are listed as deleted paths.
+// files are added or modified as kinds tell, or changed if they are not in kinds
+func summarizeDiff(r io.Reader, kinds map[string]string) (*DiffSummary, error) {
+	diff := &DiffSummary{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		base := path.Base(name)
+		change := FileChange{Path: name, Kind: kinds[name], Size: hdr.Size}
+		switch {
+		case base == whiteoutOpaque:
+			// opaque directories hide what is in lower layers, the directory itself is kept
+			change = FileChange{Path: path.Join(path.Dir(name), "*"), Kind: ChangeDeleted}
+		case strings.HasPrefix(base, whiteoutPrefix):
+			change = FileChange{Path: path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)), Kind: ChangeDeleted}
+		case change.Kind != ChangeAdded && change.Kind != ChangeModified:
+			change.Kind = ChangeChanged
+		}
+
+		switch change.Kind {
+		case ChangeAdded:
+			diff.Added++
+		case ChangeModified:
+			diff.Modified++
+		case ChangeChanged:
+			diff.Changed++
+		case ChangeDeleted:
+			diff.Deleted++
+		}
+		diff.Bytes += change.Size
+		diff.Changes = append(diff.Changes, change)
+	}
+
+	sort.Slice(diff.Changes, func(i, j int) bool { return diff.Changes[i].Path < diff.Changes[j].Path })
+	return diff, nil
+}
+
+// largest returns a copy of the summary with the n largest changes only, ties are ordered by paths
+func (d *DiffSummary) largest(n int) *DiffSummary {
+	top := *d
+	top.Changes = append([]FileChange(nil), d.Changes...)
+	sort.SliceStable(top.Changes, func(i, j int) bool { return top.Changes[i].Size > top.Changes[j].Size })
+	if len(top.Changes) > n {
+		top.Changes = top.Changes[:n]
+	}
+	return &top
+}
@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("file changes", func() {
+	var ctx = context.Background()
+
+	Context("when summarizing the container layer", func() {
+		files := map[string]string{
+			"app/":             "",
+			"app/data":         "data",
+			"app/main":         "main!!",
+			"app/.wh.old":      "",
+			"tmp/":             "",
+			"tmp/.wh..wh..opq": "",
+			"tmp/junk":         "junk!",
+		}
+
+		It("should list changed files and deleted paths, without directories", func() {
+			diff, e := summarizeDiff(bytes.NewReader(layerTarball(files)), nil)
+			Expect(e).Should(Succeed())
+			Expect(diff.Changed).Should(Equal(3))
+			Expect(diff.Deleted).Should(Equal(2))
+			Expect(diff.Bytes).Should(Equal(int64(15)))
+			Expect(diff.Changes).Should(Equal([]FileChange{
+				{Path: "/app/data", Kind: ChangeChanged, Size: 4},
+				{Path: "/app/main", Kind: ChangeChanged, Size: 6},
+				{Path: "/app/old", Kind: ChangeDeleted},
+				{Path: "/tmp/*", Kind: ChangeDeleted},
+				{Path: "/tmp/junk", Kind: ChangeChanged, Size: 5},
+			}))
+		})
+
+		It("should tell added files from modified ones by kinds listed before committing", func() {
+			diff, e := summarizeDiff(bytes.NewReader(layerTarball(files)), map[string]string{
+				"/app":      ChangeModified,
+				"/app/data": ChangeAdded,
+				"/app/main": ChangeModified,
+				"/app/old":  ChangeDeleted,
+			})
+			Expect(e).Should(Succeed())
+			Expect(diff.Added).Should(Equal(1))
+			Expect(diff.Modified).Should(Equal(1))
+			Expect(diff.Changed).Should(Equal(1))
+			Expect(diff.Deleted).Should(Equal(2))
+		})
+
+		It("should keep the largest changes only", func() {
+			diff, e := summarizeDiff(bytes.NewReader(layerTarball(files)), nil)
+			Expect(e).Should(Succeed())
+			top := diff.largest(2)
+			Expect(top.Changes).Should(Equal([]FileChange{
+				{Path: "/app/main", Kind: ChangeChanged, Size: 6},
+				{Path: "/tmp/junk", Kind: ChangeChanged, Size: 5},
+			}))
+			Expect(top.Changed).Should(Equal(3))
+			Expect(diff.Changes).Should(HaveLen(5))
+		})
+
+		It("should reject unknown kinds of container changes", func() {
+			kinds, e := containerChanges([]container.ContainerChangeResponseItem{{Kind: 1, Path: "/app/data"}, {Kind: 0, Path: "/app"}})
+			Expect(e).Should(Succeed())
+			Expect(kinds).Should(Equal(map[string]string{"/app/data": ChangeAdded, "/app": ChangeModified}))
+
+			_, e = containerChanges([]container.ContainerChangeResponseItem{{Kind: 7, Path: "/app"}})
+			Expect(e).Should(HaveOccurred())
+		})
+	})
+
+	Context("with the docker runtime", func() {
+		var (
+			client  *mockDockerClient
+			worker  Worker
+			options SnapshotOptions
+		)
+
+		BeforeEach(func() {
+			client = &mockDockerClient{
+				archive: dockerArchive(map[string]string{
+					"manifest.json":  `[{"Config":"abc.json","RepoTags":["image-name:latest"],"Layers":["base/layer.tar","top/layer.tar"]}]`,
+					"abc.json":       `{"architecture":"amd64","rootfs":{"type":"layers","diff_ids":["sha256:a","sha256:b"]}}`,
+					"base/layer.tar": string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "base"})),
+					"top/layer.tar":  string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "changed", "etc/.wh.motd": "", "tmp/": "", "tmp/junk": "junk"})),
+				}, nil),
+				changes: []container.ContainerChangeResponseItem{
+					{Kind: 0, Path: "/etc"},
+					{Kind: 0, Path: "/etc/hosts"},
+					{Kind: 2, Path: "/etc/motd"},
+					{Kind: 1, Path: "/tmp"},
+					{Kind: 1, Path: "/tmp/junk"},
+				},
+			}
+			worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+			options = SnapshotOptions{
+				Container:   "container-id",
+				Image:       "image-name",
+				FileChanges: &FileChangeOptions{Top: 1},
+			}
+		})
+
+		It("should report counts and the largest changes", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.FileChanges).Should(Equal(&DiffSummary{
+				Added: 1, Modified: 1, Deleted: 1, Bytes: 11,
+				Changes: []FileChange{{Path: "/etc/hosts", Kind: ChangeModified, Size: 7}},
+			}))
+			Expect(result.AllFileChanges).Should(Equal([]FileChange{
+				{Path: "/etc/hosts", Kind: ChangeModified, Size: 7},
+				{Path: "/etc/motd", Kind: ChangeDeleted},
+				{Path: "/tmp/junk", Kind: ChangeAdded, Size: 4},
+			}))
+		})
+
+		It("should not report paths excluded", func() {
+			options.Exclude = []string{"/tmp/*"}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.FileChanges.Added).Should(Equal(0))
+			Expect(result.AllFileChanges).Should(HaveLen(2))
+		})
+
+		It("should not report changes unless asked", func() {
+			options.FileChanges = nil
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.FileChanges).Should(BeNil())
+		})
+	})
+
+	Context("with the podman runtime", func() {
+		It("should list changes by libpod", func() {
+			server := httptest.NewServer(&mockLibpod{changes: []container.ContainerChangeResponseItem{{Kind: 1, Path: "/app/data"}}})
+			defer server.Close()
+			rt := NewPodmanRuntime(&libpodClient{client: server.Client(), base: server.URL})
+			kinds, e := listChanges(ctx, rt, "container-id")
+			Expect(e).Should(Succeed())
+			Expect(kinds).Should(Equal(map[string]string{"/app/data": ChangeAdded}))
+		})
+	})
+
+	Context("when logging all changes", func() {
+		changes := []FileChange{
+			{Path: "/etc/hosts", Kind: ChangeModified, Size: 7},
+			{Path: "/etc/motd", Kind: ChangeDeleted},
+			{Path: "/tmp/junk", Kind: ChangeAdded, Size: 4},
+		}
+
+		It("should log a change per line between the markers", func() {
+			var b bytes.Buffer
+			Expect(WriteFileChanges(&b, changes, constants.MaxFileChangesLog)).Should(Succeed())
+			Expect(b.String()).Should(Equal(constants.FileChangesLogPrefix + "begin\n" +
+				constants.FileChangesLogPrefix + `{"path":"/etc/hosts","kind":"Modified","size":7}` + "\n" +
+				constants.FileChangesLogPrefix + `{"path":"/etc/motd","kind":"Deleted"}` + "\n" +
+				constants.FileChangesLogPrefix + `{"path":"/tmp/junk","kind":"Added","size":4}` + "\n" +
+				constants.FileChangesLogPrefix + "end 3 3\n"))
+		})
+
+		It("should count changes over the size limit in the end line only", func() {
+			var b bytes.Buffer
+			Expect(WriteFileChanges(&b, changes, 100)).Should(Succeed())
+			lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+			Expect(lines).Should(HaveLen(4))
+			Expect(lines[3]).Should(Equal(constants.FileChangesLogPrefix + "end 2 3"))
+		})
+	})
+})
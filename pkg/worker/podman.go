@@ -0,0 +1,440 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	libpodAPIVersion   = "v1.0.0"
+	headerRegistryAuth = "X-Registry-Auth"
+	podmanImageFormat  = "docker"
+	// host of the url is ignored, all requests are sent to the unix socket
+	libpodBaseURL = "http://d"
+)
+
+// PodmanClient is a subset of libpod REST API, to make the worker interface simpler
+type PodmanClient interface {
+	ContainerCommit(ctx context.Context, container string, options PodmanCommitOptions) (string, error)
+	ContainerInspect(ctx context.Context, ctr string, size bool) (*PodmanContainer, error)
+	ImageInspect(ctx context.Context, image string) (*PodmanImage, error)
+	ImageTag(ctx context.Context, image, repo, tag string) error
+	ImagePush(ctx context.Context, image string, registryAuth string) (io.ReadCloser, error)
+	ContainerPause(ctx context.Context, container string) error
+	ContainerUnpause(ctx context.Context, container string) error
+	ImageRemove(ctx context.Context, image string) error
+	ImageSave(ctx context.Context, image string) (io.ReadCloser, error)
+	ImageLoad(ctx context.Context, archive io.Reader) error
+	ContainerChanges(ctx context.Context, ctr string) ([]container.ContainerChangeResponseItem, error)
+}
+
+// PodmanCommitOptions are query parameters of libpod commit API
+type PodmanCommitOptions struct {
+	Repo    string
+	Tag     string
+	Author  string
+	Comment string
+	Changes []string
+}
+
+// PodmanContainer is a subset of libpod container inspect data
+type PodmanContainer struct {
+	ID string `json:"Id"`
+	// Image is the id of the image the container runs, and ImageName is the name it is created with
+	Image     string `json:"Image"`
+	ImageName string `json:"ImageName"`
+	// SizeRw is the size of the read/write layer, reported if it is inspected with the size
+	SizeRw *int64 `json:"SizeRw,omitempty"`
+	// Config is the runtime config of the container, in the same fields as docker container configs
+	Config *container.Config `json:"Config,omitempty"`
+}
+
+// PodmanImage is a subset of libpod image inspect data
+type PodmanImage struct {
+	ID     string            `json:"Id"`
+	Config *container.Config `json:"Config,omitempty"`
+}
+
+type podmanRuntime struct {
+	client PodmanClient
+}
+
+// NewPodmanRuntime returns a runtime taking snapshots through podman, for containers run by CRI-O
+func NewPodmanRuntime(cli PodmanClient) Runtime {
+	return &podmanRuntime{client: cli}
+}
+
+// Commit commits the container through libpod, which does not report the read/write layer size
+func (r *podmanRuntime) Commit(ctx context.Context, ctr string, ref reference.Named, opt *SnapshotOptions) (*Image, error) {
+	tag, e := tagOf(ref)
+	if e != nil {
+		return nil, e
+	}
+	info, e := r.client.ContainerInspect(ctx, ctr, false)
+	if e != nil {
+		return nil, fmt.Errorf("inspect container %s: %w", ctr, e)
+	}
+	if info.Config == nil {
+		return nil, fmt.Errorf("inspect container %s: no config found", ctr)
+	}
+	base, e := r.client.ImageInspect(ctx, info.Image)
+	if e != nil {
+		return nil, fmt.Errorf("inspect source image %s: %w", info.Image, e)
+	}
+
+	changes, e := parseChanges(opt.Changes)
+	if e != nil {
+		return nil, e
+	}
+	// libpod takes changes instead of a config, the merged config goes before changes of the snapshot, and its labels after them
+	config := mergeDockerConfig(info.Config, base.Config, changes)
+	log.Info("merged snapshot config", "from container", config.Labels[LabelConfigFromContainer], "from image", config.Labels[LabelConfigFromImage])
+	fields, labels := configChanges(config)
+
+	id, e := r.client.ContainerCommit(ctx, ctr, PodmanCommitOptions{
+		Repo:    ref.Name(),
+		Tag:     tag,
+		Author:  opt.Author,
+		Comment: opt.Comment,
+		Changes: append(append(fields, opt.Changes...), labels...),
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	return &Image{
+		ID:           id,
+		Source:       info.ImageName,
+		SourceDigest: digest.NewDigestFromHex(string(digest.SHA256), info.Image).String(),
+	}, nil
+}
+
+func (r *podmanRuntime) Pause(ctx context.Context, ctr string) error {
+	return r.client.ContainerPause(ctx, ctr)
+}
+
+func (r *podmanRuntime) Unpause(ctx context.Context, ctr string) error {
+	return r.client.ContainerUnpause(ctx, ctr)
+}
+
+func (r *podmanRuntime) Tag(ctx context.Context, source, target reference.Named) error {
+	tag, e := tagOf(target)
+	if e != nil {
+		return e
+	}
+	return r.client.ImageTag(ctx, reference.TagNameOnly(source).String(), target.Name(), tag)
+}
+
+func (r *podmanRuntime) Remove(ctx context.Context, img *Image, refs []reference.Named) error {
+	return r.client.ImageRemove(ctx, img.ID)
+}
+
+func (r *podmanRuntime) Save(ctx context.Context, image string) (io.ReadCloser, error) {
+	return r.client.ImageSave(ctx, image)
+}
+
+// Diff returns the top layer of the image saved by libpod
+func (r *podmanRuntime) Diff(ctx context.Context, ref reference.Named) (io.ReadCloser, error) {
+	return savedDiff(ctx, r, reference.TagNameOnly(ref).String())
+}
+
+// Measure measures the container read/write layer by libpod
+func (r *podmanRuntime) Measure(ctx context.Context, ctr string) (int64, error) {
+	info, e := r.client.ContainerInspect(ctx, ctr, true)
+	if e != nil {
+		return 0, fmt.Errorf("inspect container %s: %w", ctr, e)
+	}
+	if info.SizeRw == nil {
+		return 0, fmt.Errorf("inspect container %s: no size reported", ctr)
+	}
+	return *info.SizeRw, nil
+}
+
+// Changes lists paths changed in the container by libpod
+func (r *podmanRuntime) Changes(ctx context.Context, ctr string) (map[string]string, error) {
+	items, e := r.client.ContainerChanges(ctx, ctr)
+	if e != nil {
+		return nil, e
+	}
+	return containerChanges(items)
+}
+
+// Rewrite rewrites the image saved by libpod, and loads the rewritten image back.
+// the image before rewritten is removed, it is left dangling by the rewritten one
+func (r *podmanRuntime) Rewrite(ctx context.Context, ref reference.Named, img *Image, rw *layerRewrite) (*Image, error) {
+	config, layers, e := rewriteSavedImage(ctx, r, r.client.ImageLoad, ref, img, rw)
+	if e != nil {
+		return nil, e
+	}
+	// libpod image ids are config digests without the algorithm
+	if config.Hex() == img.ID {
+		return img, nil
+	}
+	if e := r.client.ImageRemove(ctx, img.ID); e != nil {
+		log.Error(e, "remove the image before rewritten", "id", img.ID)
+	}
+
+	rewritten := *img
+	rewritten.ID, rewritten.Layers = config.Hex(), layers
+	return &rewritten, nil
+}
+
+// Push pushes the image through libpod, the manifest digest is not reported by the libpod push stream
+func (r *podmanRuntime) Push(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (string, error) {
+	var coded string
+	if auth != nil {
+		var e error
+		coded, e = formatAuth(*auth)
+		if e != nil {
+			return "", e
+		}
+	}
+
+	resp, e := r.client.ImagePush(ctx, reference.TagNameOnly(ref).String(), coded)
+	if e != nil {
+		return "", classifyPushError(e)
+	}
+
+	return "", r.printPushMessage(resp)
+}
+
+// podmanPushReport is a line of the libpod push response stream
+type podmanPushReport struct {
+	Stream string `json:"stream,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (r *podmanRuntime) printPushMessage(rc io.ReadCloser) error {
+	dec := json.NewDecoder(rc)
+	defer rc.Close()
+
+	for {
+		var report podmanPushReport
+		if e := dec.Decode(&report); e != nil {
+			if e == io.EOF {
+				return nil
+			}
+			return classifyPushError(e)
+		}
+
+		if report.Error != "" {
+			return classifyPushError(errors.New(report.Error))
+		}
+		log.Info(strings.TrimSpace(report.Stream))
+	}
+}
+
+type libpodClient struct {
+	client *http.Client
+	base   string
+}
+
+// NewLibpodClient returns a client of libpod REST API served on the unix socket
+func NewLibpodClient(socket string) PodmanClient {
+	return &libpodClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		base: libpodBaseURL,
+	}
+}
+
+func (c *libpodClient) ContainerCommit(ctx context.Context, container string, options PodmanCommitOptions) (string, error) {
+	query := url.Values{}
+	query.Set("container", container)
+	query.Set("repo", options.Repo)
+	query.Set("tag", options.Tag)
+	query.Set("author", options.Author)
+	query.Set("comment", options.Comment)
+	query.Set("format", podmanImageFormat)
+	// containers are paused by the worker as the pause policy requires
+	query.Set("pause", "false")
+	for _, c := range options.Changes {
+		query.Add("changes", c)
+	}
+
+	resp, e := c.post(ctx, "/commit", query, nil)
+	if e != nil {
+		return "", e
+	}
+	defer resp.Body.Close()
+
+	var id types.IDResponse
+	if e := json.NewDecoder(resp.Body).Decode(&id); e != nil {
+		return "", fmt.Errorf("decode commit response: %w", e)
+	}
+
+	return id.ID, nil
+}
+
+func (c *libpodClient) ContainerInspect(ctx context.Context, ctr string, size bool) (*PodmanContainer, error) {
+	query := url.Values{}
+	query.Set("size", strconv.FormatBool(size))
+	resp, e := c.do(ctx, http.MethodGet, "/containers/"+ctr+"/json", query, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	var info PodmanContainer
+	if e := json.NewDecoder(resp.Body).Decode(&info); e != nil {
+		return nil, fmt.Errorf("decode inspect response: %w", e)
+	}
+	return &info, nil
+}
+
+func (c *libpodClient) ImageInspect(ctx context.Context, image string) (*PodmanImage, error) {
+	resp, e := c.do(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	var info PodmanImage
+	if e := json.NewDecoder(resp.Body).Decode(&info); e != nil {
+		return nil, fmt.Errorf("decode inspect response: %w", e)
+	}
+	return &info, nil
+}
+
+func (c *libpodClient) ImageTag(ctx context.Context, image, repo, tag string) error {
+	query := url.Values{}
+	query.Set("repo", repo)
+	query.Set("tag", tag)
+
+	resp, e := c.post(ctx, "/images/"+image+"/tag", query, nil)
+	if e != nil {
+		return e
+	}
+	return resp.Body.Close()
+}
+
+func (c *libpodClient) ImagePush(ctx context.Context, image string, registryAuth string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("destination", image)
+
+	header := http.Header{}
+	if registryAuth != "" {
+		header.Set(headerRegistryAuth, registryAuth)
+	}
+
+	resp, e := c.post(ctx, "/images/"+image+"/push", query, header)
+	if e != nil {
+		return nil, e
+	}
+
+	return resp.Body, nil
+}
+
+func (c *libpodClient) ContainerPause(ctx context.Context, container string) error {
+	resp, e := c.post(ctx, "/containers/"+container+"/pause", nil, nil)
+	if e != nil {
+		return e
+	}
+	return resp.Body.Close()
+}
+
+func (c *libpodClient) ContainerUnpause(ctx context.Context, container string) error {
+	resp, e := c.post(ctx, "/containers/"+container+"/unpause", nil, nil)
+	if e != nil {
+		return e
+	}
+	return resp.Body.Close()
+}
+
+// ImageRemove removes the image by id, with all its tags
+func (c *libpodClient) ImageRemove(ctx context.Context, image string) error {
+	query := url.Values{}
+	query.Set("force", "true")
+
+	resp, e := c.do(ctx, http.MethodDelete, "/images/"+image, query, nil, nil)
+	if e != nil {
+		return e
+	}
+	return resp.Body.Close()
+}
+
+// ContainerChanges lists paths changed in the container, same as docker container diff
+func (c *libpodClient) ContainerChanges(ctx context.Context, ctr string) ([]container.ContainerChangeResponseItem, error) {
+	resp, e := c.do(ctx, http.MethodGet, "/containers/"+ctr+"/changes", nil, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	var items []container.ContainerChangeResponseItem
+	if e := json.NewDecoder(resp.Body).Decode(&items); e != nil {
+		return nil, fmt.Errorf("decode changes response: %w", e)
+	}
+	return items, nil
+}
+
+// ImageSave exports the image as a docker archive
+func (c *libpodClient) ImageSave(ctx context.Context, image string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("format", "docker-archive")
+
+	resp, e := c.do(ctx, http.MethodGet, "/images/"+image+"/get", query, nil, nil)
+	if e != nil {
+		return nil, e
+	}
+	return resp.Body, nil
+}
+
+// ImageLoad loads images in the docker archive
+func (c *libpodClient) ImageLoad(ctx context.Context, archive io.Reader) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+
+	resp, e := c.do(ctx, http.MethodPost, "/images/load", nil, header, archive)
+	if e != nil {
+		return e
+	}
+	return resp.Body.Close()
+}
+
+func (c *libpodClient) post(ctx context.Context, path string, query url.Values, header http.Header) (*http.Response, error) {
+	return c.do(ctx, http.MethodPost, path, query, header, nil)
+}
+
+func (c *libpodClient) do(ctx context.Context, method, path string, query url.Values, header http.Header, body io.Reader) (*http.Response, error) {
+	u := c.base + "/" + libpodAPIVersion + "/libpod" + path + "?" + query.Encode()
+	req, e := http.NewRequestWithContext(ctx, method, u, body)
+	if e != nil {
+		return nil, fmt.Errorf("create request: %w", e)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, e := c.client.Do(req)
+	if e != nil {
+		return nil, fmt.Errorf("%s %s: %w", strings.ToLower(method), path, e)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s %s: %s: %s", strings.ToLower(method), path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,318 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("podman runtime", func() {
+	var (
+		ctx     = context.Background()
+		server  *httptest.Server
+		libpod  *mockLibpod
+		worker  Worker
+		options = SnapshotOptions{
+			Container: "container-id",
+			Image:     "reg.example.com/snapshots/image-name:v1",
+			Author:    "someone",
+		}
+	)
+
+	BeforeEach(func() {
+		libpod = &mockLibpod{}
+		server = httptest.NewServer(libpod)
+		worker = Worker{
+			runtime: NewPodmanRuntime(&libpodClient{client: server.Client(), base: server.URL}),
+			auths: mergedDockerAuth{
+				"reg.example.com": {{Username: "user", Password: "password"}},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Context("when libpod steps all good", func() {
+		It("should succeed", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+		})
+
+		It("should commit the container", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(libpod.commit.Get("container")).Should(Equal("container-id"))
+			Expect(libpod.commit.Get("repo")).Should(Equal("reg.example.com/snapshots/image-name"))
+			Expect(libpod.commit.Get("tag")).Should(Equal("v1"))
+			Expect(libpod.commit.Get("author")).Should(Equal("someone"))
+		})
+
+		It("should carry over the container config and record where it comes from", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(libpod.commit["changes"]).Should(Equal([]string{
+				`CMD ["serve","--debug"]`,
+				`ENV PATH="/bin"`,
+				`ENV DEBUG="1"`,
+				`USER 1000`,
+				`LABEL ` + LabelConfigFromContainer + `="Cmd,Env,User"`,
+				`LABEL ` + LabelConfigFromImage + `="Entrypoint,WorkingDir,ExposedPorts"`,
+			}))
+		})
+
+		It("should report the source image of the container", func() {
+			ref, e := reference.ParseNormalizedNamed(options.Image)
+			Expect(e).Should(Succeed())
+			img, e := worker.runtime.Commit(ctx, "container-id", ref, &options)
+			Expect(e).Should(Succeed())
+			Expect(img.Source).Should(Equal("quay.io/example/source-image:latest"))
+			Expect(img.SourceDigest).Should(Equal("sha256:source-image-id"))
+		})
+
+		It("should push the image with registry auth", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(libpod.pushed).Should(Equal("reg.example.com/snapshots/image-name:v1"))
+			Expect(libpod.auth).ShouldNot(BeEmpty())
+		})
+
+		It("should refuse containers over the max size before committing", func() {
+			opt := options
+			opt.MaxSize = 1024
+			result, e := worker.TakeSnapshot(ctx, &opt)
+			Expect(e).Should(MatchError(ErrTooLarge))
+			Expect(result.Size).Should(Equal(int64(2048)))
+			Expect(libpod.commit).Should(BeNil())
+		})
+	})
+
+	Context("with additional tags", func() {
+		It("should tag the committed image", func() {
+			opts := options
+			opts.Tags = []string{"latest"}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(libpod.tagged).Should(Equal([]string{"reg.example.com/snapshots/image-name:latest"}))
+			Expect(libpod.pushed).Should(Equal("reg.example.com/snapshots/image-name:latest"))
+		})
+	})
+
+	Context("with digest references", func() {
+		const d = "@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+		It("should reject them before committing", func() {
+			opts := options
+			opts.Image = "reg.example.com/snapshots/image-name" + d
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrInvalidImage))
+
+			opts = options
+			opts.Mirrors = []string{"mirror.example.com/image-name" + d}
+			_, e = worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrInvalidImage))
+			Expect(libpod.commit).Should(BeNil())
+		})
+
+		It("should fail instead of panicking if the runtime is given one", func() {
+			ref, e := reference.ParseNormalizedNamed("reg.example.com/snapshots/image-name" + d)
+			Expect(e).Should(Succeed())
+			_, e = worker.runtime.Commit(ctx, "container-id", ref, &options)
+			Expect(e).Should(HaveOccurred())
+			Expect(worker.runtime.Tag(ctx, ref, ref)).ShouldNot(Succeed())
+		})
+	})
+
+	Context("with the Always cleanup policy", func() {
+		It("should remove the committed image by id", func() {
+			opts := options
+			opts.Cleanup = constants.CleanupAlways
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(libpod.removed).Should(Equal([]string{"mock id?force=true"}))
+		})
+	})
+
+	Context("with the default pause policy", func() {
+		It("should pause the container while committing", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(libpod.calls).Should(Equal([]string{"container-id/pause", "container-id/unpause"}))
+			Expect(libpod.commit.Get("pause")).Should(Equal("false"))
+		})
+	})
+
+	Context("when commit changes are given", func() {
+		It("should pass changes to libpod", func() {
+			opts := options
+			opts.Changes = []string{"USER nobody", "WORKDIR /app"}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			// changes of the snapshot override the config carried over from the container
+			changes := libpod.commit["changes"]
+			Expect(changes).Should(HaveLen(8))
+			Expect(changes[:3]).Should(Equal([]string{`CMD ["serve","--debug"]`, `ENV PATH="/bin"`, `ENV DEBUG="1"`}))
+			Expect(changes[3:5]).Should(Equal(opts.Changes))
+			Expect(changes[7]).Should(Equal(`LABEL ` + LabelConfigFromChanges + `="User,WorkingDir"`))
+		})
+
+		It("should escape env values for dockerfile instructions", func() {
+			fields, labels := configChanges(&container.Config{
+				Env: []string{`PS1=$HOME\n`, `GREETING=café "au lait"`, `PATH=/bin`},
+				Labels: map[string]string{
+					LabelConfigFromContainer: "Env",
+					LabelConfigFromImage:     `$dollar\back`,
+				},
+			})
+			// dollars, backslashes and quotes are escaped, so the values are parsed back as is
+			Expect(fields).Should(Equal([]string{
+				`ENV PS1="\$HOME\\n"`,
+				`ENV GREETING="café \"au lait\""`,
+				`ENV PATH="/bin"`,
+			}))
+			Expect(labels).Should(Equal([]string{
+				`LABEL ` + LabelConfigFromContainer + `="Env"`,
+				`LABEL ` + LabelConfigFromImage + `="\$dollar\\back"`,
+			}))
+		})
+	})
+
+	Context("when container commit fails", func() {
+		BeforeEach(func() {
+			libpod.badCommit = true
+		})
+
+		It("should fail", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrCommit))
+		})
+	})
+
+	Context("when push reports an error in the stream", func() {
+		BeforeEach(func() {
+			libpod.badPush = true
+		})
+
+		It("should fail", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPush))
+		})
+
+		It("should tell the access is denied", func() {
+			result, _ := worker.TakeSnapshot(ctx, &options)
+			Expect(result.Destinations[0].Error).Should(Equal(constants.ErrorPushAccessDenied))
+		})
+	})
+
+	Context("when the push stream breaks", func() {
+		BeforeEach(func() {
+			libpod.brokenPush = true
+		})
+
+		It("should tell it is a network error", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Destinations[0].Error).Should(Equal(constants.ErrorPushNetwork))
+		})
+	})
+})
+
+// mockLibpod serves a minimal libpod REST API
+type mockLibpod struct {
+	badCommit bool
+	badPush   bool
+	// brokenPush cuts the push stream in the middle of a report
+	brokenPush bool
+	commit     url.Values
+	pushed     string
+	auth       string
+	calls      []string
+	tagged     []string
+	removed    []string
+	changes    []container.ContainerChangeResponseItem
+}
+
+func (m *mockLibpod) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/" + libpodAPIVersion + "/libpod"
+
+	switch {
+	case r.URL.Path == prefix+"/commit":
+		if m.badCommit {
+			http.Error(w, `{"cause":"no such container","message":"no such container","response":404}`, http.StatusNotFound)
+			return
+		}
+		m.commit = r.URL.Query()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(types.IDResponse{ID: "mock id"})
+
+	case strings.HasPrefix(r.URL.Path, prefix+"/containers/") && strings.HasSuffix(r.URL.Path, "/changes"):
+		json.NewEncoder(w).Encode(m.changes)
+
+	case strings.HasPrefix(r.URL.Path, prefix+"/containers/") && r.Method == http.MethodGet:
+		info := PodmanContainer{
+			ID:        "container-id",
+			Image:     "source-image-id",
+			ImageName: "quay.io/example/source-image:latest",
+			Config: &container.Config{
+				Cmd:        []string{"serve", "--debug"},
+				Entrypoint: []string{"/entrypoint.sh"},
+				Env:        []string{"PATH=/bin", "DEBUG=1"},
+				WorkingDir: "/",
+				User:       "1000",
+			},
+		}
+		if r.URL.Query().Get("size") == "true" {
+			info.SizeRw = new(int64)
+			*info.SizeRw = 2048
+		}
+		json.NewEncoder(w).Encode(info)
+
+	case strings.HasPrefix(r.URL.Path, prefix+"/containers/"):
+		m.calls = append(m.calls, strings.TrimPrefix(r.URL.Path, prefix+"/containers/"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case strings.HasPrefix(r.URL.Path, prefix+"/images/") && r.Method == http.MethodDelete:
+		m.removed = append(m.removed, strings.TrimPrefix(r.URL.Path, prefix+"/images/")+"?"+r.URL.RawQuery)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Deleted": []string{"mock id"}})
+
+	case strings.HasPrefix(r.URL.Path, prefix+"/images/") && strings.HasSuffix(r.URL.Path, "/json"):
+		json.NewEncoder(w).Encode(PodmanImage{ID: "source-image-id", Config: &container.Config{
+			Cmd:        []string{"serve"},
+			Entrypoint: []string{"/entrypoint.sh"},
+			Env:        []string{"PATH=/bin"},
+			WorkingDir: "/",
+			Labels:     map[string]string{"maintainer": "someone@example.com"},
+		}})
+
+	case strings.HasPrefix(r.URL.Path, prefix+"/images/") && strings.HasSuffix(r.URL.Path, "/tag"):
+		m.tagged = append(m.tagged, r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag"))
+		w.WriteHeader(http.StatusCreated)
+
+	case strings.HasPrefix(r.URL.Path, prefix+"/images/"):
+		m.pushed = r.URL.Query().Get("destination")
+		m.auth = r.Header.Get(headerRegistryAuth)
+		fmt.Fprintln(w, `{"stream":"Getting image source signatures\n"}`)
+		if m.badPush {
+			fmt.Fprintln(w, `{"error":"denied: requested access to the resource is denied"}`)
+		}
+		if m.brokenPush {
+			fmt.Fprint(w, `{"stream":"Copying blob`)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,161 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// PolicyRequestVersion is the version of requests sent to policy checkers
+const PolicyRequestVersion = "v1"
+
+// maxPolicyMessage is the max size of error messages and reasons read from policy checkers,
+// they end up in the termination message, which is limited to 4KiB with all other results
+const maxPolicyMessage = 256
+
+// PolicyOptions configures the policy check before pushing or exporting the snapshot
+type PolicyOptions struct {
+	// Metadata is about the snapshot, such as its namespace, name and source pod, passed to the checker as is
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Timeout limits time of the check, no limit other than the worker timeout if it is 0
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Checker PolicyChecker `json:"-"`
+}
+
+// PolicyChecker decides if the snapshot could be pushed or exported
+type PolicyChecker interface {
+	Check(ctx context.Context, req *PolicyRequest) (*PolicyDecision, error)
+}
+
+// PolicyRequest is what policy checkers decide on
+type PolicyRequest struct {
+	// Version is the version of the request document, PolicyRequestVersion
+	Version string `json:"version"`
+	// Image is the full name of the snapshot image
+	Image string `json:"image"`
+	// ImageID is the id of the committed image on the node, after secret envs are scrubbed and paths are excluded
+	ImageID string `json:"imageID"`
+	// Size is the size of the container read/write layer in bytes, and Layers is the number of layers of the image
+	Size   int64 `json:"size,omitempty"`
+	Layers int   `json:"layers,omitempty"`
+	// Diff summarizes files changed by the container
+	Diff     *DiffSummary      `json:"diff"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// PolicyDecision is the answer of policy checkers, the snapshot is rejected unless it is allowed
+type PolicyDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// checkPolicy asks the checker if the snapshot with files changed by the container is allowed
+func (c *Worker) checkPolicy(ctx context.Context, ref reference.Named, img *Image, diff *DiffSummary, opt *PolicyOptions) (*PolicyDecision, error) {
+	if opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opt.Timeout)
+		defer cancel()
+	}
+	return opt.Checker.Check(ctx, &PolicyRequest{
+		Version:  PolicyRequestVersion,
+		Image:    reference.TagNameOnly(ref).String(),
+		ImageID:  img.ID,
+		Size:     img.Size,
+		Layers:   img.Layers,
+		Diff:     diff,
+		Metadata: opt.Metadata,
+	})
+}
+
+// execChecker runs a local executable as the policy checker,
+// the request is written to its stdin as json, and the decision is read from its stdout
+type execChecker struct {
+	command []string
+}
+
+// NewExecChecker returns a checker running the command, the first of which is the executable
+func NewExecChecker(command []string) (PolicyChecker, error) {
+	if len(command) == 0 {
+		return nil, errors.New("empty policy command")
+	}
+	return &execChecker{command: command}, nil
+}
+
+func (c *execChecker) Check(ctx context.Context, req *PolicyRequest) (*PolicyDecision, error) {
+	in, e := json.Marshal(req)
+	if e != nil {
+		return nil, e
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if e := cmd.Run(); e != nil {
+		return nil, fmt.Errorf("run policy command: %w: %s", e, truncate(stderr.String(), maxPolicyMessage))
+	}
+
+	var decision PolicyDecision
+	if e := json.Unmarshal(stdout.Bytes(), &decision); e != nil {
+		return nil, fmt.Errorf("parse policy decision: %w", e)
+	}
+	return &decision, nil
+}
+
+// webhookChecker posts the request to an http endpoint as json, the decision is read from the response body
+type webhookChecker struct {
+	client *http.Client
+	url    string
+}
+
+// NewWebhookChecker returns a checker posting requests to the url
+func NewWebhookChecker(client *http.Client, url string) PolicyChecker {
+	return &webhookChecker{client: client, url: url}
+}
+
+func (c *webhookChecker) Check(ctx context.Context, req *PolicyRequest) (*PolicyDecision, error) {
+	body, e := json.Marshal(req)
+	if e != nil {
+		return nil, e
+	}
+	r, e := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, e := c.client.Do(r)
+	if e != nil {
+		return nil, fmt.Errorf("call policy webhook: %w", e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxPolicyMessage+1))
+		return nil, fmt.Errorf("policy webhook responds %s: %s", resp.Status, shorten(string(msg), maxPolicyMessage))
+	}
+
+	var decision PolicyDecision
+	if e := json.NewDecoder(resp.Body).Decode(&decision); e != nil {
+		return nil, fmt.Errorf("parse policy decision: %w", e)
+	}
+	return &decision, nil
+}
+
+// truncate keeps the tail of the message, which is where errors usually are
+func truncate(msg string, n int) string {
+	msg = strings.TrimSpace(msg)
+	if len(msg) <= n {
+		return msg
+	}
+	return "..." + msg[len(msg)-n:]
+}
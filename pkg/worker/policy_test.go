@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("policy", func() {
+	var ctx = context.Background()
+
+	request := &PolicyRequest{
+		Version: PolicyRequestVersion,
+		Image:   "docker.io/library/image-name:latest",
+		ImageID: "sha256:image-id",
+		Diff:    &DiffSummary{Added: 1, Bytes: 4, Changes: []FileChange{{Path: "/app/data", Kind: ChangeAdded, Size: 4}}},
+	}
+
+	Context("with a command checker", func() {
+		It("should pass the request by stdin and read the decision from stdout", func() {
+			checker, e := NewExecChecker([]string{"sh", "-c", `grep -q '"imageID":"sha256:image-id"' && echo '{"allow":false,"reason":"no data allowed"}'`})
+			Expect(e).Should(Succeed())
+			decision, e := checker.Check(ctx, request)
+			Expect(e).Should(Succeed())
+			Expect(decision).Should(Equal(&PolicyDecision{Allow: false, Reason: "no data allowed"}))
+		})
+
+		It("should fail if the command fails", func() {
+			checker, e := NewExecChecker([]string{"sh", "-c", "echo broken >&2; exit 3"})
+			Expect(e).Should(Succeed())
+			_, e = checker.Check(ctx, request)
+			Expect(e).Should(MatchError(ContainSubstring("broken")))
+		})
+
+		It("should cut long errors short", func() {
+			checker, e := NewExecChecker([]string{"sh", "-c", "head -c 10000 /dev/zero | tr '\\0' x >&2; exit 3"})
+			Expect(e).Should(Succeed())
+			_, e = checker.Check(ctx, request)
+			Expect(e).Should(HaveOccurred())
+			Expect(len(e.Error())).Should(BeNumerically("<", 512))
+		})
+
+		It("should reject an empty command", func() {
+			_, e := NewExecChecker(nil)
+			Expect(e).Should(HaveOccurred())
+		})
+	})
+
+	Context("with a webhook checker", func() {
+		var (
+			server   *httptest.Server
+			received PolicyRequest
+			status   int
+		)
+
+		BeforeEach(func() {
+			status = http.StatusOK
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Method).Should(Equal(http.MethodPost))
+				Expect(json.NewDecoder(r.Body).Decode(&received)).Should(Succeed())
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					w.Write([]byte(`{"allow":true}`))
+				} else {
+					w.Write([]byte("policy engine down" + strings.Repeat(".", 10000)))
+				}
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should post the request and read the decision from the response", func() {
+			decision, e := NewWebhookChecker(server.Client(), server.URL).Check(ctx, request)
+			Expect(e).Should(Succeed())
+			Expect(decision.Allow).Should(BeTrue())
+			Expect(received).Should(Equal(*request))
+		})
+
+		It("should fail on error responses", func() {
+			status = http.StatusServiceUnavailable
+			_, e := NewWebhookChecker(server.Client(), server.URL).Check(ctx, request)
+			Expect(e).Should(MatchError(ContainSubstring("policy engine down")))
+			Expect(len(e.Error())).Should(BeNumerically("<", 512))
+		})
+	})
+
+	Context("with the docker runtime", func() {
+		var (
+			client  *mockDockerClient
+			checker *mockPolicyChecker
+			worker  Worker
+			options SnapshotOptions
+		)
+
+		BeforeEach(func() {
+			client = &mockDockerClient{archive: dockerArchive(map[string]string{
+				"manifest.json":  `[{"Config":"abc.json","RepoTags":["image-name:latest"],"Layers":["base/layer.tar","top/layer.tar"]}]`,
+				"abc.json":       `{"architecture":"amd64","rootfs":{"type":"layers","diff_ids":["sha256:a","sha256:b"]}}`,
+				"base/layer.tar": string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "base"})),
+				"top/layer.tar":  string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "changed", "tmp/": "", "tmp/junk": "junk"})),
+			}, nil)}
+			checker = &mockPolicyChecker{decision: &PolicyDecision{Allow: true}}
+			worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+			options = SnapshotOptions{
+				Container: "container-id",
+				Image:     "image-name",
+				Policy:    &PolicyOptions{Checker: checker, Metadata: map[string]string{"snapshot": "example"}},
+			}
+		})
+
+		It("should push the snapshot allowed by the policy", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+			Expect(client.pushed).ShouldNot(BeEmpty())
+
+			Expect(checker.request.ImageID).Should(Equal(result.ImageID))
+			Expect(checker.request.Image).Should(Equal("docker.io/library/image-name:latest"))
+			Expect(checker.request.Metadata).Should(Equal(map[string]string{"snapshot": "example"}))
+			Expect(checker.request.Diff.Changed).Should(Equal(2))
+		})
+
+		It("should check the snapshot after paths are excluded", func() {
+			options.Exclude = []string{"/tmp/*"}
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(checker.request.Diff.Changes).Should(Equal([]FileChange{{Path: "/etc/hosts", Kind: ChangeChanged, Size: 7}}))
+		})
+
+		It("should not push the snapshot denied by the policy", func() {
+			checker.decision = &PolicyDecision{Reason: "scratch data is not allowed"}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrRejected))
+			Expect(result.Phase).Should(Equal(constants.PhasePolicy))
+			Expect(result.Error).Should(Equal(constants.ErrorPolicyRejected))
+			Expect(result.Message).Should(ContainSubstring("scratch data is not allowed"))
+			Expect(client.pushed).Should(BeEmpty())
+		})
+
+		It("should not push the snapshot if the policy could not be checked", func() {
+			checker.err = errors.New("connection refused")
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPolicy))
+			Expect(result.Error).Should(Equal(constants.ErrorPolicy))
+			Expect(client.pushed).Should(BeEmpty())
+		})
+
+		It("should cut long reasons short", func() {
+			checker.decision = &PolicyDecision{Reason: strings.Repeat("x", 10000)}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrRejected))
+			Expect(len(result.Message)).Should(BeNumerically("<", 512))
+
+			checker.decision, checker.err = nil, errors.New(strings.Repeat("x", 10000))
+			result, e = worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPolicy))
+			Expect(len(result.Message)).Should(BeNumerically("<", 512))
+		})
+
+		It("should remove the committed image denied or not checked with the Always policy", func() {
+			options.Cleanup = constants.CleanupAlways
+			checker.decision = &PolicyDecision{Reason: "scratch data is not allowed"}
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrRejected))
+			Expect(client.removed).Should(Equal([]string{"mock id"}))
+
+			client.removed = nil
+			checker.err = errors.New("connection refused")
+			_, e = worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPolicy))
+			Expect(client.removed).Should(Equal([]string{"mock id"}))
+		})
+
+		It("should stop the check on timeout", func() {
+			checker.delay = time.Second
+			options.Policy.Timeout = 10 * time.Millisecond
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPolicy))
+		})
+	})
+})
+
+type mockPolicyChecker struct {
+	decision *PolicyDecision
+	err      error
+	delay    time.Duration
+	request  *PolicyRequest
+}
+
+func (c *mockPolicyChecker) Check(ctx context.Context, req *PolicyRequest) (*PolicyDecision, error) {
+	c.request = req
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.delay):
+	}
+	return c.decision, c.err
+}
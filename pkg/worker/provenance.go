@@ -0,0 +1,435 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+	"github.com/supremind/container-snapshot/version"
+)
+
+// provenance is an in-toto statement with the SLSA provenance predicate, attached to pushed images as OCI referrers or written next to exported tarballs,
+// see https://github.com/in-toto/attestation/blob/main/spec/README.md and https://slsa.dev/provenance/v0.2
+const (
+	// MediaTypeInToto is the media type of unsigned statements, and the artifact type of attestations
+	MediaTypeInToto = "application/vnd.in-toto+json"
+	// MediaTypeDSSE is the media type of statements signed in DSSE envelopes
+	MediaTypeDSSE = "application/vnd.dsse.envelope.v1+json"
+	// AnnotationPredicateType annotates attestations with the predicate type of the statement
+	AnnotationPredicateType = "in-toto.io/predicate-type"
+
+	StatementType           = "https://in-toto.io/Statement/v0.1"
+	PredicateSLSAProvenance = "https://slsa.dev/provenance/v0.2"
+	// BuildType tells how snapshots are built, parameters and environment of the predicate are defined by it
+	BuildType = "https://github.com/supremind/container-snapshot/ContainerSnapshot@v1"
+
+	// mediaTypeEmpty is the empty config of artifacts, whose content is {}
+	mediaTypeEmpty = "application/vnd.oci.empty.v1+json"
+)
+
+// builderID identifies the worker building snapshots
+var builderID = "https://github.com/supremind/container-snapshot/worker@" + version.Version
+
+// ProvenanceOptions configures the provenance attestation of pushed images, it describes where the snapshot comes from
+type ProvenanceOptions struct {
+	// Namespace, Snapshot and SnapshotUID identify the snapshot resource
+	Namespace   string `json:"namespace,omitempty"`
+	Snapshot    string `json:"snapshot,omitempty"`
+	SnapshotUID string `json:"snapshotUID,omitempty"`
+	// Pod, ContainerName and Node are where the source container runs, Runtime is its container runtime
+	Pod           string `json:"pod,omitempty"`
+	ContainerName string `json:"containerName,omitempty"`
+	Node          string `json:"node,omitempty"`
+	Runtime       string `json:"runtime,omitempty"`
+	// RequestedBy is the user claimed to request the snapshot, not verified by the worker, and RequestedAt is when it is requested
+	RequestedBy string    `json:"requestedBy,omitempty"`
+	RequestedAt time.Time `json:"requestedAt,omitempty"`
+	// Pusher resolves manifests of pushed images and pushes attestations referring to them
+	Pusher ReferrerPusher `json:"-"`
+}
+
+// ReferrerPusher pushes artifacts referring to other manifests, such as attestations of images
+type ReferrerPusher interface {
+	ManifestResolver
+	// PushReferrer pushes the artifact to the repository of ref, returns digest of the pushed manifest
+	PushReferrer(ctx context.Context, ref reference.Named, img *registry.Image, auth *types.AuthConfig) (digest.Digest, error)
+}
+
+// Statement is an in-toto statement about the subjects
+type Statement struct {
+	Type          string          `json:"_type"`
+	Subject       []Subject       `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// Subject is an artifact the statement is about, digests are keyed by algorithms
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Provenance is the SLSA provenance predicate of a snapshot
+type Provenance struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string `json:"buildType"`
+	Invocation struct {
+		Parameters  ProvenanceParameters  `json:"parameters"`
+		Environment ProvenanceEnvironment `json:"environment"`
+	} `json:"invocation"`
+	Metadata struct {
+		BuildInvocationID string     `json:"buildInvocationId,omitempty"`
+		BuildStartedOn    *time.Time `json:"buildStartedOn,omitempty"`
+		BuildFinishedOn   *time.Time `json:"buildFinishedOn,omitempty"`
+	} `json:"metadata"`
+	Materials []Subject `json:"materials,omitempty"`
+}
+
+// ProvenanceParameters are what is requested for the snapshot, the requesting user is as claimed by the snapshot and unverified
+type ProvenanceParameters struct {
+	Namespace   string     `json:"namespace,omitempty"`
+	Snapshot    string     `json:"snapshot,omitempty"`
+	SnapshotUID string     `json:"snapshotUID,omitempty"`
+	Image       string     `json:"image"`
+	RequestedBy string     `json:"requestedBy,omitempty"`
+	RequestedAt *time.Time `json:"requestedAt,omitempty"`
+}
+
+// ProvenanceEnvironment is where the snapshot is taken
+type ProvenanceEnvironment struct {
+	Pod           string `json:"pod,omitempty"`
+	ContainerName string `json:"containerName,omitempty"`
+	ContainerID   string `json:"containerID"`
+	Node          string `json:"node,omitempty"`
+	Runtime       string `json:"runtime,omitempty"`
+	ImageID       string `json:"imageID,omitempty"`
+}
+
+// Envelope is a DSSE envelope of the signed payload, see https://github.com/secure-systems-lab/dsse
+type Envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     []byte              `json:"payload"`
+	Signatures  []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is a signature of the envelope payload
+type EnvelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   []byte `json:"sig"`
+}
+
+// pae is the pre-authentication encoding of the payload, which is what is signed in DSSE envelopes
+func pae(payloadType string, payload []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// signEnvelope signs the statement into a DSSE envelope
+func signEnvelope(signer crypto.Signer, statement []byte) ([]byte, error) {
+	sig, e := signPayload(signer, pae(MediaTypeInToto, statement))
+	if e != nil {
+		return nil, e
+	}
+	return json.Marshal(Envelope{
+		PayloadType: MediaTypeInToto,
+		Payload:     statement,
+		Signatures:  []EnvelopeSignature{{Sig: sig}},
+	})
+}
+
+// VerifyEnvelope verifies the DSSE envelope with the public key only, without any network access, returns the signed statement
+func VerifyEnvelope(pub crypto.PublicKey, envelope []byte) ([]byte, error) {
+	var env Envelope
+	if e := json.Unmarshal(envelope, &env); e != nil {
+		return nil, fmt.Errorf("malformed envelope: %w", e)
+	}
+	if env.PayloadType != MediaTypeInToto {
+		return nil, fmt.Errorf("unexpected payload type %q", env.PayloadType)
+	}
+	for _, sig := range env.Signatures {
+		if VerifySignature(pub, pae(env.PayloadType, env.Payload), sig.Sig) == nil {
+			return env.Payload, nil
+		}
+	}
+	return nil, errors.New("no valid signature")
+}
+
+// subjectOf returns the statement subject of the manifest digest in the repository
+func subjectOf(name string, d digest.Digest) Subject {
+	return Subject{Name: name, Digest: map[string]string{d.Algorithm().String(): d.Hex()}}
+}
+
+// provenanceStatement returns the provenance statement of the snapshot image pushed as subjects, source is the committed image
+func provenanceStatement(result *Result, source *Image, subjects []Subject, opt *SnapshotOptions) ([]byte, error) {
+	p := opt.Provenance
+	var pred Provenance
+	pred.Builder.ID = builderID
+	pred.BuildType = BuildType
+	pred.Invocation.Parameters = ProvenanceParameters{
+		Namespace:   p.Namespace,
+		Snapshot:    p.Snapshot,
+		SnapshotUID: p.SnapshotUID,
+		Image:       opt.Image,
+		RequestedBy: p.RequestedBy,
+	}
+	if !p.RequestedAt.IsZero() {
+		requested := p.RequestedAt.UTC()
+		pred.Invocation.Parameters.RequestedAt = &requested
+	}
+
+	containerID := opt.Container
+	if p.Runtime != "" {
+		// same as container ids in the pod status
+		containerID = p.Runtime + "://" + opt.Container
+	}
+	pred.Invocation.Environment = ProvenanceEnvironment{
+		Pod:           p.Pod,
+		ContainerName: p.ContainerName,
+		ContainerID:   containerID,
+		Node:          p.Node,
+		Runtime:       p.Runtime,
+		ImageID:       result.ImageID,
+	}
+
+	pred.Metadata.BuildInvocationID = p.SnapshotUID
+	started, finished := result.StartedAt, time.Now().UTC()
+	pred.Metadata.BuildStartedOn, pred.Metadata.BuildFinishedOn = &started, &finished
+
+	if source != nil && source.Source != "" {
+		material := Subject{Name: source.Source}
+		if ref, e := reference.ParseNormalizedNamed(source.Source); e == nil {
+			material.Name = reference.TagNameOnly(ref).String()
+		}
+		if d, e := digest.Parse(source.SourceDigest); e == nil {
+			material.Digest = subjectOf("", d).Digest
+		}
+		pred.Materials = []Subject{material}
+	}
+
+	predicate, e := json.Marshal(pred)
+	if e != nil {
+		return nil, e
+	}
+	return json.Marshal(Statement{
+		Type:          StatementType,
+		Subject:       subjects,
+		PredicateType: PredicateSLSAProvenance,
+		Predicate:     predicate,
+	})
+}
+
+// attestationArtifact builds the attestation of the statement referring to the subject manifest,
+// the statement is signed in a DSSE envelope if signer is not nil
+func attestationArtifact(statement []byte, signer crypto.Signer, subject ocispec.Descriptor) (*registry.Image, error) {
+	layer := bytesBlob(MediaTypeInToto, statement, map[string]string{AnnotationPredicateType: PredicateSLSAProvenance})
+	if signer != nil {
+		envelope, e := signEnvelope(signer, statement)
+		if e != nil {
+			return nil, fmt.Errorf("sign statement: %w", e)
+		}
+		layer = bytesBlob(MediaTypeDSSE, envelope, map[string]string{AnnotationPredicateType: PredicateSLSAProvenance})
+	}
+
+	return &registry.Image{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: MediaTypeInToto,
+		Config:       bytesBlob(mediaTypeEmpty, []byte("{}"), nil),
+		Layers:       []registry.Blob{layer},
+		Annotations: map[string]string{
+			AnnotationPredicateType:   PredicateSLSAProvenance,
+			ocispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339),
+		},
+		Subject: &subject,
+	}, nil
+}
+
+// attestSnapshot attaches the provenance of the snapshot to all pushed destinations as referrers, destinations of the same repository
+// and digest share the attestation. failures of optional destinations are recorded but do not fail the snapshot
+func (c *Worker) attestSnapshot(ctx context.Context, result *Result, source *Image, signer crypto.Signer, opt *SnapshotOptions) *Error {
+	var failed []string
+	fail := func(dest *Destination, e error) {
+		log.Error(e, "attest image", "destination", dest.Image, "optional", dest.Optional)
+		dest.Error = constants.ErrorAttest
+		dest.Message = e.Error()
+		if !dest.Optional {
+			failed = append(failed, dest.Image+": "+e.Error())
+		}
+	}
+
+	// manifests of pushed destinations, and destinations of each of them, in the order of destinations
+	type subjectManifest struct {
+		repo  reference.Named
+		desc  ocispec.Descriptor
+		dests []*Destination
+	}
+	var manifests []*subjectManifest
+	byKey := make(map[string]*subjectManifest)
+	var subjects []Subject
+	for i := range result.Destinations {
+		dest := &result.Destinations[i]
+		if !dest.Pushed {
+			continue
+		}
+
+		ref, e := reference.ParseNormalizedNamed(dest.Image)
+		if e != nil {
+			fail(dest, e)
+			continue
+		}
+		desc, e := c.resolveManifest(ctx, reference.TagNameOnly(ref), dest.Digest, opt.Provenance.Pusher)
+		if e != nil {
+			fail(dest, fmt.Errorf("resolve manifest: %w", e))
+			continue
+		}
+		dest.Digest = desc.Digest.String()
+
+		repo := reference.TrimNamed(ref)
+		key := repo.Name() + "@" + dest.Digest
+		if m, ok := byKey[key]; ok {
+			m.dests = append(m.dests, dest)
+			continue
+		}
+		byKey[key] = &subjectManifest{repo: repo, desc: desc, dests: []*Destination{dest}}
+		manifests = append(manifests, byKey[key])
+		subjects = append(subjects, subjectOf(repo.Name(), desc.Digest))
+	}
+
+	if len(subjects) > 0 {
+		statement, e := provenanceStatement(result, source, subjects, opt)
+		if e != nil {
+			return errAttest(fmt.Sprintf("build provenance statement: %v", e))
+		}
+
+		for _, m := range manifests {
+			attestation, e := c.attach(ctx, m.repo, statement, signer, m.desc, opt.Provenance.Pusher)
+			for _, dest := range m.dests {
+				if e != nil {
+					fail(dest, e)
+					continue
+				}
+				log.Info("provenance attached", "destination", dest.Image, "attestation", attestation)
+				dest.Provenance = attestation
+			}
+		}
+	}
+	// the snapshot image is always the first destination
+	result.Digest = result.Destinations[0].Digest
+	result.Provenance = result.Destinations[0].Provenance
+
+	if len(failed) > 0 {
+		return errAttest(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// attestExport writes the provenance statement of the exported tarball next to it, as a file or an object with the provenance suffix.
+// subjects are the tarball by its checksum, and the snapshot image by the manifest digest in the tarball, if the format has one.
+// the statement is not signed, as exported snapshots are not
+func (c *Worker) attestExport(ctx context.Context, result *Result, source *Image, opt *SnapshotOptions) *Error {
+	export := result.Export
+	name := export.Path
+	if name == "" {
+		name = export.Key
+	}
+	checksum, e := digest.Parse(export.Checksum)
+	if e != nil {
+		return errAttest(fmt.Sprintf("invalid tarball checksum: %v", e))
+	}
+	subjects := []Subject{subjectOf(path.Base(name), checksum)}
+	if manifest, e := digest.Parse(result.Digest); e == nil {
+		if ref, e := reference.ParseNormalizedNamed(opt.Image); e == nil {
+			subjects = append(subjects, subjectOf(ref.Name(), manifest))
+		}
+	}
+
+	statement, e := provenanceStatement(result, source, subjects, opt)
+	if e != nil {
+		return errAttest(fmt.Sprintf("build provenance statement: %v", e))
+	}
+
+	name += constants.ProvenanceSuffix
+	if export.Path != "" {
+		e = ioutil.WriteFile(name, statement, 0644)
+	} else {
+		_, e = opt.Export.Uploader.Upload(ctx, export.Bucket, name, bytes.NewReader(statement))
+	}
+	if e != nil {
+		log.Error(e, "write provenance failed", "path", export.Path, "bucket", export.Bucket, "key", export.Key)
+		return errAttest(fmt.Sprintf("write provenance %s: %v", name, e))
+	}
+
+	log.Info("provenance written", "provenance", name)
+	export.Provenance = name
+	return nil
+}
+
+// attach pushes the attestation of the statement referring to the subject manifest of the repository,
+// returns the reference of the attestation with its digest
+func (c *Worker) attach(ctx context.Context, repo reference.Named, statement []byte, signer crypto.Signer, subject ocispec.Descriptor, pusher ReferrerPusher) (string, error) {
+	artifact, e := attestationArtifact(statement, signer, subject)
+	if e != nil {
+		return "", e
+	}
+	ref, e := reference.WithDigest(repo, subject.Digest)
+	if e != nil {
+		return "", e
+	}
+
+	var pushed digest.Digest
+	e = c.withAuths(ref, func(auth *types.AuthConfig) error {
+		var e error
+		if pushed, e = pusher.PushReferrer(ctx, ref, artifact, auth); e != nil {
+			return classifyPushError(e)
+		}
+		return nil
+	})
+	if e != nil {
+		return "", fmt.Errorf("push attestation: %w", e)
+	}
+
+	withDigest, e := reference.WithDigest(repo, pushed)
+	if e != nil {
+		return "", e
+	}
+	return reference.FamiliarString(withDigest), nil
+}
+
+// resolveManifest returns the manifest descriptor of the pushed image, by the digest if it is known, or by the tag of ref otherwise
+func (c *Worker) resolveManifest(ctx context.Context, ref reference.Named, known string, resolver ManifestResolver) (ocispec.Descriptor, error) {
+	if known != "" {
+		d, e := digest.Parse(known)
+		if e != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("invalid manifest digest: %w", e)
+		}
+		if ref, e = reference.WithDigest(reference.TrimNamed(ref), d); e != nil {
+			return ocispec.Descriptor{}, e
+		}
+	}
+
+	var desc ocispec.Descriptor
+	e := c.withAuths(ref, func(auth *types.AuthConfig) error {
+		var e error
+		if desc, e = resolver.Resolve(ctx, ref, auth); e != nil {
+			return classifyPushError(e)
+		}
+		return nil
+	})
+	return desc, e
+}
@@ -0,0 +1,264 @@
+package worker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+)
+
+var _ = Describe("provenance", func() {
+	const (
+		imageDigest  = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		mirrorDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+
+	var (
+		ctx         = context.Background()
+		requestedAt = time.Date(2020, 3, 1, 8, 0, 0, 0, time.UTC)
+		client      *mockDockerClient
+		pusher      *mockReferrerPusher
+		worker      Worker
+		options     SnapshotOptions
+	)
+
+	BeforeEach(func() {
+		client = &mockDockerClient{digests: map[string]string{
+			"reg.example.com/snapshots/app:v1":     imageDigest,
+			"reg.example.com/snapshots/app:latest": imageDigest,
+			"mirror.example.com/app:v1":            mirrorDigest,
+		}}
+		pusher = &mockReferrerPusher{resolved: map[string]string{}}
+		worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+		options = SnapshotOptions{
+			Container: "container-id",
+			Image:     "reg.example.com/snapshots/app:v1",
+			Tags:      []string{"latest"},
+			Mirrors:   []string{"mirror.example.com/app:v1"},
+			Provenance: &ProvenanceOptions{
+				Namespace:     "default",
+				Snapshot:      "app-snapshot",
+				SnapshotUID:   "snapshot-uid",
+				Pod:           "app-0",
+				ContainerName: "app",
+				Node:          "node-1",
+				Runtime:       constants.RuntimeDocker,
+				RequestedBy:   "alice@example.com",
+				RequestedAt:   requestedAt,
+				Pusher:        pusher,
+			},
+		}
+	})
+
+	statementOf := func(img *registry.Image) (Statement, Provenance) {
+		rc, e := img.Layers[0].Open()
+		Expect(e).Should(Succeed())
+		content, e := ioutil.ReadAll(rc)
+		Expect(e).Should(Succeed())
+		Expect(digest.FromBytes(content)).Should(Equal(img.Layers[0].Digest))
+
+		if img.Layers[0].MediaType == MediaTypeDSSE {
+			var env Envelope
+			Expect(json.Unmarshal(content, &env)).Should(Succeed())
+			content = env.Payload
+		}
+		var s Statement
+		Expect(json.Unmarshal(content, &s)).Should(Succeed())
+		var p Provenance
+		Expect(json.Unmarshal(s.Predicate, &p)).Should(Succeed())
+		return s, p
+	}
+
+	It("should attach the provenance to pushed images as referrers", func() {
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+
+		// tags of the same repository share the attestation
+		Expect(pusher.pushed).Should(Equal([]string{
+			"reg.example.com/snapshots/app@" + imageDigest,
+			"mirror.example.com/app@" + mirrorDigest,
+		}))
+		Expect(result.Provenance).Should(Equal("reg.example.com/snapshots/app@" + pusher.digests[0].String()))
+		Expect(result.Destinations[1].Provenance).Should(Equal(result.Provenance))
+		Expect(result.Destinations[2].Provenance).Should(Equal("mirror.example.com/app@" + pusher.digests[1].String()))
+
+		img := pusher.images[0]
+		Expect(img.ArtifactType).Should(Equal(MediaTypeInToto))
+		Expect(img.Subject).Should(Equal(&ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: imageDigest, Size: 1024}))
+		Expect(img.Annotations).Should(HaveKeyWithValue(AnnotationPredicateType, PredicateSLSAProvenance))
+		Expect(img.Layers).Should(HaveLen(1))
+		Expect(img.Layers[0].MediaType).Should(Equal(MediaTypeInToto))
+
+		s, p := statementOf(img)
+		Expect(s.Type).Should(Equal(StatementType))
+		Expect(s.PredicateType).Should(Equal(PredicateSLSAProvenance))
+		Expect(s.Subject).Should(Equal([]Subject{
+			{Name: "reg.example.com/snapshots/app", Digest: map[string]string{"sha256": imageDigest[len("sha256:"):]}},
+			{Name: "mirror.example.com/app", Digest: map[string]string{"sha256": mirrorDigest[len("sha256:"):]}},
+		}))
+		Expect(p.BuildType).Should(Equal(BuildType))
+		Expect(p.Invocation.Parameters).Should(Equal(ProvenanceParameters{
+			Namespace:   "default",
+			Snapshot:    "app-snapshot",
+			SnapshotUID: "snapshot-uid",
+			Image:       "reg.example.com/snapshots/app:v1",
+			RequestedBy: "alice@example.com",
+			RequestedAt: &requestedAt,
+		}))
+		Expect(p.Invocation.Environment).Should(Equal(ProvenanceEnvironment{
+			Pod:           "app-0",
+			ContainerName: "app",
+			ContainerID:   "docker://container-id",
+			Node:          "node-1",
+			Runtime:       constants.RuntimeDocker,
+			ImageID:       result.ImageID,
+		}))
+		Expect(p.Metadata.BuildInvocationID).Should(Equal("snapshot-uid"))
+		Expect(p.Metadata.BuildStartedOn.Equal(result.StartedAt)).Should(BeTrue())
+		Expect(p.Materials).Should(Equal([]Subject{{Name: "docker.io/library/source-image:latest"}}))
+
+		// all attestations carry the same statement
+		Expect(pusher.images[1].Layers[0].Digest).Should(Equal(img.Layers[0].Digest))
+	})
+
+	It("should record the source image digest as the material", func() {
+		result := &Result{StartedAt: time.Now().UTC(), ImageID: "sha256:committed"}
+		source := &Image{Source: "library/busybox:1.31", SourceDigest: imageDigest}
+		statement, e := provenanceStatement(result, source, nil, &options)
+		Expect(e).Should(Succeed())
+
+		var s Statement
+		Expect(json.Unmarshal(statement, &s)).Should(Succeed())
+		var p Provenance
+		Expect(json.Unmarshal(s.Predicate, &p)).Should(Succeed())
+		Expect(p.Materials).Should(Equal([]Subject{{
+			Name:   "docker.io/library/busybox:1.31",
+			Digest: map[string]string{"sha256": imageDigest[len("sha256:"):]},
+		}}))
+	})
+
+	It("should sign the statement in a dsse envelope with the signing key", func() {
+		key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(e).Should(Succeed())
+		options.Sign = &SignOptions{Key: pkcs8Key(key), Pusher: &mockSignaturePusher{}}
+
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(result.Signature).ShouldNot(BeEmpty())
+		Expect(result.Provenance).ShouldNot(BeEmpty())
+
+		layer := pusher.images[0].Layers[0]
+		Expect(layer.MediaType).Should(Equal(MediaTypeDSSE))
+		rc, e := layer.Open()
+		Expect(e).Should(Succeed())
+		envelope, e := ioutil.ReadAll(rc)
+		Expect(e).Should(Succeed())
+
+		statement, e := VerifyEnvelope(key.Public(), envelope)
+		Expect(e).Should(Succeed())
+		s, _ := statementOf(pusher.images[0])
+		Expect(statement).Should(MatchJSON(mustMarshal(s)))
+
+		another, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(e).Should(Succeed())
+		_, e = VerifyEnvelope(another.Public(), envelope)
+		Expect(e).Should(MatchError("no valid signature"))
+	})
+
+	It("should resolve digests not reported by the runtime", func() {
+		client.digests["reg.example.com/snapshots/app:v1"] = ""
+		pusher.resolved["reg.example.com/snapshots/app:v1"] = imageDigest
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(result.Digest).Should(Equal(imageDigest))
+		Expect(pusher.pushed).Should(HaveLen(2))
+	})
+
+	It("should fail if the attestation could not be pushed", func() {
+		pusher.badRepos = map[string]bool{"reg.example.com/snapshots/app": true}
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(MatchError(ErrAttest))
+		Expect(result.Phase).Should(Equal(constants.PhaseAttest))
+		Expect(result.Error).Should(Equal(constants.ErrorAttest))
+		Expect(result.Destinations[0].Pushed).Should(BeTrue())
+		Expect(result.Destinations[0].Error).Should(Equal(constants.ErrorAttest))
+		Expect(result.Destinations[1].Error).Should(Equal(constants.ErrorAttest))
+		Expect(result.Provenance).Should(BeEmpty())
+	})
+
+	It("should not fail for optional mirrors not attested", func() {
+		options.Mirrors = nil
+		options.OptionalMirrors = []string{"mirror.example.com/app:v1"}
+		pusher.badRepos = map[string]bool{"mirror.example.com/app": true}
+		result, e := worker.TakeSnapshot(ctx, &options)
+		Expect(e).Should(Succeed())
+		Expect(result.Provenance).ShouldNot(BeEmpty())
+		Expect(result.Destinations[2].Provenance).Should(BeEmpty())
+		Expect(result.Destinations[2].Error).Should(Equal(constants.ErrorAttest))
+	})
+})
+
+func pkcs8Key(k *ecdsa.PrivateKey) []byte {
+	der, e := x509.MarshalPKCS8PrivateKey(k)
+	Expect(e).Should(Succeed())
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, e := json.Marshal(v)
+	Expect(e).Should(Succeed())
+	return b
+}
+
+// mockReferrerPusher resolves manifests of pushed images and pushes attestations referring to them
+type mockReferrerPusher struct {
+	// badRepos are repositories failed to push
+	badRepos map[string]bool
+	// resolved are digests of tags not reported by the runtime
+	resolved map[string]string
+	pushed   []string
+	images   []*registry.Image
+	digests  []digest.Digest
+}
+
+func (p *mockReferrerPusher) Resolve(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (ocispec.Descriptor, error) {
+	d := digest.Digest(p.resolved[ref.String()])
+	if canonical, ok := ref.(reference.Canonical); ok {
+		d = canonical.Digest()
+	}
+	if d == "" {
+		return ocispec.Descriptor{}, errors.New("manifest unknown")
+	}
+	return ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: d, Size: 1024}, nil
+}
+
+func (p *mockReferrerPusher) PushReferrer(ctx context.Context, ref reference.Named, img *registry.Image, auth *types.AuthConfig) (digest.Digest, error) {
+	if p.badRepos[ref.Name()] {
+		return "", errors.New("denied: requested access to the resource is denied")
+	}
+	m, e := img.Manifest()
+	if e != nil {
+		return "", e
+	}
+	p.pushed = append(p.pushed, reference.FamiliarString(ref))
+	p.images = append(p.images, img)
+	p.digests = append(p.digests, digest.FromBytes(m))
+	return digest.FromBytes(m), nil
+}
@@ -0,0 +1,250 @@
+package worker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// ImageRewriter is implemented by runtimes able to rewrite layers of committed images, such as squashing them
+type ImageRewriter interface {
+	// Rewrite replaces top layers of the image named ref by the layer written by rw, and names the rewritten image as ref
+	Rewrite(ctx context.Context, ref reference.Named, img *Image, rw *layerRewrite) (*Image, error)
+}
+
+// layerRewrite replaces top layers of an image by a single layer written from all layers of the image
+type layerRewrite struct {
+	// name tells what the rewrite does, in logs and temporary file names
+	name string
+	// keepBase keeps layers below the top layer as they are and replaces the top layer only, or all layers are replaced
+	keepBase bool
+	// write writes the rewritten layer, layers are ordered from the base to the top.
+	// all layers are kept as they are if it is nil, and only the config is rewritten
+	write func(layers []layerOpener, w io.Writer) error
+	// config returns the raw image config of the rewritten image, layers is the number of layers before rewritten,
+	// and diffID is the digest of the rewritten layer, or empty if no layer is rewritten
+	config func(raw []byte, layers int, diffID digest.Digest) ([]byte, error)
+}
+
+// kept returns the number of bottom layers kept as they are, of an image with the number of layers
+func (rw *layerRewrite) kept(layers int) int {
+	switch {
+	case rw.write == nil:
+		return layers
+	case rw.keepBase && layers > 0:
+		return layers - 1
+	default:
+		return 0
+	}
+}
+
+// rewrite rewrites layers of the committed image through the runtime
+func (c *Worker) rewrite(ctx context.Context, ref reference.Named, img *Image, rw *layerRewrite) (*Image, error) {
+	rewriter, ok := c.runtime.(ImageRewriter)
+	if !ok {
+		return nil, fmt.Errorf("the container runtime can not %s images", rw.name)
+	}
+	return rewriter.Rewrite(ctx, ref, img, rw)
+}
+
+// writeLayer writes the rewritten layer to the path, returns its diff id, or empty if no layer is rewritten
+func (rw *layerRewrite) writeLayer(layers []layerOpener, path string) (digest.Digest, error) {
+	if rw.write == nil {
+		return "", nil
+	}
+	f, e := os.Create(path)
+	if e != nil {
+		return "", e
+	}
+	w := &digestWriter{w: f, digester: digest.Canonical.Digester()}
+	e = rw.write(layers, w)
+	if e == nil {
+		e = f.Close()
+	} else {
+		f.Close()
+	}
+	if e != nil {
+		return "", fmt.Errorf("%s layers: %w", rw.name, e)
+	}
+	return w.digester.Digest(), nil
+}
+
+// replaceDiffIDs replaces diff ids of the rootfs in the raw image config,
+// configs are edited as raw json, to keep fields unknown to the worker
+func replaceDiffIDs(config map[string]json.RawMessage, diffIDs []digest.Digest) error {
+	buf, e := json.Marshal(map[string]interface{}{"type": "layers", "diff_ids": diffIDs})
+	if e != nil {
+		return e
+	}
+	config["rootfs"] = buf
+	return nil
+}
+
+// rewriteTopConfig returns the raw image config with the diff id of the top layer replaced
+func rewriteTopConfig(raw []byte, layers int, diffID digest.Digest) ([]byte, error) {
+	var config map[string]json.RawMessage
+	if e := json.Unmarshal(raw, &config); e != nil {
+		return nil, fmt.Errorf("parse image config: %w", e)
+	}
+	var rootfs struct {
+		DiffIDs []digest.Digest `json:"diff_ids"`
+	}
+	if e := json.Unmarshal(config["rootfs"], &rootfs); e != nil {
+		return nil, fmt.Errorf("parse image rootfs: %w", e)
+	}
+	if len(rootfs.DiffIDs) != layers || layers == 0 {
+		return nil, fmt.Errorf("image config has %d diff ids for %d layers", len(rootfs.DiffIDs), layers)
+	}
+
+	rootfs.DiffIDs[layers-1] = diffID
+	if e := replaceDiffIDs(config, rootfs.DiffIDs); e != nil {
+		return nil, e
+	}
+	return json.Marshal(config)
+}
+
+// rewriteSavedImage rewrites the image saved by the runtime, and loads the rewritten image named ref back into the runtime,
+// unless nothing is changed. returns the config digest and the number of layers of the rewritten image
+func rewriteSavedImage(ctx context.Context, saver ImageSaver, load func(context.Context, io.Reader) error, ref reference.Named, img *Image, rw *layerRewrite) (digest.Digest, int, error) {
+	dir, e := ioutil.TempDir("", rw.name+"-")
+	if e != nil {
+		return "", 0, e
+	}
+	defer os.RemoveAll(dir)
+
+	rc, e := saver.Save(ctx, img.ID)
+	if e != nil {
+		return "", 0, fmt.Errorf("save image: %w", e)
+	}
+	a, e := extractDockerArchive(rc, dir)
+	rc.Close()
+	if e != nil {
+		return "", 0, fmt.Errorf("extract image: %w", e)
+	}
+	if len(a.manifest.Layers) == 0 {
+		return "", 0, errors.New("no layer in the image")
+	}
+
+	layers := make([]layerOpener, 0, len(a.manifest.Layers))
+	paths := make([]string, 0, len(a.manifest.Layers))
+	for _, l := range a.manifest.Layers {
+		p, e := a.path(l)
+		if e != nil {
+			return "", 0, e
+		}
+		layers = append(layers, func() (io.ReadCloser, error) { return os.Open(p) })
+		paths = append(paths, p)
+	}
+
+	layerPath := filepath.Join(dir, rw.name+".tar")
+	diffID, e := rw.writeLayer(layers, layerPath)
+	if e != nil {
+		return "", 0, e
+	}
+
+	configPath, e := a.path(a.manifest.Config)
+	if e != nil {
+		return "", 0, e
+	}
+	raw, e := ioutil.ReadFile(configPath)
+	if e != nil {
+		return "", 0, fmt.Errorf("read image config: %w", e)
+	}
+	config, e := rw.config(raw, len(layers), diffID)
+	if e != nil {
+		return "", 0, e
+	}
+	configDigest := digest.FromBytes(config)
+	if diffID == "" && configDigest == digest.FromBytes(raw) {
+		log.Info("image not changed", "rewrite", rw.name)
+		return configDigest, len(paths), nil
+	}
+
+	files := append([]string{}, paths[:rw.kept(len(paths))]...)
+	names := make([]string, 0, len(files)+1)
+	for i := range files {
+		names = append(names, fmt.Sprintf("%d/layer.tar", i))
+	}
+	if diffID != "" {
+		files = append(files, layerPath)
+		names = append(names, diffID.Hex()+"/layer.tar")
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeRewrittenArchive(pw, ref, config, configDigest, files, names))
+	}()
+	e = load(ctx, pr)
+	pr.CloseWithError(e)
+	if e != nil {
+		return "", 0, fmt.Errorf("load %s image: %w", rw.name, e)
+	}
+
+	log.Info("image rewritten", "rewrite", rw.name, "layers", len(files), "config", configDigest)
+	return configDigest, len(files), nil
+}
+
+// writeRewrittenArchive writes the rewritten image as a docker archive tagged as ref,
+// files are layer tarballs from the base to the top, written as names in the archive
+func writeRewrittenArchive(w io.Writer, ref reference.Named, config []byte, configDigest digest.Digest, files, names []string) error {
+
+	manifest, e := json.Marshal([]dockerArchiveManifest{{
+		Config:   configDigest.Hex() + ".json",
+		RepoTags: []string{reference.FamiliarString(reference.TagNameOnly(ref))},
+		Layers:   names,
+	}})
+	if e != nil {
+		return e
+	}
+
+	tw := tar.NewWriter(w)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{
+		{configDigest.Hex() + ".json", config},
+		{"manifest.json", manifest},
+	} {
+		if e := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); e != nil {
+			return e
+		}
+		if _, e := tw.Write(f.content); e != nil {
+			return e
+		}
+	}
+
+	for i, file := range files {
+		if e := writeArchiveFile(tw, names[i], file); e != nil {
+			return e
+		}
+	}
+
+	return tw.Close()
+}
+
+// writeArchiveFile writes the file into the tarball as name
+func writeArchiveFile(tw *tar.Writer, name, file string) error {
+	f, e := os.Open(file)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+	info, e := f.Stat()
+	if e != nil {
+		return e
+	}
+	if e := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), Typeflag: tar.TypeReg}); e != nil {
+		return e
+	}
+	_, e = io.Copy(tw, f)
+	return e
+}
@@ -0,0 +1,239 @@
+package worker
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+const (
+	// maxScanFileSize is the max size of files scanned for secrets, larger files are skipped as they are rarely config files
+	maxScanFileSize = 8 << 20
+	// binarySniffSize is the size of the file head looked for null bytes, files with null bytes are skipped as binaries.
+	// it is the size of the line buffer too, longer lines are scanned in pieces
+	binarySniffSize = 8 << 10
+	// maxDescribedFindings is the max number of findings in error messages, which are kept in termination messages
+	maxDescribedFindings = 10
+
+	// RuleHighEntropy is the default rule matching long random strings, such as api tokens or passwords
+	RuleHighEntropy = "high-entropy-string"
+	// minEntropyLength and minEntropy are the min length and shannon entropy in bits per char of high entropy strings,
+	// hex encoded digests stay under the entropy, as they have 16 chars only
+	minEntropyLength = 24
+	minEntropy       = 4.5
+)
+
+// subresourceIntegrity matches integrity hashes of package locks, such as sha512-<base64>, which are not secrets
+var subresourceIntegrity = regexp.MustCompile(`^sha(1|256|384|512)-`)
+
+// defaultScanRules are rules of well known secrets
+var defaultScanRules = []ScanRule{
+	{Name: "private-key", Pattern: `-----BEGIN ((RSA|EC|DSA|OPENSSH|PGP|ENCRYPTED) )?PRIVATE KEY( BLOCK)?-----`},
+	{Name: "aws-access-key", Pattern: `\b(AKIA|ASIA)[0-9A-Z]{16}\b`},
+	{Name: "gcp-service-account", Pattern: `"type"\s*:\s*"service_account"`},
+	{Name: "github-token", Pattern: `\bgh[pousr]_[A-Za-z0-9]{36,}\b`},
+	{Name: "slack-token", Pattern: `\bxox[abposr]-[A-Za-z0-9-]{10,}`},
+}
+
+// entropyCandidate matches strings checked by the high entropy rule
+var entropyCandidate = regexp.MustCompile(`[A-Za-z0-9+/=_-]{24,}`)
+
+// ScanOptions configures the secret scan of files changed by the container
+type ScanOptions struct {
+	// Rules are extra rules, matched against each line of changed files
+	Rules []ScanRule `json:"rules,omitempty"`
+	// DisabledRules are names of default rules not applied
+	DisabledRules []string `json:"disabledRules,omitempty"`
+	// Allow reports secrets found without blocking the snapshot
+	Allow bool `json:"allow,omitempty"`
+}
+
+// ScanRule is a named regular expression of secrets
+type ScanRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+// SecretFinding is a file found with secrets, values of secrets are never reported
+type SecretFinding struct {
+	// Path is the absolute path of the file in the snapshot
+	Path string `json:"path"`
+	// Rule is the name of the rule matched
+	Rule string `json:"rule"`
+	// Line is the first line matched, starts from 1
+	Line int `json:"line"`
+}
+
+// scanner matches files against compiled rules
+type scanner struct {
+	rules   []compiledRule
+	entropy bool
+}
+
+type compiledRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// newScanner compiles default rules except disabled ones, and extra rules of the options
+func newScanner(opt *ScanOptions) (*scanner, error) {
+	disabled := make(map[string]bool, len(opt.DisabledRules))
+	for _, name := range opt.DisabledRules {
+		disabled[name] = true
+	}
+
+	s := &scanner{entropy: !disabled[RuleHighEntropy]}
+	rules := make([]ScanRule, 0, len(defaultScanRules)+len(opt.Rules))
+	for _, r := range defaultScanRules {
+		if !disabled[r.Name] {
+			rules = append(rules, r)
+		}
+	}
+	for _, r := range append(rules, opt.Rules...) {
+		if r.Name == "" {
+			return nil, fmt.Errorf("scan rule %q has no name", r.Pattern)
+		}
+		re, e := regexp.Compile(r.Pattern)
+		if e != nil {
+			return nil, fmt.Errorf("invalid scan rule %s: %w", r.Name, e)
+		}
+		s.rules = append(s.rules, compiledRule{name: r.Name, re: re})
+	}
+	return s, nil
+}
+
+// scanSecrets scans files changed by the container, which are in the read/write layer of the committed image
+func (c *Worker) scanSecrets(ctx context.Context, ref reference.Named, s *scanner) ([]SecretFinding, error) {
+	reader, ok := c.runtime.(DiffReader)
+	if !ok {
+		return nil, errors.New("the container runtime can not read layers of committed images")
+	}
+	rc, e := reader.Diff(ctx, ref)
+	if e != nil {
+		return nil, fmt.Errorf("read container layer: %w", e)
+	}
+	defer rc.Close()
+
+	return s.scanLayer(rc)
+}
+
+// scanLayer scans regular files of the layer tarball, whiteouts, binaries and large files are skipped.
+// findings are sorted by paths, each file is reported once for each rule it matches
+func (s *scanner) scanLayer(r io.Reader) ([]SecretFinding, error) {
+	var findings []SecretFinding
+	tr := tar.NewReader(r)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA || hdr.Size > maxScanFileSize ||
+			strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			continue
+		}
+		found, e := s.scanFile(name, tr)
+		if e != nil {
+			return nil, fmt.Errorf("scan %s: %w", name, e)
+		}
+		findings = append(findings, found...)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Path < findings[j].Path })
+	return findings, nil
+}
+
+// scanFile matches each line of the file against rules
+func (s *scanner) scanFile(name string, r io.Reader) ([]SecretFinding, error) {
+	br := bufio.NewReaderSize(r, binarySniffSize)
+	head, e := br.Peek(binarySniffSize)
+	if e != nil && e != io.EOF && e != bufio.ErrBufferFull {
+		return nil, e
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+
+	var findings []SecretFinding
+	matched := make(map[string]bool)
+	for n := 1; ; {
+		line, more, e := br.ReadLine()
+		if e == io.EOF {
+			return findings, nil
+		}
+		if e != nil {
+			return nil, e
+		}
+
+		for _, rule := range s.rules {
+			if !matched[rule.name] && rule.re.Match(line) {
+				matched[rule.name] = true
+				findings = append(findings, SecretFinding{Path: name, Rule: rule.name, Line: n})
+			}
+		}
+		if s.entropy && !matched[RuleHighEntropy] && hasHighEntropy(line) {
+			matched[RuleHighEntropy] = true
+			findings = append(findings, SecretFinding{Path: name, Rule: RuleHighEntropy, Line: n})
+		}
+		if !more {
+			n++
+		}
+	}
+}
+
+// hasHighEntropy tells if the line has a long string of high shannon entropy
+func hasHighEntropy(line []byte) bool {
+	for _, candidate := range entropyCandidate.FindAll(line, -1) {
+		if len(candidate) >= minEntropyLength && !subresourceIntegrity.Match(candidate) && entropy(candidate) >= minEntropy {
+			return true
+		}
+	}
+	return false
+}
+
+// entropy returns the shannon entropy of the string in bits per char
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var h float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// describeFindings names paths and rules of findings, without values of secrets
+func describeFindings(findings []SecretFinding) string {
+	files := make(map[string]bool)
+	descs := make([]string, 0, maxDescribedFindings+1)
+	for i, f := range findings {
+		files[f.Path] = true
+		if i < maxDescribedFindings {
+			descs = append(descs, fmt.Sprintf("%s:%d (%s)", f.Path, f.Line, f.Rule))
+		}
+	}
+	if len(findings) > maxDescribedFindings {
+		descs = append(descs, fmt.Sprintf("and %d more", len(findings)-maxDescribedFindings))
+	}
+	return fmt.Sprintf("secrets found in %d files: %s", len(files), strings.Join(descs, ", "))
+}
@@ -0,0 +1,79 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// scrubRewrite removes env vars of the names from the image config, layers are kept as they are.
+// names of env vars removed are recorded into scrubbed
+func scrubRewrite(names []string, scrubbed *[]string) *layerRewrite {
+	return &layerRewrite{
+		name: "scrub",
+		config: func(raw []byte, _ int, _ digest.Digest) ([]byte, error) {
+			config, removed, e := scrubEnvs(raw, names)
+			if e != nil {
+				return nil, e
+			}
+			*scrubbed = removed
+			return config, nil
+		},
+	}
+}
+
+// scrubEnvs returns the raw image config without env vars of the names, and names of env vars removed.
+// the config is returned as is if no env var is removed
+func scrubEnvs(raw []byte, names []string) ([]byte, []string, error) {
+	var config map[string]json.RawMessage
+	if e := json.Unmarshal(raw, &config); e != nil {
+		return nil, nil, fmt.Errorf("parse image config: %w", e)
+	}
+	// the container config is edited as raw json too, to keep fields unknown to the worker
+	var container map[string]json.RawMessage
+	if c, ok := config["config"]; ok {
+		if e := json.Unmarshal(c, &container); e != nil {
+			return nil, nil, fmt.Errorf("parse container config: %w", e)
+		}
+	}
+	var envs []string
+	if env, ok := container["Env"]; ok {
+		if e := json.Unmarshal(env, &envs); e != nil {
+			return nil, nil, fmt.Errorf("parse container envs: %w", e)
+		}
+	}
+
+	secret := make(map[string]bool, len(names))
+	for _, name := range names {
+		secret[name] = true
+	}
+	kept := make([]string, 0, len(envs))
+	var removed []string
+	for _, env := range envs {
+		name := strings.SplitN(env, "=", 2)[0]
+		if secret[name] {
+			removed = append(removed, name)
+			continue
+		}
+		kept = append(kept, env)
+	}
+	if len(removed) == 0 {
+		return raw, nil, nil
+	}
+
+	buf, e := json.Marshal(kept)
+	if e != nil {
+		return nil, nil, e
+	}
+	container["Env"] = buf
+	if config["config"], e = json.Marshal(container); e != nil {
+		return nil, nil, e
+	}
+	scrubbed, e := json.Marshal(config)
+	if e != nil {
+		return nil, nil, e
+	}
+	return scrubbed, removed, nil
+}
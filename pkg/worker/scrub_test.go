@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("scrub", func() {
+	var ctx = context.Background()
+
+	Context("when scrubbing the image config", func() {
+		It("should remove env vars of the names only", func() {
+			raw := `{"architecture":"amd64","config":{"Env":["PATH=/bin","TOKEN=secret","LOG=debug","PASSWORD="],"Custom":true},"rootfs":{"type":"layers"}}`
+			scrubbed, removed, e := scrubEnvs([]byte(raw), []string{"TOKEN", "PASSWORD", "NOT_SET"})
+			Expect(e).Should(Succeed())
+			Expect(removed).Should(Equal([]string{"TOKEN", "PASSWORD"}))
+
+			var config struct {
+				ocispec.Image
+				Config struct {
+					Env    []string
+					Custom bool
+				} `json:"config"`
+			}
+			Expect(json.Unmarshal(scrubbed, &config)).Should(Succeed())
+			Expect(config.Architecture).Should(Equal("amd64"))
+			Expect(config.Config.Env).Should(Equal([]string{"PATH=/bin", "LOG=debug"}))
+			Expect(config.Config.Custom).Should(BeTrue())
+		})
+
+		It("should keep the config as is if no env var is removed", func() {
+			raw := `{"config":{"Env":["PATH=/bin"]}}`
+			scrubbed, removed, e := scrubEnvs([]byte(raw), []string{"TOKEN"})
+			Expect(e).Should(Succeed())
+			Expect(removed).Should(BeEmpty())
+			Expect(string(scrubbed)).Should(Equal(raw))
+		})
+	})
+
+	Context("with the docker runtime", func() {
+		var (
+			client  *mockDockerClient
+			worker  Worker
+			options SnapshotOptions
+		)
+
+		BeforeEach(func() {
+			client = &mockDockerClient{archive: dockerArchive(map[string]string{
+				"manifest.json":  `[{"Config":"abc.json","RepoTags":["image-name:latest"],"Layers":["base/layer.tar","top/layer.tar"]}]`,
+				"abc.json":       `{"architecture":"amd64","config":{"Env":["PATH=/bin","TOKEN=secret"]},"rootfs":{"type":"layers","diff_ids":["sha256:a","sha256:b"]}}`,
+				"base/layer.tar": string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "base"})),
+				"top/layer.tar":  string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "changed"})),
+			}, nil)}
+			worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+			options = SnapshotOptions{
+				Container:  "container-id",
+				Image:      "image-name",
+				SecretEnvs: []string{"TOKEN"},
+			}
+		})
+
+		It("should load the image with the scrubbed config back", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.ScrubbedEnvs).Should(Equal([]string{"TOKEN"}))
+			Expect(result.Layers).Should(Equal(2))
+
+			archive := layerEntries(client.loaded)
+			var mfst []dockerArchiveManifest
+			Expect(json.Unmarshal([]byte(archive["manifest.json"]), &mfst)).Should(Succeed())
+			Expect(mfst[0].Layers).Should(HaveLen(2))
+			Expect(layerEntries([]byte(archive[mfst[0].Layers[1]]))).Should(Equal(map[string]string{"etc/": "", "etc/hosts": "changed"}))
+
+			var config ocispec.Image
+			Expect(json.Unmarshal([]byte(archive[mfst[0].Config]), &config)).Should(Succeed())
+			Expect(config.Config.Env).Should(Equal([]string{"PATH=/bin"}))
+		})
+
+		It("should not load the image again if no env var is scrubbed", func() {
+			options.SecretEnvs = []string{"NOT_SET"}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.ScrubbedEnvs).Should(BeEmpty())
+			Expect(client.loaded).Should(BeEmpty())
+		})
+
+		It("should fail the commit if the config could not be scrubbed", func() {
+			client.archive = nil
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrCommit))
+			Expect(result.Phase).Should(Equal(constants.PhaseCommit))
+			Expect(client.pushed).Should(BeEmpty())
+		})
+
+		It("should remove the committed image with secret envs if the scrub fails with the Always policy", func() {
+			client.archive = nil
+			options.Cleanup = constants.CleanupAlways
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrCommit))
+			Expect(client.removed).Should(Equal([]string{"mock id"}))
+			Expect(result.FreedBytes).Should(Equal(int64(1024)))
+		})
+	})
+
+	Context("with the containerd runtime", func() {
+		var (
+			root   string
+			client *mockContainerdClient
+			worker Worker
+		)
+
+		BeforeEach(func() {
+			var e error
+			root, e = ioutil.TempDir("", "containerd-content-")
+			Expect(e).Should(Succeed())
+			client, e = newMockContainerdClient(root)
+			Expect(e).Should(Succeed())
+			worker = Worker{runtime: NewContainerdRuntime(client, ContainerdNamespace), auths: make(mergedDockerAuth)}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(root)
+		})
+
+		It("should point the snapshot image to the scrubbed config", func() {
+			result, e := worker.TakeSnapshot(ctx, &SnapshotOptions{
+				Container:  "container-id",
+				Image:      "image-name",
+				SecretEnvs: []string{"DEBUG"},
+			})
+			Expect(e).Should(Succeed())
+			Expect(result.ScrubbedEnvs).Should(Equal([]string{"DEBUG"}))
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			Expect(mfst.Layers).Should(HaveLen(2))
+			Expect(result.ImageID).Should(Equal(mfst.Config.Digest.String()))
+
+			var config ocispec.Image
+			Expect(readJSONBlob(ctx, client.content, mfst.Config, &config)).Should(Succeed())
+			Expect(config.Config.Env).Should(Equal([]string{"PATH=/bin"}))
+		})
+	})
+})
@@ -0,0 +1,371 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// signatures follow the cosign conventions, so that they are verified by cosign and admission controllers built on it,
+// see https://github.com/sigstore/cosign/blob/main/specs/SIGNATURE_SPEC.md
+const (
+	// MediaTypeSimpleSigning is the media type of the signed payload, a layer of the signature artifact
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// AnnotationSignature annotates the payload layer with its base64 encoded signature
+	AnnotationSignature = "dev.cosignproject.cosign/signature"
+
+	signatureType = "cosign container image signature"
+	// signatureTagSuffix is the suffix of signature tags, which are named after the signed digest, e.g. sha256-<hex>.sig
+	signatureTagSuffix = ".sig"
+)
+
+// pem block types of private keys encrypted by `cosign generate-key-pair`
+var encryptedKeyTypes = map[string]bool{
+	"ENCRYPTED COSIGN PRIVATE KEY":   true,
+	"ENCRYPTED SIGSTORE PRIVATE KEY": true,
+}
+
+// SignOptions configures signing pushed images, signatures are pushed next to the images
+type SignOptions struct {
+	// Key is the pem encoded private key, either unencrypted or encrypted by cosign with the password
+	Key      []byte `json:"-"`
+	Password []byte `json:"-"`
+	// Pusher pushes signatures to registries, and resolves digests of images pushed by runtimes not reporting them
+	Pusher ImagePusher `json:"-"`
+}
+
+// ManifestResolver is implemented by pushers able to resolve manifest descriptors of pushed images
+type ManifestResolver interface {
+	Resolve(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (ocispec.Descriptor, error)
+}
+
+// ImageFetcher is implemented by pushers able to fetch pushed images, signatures are appended to existing ones fetched from registries
+type ImageFetcher interface {
+	Fetch(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (*registry.Image, error)
+}
+
+// LoadSigningKey parses a pem encoded ECDSA, RSA or Ed25519 private key, keys encrypted by cosign are decrypted with the password
+func LoadSigningKey(key, password []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("no pem block in the key")
+	}
+
+	der := block.Bytes
+	switch {
+	case encryptedKeyTypes[block.Type]:
+		var e error
+		if der, e = decryptKey(block.Bytes, password); e != nil {
+			return nil, fmt.Errorf("decrypt key: %w", e)
+		}
+	case block.Type == "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case block.Type == "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case block.Type != "PRIVATE KEY":
+		return nil, fmt.Errorf("unsupported pem block type %q", block.Type)
+	}
+
+	k, e := x509.ParsePKCS8PrivateKey(der)
+	if e != nil {
+		return nil, e
+	}
+	switch k := k.(type) {
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", k)
+	}
+}
+
+// encryptedKey is the encrypted key document of cosign, the pkcs8 key sealed by nacl/secretbox with a key derived by scrypt
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// decryptKey decrypts a key encrypted by cosign, returns the pkcs8 key
+func decryptKey(data, password []byte) ([]byte, error) {
+	var k encryptedKey
+	if e := json.Unmarshal(data, &k); e != nil {
+		return nil, e
+	}
+	if k.KDF.Name != "scrypt" || k.Cipher.Name != "nacl/secretbox" {
+		return nil, fmt.Errorf("unsupported encryption %s with %s", k.Cipher.Name, k.KDF.Name)
+	}
+	if len(k.Cipher.Nonce) != 24 {
+		return nil, errors.New("invalid nonce")
+	}
+
+	derived, e := scrypt.Key(password, k.KDF.Salt, k.KDF.Params.N, k.KDF.Params.R, k.KDF.Params.P, 32)
+	if e != nil {
+		return nil, e
+	}
+	var secret [32]byte
+	var nonce [24]byte
+	copy(secret[:], derived)
+	copy(nonce[:], k.Cipher.Nonce)
+	der, ok := secretbox.Open(nil, k.Ciphertext, &nonce, &secret)
+	if !ok {
+		return nil, errors.New("wrong password or corrupted key")
+	}
+	return der, nil
+}
+
+// simpleSigning is the payload signed for an image, binding the repository to the manifest digest
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// signaturePayload returns the payload signed for the manifest digest of the repository
+func signaturePayload(repo reference.Named, d digest.Digest) ([]byte, error) {
+	var p simpleSigning
+	p.Critical.Identity.DockerReference = repo.Name()
+	p.Critical.Image.DockerManifestDigest = d.String()
+	p.Critical.Type = signatureType
+	return json.Marshal(p)
+}
+
+// signPayload signs sha256 of the payload, or the payload itself with Ed25519 keys
+func signPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	sum := sha256.Sum256(payload)
+	return signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
+
+// VerifySignature verifies the signature of the payload with the public key only, without any network access.
+// ECDSA signatures are asn1 encoded, and RSA signatures are PKCS #1 v1.5
+func VerifySignature(pub crypto.PublicKey, payload, sig []byte) error {
+	sum := sha256.Sum256(payload)
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if rest, e := asn1.Unmarshal(sig, &rs); e != nil || len(rest) > 0 {
+			return errors.New("malformed ecdsa signature")
+		}
+		if !ecdsa.Verify(pub, sum[:], rs.R, rs.S) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, payload, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// signatureRef returns the reference the signature of the digest is pushed to, in the same repository
+func signatureRef(repo reference.Named, d digest.Digest) (reference.NamedTagged, error) {
+	return reference.WithTag(repo, strings.Replace(d.String(), ":", "-", 1)+signatureTagSuffix)
+}
+
+// signatureArtifact builds the signature artifact of the payload, appended to the existing signature artifact if it is not nil,
+// as cosign does, so signatures of other signers are kept. the config lists all payloads as its layers
+func signatureArtifact(payload, sig []byte, existing *registry.Image) (*registry.Image, error) {
+	layer := bytesBlob(MediaTypeSimpleSigning, payload, map[string]string{AnnotationSignature: base64.StdEncoding.EncodeToString(sig)})
+	artifact := &registry.Image{MediaType: ocispec.MediaTypeImageManifest}
+	if existing != nil {
+		artifact.MediaType, artifact.Annotations = existing.MediaType, existing.Annotations
+		for _, l := range existing.Layers {
+			if l.Digest == layer.Digest && l.Annotations[AnnotationSignature] == layer.Annotations[AnnotationSignature] {
+				continue
+			}
+			artifact.Layers = append(artifact.Layers, l)
+		}
+	}
+	artifact.Layers = append(artifact.Layers, layer)
+
+	diffIDs := make([]digest.Digest, 0, len(artifact.Layers))
+	for _, l := range artifact.Layers {
+		diffIDs = append(diffIDs, l.Digest)
+	}
+	config, e := json.Marshal(ocispec.Image{
+		RootFS: ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	if e != nil {
+		return nil, e
+	}
+	artifact.Config = bytesBlob(ocispec.MediaTypeImageConfig, config, nil)
+
+	return artifact, nil
+}
+
+// bytesBlob returns a blob of the content in memory
+func bytesBlob(mediaType string, content []byte, annotations map[string]string) registry.Blob {
+	return registry.Blob{
+		Descriptor: ocispec.Descriptor{
+			MediaType:   mediaType,
+			Digest:      digest.FromBytes(content),
+			Size:        int64(len(content)),
+			Annotations: annotations,
+		},
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		},
+	}
+}
+
+// signSnapshot signs all pushed destinations and pushes the signatures next to them, destinations of the same repository and digest
+// share the signature. failures of optional destinations are recorded but do not fail the snapshot
+func (c *Worker) signSnapshot(ctx context.Context, result *Result, signer crypto.Signer, opt *SignOptions) *Error {
+	var failed []string
+	signed := make(map[string]string)
+	for i := range result.Destinations {
+		dest := &result.Destinations[i]
+		if !dest.Pushed {
+			continue
+		}
+
+		sig, e := c.signDestination(ctx, dest, signer, opt, signed)
+		if e != nil {
+			log.Error(e, "sign image", "destination", dest.Image, "optional", dest.Optional)
+			dest.Error = constants.ErrorSign
+			dest.Message = e.Error()
+			if !dest.Optional {
+				failed = append(failed, dest.Image+": "+e.Error())
+			}
+			continue
+		}
+		log.Info("image signed", "destination", dest.Image, "signature", sig)
+		dest.Signature = sig
+	}
+	// the snapshot image is always the first destination
+	result.Digest = result.Destinations[0].Digest
+	result.Signature = result.Destinations[0].Signature
+
+	if len(failed) > 0 {
+		return errSign(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// signDestination signs the manifest digest of the pushed destination, resolving it from the registry if the runtime does not report it.
+// signed are signature references keyed by repositories and digests signed already
+func (c *Worker) signDestination(ctx context.Context, dest *Destination, signer crypto.Signer, opt *SignOptions, signed map[string]string) (string, error) {
+	ref, e := reference.ParseNormalizedNamed(dest.Image)
+	if e != nil {
+		return "", e
+	}
+	ref = reference.TagNameOnly(ref)
+
+	if dest.Digest == "" {
+		resolver, ok := opt.Pusher.(ManifestResolver)
+		if !ok {
+			return "", errors.New("the manifest digest is unknown")
+		}
+		desc, e := c.resolveManifest(ctx, ref, "", resolver)
+		if e != nil {
+			return "", fmt.Errorf("resolve manifest digest: %w", e)
+		}
+		dest.Digest = desc.Digest.String()
+	}
+	d, e := digest.Parse(dest.Digest)
+	if e != nil {
+		return "", fmt.Errorf("invalid manifest digest: %w", e)
+	}
+
+	repo := reference.TrimNamed(ref)
+	key := repo.Name() + "@" + d.String()
+	if sig, ok := signed[key]; ok {
+		return sig, nil
+	}
+
+	payload, e := signaturePayload(repo, d)
+	if e != nil {
+		return "", e
+	}
+	sig, e := signPayload(signer, payload)
+	if e != nil {
+		return "", fmt.Errorf("sign payload: %w", e)
+	}
+	target, e := signatureRef(repo, d)
+	if e != nil {
+		return "", e
+	}
+
+	var pushed digest.Digest
+	e = c.withAuths(target, func(auth *types.AuthConfig) error {
+		var existing *registry.Image
+		if fetcher, ok := opt.Pusher.(ImageFetcher); ok {
+			var e error
+			if existing, e = fetcher.Fetch(ctx, target, auth); e != nil {
+				return classifyPushError(fmt.Errorf("fetch existing signatures: %w", e))
+			}
+		}
+		artifact, e := signatureArtifact(payload, sig, existing)
+		if e != nil {
+			return e
+		}
+		if pushed, e = opt.Pusher.Push(ctx, target, artifact, auth); e != nil {
+			return classifyPushError(e)
+		}
+		return nil
+	})
+	if e != nil {
+		return "", fmt.Errorf("push signature: %w", e)
+	}
+
+	withDigest, e := reference.WithDigest(target, pushed)
+	if e != nil {
+		return "", e
+	}
+	signed[key] = reference.FamiliarString(withDigest)
+	return signed[key], nil
+}
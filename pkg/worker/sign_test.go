@@ -0,0 +1,303 @@
+package worker
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+	"github.com/supremind/container-snapshot/pkg/registry"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+var _ = Describe("sign", func() {
+	var ctx = context.Background()
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	pkcs8 := func(k crypto.Signer) []byte {
+		der, e := x509.MarshalPKCS8PrivateKey(k)
+		Expect(e).Should(Succeed())
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	Context("when loading keys", func() {
+		It("should load pkcs8 keys of all supported types", func() {
+			rsaKey, e := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(e).Should(Succeed())
+			_, edKey, e := ed25519.GenerateKey(rand.Reader)
+			Expect(e).Should(Succeed())
+
+			for _, k := range []crypto.Signer{ecKey, rsaKey, edKey} {
+				signer, e := LoadSigningKey(pkcs8(k), nil)
+				Expect(e).Should(Succeed())
+				Expect(signer.Public()).Should(Equal(k.Public()))
+			}
+		})
+
+		It("should load sec1 ec keys", func() {
+			der, e := x509.MarshalECPrivateKey(ecKey)
+			Expect(e).Should(Succeed())
+			signer, e := LoadSigningKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil)
+			Expect(e).Should(Succeed())
+			Expect(signer.Public()).Should(Equal(ecKey.Public()))
+		})
+
+		It("should decrypt keys encrypted by cosign with the password", func() {
+			key := encryptKey(ecKey, "secret")
+			signer, e := LoadSigningKey(key, []byte("secret"))
+			Expect(e).Should(Succeed())
+			Expect(signer.Public()).Should(Equal(ecKey.Public()))
+
+			_, e = LoadSigningKey(key, []byte("wrong"))
+			Expect(e).Should(MatchError(ContainSubstring("wrong password")))
+		})
+
+		It("should reject malformed keys", func() {
+			_, e := LoadSigningKey([]byte("not a key"), nil)
+			Expect(e).Should(HaveOccurred())
+			_, e = LoadSigningKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("key")}), nil)
+			Expect(e).Should(MatchError(ContainSubstring("unsupported pem block type")))
+		})
+	})
+
+	It("should verify signatures offline with the public key", func() {
+		rsaKey, e := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(e).Should(Succeed())
+		_, edKey, e := ed25519.GenerateKey(rand.Reader)
+		Expect(e).Should(Succeed())
+
+		payload := []byte(`{"critical":{}}`)
+		for _, k := range []crypto.Signer{ecKey, rsaKey, edKey} {
+			sig, e := signPayload(k, payload)
+			Expect(e).Should(Succeed())
+			Expect(VerifySignature(k.Public(), payload, sig)).Should(Succeed())
+			Expect(VerifySignature(k.Public(), []byte(`{"critical":{"tampered":true}}`), sig)).ShouldNot(Succeed())
+		}
+	})
+
+	Context("with the docker runtime", func() {
+		const (
+			imageDigest  = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+			mirrorDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+		)
+
+		var (
+			client  *mockDockerClient
+			pusher  *mockSignaturePusher
+			worker  Worker
+			options SnapshotOptions
+		)
+
+		BeforeEach(func() {
+			client = &mockDockerClient{digests: map[string]string{
+				"reg.example.com/snapshots/app:v1":     imageDigest,
+				"reg.example.com/snapshots/app:latest": imageDigest,
+				"mirror.example.com/app:v1":            mirrorDigest,
+			}}
+			pusher = &mockSignaturePusher{}
+			worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+			options = SnapshotOptions{
+				Container: "container-id",
+				Image:     "reg.example.com/snapshots/app:v1",
+				Tags:      []string{"latest"},
+				Mirrors:   []string{"mirror.example.com/app:v1"},
+				Sign:      &SignOptions{Key: pkcs8(ecKey), Pusher: pusher},
+			}
+		})
+
+		It("should push signatures verified by the public key next to the images", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+			// tags of the same repository share the signature
+			Expect(pusher.pushed).Should(Equal([]string{
+				"reg.example.com/snapshots/app:sha256-1111111111111111111111111111111111111111111111111111111111111111.sig",
+				"mirror.example.com/app:sha256-2222222222222222222222222222222222222222222222222222222222222222.sig",
+			}))
+			Expect(result.Signature).Should(Equal(pusher.pushed[0] + "@" + pusher.digests[0].String()))
+			Expect(result.Destinations[1].Signature).Should(Equal(result.Signature))
+			Expect(result.Destinations[2].Signature).Should(Equal(pusher.pushed[1] + "@" + pusher.digests[1].String()))
+
+			img := pusher.images[0]
+			Expect(img.MediaType).Should(Equal(ocispec.MediaTypeImageManifest))
+			Expect(img.Layers).Should(HaveLen(1))
+			layer := img.Layers[0]
+			Expect(layer.MediaType).Should(Equal(MediaTypeSimpleSigning))
+			rc, e := layer.Open()
+			Expect(e).Should(Succeed())
+			payload, e := ioutil.ReadAll(rc)
+			Expect(e).Should(Succeed())
+			Expect(digest.FromBytes(payload)).Should(Equal(layer.Digest))
+
+			var p simpleSigning
+			Expect(json.Unmarshal(payload, &p)).Should(Succeed())
+			Expect(p.Critical.Identity.DockerReference).Should(Equal("reg.example.com/snapshots/app"))
+			Expect(p.Critical.Image.DockerManifestDigest).Should(Equal(imageDigest))
+			Expect(p.Critical.Type).Should(Equal("cosign container image signature"))
+
+			sig, e := base64.StdEncoding.DecodeString(layer.Annotations[AnnotationSignature])
+			Expect(e).Should(Succeed())
+			Expect(VerifySignature(ecKey.Public(), payload, sig)).Should(Succeed())
+		})
+
+		It("should keep signatures of other signers", func() {
+			other := bytesBlob(MediaTypeSimpleSigning, []byte(`{"other":"payload"}`), map[string]string{AnnotationSignature: "b3RoZXI="})
+			pusher.existing = map[string]*registry.Image{
+				"reg.example.com/snapshots/app:sha256-1111111111111111111111111111111111111111111111111111111111111111.sig": {
+					MediaType: ocispec.MediaTypeImageManifest,
+					Layers:    []registry.Blob{other},
+				},
+			}
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			img := pusher.images[0]
+			Expect(img.Layers).Should(HaveLen(2))
+			Expect(img.Layers[0].Descriptor).Should(Equal(other.Descriptor))
+			Expect(img.Layers[1].MediaType).Should(Equal(MediaTypeSimpleSigning))
+
+			rc, e := img.Config.Open()
+			Expect(e).Should(Succeed())
+			var config ocispec.Image
+			Expect(json.NewDecoder(rc).Decode(&config)).Should(Succeed())
+			Expect(config.RootFS.DiffIDs).Should(Equal([]digest.Digest{other.Digest, img.Layers[1].Digest}))
+
+			// the mirror has no signatures yet
+			Expect(pusher.images[1].Layers).Should(HaveLen(1))
+		})
+
+		It("should not push signatures if existing ones could not be fetched", func() {
+			pusher.badFetch = true
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrSign))
+			Expect(result.Destinations[0].Message).Should(ContainSubstring("fetch existing signatures"))
+			Expect(pusher.pushed).Should(BeEmpty())
+		})
+
+		It("should resolve digests not reported by the runtime", func() {
+			client.digests["reg.example.com/snapshots/app:v1"] = ""
+			pusher.resolved = imageDigest
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Digest).Should(Equal(imageDigest))
+			Expect(pusher.pushed).Should(HaveLen(2))
+		})
+
+		It("should fail if the digest could not be resolved", func() {
+			client.digests["reg.example.com/snapshots/app:v1"] = ""
+			options.Sign.Pusher = &mockPusher{}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrSign))
+			Expect(result.Phase).Should(Equal(constants.PhaseSign))
+			Expect(result.Error).Should(Equal(constants.ErrorSign))
+			Expect(result.Destinations[0].Pushed).Should(BeTrue())
+			Expect(result.Destinations[0].Error).Should(Equal(constants.ErrorSign))
+		})
+
+		It("should not fail for optional mirrors not signed", func() {
+			options.Mirrors = nil
+			options.OptionalMirrors = []string{"mirror.example.com/app:v1"}
+			pusher.badRepos = map[string]bool{"mirror.example.com/app": true}
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Signature).ShouldNot(BeEmpty())
+			Expect(result.Destinations[2].Signature).Should(BeEmpty())
+			Expect(result.Destinations[2].Error).Should(Equal(constants.ErrorSign))
+		})
+
+		It("should fail with a bad key before committing", func() {
+			options.Sign.Key = []byte("not a key")
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrSign))
+			Expect(result.Phase).Should(Equal(constants.PhaseValidate))
+			Expect(client.calls).Should(BeEmpty())
+		})
+	})
+})
+
+// encryptKey encrypts the key the way `cosign generate-key-pair` does
+func encryptKey(k crypto.Signer, password string) []byte {
+	der, e := x509.MarshalPKCS8PrivateKey(k)
+	Expect(e).Should(Succeed())
+
+	var enc encryptedKey
+	enc.KDF.Name = "scrypt"
+	enc.KDF.Params.N, enc.KDF.Params.R, enc.KDF.Params.P = 32768, 8, 1
+	enc.KDF.Salt = make([]byte, 32)
+	enc.Cipher.Name = "nacl/secretbox"
+	enc.Cipher.Nonce = make([]byte, 24)
+	rand.Read(enc.KDF.Salt)
+	rand.Read(enc.Cipher.Nonce)
+
+	derived, e := scrypt.Key([]byte(password), enc.KDF.Salt, enc.KDF.Params.N, enc.KDF.Params.R, enc.KDF.Params.P, 32)
+	Expect(e).Should(Succeed())
+	var secret [32]byte
+	var nonce [24]byte
+	copy(secret[:], derived)
+	copy(nonce[:], enc.Cipher.Nonce)
+	enc.Ciphertext = secretbox.Seal(nil, der, &nonce, &secret)
+
+	data, e := json.Marshal(enc)
+	Expect(e).Should(Succeed())
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED COSIGN PRIVATE KEY", Bytes: data})
+}
+
+// mockSignaturePusher pushes signatures and resolves image digests
+type mockSignaturePusher struct {
+	// badRepos are repositories failed to push
+	badRepos map[string]bool
+	resolved string
+	// existing are signatures pushed already by their references, and badFetch fails fetching them
+	existing map[string]*registry.Image
+	badFetch bool
+	pushed   []string
+	images   []*registry.Image
+	digests  []digest.Digest
+}
+
+func (p *mockSignaturePusher) Push(ctx context.Context, ref reference.Named, img *registry.Image, auth *types.AuthConfig) (digest.Digest, error) {
+	if p.badRepos[ref.Name()] {
+		return "", errors.New("denied: requested access to the resource is denied")
+	}
+	m, e := img.Manifest()
+	if e != nil {
+		return "", e
+	}
+	p.pushed = append(p.pushed, reference.FamiliarString(ref))
+	p.images = append(p.images, img)
+	p.digests = append(p.digests, digest.FromBytes(m))
+	return digest.FromBytes(m), nil
+}
+
+func (p *mockSignaturePusher) Resolve(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (ocispec.Descriptor, error) {
+	if p.resolved == "" {
+		return ocispec.Descriptor{}, errors.New("manifest unknown")
+	}
+	return ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.Digest(p.resolved), Size: 1024}, nil
+}
+
+func (p *mockSignaturePusher) Fetch(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (*registry.Image, error) {
+	if p.badFetch {
+		return nil, errors.New("manifest invalid")
+	}
+	return p.existing[ref.String()], nil
+}
@@ -0,0 +1,36 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// SizeMeasurer is implemented by runtimes able to measure the container read/write layer before committing
+type SizeMeasurer interface {
+	// Measure returns the size of the container read/write layer in bytes
+	Measure(ctx context.Context, container string) (int64, error)
+}
+
+// measureSize measures the container read/write layer by the runtime
+func measureSize(ctx context.Context, rt Runtime, ctr string) (int64, error) {
+	measurer, ok := rt.(SizeMeasurer)
+	if !ok {
+		return 0, errors.New("the container runtime can not measure containers")
+	}
+	return measurer.Measure(ctx, ctr)
+}
+
+// formatSize formats bytes in binary units, such as 1.5GiB
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 5; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
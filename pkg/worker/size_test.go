@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("max size", func() {
+	var ctx = context.Background()
+
+	It("should format sizes in binary units", func() {
+		Expect(formatSize(512)).Should(Equal("512B"))
+		Expect(formatSize(1536)).Should(Equal("1.5KiB"))
+		Expect(formatSize(10 << 30)).Should(Equal("10.0GiB"))
+		Expect(formatSize(3 << 40)).Should(Equal("3.0TiB"))
+	})
+
+	Context("with the docker runtime", func() {
+		var (
+			client  *mockDockerClient
+			worker  Worker
+			options SnapshotOptions
+		)
+
+		BeforeEach(func() {
+			client = &mockDockerClient{}
+			worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+			options = SnapshotOptions{
+				Container: "container-id",
+				Image:     "image-name",
+			}
+		})
+
+		It("should refuse containers over the max size, without committing or pushing", func() {
+			options.MaxSize = 1000
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrTooLarge))
+			Expect(result.Phase).Should(Equal(constants.PhaseCommit))
+			Expect(result.Error).Should(Equal(constants.ErrorTooLarge))
+			Expect(result.Size).Should(Equal(int64(1024)))
+			Expect(result.Message).Should(ContainSubstring("1.0KiB (1024 bytes), over the max size 1000B (1000 bytes)"))
+			Expect(client.calls).Should(BeEmpty())
+			Expect(client.pushed).Should(BeEmpty())
+		})
+
+		It("should take snapshots within the max size", func() {
+			options.MaxSize = 1024
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+			Expect(client.pushed).ShouldNot(BeEmpty())
+		})
+
+		It("should measure containers through wrapped runtimes", func() {
+			rt, e := NewDirectPushRuntime(worker.runtime, nil)
+			Expect(e).Should(Succeed())
+			size, e := measureSize(ctx, rt, "container-id")
+			Expect(e).Should(Succeed())
+			Expect(size).Should(Equal(int64(1024)))
+		})
+	})
+})
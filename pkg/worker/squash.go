@@ -0,0 +1,185 @@
+package worker
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// squashRewrite flattens all layers of the image into a single layer,
+// histories of the image are kept in its config as empty layers
+var squashRewrite = &layerRewrite{
+	name:   "squash",
+	write:  squashLayers,
+	config: squashConfig,
+}
+
+// layerOpener returns a reader of an uncompressed layer tarball
+type layerOpener func() (io.ReadCloser, error)
+
+// squashedEntry is the file of a path in the squashed layer
+type squashedEntry struct {
+	// layer is the index of the layer the file comes from
+	layer int
+	dir   bool
+}
+
+// squashLayers writes the union of layers as a single layer tarball, layers are ordered from the base to the top.
+// files are taken from the top most layer having them, whiteouts are applied and dropped,
+// so the squashed layer is applied to an empty root filesystem
+func squashLayers(layers []layerOpener, w io.Writer) error {
+	entries := make(map[string]squashedEntry)
+	deleted := make(map[string]bool)
+	opaque := make(map[string]bool)
+
+	// hidden tells if the path is deleted, or replaced by a non directory, in upper layers
+	hidden := func(name string) bool {
+		if deleted[name] {
+			return true
+		}
+		for p := path.Dir(name); p != "."; p = path.Dir(p) {
+			if deleted[p] || opaque[p] {
+				return true
+			}
+			if e, ok := entries[p]; ok && !e.dir {
+				return true
+			}
+		}
+		return false
+	}
+
+	// find which layer each path comes from, from the top layer to the base
+	for i := len(layers) - 1; i >= 0; i-- {
+		// whiteouts only apply to lower layers
+		deletedHere := make(map[string]bool)
+		opaqueHere := make(map[string]bool)
+		e := walkLayer(layers[i], func(name string, hdr *tar.Header, _ io.Reader) error {
+			base := path.Base(name)
+			if base == whiteoutOpaque {
+				opaqueHere[path.Dir(name)] = true
+				return nil
+			}
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				deletedHere[path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix))] = true
+				return nil
+			}
+			if _, ok := entries[name]; ok || hidden(name) {
+				return nil
+			}
+			entries[name] = squashedEntry{layer: i, dir: hdr.Typeflag == tar.TypeDir}
+			return nil
+		})
+		if e != nil {
+			return fmt.Errorf("read layer %d: %w", i, e)
+		}
+		for k := range deletedHere {
+			deleted[k] = true
+		}
+		for k := range opaqueHere {
+			opaque[k] = true
+		}
+	}
+
+	// write files from the base to the top, so parent directories mostly come before their children.
+	// hard links are kept as they are, they refer to files in the same layer, which are rarely changed by upper layers
+	tw := tar.NewWriter(w)
+	for i := range layers {
+		e := walkLayer(layers[i], func(name string, hdr *tar.Header, r io.Reader) error {
+			entry, ok := entries[name]
+			if !ok || entry.layer != i {
+				return nil
+			}
+			// written once even if the layer has the path more than once
+			delete(entries, name)
+
+			hdr.Name = name
+			if hdr.Typeflag == tar.TypeDir {
+				hdr.Name += "/"
+			}
+			if e := tw.WriteHeader(hdr); e != nil {
+				return e
+			}
+			_, e := io.Copy(tw, r)
+			return e
+		})
+		if e != nil {
+			return fmt.Errorf("squash layer %d: %w", i, e)
+		}
+	}
+
+	return tw.Close()
+}
+
+// walkLayer calls fn for each entry of the layer, with the cleaned path of the entry, the root directory is skipped
+func walkLayer(open layerOpener, fn func(name string, hdr *tar.Header, r io.Reader) error) error {
+	rc, e := open()
+	if e != nil {
+		return e
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		if e := fn(name, hdr, tr); e != nil {
+			return e
+		}
+	}
+}
+
+// squashConfig returns the image config with the squashed layer as its only layer,
+// histories are kept as empty layers, and a history of squashing is appended
+func squashConfig(raw []byte, layers int, diffID digest.Digest) ([]byte, error) {
+	var config map[string]json.RawMessage
+	if e := json.Unmarshal(raw, &config); e != nil {
+		return nil, fmt.Errorf("parse image config: %w", e)
+	}
+
+	var history []map[string]interface{}
+	if h, ok := config["history"]; ok {
+		if e := json.Unmarshal(h, &history); e != nil {
+			return nil, fmt.Errorf("parse image history: %w", e)
+		}
+	}
+	for _, h := range history {
+		h["empty_layer"] = true
+	}
+	history = append(history, map[string]interface{}{
+		"created":    time.Now().UTC(),
+		"created_by": "container snapshot squash",
+		"comment":    fmt.Sprintf("squashed %d layers", layers),
+	})
+
+	buf, e := json.Marshal(history)
+	if e != nil {
+		return nil, e
+	}
+	config["history"] = buf
+	if e := replaceDiffIDs(config, []digest.Digest{diffID}); e != nil {
+		return nil, e
+	}
+
+	return json.Marshal(config)
+}
@@ -0,0 +1,273 @@
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/supremind/container-snapshot/pkg/constants"
+)
+
+var _ = Describe("squash", func() {
+	var ctx = context.Background()
+
+	squash := func(layers ...[]byte) map[string]string {
+		openers := make([]layerOpener, 0, len(layers))
+		for _, l := range layers {
+			l := l
+			openers = append(openers, func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(l)), nil })
+		}
+		buf := &bytes.Buffer{}
+		Expect(squashLayers(openers, buf)).Should(Succeed())
+		return layerEntries(buf.Bytes())
+	}
+
+	Context("when squashing layers", func() {
+		It("should take files from the top most layer", func() {
+			Expect(squash(
+				layerTarball(map[string]string{"etc/": "", "etc/hosts": "base", "etc/passwd": "root"}),
+				layerTarball(map[string]string{"etc/": "", "etc/hosts": "changed"}),
+			)).Should(Equal(map[string]string{"etc/": "", "etc/hosts": "changed", "etc/passwd": "root"}))
+		})
+
+		It("should apply and drop whiteouts", func() {
+			Expect(squash(
+				layerTarball(map[string]string{"tmp/": "", "tmp/cache/": "", "tmp/cache/a": "a", "tmp/keep": "keep"}),
+				layerTarball(map[string]string{"tmp/": "", "tmp/.wh.cache": ""}),
+			)).Should(Equal(map[string]string{"tmp/": "", "tmp/keep": "keep"}))
+		})
+
+		It("should keep files created again above whiteouts", func() {
+			Expect(squash(
+				layerTarball(map[string]string{"data": "old"}),
+				layerTarball(map[string]string{".wh.data": ""}),
+				layerTarball(map[string]string{"data": "new"}),
+			)).Should(Equal(map[string]string{"data": "new"}))
+		})
+
+		It("should hide lower contents of opaque directories", func() {
+			Expect(squash(
+				layerTarball(map[string]string{"var/": "", "var/lib/": "", "var/lib/old": "old"}),
+				layerTarball(map[string]string{"var/": "", "var/lib/": "", "var/lib/.wh..wh..opq": "", "var/lib/new": "new"}),
+			)).Should(Equal(map[string]string{"var/": "", "var/lib/": "", "var/lib/new": "new"}))
+		})
+
+		It("should hide lower contents of directories replaced by files", func() {
+			Expect(squash(
+				layerTarball(map[string]string{"opt/": "", "opt/app/": "", "opt/app/bin": "bin"}),
+				layerTarball(map[string]string{"opt/": "", "opt/app": "file"}),
+			)).Should(Equal(map[string]string{"opt/": "", "opt/app": "file"}))
+		})
+	})
+
+	Context("when squashing the config", func() {
+		It("should keep histories as empty layers", func() {
+			raw := `{"architecture":"amd64","custom":{"kept":true},"history":[{"created_by":"base"},{"created_by":"commit","comment":"snapshot"}],` +
+				`"rootfs":{"type":"layers","diff_ids":["sha256:a","sha256:b"]}}`
+			squashed, e := squashConfig([]byte(raw), 2, "sha256:squashed")
+			Expect(e).Should(Succeed())
+
+			var config struct {
+				ocispec.Image
+				Custom map[string]bool `json:"custom"`
+			}
+			Expect(json.Unmarshal(squashed, &config)).Should(Succeed())
+			Expect(config.Architecture).Should(Equal("amd64"))
+			Expect(config.Custom).Should(HaveKeyWithValue("kept", true))
+			Expect(config.RootFS.DiffIDs).Should(Equal([]digest.Digest{"sha256:squashed"}))
+			Expect(config.History).Should(HaveLen(3))
+			Expect(config.History[0].CreatedBy).Should(Equal("base"))
+			Expect(config.History[1].Comment).Should(Equal("snapshot"))
+			Expect(config.History[0].EmptyLayer).Should(BeTrue())
+			Expect(config.History[1].EmptyLayer).Should(BeTrue())
+			Expect(config.History[2].EmptyLayer).Should(BeFalse())
+			Expect(config.History[2].Comment).Should(Equal("squashed 2 layers"))
+		})
+	})
+
+	Context("with the docker runtime", func() {
+		var (
+			client  *mockDockerClient
+			worker  Worker
+			options = SnapshotOptions{
+				Container: "container-id",
+				Image:     "image-name",
+				Squash:    true,
+			}
+		)
+
+		BeforeEach(func() {
+			client = &mockDockerClient{archive: dockerArchive(map[string]string{
+				"manifest.json":  `[{"Config":"abc.json","RepoTags":["image-name:latest"],"Layers":["base/layer.tar","top/layer.tar"]}]`,
+				"abc.json":       `{"architecture":"amd64","history":[{"created_by":"base"},{"created_by":"commit"}],"rootfs":{"type":"layers","diff_ids":["sha256:a","sha256:b"]}}`,
+				"base/layer.tar": string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "base", "tmp/": "", "tmp/cache": "cached"})),
+				"top/layer.tar":  string(layerTarball(map[string]string{"etc/": "", "etc/hosts": "changed", "tmp/": "", "tmp/.wh.cache": ""})),
+			}, nil)}
+			worker = Worker{runtime: NewDockerRuntime(client), auths: make(mergedDockerAuth)}
+		})
+
+		It("should load the squashed image back as the snapshot image", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(client.loaded).ShouldNot(BeEmpty())
+
+			archive := layerEntries(client.loaded)
+			var mfst []dockerArchiveManifest
+			Expect(json.Unmarshal([]byte(archive["manifest.json"]), &mfst)).Should(Succeed())
+			Expect(mfst).Should(HaveLen(1))
+			Expect(mfst[0].RepoTags).Should(Equal([]string{"image-name:latest"}))
+			Expect(mfst[0].Layers).Should(HaveLen(1))
+			Expect(layerEntries([]byte(archive[mfst[0].Layers[0]]))).Should(Equal(map[string]string{"etc/": "", "etc/hosts": "changed", "tmp/": ""}))
+
+			config := archive[mfst[0].Config]
+			Expect(result.ImageID).Should(Equal(digest.FromString(config).String()))
+			Expect(result.Layers).Should(Equal(1))
+			Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+			Expect(client.pushed).Should(Equal([]string{"image-name:latest"}))
+		})
+
+		It("should push the squashed image directly", func() {
+			pusher := &mockPusher{}
+			rt, e := NewDirectPushRuntime(NewDockerRuntime(client), pusher)
+			Expect(e).Should(Succeed())
+			worker.runtime = rt
+
+			_, e = worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(pusher.image.Layers).Should(HaveLen(1))
+		})
+
+		It("should fail if the image can not be saved", func() {
+			client.archive = nil
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrSquash))
+			Expect(result.Phase).Should(Equal(constants.PhaseSquash))
+			Expect(result.Error).Should(Equal(constants.ErrorSquash))
+			Expect(client.pushed).Should(BeEmpty())
+		})
+
+		It("should remove the committed image if the squash fails with the Always policy", func() {
+			client.archive = nil
+			opt := options
+			opt.Cleanup = constants.CleanupAlways
+			result, e := worker.TakeSnapshot(ctx, &opt)
+			Expect(e).Should(MatchError(ErrSquash))
+			Expect(client.removed).Should(Equal([]string{"mock id"}))
+			Expect(result.FreedBytes).Should(Equal(int64(1024)))
+		})
+	})
+
+	Context("with the containerd runtime", func() {
+		var (
+			root    string
+			client  *mockContainerdClient
+			worker  Worker
+			options = SnapshotOptions{
+				Container: "container-id",
+				Image:     "image-name",
+				Squash:    true,
+			}
+		)
+
+		BeforeEach(func() {
+			var e error
+			root, e = ioutil.TempDir("", "containerd-content-")
+			Expect(e).Should(Succeed())
+			client, e = newMockContainerdClient(root)
+			Expect(e).Should(Succeed())
+			worker = Worker{runtime: NewContainerdRuntime(client, ContainerdNamespace), auths: make(mergedDockerAuth)}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(root)
+		})
+
+		It("should point the snapshot image to the squashed one", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Layers).Should(Equal(1))
+
+			img, e := client.images.Get(ctx, "docker.io/library/image-name:latest")
+			Expect(e).Should(Succeed())
+			var mfst manifest
+			Expect(readJSONBlob(ctx, client.content, img.Target, &mfst)).Should(Succeed())
+			Expect(mfst.Layers).Should(HaveLen(1))
+			Expect(mfst.Layers[0].MediaType).Should(Equal(images.MediaTypeDockerSchema2LayerGzip))
+			Expect(result.ImageID).Should(Equal(mfst.Config.Digest.String()))
+
+			var config ocispec.Image
+			Expect(readJSONBlob(ctx, client.content, mfst.Config, &config)).Should(Succeed())
+			Expect(config.RootFS.DiffIDs).Should(HaveLen(1))
+			Expect(config.History).Should(HaveLen(3))
+			Expect(config.History[0].CreatedBy).Should(Equal("base"))
+
+			rc, e := openLayer(ctx, client.content, mfst.Layers[0])
+			Expect(e).Should(Succeed())
+			defer rc.Close()
+			layer, e := ioutil.ReadAll(rc)
+			Expect(e).Should(Succeed())
+			Expect(digest.FromBytes(layer)).Should(Equal(config.RootFS.DiffIDs[0]))
+			Expect(layerEntries(layer)).Should(Equal(map[string]string{"app/": "", "app/data": "changed", "etc/": "", "etc/os-release": "base", "tmp/": ""}))
+		})
+
+		It("should report layers of the image without squashing", func() {
+			opts := options
+			opts.Squash = false
+			result, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(result.Layers).Should(Equal(2))
+		})
+	})
+})
+
+// layerTarball builds a layer tarball of the files, names ending with / are directories
+func layerTarball(files map[string]string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir})).Should(Succeed())
+			continue
+		}
+		content := files[name]
+		Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})).Should(Succeed())
+		_, e := tw.Write([]byte(content))
+		Expect(e).Should(Succeed())
+	}
+	Expect(tw.Close()).Should(Succeed())
+	return buf.Bytes()
+}
+
+// layerEntries reads files and directories of the tarball, in the same form as layerTarball takes
+func layerEntries(b []byte) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return files
+		}
+		Expect(e).Should(Succeed())
+		content, e := ioutil.ReadAll(tr)
+		Expect(e).Should(Succeed())
+		files[hdr.Name] = string(content)
+	}
+}
@@ -2,17 +2,18 @@ package worker
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto"
 	"encoding/json"
 	"fmt"
-	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/supremind/container-snapshot/pkg/constants"
 	"github.com/supremind/container-snapshot/version"
 	corev1 "k8s.io/api/core/v1"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
@@ -20,24 +21,54 @@ import (
 
 var log = logf.Log.WithName("container snapshot worker").WithValues("version", version.Version)
 
+// unpauseTimeout limits time of unpausing containers, which is done even if the snapshot is cancelled
+const unpauseTimeout = 30 * time.Second
+
+// cleanupTimeout limits time of removing the committed image, which is done even if the snapshot is cancelled
+const cleanupTimeout = time.Minute
+
 type Worker struct {
-	client DockerClient
-	auths  mergedDockerAuth
+	runtime Runtime
+	auths   mergedDockerAuth
+}
+
+// Runtime commits containers as images and pushes them, it is implemented for each supported container runtime
+type Runtime interface {
+	// Commit creates an image named ref from the container's read/write layer
+	Commit(ctx context.Context, container string, ref reference.Named, opt *SnapshotOptions) (*Image, error)
+	// Tag adds the target name to the image named source
+	Tag(ctx context.Context, source, target reference.Named) error
+	// Push pushes the image named ref, auth is nil for an anonymous push.
+	// returns manifest digest of the pushed image, empty if the runtime does not report it
+	Push(ctx context.Context, ref reference.Named, auth *types.AuthConfig) (string, error)
+	// Pause freezes all processes in the container
+	Pause(ctx context.Context, container string) error
+	// Unpause resumes a paused container
+	Unpause(ctx context.Context, container string) error
+	// Remove removes the committed image from the node, refs are all names it is tagged as
+	Remove(ctx context.Context, img *Image, refs []reference.Named) error
 }
 
-// DockerClient is a subset of docker CommonAPIClient, to make the worker interface simpler
-type DockerClient interface {
-	ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error)
-	ImagePush(ctx context.Context, ref string, options types.ImagePushOptions) (io.ReadCloser, error)
+// Image is an image committed from a container
+type Image struct {
+	ID string
+	// Size is size of the container read/write layer in bytes, 0 if the runtime does not report it
+	Size int64
+	// Layers is the number of layers of the image, 0 if the runtime does not report it
+	Layers int
+	// Source is the name of the image the container runs, and SourceDigest is its manifest digest,
+	// or its image id if the manifest digest is unknown. both are empty if the runtime does not report them
+	Source       string
+	SourceDigest string
 }
 
-func New(cli DockerClient, authpath string) (*Worker, error) {
+func New(rt Runtime, authpath string) (*Worker, error) {
 	auths, e := loadDockerAuths(authpath)
 	if e != nil {
 		return nil, fmt.Errorf("load docker auths: %w", e)
 	}
 
-	return &Worker{client: cli, auths: auths}, nil
+	return &Worker{runtime: rt, auths: auths}, nil
 }
 
 type SnapshotOptions struct {
@@ -47,95 +78,673 @@ type SnapshotOptions struct {
 	Image     string `json:"image,omitempty"` // image full name: host/path/image:tag
 	Author    string `json:"author,omitempty"`
 	Comment   string `json:"comment,omitempty"`
+	// dockerfile instructions applied to the snapshot, same as `docker commit --change`
+	Changes []string `json:"changes,omitempty"`
+	// Pause is the pause policy while committing: None, Container (the default), or Pod
+	Pause string `json:"pause,omitempty"`
+	// PodContainers are ids of all containers in the source pod, paused with the Pod policy
+	PodContainers []string `json:"podContainers,omitempty"`
+	// Tags are extra tags of the snapshot, pushed to the same repository as Image
+	Tags []string `json:"tags,omitempty"`
+	// Mirrors are full names of other images the snapshot is pushed to, a snapshot fails if any mirror push fails
+	Mirrors []string `json:"mirrors,omitempty"`
+	// OptionalMirrors are same as mirrors, except failures of pushing them are ignored
+	OptionalMirrors []string `json:"optionalMirrors,omitempty"`
+	// Retry configures retries of pushing each destination on transient errors
+	Retry RetryOptions `json:"retry,omitempty"`
+	// Cleanup is the policy of removing the committed image from the node after pushing, Always, OnSuccess or Never
+	Cleanup string `json:"cleanup,omitempty"`
+	// Export writes the snapshot as a tarball instead of pushing it, if it is set
+	Export *ExportOptions `json:"export,omitempty"`
+	// Squash flattens layers of the committed image into a single layer before pushing or exporting it
+	Squash bool `json:"squash,omitempty"`
+	// SecretEnvs are names of env vars of the container from secrets, removed from the snapshot image config
+	SecretEnvs []string `json:"secretEnvs,omitempty"`
+	// Scan scans files changed by the container for secrets before pushing or exporting the snapshot, if it is set
+	Scan *ScanOptions `json:"scan,omitempty"`
+	// FileChanges summarizes files changed by the container into the result, if it is set
+	FileChanges *FileChangeOptions `json:"fileChanges,omitempty"`
+	// Policy asks an external checker if the snapshot could be pushed or exported, if it is set
+	Policy *PolicyOptions `json:"policy,omitempty"`
+	// MaxSize is the max size in bytes of the container read/write layer, measured before committing, no limit if it is 0
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// Sign signs pushed images with the private key, and pushes the signatures next to them, if it is set
+	Sign *SignOptions `json:"sign,omitempty"`
+	// Provenance attaches a provenance attestation to pushed images, signed with the key of Sign if it is set,
+	// or writes the provenance statement next to the exported tarball
+	Provenance *ProvenanceOptions `json:"provenance,omitempty"`
+	// Exclude are glob patterns of paths dropped from the container read/write layer before pushing or exporting it,
+	// patterns with a slash match paths from the root, others match base names at any depth
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// RetryOptions configures retries with exponential backoff and jitter
+type RetryOptions struct {
+	// Attempts is the max number of attempts, no retry if it is less than 2
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is the delay before the first retry, doubled for each following retry
+	Backoff time.Duration `json:"backoff,omitempty"`
+	// MaxBackoff caps the delay between retries, no cap if it is 0
+	MaxBackoff time.Duration `json:"maxBackoff,omitempty"`
+}
+
+// jitter randomizes retry delays, so that workers pushing to the same registry do not retry at the same moment
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// delay returns the delay before the n-th retry, n starts from 1, it is a random duration in [d/2, d),
+// where d is the exponential backoff
+func (o RetryOptions) delay(n int) time.Duration {
+	d := o.Backoff
+	for i := 1; i < n && (o.MaxBackoff <= 0 || d < o.MaxBackoff); i++ {
+		d *= 2
+	}
+	if o.MaxBackoff > 0 && d > o.MaxBackoff {
+		d = o.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)))
+}
+
+// Result is the outcome of a snapshot, reported to the operator by the termination message
+type Result struct {
+	// Version is the version of the result document, constants.ResultVersion
+	Version string `json:"version"`
+	// Phase is the last phase the worker reached
+	Phase string `json:"phase"`
+	// Error is the error class if the snapshot failed, see constants for all classes
+	Error string `json:"error,omitempty"`
+	// Message is a human readable message of the error
+	Message string `json:"message,omitempty"`
+
+	// ImageID is id of the committed image on the node
+	ImageID string `json:"imageID,omitempty"`
+	// Digest is manifest digest of the pushed snapshot image
+	Digest string `json:"digest,omitempty"`
+	// Signature is the reference of the signature of the snapshot image, with the digest of the signature manifest
+	Signature string `json:"signature,omitempty"`
+	// Provenance is the reference of the provenance attestation of the snapshot image, with the digest of the attestation manifest
+	Provenance string `json:"provenance,omitempty"`
+	// Size is size of the committed container read/write layer in bytes
+	Size int64 `json:"size,omitempty"`
+	// Layers is the number of layers of the snapshot image, 0 if the runtime does not report it
+	Layers int `json:"layers,omitempty"`
+	// FreedBytes is the disk space freed on the node by removing the committed image
+	FreedBytes int64 `json:"freedBytes,omitempty"`
+	// ExcludedFiles and ExcludedBytes are the number and total size of files dropped from the read/write layer by exclude patterns
+	ExcludedFiles int   `json:"excludedFiles,omitempty"`
+	ExcludedBytes int64 `json:"excludedBytes,omitempty"`
+	// ScrubbedEnvs are names of env vars from secrets removed from the snapshot image config
+	ScrubbedEnvs []string `json:"scrubbedEnvs,omitempty"`
+	// SecretFindings are files found with secrets by the secret scan, at most maxDescribedFindings of them are reported
+	SecretFindings []SecretFinding `json:"secretFindings,omitempty"`
+	// FileChanges summarizes files changed by the container, with the largest changes only,
+	// and AllFileChanges are all of them, which are too many for the termination message
+	FileChanges    *DiffSummary `json:"fileChanges,omitempty"`
+	AllFileChanges []FileChange `json:"-"`
+
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// CommitDuration and PushDuration are time spent committing the container and pushing all destinations,
+	// formatted as go durations, e.g. 1m30s
+	CommitDuration string `json:"commitDuration,omitempty"`
+	PushDuration   string `json:"pushDuration,omitempty"`
+
+	Destinations []Destination `json:"destinations,omitempty"`
+	// Export is the result of writing the snapshot tarball, instead of pushing it
+	Export *Export `json:"export,omitempty"`
+}
+
+// fail records the error into the result
+func (r *Result) fail(e *Error) (*Result, error) {
+	r.Error = e.Class()
+	r.Message = e.Error()
+	r.FinishedAt = time.Now().UTC()
+	return r, e
+}
+
+// maxResultMessage is the max size of each message in the encoded result
+const maxResultMessage = 512
+
+// EncodeTermination encodes the result as json no longer than max bytes, messages are cut short,
+// then the largest file changes, secret findings, scrubbed envs and destination messages are dropped from the tail until it fits
+func (r *Result) EncodeTermination(max int) ([]byte, error) {
+	res := *r
+	res.Message = shorten(r.Message, maxResultMessage)
+	res.Destinations = append([]Destination(nil), r.Destinations...)
+	for i := range res.Destinations {
+		res.Destinations[i].Message = shorten(res.Destinations[i].Message, maxResultMessage)
+	}
+	if r.FileChanges != nil {
+		summary := *r.FileChanges
+		res.FileChanges = &summary
+	}
+
+	// each trim drops one entry, and tells whether there was anything to drop
+	trims := []func() bool{
+		func() bool {
+			if res.FileChanges == nil || len(res.FileChanges.Changes) == 0 {
+				return false
+			}
+			res.FileChanges.Changes = res.FileChanges.Changes[:len(res.FileChanges.Changes)-1]
+			return true
+		},
+		func() bool {
+			if len(res.SecretFindings) == 0 {
+				return false
+			}
+			res.SecretFindings = res.SecretFindings[:len(res.SecretFindings)-1]
+			return true
+		},
+		func() bool {
+			if len(res.ScrubbedEnvs) == 0 {
+				return false
+			}
+			res.ScrubbedEnvs = res.ScrubbedEnvs[:len(res.ScrubbedEnvs)-1]
+			return true
+		},
+		func() bool {
+			for i := len(res.Destinations) - 1; i >= 0; i-- {
+				if res.Destinations[i].Message != "" {
+					res.Destinations[i].Message = ""
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	for {
+		b, e := json.Marshal(&res)
+		if e != nil || len(b) <= max {
+			return b, e
+		}
+		trimmed := false
+		for _, trim := range trims {
+			if trimmed = trim(); trimmed {
+				break
+			}
+		}
+		if !trimmed {
+			return nil, fmt.Errorf("result of %d bytes exceeds %d bytes", len(b), max)
+		}
+	}
+}
+
+// shorten keeps the head of the message, which is where messages usually tell what happened
+func shorten(msg string, n int) string {
+	msg = strings.TrimSpace(msg)
+	if len(msg) <= n {
+		return msg
+	}
+	return msg[:n] + "..."
 }
 
-func (c *Worker) TakeSnapshot(ctx context.Context, opt *SnapshotOptions) error {
+// Destination is the push result of an image the snapshot is pushed to
+type Destination struct {
+	Image    string `json:"image"`
+	Pushed   bool   `json:"pushed"`
+	Optional bool   `json:"optional,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	// Signature is the reference of the pushed signature, if the image is signed
+	Signature string `json:"signature,omitempty"`
+	// Provenance is the reference of the attached provenance attestation
+	Provenance string `json:"provenance,omitempty"`
+	// Attempts is the number of push attempts made
+	Attempts int `json:"attempts,omitempty"`
+	// Error is the class of the push error, see constants for all classes
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// tagOf returns the tag of ref, latest if it has no tag, images referred by digests only could not be pushed to
+func tagOf(ref reference.Named) (string, error) {
+	tagged, ok := reference.TagNameOnly(ref).(reference.Tagged)
+	if !ok {
+		return "", fmt.Errorf("no tag in %s", ref)
+	}
+	return tagged.Tag(), nil
+}
+
+// destination is an image the snapshot is pushed to
+type destination struct {
+	ref      reference.Named
+	optional bool
+}
+
+// destinations returns all images the snapshot is pushed to, the snapshot image comes first, duplicates are removed
+func (opt *SnapshotOptions) destinations(ref reference.Named) ([]destination, error) {
+	if _, e := tagOf(ref); e != nil {
+		return nil, e
+	}
+	ref = reference.TagNameOnly(ref)
+	dests := []destination{{ref: ref}}
+	seen := map[string]bool{ref.String(): true}
+	add := func(r reference.Named, optional bool) {
+		r = reference.TagNameOnly(r)
+		if !seen[r.String()] {
+			seen[r.String()] = true
+			dests = append(dests, destination{ref: r, optional: optional})
+		}
+	}
+
+	for _, tag := range opt.Tags {
+		r, e := reference.WithTag(reference.TrimNamed(ref), tag)
+		if e != nil {
+			return nil, fmt.Errorf("invalid tag %s: %w", tag, e)
+		}
+		add(r, false)
+	}
+	for i, mirrors := range [][]string{opt.Mirrors, opt.OptionalMirrors} {
+		for _, m := range mirrors {
+			r, e := reference.ParseNormalizedNamed(m)
+			if e != nil {
+				return nil, fmt.Errorf("invalid mirror %s: %w", m, e)
+			}
+			if _, e := tagOf(r); e != nil {
+				return nil, fmt.Errorf("invalid mirror %s: %w", m, e)
+			}
+			add(r, i == 1)
+		}
+	}
+
+	return dests, nil
+}
+
+// pausedContainers returns containers should be paused while committing
+func (opt *SnapshotOptions) pausedContainers() []string {
+	switch opt.Pause {
+	case constants.PauseNone:
+		return nil
+	case constants.PausePod:
+		for _, ctr := range opt.PodContainers {
+			if ctr == opt.Container {
+				return opt.PodContainers
+			}
+		}
+		return append([]string{opt.Container}, opt.PodContainers...)
+	default:
+		return []string{opt.Container}
+	}
+}
+
+// TakeSnapshot commits the container and pushes it to all destinations,
+// the returned result is never nil, even if the snapshot fails
+func (c *Worker) TakeSnapshot(ctx context.Context, opt *SnapshotOptions) (*Result, error) {
 	log = log.WithValues("container", opt.Container, "image", opt.Image, "author", opt.Author)
 	log.Info("taking snapshot")
 
+	result := &Result{
+		Version:   constants.ResultVersion,
+		Phase:     constants.PhaseValidate,
+		StartedAt: time.Now().UTC(),
+	}
+
 	ref, e := reference.ParseNormalizedNamed(opt.Image)
 	if e != nil {
 		log.Error(e, "parse image name failed")
-		return errInvalidImage(opt.Image)
+		return result.fail(errInvalidImage(opt.Image))
+	}
+	dests, e := opt.destinations(ref)
+	if e != nil {
+		log.Error(e, "parse snapshot destinations failed")
+		return result.fail(errInvalidImage(e.Error()))
 	}
 
-	id, e := c.client.ContainerCommit(ctx, opt.Container, types.ContainerCommitOptions{
-		Reference: ref.String(),
-		Author:    opt.Author,
-		Comment:   opt.Comment,
-		Config: &container.Config{
-			Image: opt.Image,
-		},
-	})
+	if _, e := parseChanges(opt.Changes); e != nil {
+		log.Error(e, "parse commit changes failed")
+		return result.fail(errChanges(e.Error()))
+	}
+	excludes, e := newPathMatcher(opt.Exclude)
 	if e != nil {
-		log.Error(e, "container commit failed")
-		return errCommit(opt.Container)
+		log.Error(e, "parse exclude patterns failed")
+		return result.fail(errExclude(e.Error()))
+	}
+	var secretScanner *scanner
+	if opt.Scan != nil {
+		if secretScanner, e = newScanner(opt.Scan); e != nil {
+			log.Error(e, "parse scan rules failed")
+			return result.fail(errScan(e.Error()))
+		}
+	}
+	var signer crypto.Signer
+	if opt.Sign != nil {
+		if signer, e = LoadSigningKey(opt.Sign.Key, opt.Sign.Password); e != nil {
+			log.Error(e, "load signing key failed")
+			return result.fail(errSign(fmt.Sprintf("load signing key: %v", e)))
+		}
 	}
-	log.WithValues("id", id.ID).Info("container committed")
 
-	for _, auth := range c.auths[reference.Domain(ref)] {
-		e = c.push(ctx, &auth, ref)
-		if e == nil {
-			goto succeed
+	result.Phase = constants.PhaseCommit
+	// runaway containers are refused before anything is committed or pushed
+	if opt.MaxSize > 0 {
+		size, e := measureSize(ctx, c.runtime, opt.Container)
+		if e != nil {
+			log.Error(e, "measure container failed")
+			return result.fail(errCommit(fmt.Sprintf("measure %s: %v", opt.Container, e)))
+		}
+		log.WithValues("size", size).Info("container measured")
+		if size > opt.MaxSize {
+			result.Size = size
+			return result.fail(errTooLarge(fmt.Sprintf("the container read/write layer is %s (%d bytes), over the max size %s (%d bytes)",
+				formatSize(size), size, formatSize(opt.MaxSize), opt.MaxSize)))
 		}
 	}
-	e = c.push(ctx, nil, ref)
+	// paths are listed before committing, to tell added paths from modified ones in the committed layer
+	var kinds map[string]string
+	if opt.FileChanges != nil || opt.Policy != nil {
+		if kinds, e = listChanges(ctx, c.runtime, opt.Container); e != nil {
+			log.Error(e, "list container changes failed, added and modified files are not told apart")
+		}
+	}
+	start := time.Now()
+	img, e := c.commit(ctx, ref, opt)
+	result.CommitDuration = time.Since(start).Round(time.Millisecond).String()
 	if e != nil {
-		log.Error(e, "push image")
-		return errPush(ref.Name())
+		log.Error(e, "container commit failed")
+		return result.fail(errCommit(opt.Container))
+	}
+	log.WithValues("id", img.ID, "size", img.Size).Info("container committed")
+	// the source image is only known by the committed image, images rewritten from it may not report it
+	committed := img
+	// failures after committing go through the cleanup policy too, the committed image is never left on the node by them
+	refs := []reference.Named{ref}
+	failCommitted := func(e *Error) (*Result, error) {
+		if opt.Cleanup == constants.CleanupAlways {
+			result.FreedBytes = c.cleanup(img, refs)
+		}
+		return result.fail(e)
+	}
+	// secrets must never be pushed, the snapshot fails if they could not be removed
+	if len(opt.SecretEnvs) > 0 {
+		scrubbed, e := c.rewrite(ctx, ref, img, scrubRewrite(opt.SecretEnvs, &result.ScrubbedEnvs))
+		if e != nil {
+			log.Error(e, "scrub secret envs failed")
+			return failCommitted(errCommit(fmt.Sprintf("scrub secret envs of %s: %v", opt.Container, e)))
+		}
+		log.WithValues("id", scrubbed.ID, "envs", result.ScrubbedEnvs).Info("secret envs scrubbed")
+		img = scrubbed
+	}
+	result.ImageID = img.ID
+	result.Size = img.Size
+	result.Layers = img.Layers
+
+	if len(excludes) > 0 {
+		result.Phase = constants.PhaseExclude
+		var stats excluded
+		rewritten, e := c.rewrite(ctx, ref, img, excludeRewrite(excludes, &stats))
+		if e != nil {
+			log.Error(e, "path exclusion failed")
+			return failCommitted(errExclude(e.Error()))
+		}
+		log.WithValues("id", rewritten.ID, "files", stats.files, "bytes", stats.bytes).Info("paths excluded")
+		img = rewritten
+		result.ImageID = img.ID
+		result.Layers = img.Layers
+		result.ExcludedFiles = stats.files
+		result.ExcludedBytes = stats.bytes
 	}
 
-succeed:
-	log.Info("image push succeed")
-	return nil
-}
+	// files changed by the container are only told apart before squashing, so they are scanned and checked before it
+	if secretScanner != nil {
+		result.Phase = constants.PhaseScan
+		findings, e := c.scanSecrets(ctx, ref, secretScanner)
+		if e != nil {
+			log.Error(e, "secret scan failed")
+			return failCommitted(errScan(e.Error()))
+		}
+		if len(findings) > 0 {
+			result.SecretFindings = findings
+			if len(findings) > maxDescribedFindings {
+				result.SecretFindings = findings[:maxDescribedFindings]
+			}
+			msg := describeFindings(findings)
+			if !opt.Scan.Allow {
+				log.Info("snapshot blocked by secrets", "findings", msg)
+				return failCommitted(errSecretDetected(msg))
+			}
+			log.Info("secrets allowed by the override", "findings", msg)
+		}
+	}
 
-func (c *Worker) push(ctx context.Context, auth *types.AuthConfig, ref reference.Reference) error {
-	image := reference.FamiliarString(ref)
+	var diff *DiffSummary
+	var diffErr error
+	if opt.FileChanges != nil || opt.Policy != nil {
+		// the summary is for reviewers only, the snapshot goes on without it unless the policy needs it
+		if diff, diffErr = c.summarizeChanges(ctx, ref, kinds); diffErr != nil {
+			log.Error(diffErr, "summarize file changes failed")
+		} else if opt.FileChanges != nil {
+			top := opt.FileChanges.Top
+			if top <= 0 {
+				top = defaultTopChanges
+			}
+			result.FileChanges = diff.largest(top)
+			result.AllFileChanges = diff.Changes
+		}
+	}
 
-	var coded string
-	if auth != nil {
-		var e error
-		coded, e = formatAuth(*auth)
+	if opt.Policy != nil {
+		result.Phase = constants.PhasePolicy
+		if diffErr != nil {
+			return failCommitted(errPolicy(fmt.Sprintf("summarize file changes: %v", diffErr)))
+		}
+		decision, e := c.checkPolicy(ctx, ref, img, diff, opt.Policy)
 		if e != nil {
-			return e
+			log.Error(e, "policy check failed")
+			return failCommitted(errPolicy(shorten(e.Error(), maxPolicyMessage)))
+		}
+		if !decision.Allow {
+			log.Info("snapshot rejected by the policy", "reason", decision.Reason)
+			reason := shorten(decision.Reason, maxPolicyMessage)
+			if reason == "" {
+				reason = "no reason given"
+			}
+			return failCommitted(errPolicyRejected(reason))
 		}
+		log.Info("snapshot allowed by the policy", "reason", decision.Reason)
 	}
 
-	resp, e := c.client.ImagePush(ctx, image, types.ImagePushOptions{
-		RegistryAuth: coded,
-	})
-	if e != nil {
-		return e
+	if opt.Squash {
+		result.Phase = constants.PhaseSquash
+		squashed, e := c.rewrite(ctx, ref, img, squashRewrite)
+		if e != nil {
+			log.Error(e, "image squash failed")
+			return failCommitted(errSquash(e.Error()))
+		}
+		log.WithValues("id", squashed.ID, "from", img.Layers).Info("image squashed")
+		img = squashed
+		result.ImageID = img.ID
+		result.Layers = img.Layers
 	}
 
-	return c.printPushMessage(resp)
-}
+	var failure *Error
+	if opt.Export != nil {
+		result.Phase = constants.PhaseExport
+		failure = c.exportSnapshot(ctx, result, ref, opt.Export)
+		if failure == nil && opt.Provenance != nil {
+			result.Phase = constants.PhaseAttest
+			failure = c.attestExport(ctx, result, committed, opt)
+		}
+	} else {
+		result.Phase = constants.PhasePush
+		failure = c.pushSnapshot(ctx, result, ref, dests, opt.Retry)
+		if failure == nil && signer != nil {
+			result.Phase = constants.PhaseSign
+			failure = c.signSnapshot(ctx, result, signer, opt.Sign)
+		}
+		if failure == nil && opt.Provenance != nil {
+			result.Phase = constants.PhaseAttest
+			failure = c.attestSnapshot(ctx, result, committed, signer, opt)
+		}
+		refs = refs[:0]
+		for _, dest := range dests {
+			refs = append(refs, dest.ref)
+		}
+	}
 
-func (c *Worker) printPushMessage(r io.ReadCloser) error {
-	dec := json.NewDecoder(r)
-	defer r.Close()
+	if opt.Cleanup == constants.CleanupAlways || opt.Cleanup == constants.CleanupOnSuccess && failure == nil {
+		result.FreedBytes = c.cleanup(img, refs)
+	}
 
-	for {
-		var jm jsonmessage.JSONMessage
-		if e := dec.Decode(&jm); e != nil {
-			if e == io.EOF {
-				return nil
+	if failure != nil {
+		return result.fail(failure)
+	}
+
+	result.Phase = constants.PhaseComplete
+	result.FinishedAt = time.Now().UTC()
+	return result, nil
+}
+
+// pushSnapshot pushes the committed image to all destinations, and records push results of them
+func (c *Worker) pushSnapshot(ctx context.Context, result *Result, ref reference.Named, dests []destination, retry RetryOptions) *Error {
+	var failed []Destination
+	start := time.Now()
+	for _, dest := range dests {
+		digest, attempts, e := c.pushDestination(ctx, ref, dest.ref, retry)
+		status := Destination{
+			Image:    reference.FamiliarString(dest.ref),
+			Pushed:   e == nil,
+			Optional: dest.optional,
+			Digest:   digest,
+			Attempts: attempts,
+		}
+		if e != nil {
+			log.Error(e, "push image", "destination", status.Image, "optional", dest.optional)
+			status.Error = errorClass(e)
+			status.Message = e.Error()
+			if !dest.optional {
+				failed = append(failed, status)
 			}
-			return e
+		} else {
+			log.Info("image push succeed", "destination", status.Image)
 		}
+		result.Destinations = append(result.Destinations, status)
+	}
+	result.PushDuration = time.Since(start).Round(time.Millisecond).String()
+	// the snapshot image is always the first destination
+	result.Digest = result.Destinations[0].Digest
 
-		log.Info(jm.ProgressMessage, "id", jm.ID, "status", jm.Status, "stream", jm.Stream, "from", jm.From, "error message", jm.ErrorMessage)
+	if len(failed) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(failed))
+	for _, d := range failed {
+		msgs = append(msgs, d.Image+": "+d.Message)
 	}
+	failure := errPush(strings.Join(msgs, "; "))
+	// tell the operator what kind of push failure it is, if it is known
+	failure.class = failed[0].Error
+	return failure
 }
 
-func formatAuth(auth types.AuthConfig) (string, error) {
-	buf, e := json.Marshal(auth)
+// cleanup removes the committed image from the node, failures are logged but do not fail the snapshot.
+// returns bytes freed, which is the size of the committed read/write layer
+func (c *Worker) cleanup(img *Image, refs []reference.Named) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	if e := c.runtime.Remove(ctx, img, refs); e != nil {
+		log.Error(e, "remove committed image failed", "id", img.ID)
+		return 0
+	}
+	log.Info("committed image removed", "id", img.ID, "freed", img.Size)
+	return img.Size
+}
+
+// pushDestination tags the committed image as the destination and pushes it, the committed image itself is not tagged again.
+// transient push errors are retried with backoff until attempts are used up or ctx is done, the committed image is reused.
+// returns the digest and the number of attempts made
+func (c *Worker) pushDestination(ctx context.Context, committed, dest reference.Named, retry RetryOptions) (string, int, error) {
+	if dest.String() != reference.TagNameOnly(committed).String() {
+		if e := c.runtime.Tag(ctx, committed, dest); e != nil {
+			return "", 0, fmt.Errorf("tag image: %w", e)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		digest, e := c.push(ctx, dest)
+		if e == nil || attempt >= retry.Attempts || !isRetryable(e) {
+			return digest, attempt, e
+		}
+
+		delay := retry.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			log.Info("push failed, no time left to retry", "destination", reference.FamiliarString(dest), "attempt", attempt, "error", e.Error())
+			return digest, attempt, e
+		}
+		log.Info("push failed, retry later", "destination", reference.FamiliarString(dest), "attempt", attempt, "delay", delay.String(), "error", e.Error())
+		select {
+		case <-ctx.Done():
+			return "", attempt, e
+		case <-time.After(delay):
+		}
+	}
+}
+
+// push tries credentials of the image registry one by one, then an anonymous push,
+// the next one is tried only if the registry denies the current one
+func (c *Worker) push(ctx context.Context, ref reference.Named) (string, error) {
+	var digest string
+	e := c.withAuths(ref, func(auth *types.AuthConfig) error {
+		var e error
+		digest, e = c.runtime.Push(ctx, ref, auth)
+		return e
+	})
 	if e != nil {
-		return "", fmt.Errorf("marshal auth: %w", e)
+		return "", e
+	}
+	return digest, nil
+}
+
+// withAuths calls fn with credentials of the registry of ref one by one, then without any credential,
+// the next one is tried only if the registry denies the current one
+func (c *Worker) withAuths(ref reference.Named, fn func(auth *types.AuthConfig) error) error {
+	for i, auth := range c.auths[reference.Domain(ref)] {
+		auth := auth
+		e := fn(&auth)
+		if e == nil || !isAuthError(e) {
+			return e
+		}
+		log.Info("registry denied the credential, try the next one", "registry", reference.Domain(ref), "credential", i)
 	}
 
-	return base64.URLEncoding.EncodeToString(buf), nil
+	return fn(nil)
+}
+
+// commit pauses containers as the pause policy requires and commits the source container,
+// paused containers are always unpaused before it returns, even if the commit fails or ctx is cancelled
+func (c *Worker) commit(ctx context.Context, ref reference.Named, opt *SnapshotOptions) (*Image, error) {
+	var paused []string
+	defer func() {
+		c.unpause(paused)
+	}()
+
+	for _, ctr := range opt.pausedContainers() {
+		if e := c.runtime.Pause(ctx, ctr); e != nil {
+			return nil, fmt.Errorf("pause container %s: %w", ctr, e)
+		}
+		paused = append(paused, ctr)
+		log.Info("container paused", "paused", ctr)
+	}
+
+	return c.runtime.Commit(ctx, opt.Container, ref, opt)
+}
+
+func (c *Worker) unpause(containers []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), unpauseTimeout)
+	defer cancel()
+
+	for _, ctr := range containers {
+		// keep going on errors, so that as many containers as possible are resumed
+		if e := c.runtime.Unpause(ctx, ctr); e != nil {
+			log.Error(e, "unpause container", "paused", ctr)
+			continue
+		}
+		log.Info("container unpaused", "paused", ctr)
+	}
 }
 
 type mergedDockerAuth map[string][]types.AuthConfig
@@ -1,17 +1,26 @@
 package worker
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/supremind/container-snapshot/pkg/constants"
 )
 
 func TestWorker(t *testing.T) {
@@ -23,8 +32,8 @@ var _ = Describe("container snapshot worker", func() {
 	var (
 		ctx    = context.Background()
 		worker = Worker{
-			client: &mockDockerClient{},
-			auths:  make(mergedDockerAuth),
+			runtime: NewDockerRuntime(&mockDockerClient{}),
+			auths:   make(mergedDockerAuth),
 		}
 		options = SnapshotOptions{
 			Container: "container-id",
@@ -34,7 +43,514 @@ var _ = Describe("container snapshot worker", func() {
 
 	Context("when docker steps all good", func() {
 		It("should succeed", func() {
-			Expect(worker.TakeSnapshot(ctx, &options)).Should(Succeed())
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+		})
+
+		It("should report the committed and pushed image", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.ImageID).Should(Equal("mock id"))
+			Expect(result.Digest).Should(Equal("sha256:mock-digest"))
+			Expect(result.Size).Should(Equal(int64(1024)))
+			Expect(result.PushDuration).ShouldNot(BeEmpty())
+		})
+
+		It("should report a versioned complete result", func() {
+			result, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+			Expect(result.Version).Should(Equal(constants.ResultVersion))
+			Expect(result.Phase).Should(Equal(constants.PhaseComplete))
+			Expect(result.Error).Should(BeEmpty())
+			Expect(result.CommitDuration).ShouldNot(BeEmpty())
+			Expect(result.FinishedAt).ShouldNot(BeTemporally("<", result.StartedAt))
+		})
+	})
+
+	Context("when source container runs with its own config", func() {
+		var client *mockDockerClient
+
+		BeforeEach(func() {
+			client = &mockDockerClient{}
+			worker.runtime = NewDockerRuntime(client)
+		})
+
+		It("should carry over the container config", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			config := client.committed.Config
+			Expect(config.Image).Should(Equal("source-image:latest"))
+			Expect(config.Cmd).Should(Equal(strslice.StrSlice{"sh", "-c", "sleep 1d"}))
+			Expect(config.Env).Should(Equal([]string{"PATH=/bin", "FOO=bar"}))
+			Expect(config.WorkingDir).Should(Equal("/work"))
+			Expect(config.Labels).Should(HaveKeyWithValue("base-label", "base"))
+		})
+
+		It("should record where the config fields come from", func() {
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(Succeed())
+
+			labels := client.committed.Config.Labels
+			Expect(labels).Should(HaveKeyWithValue(LabelConfigFromContainer, "Cmd,Env"))
+			Expect(labels).Should(HaveKeyWithValue(LabelConfigFromImage, "Entrypoint,WorkingDir,ExposedPorts,User"))
+		})
+	})
+
+	Context("when commit changes are given", func() {
+		var client *mockDockerClient
+		opts := SnapshotOptions{
+			Container: "container-id",
+			Image:     "image-name",
+			Changes:   []string{`CMD ["serve"]`, "ENV FOO=baz"},
+		}
+
+		BeforeEach(func() {
+			client = &mockDockerClient{}
+			worker.runtime = NewDockerRuntime(client)
+		})
+
+		It("should pass changes to docker commit", func() {
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.committed.Changes).Should(Equal(opts.Changes))
+		})
+
+		It("should record fields overridden by changes", func() {
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+
+			labels := client.committed.Config.Labels
+			Expect(labels).Should(HaveKeyWithValue(LabelConfigFromContainer, ""))
+			Expect(labels).Should(HaveKeyWithValue(LabelConfigFromChanges, "Cmd,Env"))
+		})
+	})
+
+	Context("when commit changes are not supported", func() {
+		opts := SnapshotOptions{
+			Container: "container-id",
+			Image:     "image-name",
+			Changes:   []string{"RUN rm -rf /"},
+		}
+
+		It("should fail", func() {
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrChanges))
+		})
+	})
+
+	Context("with pause policies", func() {
+		var client *mockDockerClient
+		var opts SnapshotOptions
+
+		BeforeEach(func() {
+			client = &mockDockerClient{}
+			worker.runtime = NewDockerRuntime(client)
+			opts = SnapshotOptions{
+				Container:     "container-id",
+				Image:         "image-name",
+				PodContainers: []string{"sidecar-id", "container-id"},
+			}
+		})
+
+		It("should pause the source container by default", func() {
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.calls).Should(Equal([]string{"pause container-id", "commit container-id", "unpause container-id"}))
+			Expect(client.committed.Pause).Should(BeFalse())
+		})
+
+		It("should not pause any container with the None policy", func() {
+			opts.Pause = constants.PauseNone
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.calls).Should(Equal([]string{"commit container-id"}))
+		})
+
+		It("should pause all pod containers with the Pod policy", func() {
+			opts.Pause = constants.PausePod
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.calls).Should(Equal([]string{
+				"pause sidecar-id", "pause container-id",
+				"commit container-id",
+				"unpause sidecar-id", "unpause container-id",
+			}))
+		})
+
+		It("should unpause all paused containers when commit fails", func() {
+			opts.Pause = constants.PausePod
+			client.badCommit = true
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrCommit))
+			Expect(client.calls).Should(Equal([]string{
+				"pause sidecar-id", "pause container-id",
+				"unpause sidecar-id", "unpause container-id",
+			}))
+		})
+
+		It("should unpause paused containers when pausing fails", func() {
+			opts.Pause = constants.PausePod
+			client.badPause = "container-id"
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrCommit))
+			Expect(client.calls).Should(Equal([]string{"pause sidecar-id", "unpause sidecar-id"}))
+		})
+
+		It("should unpause other containers when unpausing one fails", func() {
+			opts.Pause = constants.PausePod
+			client.badUnpause = "sidecar-id"
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.calls).Should(ContainElement("unpause container-id"))
+		})
+
+		It("should unpause containers when the snapshot is cancelled", func() {
+			opts.Pause = constants.PausePod
+			cctx, cancel := context.WithCancel(ctx)
+			worker.runtime = &cancelOnCommit{Runtime: worker.runtime, cancel: cancel}
+			_, e := worker.TakeSnapshot(cctx, &opts)
+			Expect(e).Should(MatchError(ErrCommit))
+			Expect(client.calls).Should(Equal([]string{
+				"pause sidecar-id", "pause container-id",
+				"unpause sidecar-id", "unpause container-id",
+			}))
+		})
+	})
+
+	Context("with additional tags and mirrors", func() {
+		var client *mockDockerClient
+		var opts SnapshotOptions
+
+		BeforeEach(func() {
+			client = &mockDockerClient{badPushes: make(map[string]bool)}
+			worker.runtime = NewDockerRuntime(client)
+			opts = SnapshotOptions{
+				Container:       "container-id",
+				Image:           "reg.example.com/snapshots/image-name:v1",
+				Tags:            []string{"latest", "v1"},
+				Mirrors:         []string{"mirror.example.com/snapshots/image-name:v1"},
+				OptionalMirrors: []string{"backup.example.com/image-name:v1"},
+			}
+		})
+
+		It("should commit once and push to all destinations", func() {
+			result, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.calls).Should(ContainElement("commit container-id"))
+			Expect(client.tagged).Should(Equal([]string{
+				"reg.example.com/snapshots/image-name:v1 reg.example.com/snapshots/image-name:latest",
+				"reg.example.com/snapshots/image-name:v1 mirror.example.com/snapshots/image-name:v1",
+				"reg.example.com/snapshots/image-name:v1 backup.example.com/image-name:v1",
+			}))
+			Expect(client.pushed).Should(Equal([]string{
+				"reg.example.com/snapshots/image-name:v1",
+				"reg.example.com/snapshots/image-name:latest",
+				"mirror.example.com/snapshots/image-name:v1",
+				"backup.example.com/image-name:v1",
+			}))
+			Expect(result.Destinations).Should(HaveLen(4))
+			for _, d := range result.Destinations {
+				Expect(d.Pushed).Should(BeTrue())
+			}
+		})
+
+		It("should fail if a required destination fails", func() {
+			client.badPushes["mirror.example.com/snapshots/image-name:v1"] = true
+			result, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Destinations).Should(ContainElement(Destination{
+				Image:    "mirror.example.com/snapshots/image-name:v1",
+				Attempts: 1,
+				Message:  "can not do image push",
+			}))
+			Expect(client.pushed).Should(ContainElement("backup.example.com/image-name:v1"))
+		})
+
+		It("should succeed if only optional mirrors fail", func() {
+			client.badPushes["backup.example.com/image-name:v1"] = true
+			result, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(result.Destinations[3]).Should(Equal(Destination{
+				Image:    "backup.example.com/image-name:v1",
+				Optional: true,
+				Attempts: 1,
+				Message:  "can not do image push",
+			}))
+		})
+
+		It("should reject invalid tags", func() {
+			opts.Tags = []string{"not a tag"}
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrInvalidImage))
+			Expect(client.calls).Should(BeEmpty())
+		})
+	})
+
+	Context("when cleaning up the committed image", func() {
+		var client *mockDockerClient
+		var w Worker
+		var opts SnapshotOptions
+
+		BeforeEach(func() {
+			client = &mockDockerClient{badPushes: make(map[string]bool)}
+			w = Worker{runtime: NewDockerRuntime(client)}
+			opts = SnapshotOptions{
+				Container: "container-id",
+				Image:     "reg.example.com/snapshots/image-name:v1",
+				Tags:      []string{"latest"},
+			}
+		})
+
+		It("should keep the image by default", func() {
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.removed).Should(BeEmpty())
+			Expect(result.FreedBytes).Should(BeZero())
+		})
+
+		It("should remove the image by id after pushed", func() {
+			opts.Cleanup = constants.CleanupOnSuccess
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.removed).Should(Equal([]string{"mock id"}))
+			Expect(result.FreedBytes).Should(Equal(int64(1024)))
+		})
+
+		It("should keep the image if the push fails with the OnSuccess policy", func() {
+			opts.Cleanup = constants.CleanupOnSuccess
+			client.badPushes["reg.example.com/snapshots/image-name:latest"] = true
+			_, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(client.removed).Should(BeEmpty())
+		})
+
+		It("should remove the image even if the push fails with the Always policy", func() {
+			opts.Cleanup = constants.CleanupAlways
+			client.badPushes["reg.example.com/snapshots/image-name:latest"] = true
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(client.removed).Should(Equal([]string{"mock id"}))
+			Expect(result.FreedBytes).Should(Equal(int64(1024)))
+		})
+
+		It("should not fail the snapshot if the removal fails", func() {
+			opts.Cleanup = constants.CleanupAlways
+			client.badRemove = true
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(result.FreedBytes).Should(BeZero())
+		})
+	})
+
+	Context("when docker reports errors in the push stream", func() {
+		var client *mockDockerClient
+		var w Worker
+
+		BeforeEach(func() {
+			client = &mockDockerClient{}
+			w = Worker{
+				runtime: NewDockerRuntime(client),
+				auths: mergedDockerAuth{
+					"reg.example.com": {{Username: "first"}, {Username: "second"}},
+				},
+			}
+		})
+
+		opts := SnapshotOptions{
+			Container: "container-id",
+			Image:     "reg.example.com/snapshots/image-name:v1",
+		}
+
+		It("should fail with the typed error", func() {
+			client.streamErrors = []string{"denied: requested access to the resource is denied", "denied: requested access to the resource is denied", "unauthorized: authentication required"}
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Destinations[0].Pushed).Should(BeFalse())
+			Expect(result.Destinations[0].Error).Should(Equal(constants.ErrorPushAuthDenied))
+			Expect(result.Error).Should(Equal(constants.ErrorPushAuthDenied))
+			Expect(result.Message).Should(ContainSubstring("reg.example.com/snapshots/image-name:v1: registry denied the credential: unauthorized: authentication required"))
+			Expect(client.pushed).Should(BeEmpty())
+		})
+
+		It("should try the next credential if the registry denies one", func() {
+			client.streamErrors = []string{"denied: requested access to the resource is denied", ""}
+			_, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(client.pushAuths).Should(HaveLen(2))
+			Expect(client.pushed).Should(Equal([]string{"reg.example.com/snapshots/image-name:v1"}))
+		})
+
+		It("should not try other credentials for errors not about auth", func() {
+			client.streamErrors = []string{"manifest invalid: manifest invalid", ""}
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Destinations[0].Error).Should(Equal(constants.ErrorPushManifestInvalid))
+			Expect(client.pushAuths).Should(HaveLen(1))
+		})
+	})
+
+	Context("when pushes fail with transient errors", func() {
+		var client *mockDockerClient
+		var w Worker
+
+		BeforeEach(func() {
+			client = &mockDockerClient{}
+			w = Worker{runtime: NewDockerRuntime(client)}
+		})
+
+		opts := SnapshotOptions{
+			Container: "container-id",
+			Image:     "reg.example.com/snapshots/image-name:v1",
+			Retry:     RetryOptions{Attempts: 3, Backoff: time.Millisecond},
+		}
+
+		It("should retry until pushed", func() {
+			client.streamErrors = []string{"received unexpected HTTP status: 503 Service Unavailable", "read tcp 10.0.0.1:443: connection reset by peer", ""}
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(Succeed())
+			Expect(result.Destinations[0].Pushed).Should(BeTrue())
+			Expect(result.Destinations[0].Attempts).Should(Equal(3))
+			Expect(client.calls).Should(ContainElement("commit container-id"))
+			Expect(client.calls).Should(HaveLen(3), "committed only once")
+			Expect(client.pushAuths).Should(HaveLen(3))
+		})
+
+		It("should fail when attempts are used up", func() {
+			client.streamErrors = []string{"toomanyrequests: slow down", "toomanyrequests: slow down", "toomanyrequests: slow down", ""}
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Error).Should(Equal(constants.ErrorPushRateLimited))
+			Expect(result.Destinations[0].Attempts).Should(Equal(3))
+		})
+
+		It("should not retry errors which are not transient", func() {
+			client.streamErrors = []string{"manifest invalid: manifest invalid", ""}
+			result, e := w.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Destinations[0].Attempts).Should(Equal(1))
+		})
+
+		It("should stop retrying when the context is done", func() {
+			ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer cancel()
+			o := opts
+			o.Retry = RetryOptions{Attempts: 10, Backoff: time.Hour}
+			client.streamErrors = []string{"received unexpected HTTP status: 502 Bad Gateway", ""}
+			result, e := w.TakeSnapshot(ctx, &o)
+			Expect(e).Should(MatchError(ErrPush))
+			Expect(result.Destinations[0].Attempts).Should(Equal(1))
+		})
+	})
+
+	Context("when computing retry delays", func() {
+		It("should back off exponentially with jitter up to the max", func() {
+			r := RetryOptions{Attempts: 10, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+			Expect(r.delay(1)).Should(BeNumerically("~", 750*time.Millisecond, 250*time.Millisecond))
+			Expect(r.delay(2)).Should(BeNumerically("~", 1500*time.Millisecond, 500*time.Millisecond))
+			Expect(r.delay(3)).Should(BeNumerically("~", 3*time.Second, time.Second))
+			Expect(r.delay(8)).Should(BeNumerically("~", 3750*time.Millisecond, 1250*time.Millisecond))
+		})
+	})
+
+	Context("when classifying push errors", func() {
+		It("should tell apart kinds of push errors", func() {
+			for msg, reason := range map[string]error{
+				"denied: requested access to the resource is denied":                                  ErrPushAccessDenied,
+				"name unknown: repository name not known to registry":                                 ErrPushAccessDenied,
+				"unauthorized: authentication required":                                               ErrPushAuthDenied,
+				"unexpected status: 401 Unauthorized":                                                 ErrPushAuthDenied,
+				"manifest invalid: manifest invalid":                                                  ErrPushManifestInvalid,
+				"denied: quota exceeded":                                                              ErrPushQuotaExceeded,
+				"denied: adding 10 MiB of storage, which will exceed the configured upper limit":      ErrPushQuotaExceeded,
+				"toomanyrequests: You have reached your pull rate limit":                              ErrPushRateLimited,
+				"x509: certificate signed by unknown authority":                                       ErrPushTLS,
+				"net/http: TLS handshake timeout":                                                     ErrPushTimeout,
+				"dial tcp 10.0.0.1:443: i/o timeout":                                                  ErrPushTimeout,
+				"Put https://reg.example.com/v2/: dial tcp 10.0.0.1:443: connect: connection refused": ErrPushNetwork,
+				"received unexpected HTTP status: 503 Service Unavailable":                            ErrPushServer,
+				"received unexpected HTTP status: 504 Gateway Timeout":                                ErrPushServer,
+			} {
+				Expect(classifyPushError(errors.New(msg))).Should(MatchError(reason), msg)
+			}
+		})
+
+		It("should treat net errors as network errors", func() {
+			e := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("something wrong")}
+			Expect(classifyPushError(e)).Should(MatchError(ErrPushNetwork))
+		})
+
+		It("should treat exceeded deadlines as timeouts", func() {
+			e := fmt.Errorf("push: %w", context.DeadlineExceeded)
+			Expect(classifyPushError(e)).Should(MatchError(ErrPushTimeout))
+		})
+
+		It("should return unknown errors as is", func() {
+			e := errors.New("something wrong")
+			Expect(classifyPushError(e)).Should(Equal(e))
+		})
+	})
+
+	Context("when the result is too large for the termination message", func() {
+		var result Result
+
+		BeforeEach(func() {
+			result = Result{
+				Version:      constants.ResultVersion,
+				Phase:        constants.PhaseScan,
+				Error:        constants.ErrorSecretDetected,
+				Message:      strings.Repeat("m", 10000),
+				Digest:       "sha256:mock-digest",
+				ScrubbedEnvs: []string{"PASSWORD"},
+				FileChanges:  &DiffSummary{Added: 1000, Bytes: 1 << 20},
+				Destinations: []Destination{
+					{Image: "reg.example.com/app:v1", Pushed: true, Digest: "sha256:mock-digest"},
+					{Image: "mirror.example.com/app:v1", Message: strings.Repeat("d", 10000)},
+				},
+			}
+			for i := 0; i < 100; i++ {
+				path := fmt.Sprintf("/data/%s/%d", strings.Repeat("p", 50), i)
+				result.FileChanges.Changes = append(result.FileChanges.Changes, FileChange{Path: path, Kind: ChangeAdded, Size: 1024})
+				result.SecretFindings = append(result.SecretFindings, SecretFinding{Path: path, Rule: "aws-access-key", Line: 1})
+			}
+		})
+
+		It("should trim the result to fit", func() {
+			b, e := result.EncodeTermination(constants.MaxTerminationMessage)
+			Expect(e).Should(Succeed())
+			Expect(len(b)).Should(BeNumerically("<=", constants.MaxTerminationMessage))
+
+			var decoded Result
+			Expect(json.Unmarshal(b, &decoded)).Should(Succeed())
+			Expect(decoded.Error).Should(Equal(constants.ErrorSecretDetected))
+			Expect(decoded.Digest).Should(Equal("sha256:mock-digest"))
+			Expect(decoded.Message).Should(HavePrefix("mmm"))
+			Expect(len(decoded.Message)).Should(BeNumerically("<=", maxResultMessage+len("...")))
+			Expect(decoded.FileChanges.Added).Should(Equal(1000))
+			Expect(decoded.FileChanges.Changes).Should(BeEmpty())
+			Expect(decoded.SecretFindings).ShouldNot(BeEmpty())
+			Expect(decoded.SecretFindings).Should(Equal(result.SecretFindings[:len(decoded.SecretFindings)]))
+			Expect(decoded.Destinations).Should(HaveLen(2))
+		})
+
+		It("should not change the result", func() {
+			_, e := result.EncodeTermination(constants.MaxTerminationMessage)
+			Expect(e).Should(Succeed())
+			Expect(result.Message).Should(HaveLen(10000))
+			Expect(result.FileChanges.Changes).Should(HaveLen(100))
+			Expect(result.Destinations[1].Message).Should(HaveLen(10000))
+		})
+
+		It("should keep small results as they are", func() {
+			small := Result{Version: constants.ResultVersion, Phase: constants.PhaseComplete, Digest: "sha256:mock-digest"}
+			b, e := small.EncodeTermination(constants.MaxTerminationMessage)
+			Expect(e).Should(Succeed())
+			Expect(b).Should(MatchJSON(mustMarshal(&small)))
+		})
+
+		It("should fail if nothing is left to trim", func() {
+			_, e := result.EncodeTermination(100)
+			Expect(e).Should(HaveOccurred())
 		})
 	})
 
@@ -45,52 +561,211 @@ var _ = Describe("container snapshot worker", func() {
 		}
 
 		It("should fail", func() {
-			Expect(worker.TakeSnapshot(ctx, &opts)).Should(MatchError(ErrInvalidImage))
+			_, e := worker.TakeSnapshot(ctx, &opts)
+			Expect(e).Should(MatchError(ErrInvalidImage))
+		})
+
+		It("should report the error class before committing", func() {
+			result, _ := worker.TakeSnapshot(ctx, &opts)
+			Expect(result.Phase).Should(Equal(constants.PhaseValidate))
+			Expect(result.Error).Should(Equal(constants.ErrorInvalidImage))
 		})
 	})
 
 	Context("when container commit fails", func() {
 		BeforeEach(func() {
-			worker.client = &mockDockerClient{
+			worker.runtime = NewDockerRuntime(&mockDockerClient{
 				badCommit: true,
-			}
+			})
 		})
 
 		It("should fail", func() {
-			Expect(worker.TakeSnapshot(ctx, &options)).Should(MatchError(ErrCommit))
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrCommit))
+		})
+
+		It("should report the failed phase and error class", func() {
+			result, _ := worker.TakeSnapshot(ctx, &options)
+			Expect(result.Phase).Should(Equal(constants.PhaseCommit))
+			Expect(result.Error).Should(Equal(constants.ErrorCommit))
+			Expect(result.Message).Should(Equal("container commit failed: container-id"))
 		})
 	})
 
 	Context("when docker push fails", func() {
 		BeforeEach(func() {
-			worker.client = &mockDockerClient{
+			worker.runtime = NewDockerRuntime(&mockDockerClient{
 				badPush: true,
-			}
+			})
 		})
 
 		It("should fail", func() {
-			Expect(worker.TakeSnapshot(ctx, &options)).Should(MatchError(ErrPush))
+			_, e := worker.TakeSnapshot(ctx, &options)
+			Expect(e).Should(MatchError(ErrPush))
 		})
 	})
 })
 
+// cancelOnCommit cancels the snapshot while committing
+type cancelOnCommit struct {
+	Runtime
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnCommit) Commit(ctx context.Context, ctr string, ref reference.Named, opt *SnapshotOptions) (*Image, error) {
+	r.cancel()
+	return nil, ctx.Err()
+}
+
 type mockDockerClient struct {
-	badCommit bool
-	badPush   bool
+	badCommit  bool
+	badPush    bool
+	badPause   string
+	badUnpause string
+	committed  types.ContainerCommitOptions
+	// badPushes are images failed to push
+	badPushes map[string]bool
+	// streamErrors are errors reported in the push stream of each push call in order, empty for a successful push
+	streamErrors []string
+	pushAuths    []string
+	// digests are reported by pushes of each image, sha256:mock-digest for images not in it
+	digests   map[string]string
+	tagged    []string
+	pushed    []string
+	removed   []string
+	badRemove bool
+	// archive is returned by image save
+	archive []byte
+	saves   int
+	// loaded is the last archive loaded
+	loaded []byte
+	// calls records container pause, unpause and commit calls in order
+	calls []string
+	// changes are returned by container diff
+	changes []container.ContainerChangeResponseItem
+}
+
+func (c *mockDockerClient) ImageSave(ctx context.Context, images []string) (io.ReadCloser, error) {
+	if c.archive == nil {
+		return nil, errors.New("can not save image")
+	}
+	c.saves++
+	// images loaded replace the saved one, as they are loaded with the same name
+	if c.loaded != nil {
+		return ioutil.NopCloser(bytes.NewReader(c.loaded)), nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(c.archive)), nil
+}
+
+func (c *mockDockerClient) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+	loaded, e := ioutil.ReadAll(input)
+	if e != nil {
+		return types.ImageLoadResponse{}, e
+	}
+	c.loaded = loaded
+	return types.ImageLoadResponse{
+		Body: ioutil.NopCloser(strings.NewReader(`{"stream":"Loaded image: mock image\n"}`)),
+		JSON: true,
+	}, nil
+}
+
+func (c *mockDockerClient) ImageRemove(ctx context.Context, image string, options types.ImageRemoveOptions) ([]types.ImageDeleteResponseItem, error) {
+	if c.badRemove {
+		return nil, errors.New("can not remove image")
+	}
+	if !options.Force {
+		return nil, errors.New("image is referenced in multiple repositories")
+	}
+	c.removed = append(c.removed, image)
+	return []types.ImageDeleteResponseItem{{Deleted: image}}, nil
+}
+
+func (c *mockDockerClient) ContainerPause(ctx context.Context, ctr string) error {
+	if ctr == c.badPause {
+		return errors.New("can not pause container")
+	}
+	c.calls = append(c.calls, "pause "+ctr)
+	return nil
+}
+
+func (c *mockDockerClient) ContainerUnpause(ctx context.Context, ctr string) error {
+	if ctr == c.badUnpause {
+		return errors.New("can not unpause container")
+	}
+	c.calls = append(c.calls, "unpause "+ctr)
+	return nil
+}
+
+func (c *mockDockerClient) ContainerInspectWithRaw(ctx context.Context, ctr string, getSize bool) (types.ContainerJSON, []byte, error) {
+	var size *int64
+	if getSize {
+		size = new(int64)
+		*size = 1024
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: ctr, Image: "sha256:source-image", SizeRw: size},
+		Config: &container.Config{
+			Image:      "source-image:latest",
+			Cmd:        strslice.StrSlice{"sh", "-c", "sleep 1d"},
+			Env:        []string{"PATH=/bin", "FOO=bar"},
+			WorkingDir: "/work",
+			Labels:     map[string]string{"io.kubernetes.pod.name": "source-pod"},
+		},
+	}, nil, nil
+}
+
+func (c *mockDockerClient) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{
+		ID: image,
+		Config: &container.Config{
+			Cmd:        strslice.StrSlice{"sh"},
+			Env:        []string{"PATH=/bin"},
+			WorkingDir: "/work",
+			Labels:     map[string]string{"base-label": "base"},
+		},
+	}, nil, nil
 }
 
 func (c *mockDockerClient) ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error) {
 	if c.badCommit {
 		return types.IDResponse{}, errors.New("can not do container commit")
 	}
+	c.committed = options
+	c.calls = append(c.calls, "commit "+container)
 
 	return types.IDResponse{ID: "mock id"}, nil
 }
 
+func (c *mockDockerClient) ContainerDiff(ctx context.Context, ctr string) ([]container.ContainerChangeResponseItem, error) {
+	return c.changes, nil
+}
+
+func (c *mockDockerClient) ImageTag(ctx context.Context, source, target string) error {
+	c.tagged = append(c.tagged, source+" "+target)
+	return nil
+}
+
 func (c *mockDockerClient) ImagePush(ctx context.Context, ref string, options types.ImagePushOptions) (io.ReadCloser, error) {
-	if c.badPush {
+	if c.badPush || c.badPushes[ref] {
 		return nil, errors.New("can not do image push")
 	}
+	c.pushAuths = append(c.pushAuths, options.RegistryAuth)
+	if len(c.streamErrors) > 0 {
+		msg := c.streamErrors[0]
+		c.streamErrors = c.streamErrors[1:]
+		if msg != "" {
+			return ioutil.NopCloser(strings.NewReader(`{"status":"Preparing","progressDetail":{},"id":"mock layer"}
+{"errorDetail":{"message":"` + msg + `"},"error":"` + msg + `"}
+`)), nil
+		}
+	}
+	c.pushed = append(c.pushed, ref)
+	d, ok := c.digests[ref]
+	if !ok {
+		d = "sha256:mock-digest"
+	}
 
-	return ioutil.NopCloser(strings.NewReader("{}")), nil
+	return ioutil.NopCloser(strings.NewReader(`{"status":"Pushed","progressDetail":{},"id":"mock layer"}
+{"progressDetail":{},"aux":{"Tag":"latest","Digest":"` + d + `","Size":1024}}
+`)), nil
 }